@@ -0,0 +1,79 @@
+package api
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/makeworld-the-better-one/whatsup/config"
+	"github.com/makeworld-the-better-one/whatsup/db"
+	"github.com/makeworld-the-better-one/whatsup/takeout"
+)
+
+// Account data requests
+// Not in the spec, lets users get or delete everything stored about them.
+//
+// GET    /.well-known/fmrl/user/<username>/takeout              - download an export of all the user's data
+// DELETE /.well-known/fmrl/user/<username>?confirm=<username>   - delete the account and all its data
+//
+// Deleted users are gone for good, status queries for them get 410 Gone.
+
+// userGone returns true if the local user was deleted. Errors are logged,
+// and the user is treated as not deleted.
+func (s *Server) userGone(username string) bool {
+	deleted, err := s.store.IsDeleted(username)
+	if err != nil {
+		log.Printf("store.IsDeleted(%s): %v", username, err)
+		return false
+	}
+	return deleted
+}
+
+func (s *Server) userTakeout(w http.ResponseWriter, r *http.Request) {
+	username := r.URL.Path[len("/.well-known/fmrl/user/") : len(r.URL.Path)-len("/takeout")]
+
+	if _, ok := config.Conf.Users[username]; !ok {
+		// User doesn't exist
+		writeStatusCodePage(w, http.StatusNotFound)
+		return
+	}
+	if !s.checkAuth(username, w, r) {
+		return
+	}
+
+	w.Header().Set("Content-Type", takeout.ContentType)
+	w.Header().Set("Content-Disposition", `attachment; filename="`+takeout.Filename(username)+`"`)
+	w.Header().Set("Cache-Control", "no-store")
+	if err := takeout.Write(w, s.store, username); err != nil {
+		// Headers may have been sent already, but this is the best that can be done
+		log.Printf("takeout.Write(%s): %v", username, err)
+		writeStatusCodePage(w, http.StatusInternalServerError)
+	}
+}
+
+func (s *Server) deleteAccount(w http.ResponseWriter, r *http.Request) {
+	username := r.URL.Path[len("/.well-known/fmrl/user/"):]
+
+	if _, ok := config.Conf.Users[username]; !ok {
+		// User doesn't exist
+		writeStatusCodePage(w, http.StatusNotFound)
+		return
+	}
+	if !s.checkAuth(username, w, r) {
+		return
+	}
+	if r.URL.Query().Get("confirm") != username {
+		// Makes sure this wasn't sent by accident
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Set the confirm query parameter to the username to delete the account"))
+		return
+	}
+
+	if err := db.DeleteAccount(s.store, username); err != nil {
+		log.Printf("db.DeleteAccount(%s): %v", username, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Error deleting account, not your fault.\nContact your server administrator or try again later."))
+		return
+	}
+	log.Printf("deleted account %s", username)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,196 @@
+package api
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/makeworld-the-better-one/whatsup/model"
+)
+
+// readTakeout returns the files in a takeout archive by name.
+func readTakeout(t *testing.T, r io.Reader) map[string][]byte {
+	t.Helper()
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := make(map[string][]byte)
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return files
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[hdr.Name] = b
+	}
+}
+
+func TestTakeout(t *testing.T) {
+	s := newTestServer(t, "alice", "bob")
+	setStatusText(t, s, "alice", "one")
+	setStatusText(t, s, "alice", "two")
+	fw := &model.Following{Usernames: model.FollowingUsernames{"@bob@example.org": {}}}
+	if err := s.store.SetFollowing("alice", fw); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.store.CreateList("alice", "friends"); err != nil {
+		t.Fatal(err)
+	}
+	_, err := s.store.UpdateList("alice", "friends", func(list *model.List, _ model.FollowingUsernames) error {
+		list.Usernames = model.FollowingUsernames{"@bob@example.org": {}}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	privacy := model.NewPrivacy()
+	privacy.Mode = model.PrivacyLocal
+	if err := s.store.SetPrivacy("alice", privacy); err != nil {
+		t.Fatal(err)
+	}
+	wh := &model.Webhook{
+		Owner:   "alice",
+		URL:     "https://hooks.example/",
+		Secret:  "hunter2",
+		Events:  []string{model.WebhookStatus},
+		Enabled: true,
+	}
+	if err := s.store.CreateWebhook(wh); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the user can get it
+	r := httptest.NewRequest("GET", "/.well-known/fmrl/user/alice/takeout", nil)
+	r.SetBasicAuth("bob", "bob")
+	if resp := do(s, r); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("another user got %d", resp.StatusCode)
+	}
+	r = httptest.NewRequest("GET", "/.well-known/fmrl/user/alice/takeout", nil)
+	r.SetBasicAuth("alice", "bob")
+	if resp := do(s, r); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("wrong password got %d", resp.StatusCode)
+	}
+
+	r = httptest.NewRequest("GET", "/.well-known/fmrl/user/alice/takeout", nil)
+	r.SetBasicAuth("alice", "alice")
+	resp := do(s, r)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got %d", resp.StatusCode)
+	}
+	files := readTakeout(t, resp.Body)
+
+	decode := func(name string, v interface{}) {
+		t.Helper()
+		b, ok := files[name]
+		if !ok {
+			t.Fatalf("%s is missing", name)
+		}
+		if err := json.Unmarshal(b, v); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+	}
+
+	var acct struct {
+		Username string `json:"username"`
+		Global   string `json:"global_username"`
+	}
+	decode("account.json", &acct)
+	if acct.Username != "alice" || acct.Global != "@alice@example.org" {
+		t.Errorf("account is %+v", acct)
+	}
+	var st struct {
+		Status *model.Status `json:"status"`
+	}
+	decode("status.json", &st)
+	if st.Status == nil || st.Status.Status == nil || *st.Status.Status != "two" {
+		t.Errorf("status is %+v", st.Status)
+	}
+	var history []struct {
+		Status *model.Status `json:"status"`
+	}
+	decode("history.json", &history)
+	if len(history) != 2 || *history[0].Status.Status != "two" || *history[1].Status.Status != "one" {
+		t.Errorf("history has %d entries", len(history))
+	}
+	var following []string
+	decode("following.json", &following)
+	if len(following) != 1 || following[0] != "@bob@example.org" {
+		t.Errorf("following is %v", following)
+	}
+	var lists []struct {
+		Name      string   `json:"name"`
+		Usernames []string `json:"usernames"`
+	}
+	decode("lists.json", &lists)
+	if len(lists) != 1 || lists[0].Name != "friends" || len(lists[0].Usernames) != 1 || lists[0].Usernames[0] != "@bob@example.org" {
+		t.Errorf("lists are %+v", lists)
+	}
+	var gotPrivacy model.Privacy
+	decode("privacy.json", &gotPrivacy)
+	if gotPrivacy.Mode != model.PrivacyLocal {
+		t.Errorf("privacy mode is %q", gotPrivacy.Mode)
+	}
+	var webhooks []*model.Webhook
+	decode("webhooks.json", &webhooks)
+	if len(webhooks) != 1 || webhooks[0].URL != wh.URL {
+		t.Fatalf("webhooks are %+v", webhooks)
+	}
+	if webhooks[0].Secret != "" {
+		t.Error("the webhook secret was exported")
+	}
+	if _, ok := files["avatar"]; ok {
+		t.Error("avatar exported without one being set")
+	}
+}
+
+func TestDeleteAccount(t *testing.T) {
+	s := newTestServer(t, "alice", "bob")
+	setStatusText(t, s, "alice", "hi")
+	setStatusText(t, s, "bob", "hi")
+
+	// Needs confirming
+	r := httptest.NewRequest("DELETE", "/.well-known/fmrl/user/alice", nil)
+	r.SetBasicAuth("alice", "alice")
+	if resp := do(s, r); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("without confirm: got %d", resp.StatusCode)
+	}
+
+	r = httptest.NewRequest("DELETE", "/.well-known/fmrl/user/alice?confirm=alice", nil)
+	r.SetBasicAuth("alice", "alice")
+	if resp := do(s, r); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("got %d", resp.StatusCode)
+	}
+
+	_, users := query(t, s, "", "alice", "bob")
+	if len(users) != 2 {
+		t.Fatalf("got %d users", len(users))
+	}
+	if users[0].Code != http.StatusGone {
+		t.Errorf("deleted user got %d", users[0].Code)
+	}
+	if users[0].Data != nil {
+		t.Errorf("deleted user has data %+v", users[0].Data)
+	}
+	if users[1].Code != http.StatusOK {
+		t.Errorf("other user got %d", users[1].Code)
+	}
+
+	// The account is gone too
+	r = httptest.NewRequest("GET", "/.well-known/fmrl/user/alice/takeout", nil)
+	r.SetBasicAuth("alice", "alice")
+	if resp := do(s, r); resp.StatusCode != http.StatusGone {
+		t.Errorf("takeout of a deleted user got %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,276 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/matthewhartstonge/argon2"
+
+	"github.com/makeworld-the-better-one/whatsup/config"
+	"github.com/makeworld-the-better-one/whatsup/db"
+	"github.com/makeworld-the-better-one/whatsup/hub"
+	"github.com/makeworld-the-better-one/whatsup/logring"
+	"github.com/makeworld-the-better-one/whatsup/model"
+	"github.com/makeworld-the-better-one/whatsup/version"
+	"github.com/makeworld-the-better-one/whatsup/web"
+)
+
+// Admin pages
+// Part of the settings web UI, only for users with the admin role. Roles are
+// granted with the "whatsup admin grant" command.
+//
+// GET  /.well-known/fmrl/settings/admin       - users, server stats, and recent log lines
+// POST /.well-known/fmrl/settings/admin/user  - moderate a user, with the "action" form value:
+//                                                disable, enable, reset_password, clear_status, or clear_avatar
+
+const adminPath = settingsPath + "/admin"
+
+var startTime = time.Now()
+
+var adminMessages = map[string]string{
+	"disable":      "Account disabled.",
+	"enable":       "Account enabled.",
+	"clear_status": "Status cleared.",
+	"clear_avatar": "Avatar removed.",
+}
+
+// admin handles the admin pages, after settings has checked the session
+// and CSRF token.
+func (s *Server) admin(w http.ResponseWriter, r *http.Request, sess *model.Session) {
+	acct, err := s.store.GetAccount(sess.Username)
+	if err != nil {
+		log.Printf("store.GetAccount(%s): %v", sess.Username, err)
+		web.RenderError(w, http.StatusInternalServerError)
+		return
+	}
+	if !acct.IsAdmin() {
+		web.RenderError(w, http.StatusForbidden)
+		return
+	}
+
+	if r.Method == "GET" {
+		if r.URL.Path != adminPath {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		data := &web.AdminData{Message: adminMessages[r.URL.Query().Get("done")]}
+		s.renderAdmin(w, sess, http.StatusOK, data)
+		return
+	}
+	if r.URL.Path != adminPath+"/user" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	s.adminUser(w, r, sess)
+}
+
+func (s *Server) adminUser(w http.ResponseWriter, r *http.Request, sess *model.Session) {
+	username := r.PostFormValue("username")
+	action := r.PostFormValue("action")
+	if _, ok := config.Conf.Users[username]; !ok {
+		s.renderAdmin(w, sess, http.StatusBadRequest, &web.AdminData{Error: "No such user: " + username})
+		return
+	}
+
+	switch action {
+	case "disable", "enable":
+		if username == sess.Username {
+			// Admins could lock everyone out otherwise
+			s.renderAdmin(w, sess, http.StatusBadRequest, &web.AdminData{Error: "You can't disable your own account."})
+			return
+		}
+		if err := s.store.SetDisabled(username, action == "disable"); err != nil {
+			log.Printf("store.SetDisabled(%s): %v", username, err)
+			s.renderAdmin(w, sess, http.StatusInternalServerError, &web.AdminData{Error: "Error changing account, see the log below."})
+			return
+		}
+	case "reset_password":
+		if username == sess.Username {
+			// Resetting logs them out before they could see the new password
+			s.renderAdmin(w, sess, http.StatusBadRequest, &web.AdminData{Error: "You can't reset your own password."})
+			return
+		}
+		password, err := randomToken()
+		if err != nil {
+			log.Printf("adminUser: generating password: %v", err)
+			web.RenderError(w, http.StatusInternalServerError)
+			return
+		}
+		password = password[:20]
+		argon := argon2.DefaultConfig()
+		hash, err := argon.HashEncoded([]byte(password))
+		if err != nil {
+			log.Printf("adminUser: hashing password: %v", err)
+			web.RenderError(w, http.StatusInternalServerError)
+			return
+		}
+		if err := s.store.SetPasswordHash(username, string(hash)); err != nil {
+			log.Printf("store.SetPasswordHash(%s): %v", username, err)
+			s.renderAdmin(w, sess, http.StatusInternalServerError, &web.AdminData{Error: "Error resetting password, see the log below."})
+			return
+		}
+		log.Printf("admin %s reset the password of %s", sess.Username, username)
+		// Rendered instead of redirecting, so the password is only ever
+		// in this response
+		s.renderAdmin(w, sess, http.StatusOK, &web.AdminData{PasswordUser: globalUsername(username), Password: password})
+		return
+	case "clear_status":
+		empty := ""
+		zero := 0
+		err := s.store.SetUser(username, &model.Status{
+			Name: &empty, Status: &empty, Emoji: &empty, Media: &empty, MediaType: &zero, URI: &empty,
+		})
+		if err != nil {
+			log.Printf("SetUser %s: %v", username, err)
+			s.renderAdmin(w, sess, http.StatusInternalServerError, &web.AdminData{Error: "Error clearing status, see the log below."})
+			return
+		}
+	case "clear_avatar":
+		if err := s.store.RemoveAvatar(username); err != nil {
+			// Logging is done within db.RemoveAvatar, not needed here
+			s.renderAdmin(w, sess, http.StatusInternalServerError, &web.AdminData{Error: "Error removing avatar, see the log below."})
+			return
+		}
+	default:
+		s.renderAdmin(w, sess, http.StatusBadRequest, &web.AdminData{Error: "Unknown action."})
+		return
+	}
+
+	log.Printf("admin %s: %s %s", sess.Username, action, username)
+	http.Redirect(w, r, adminPath+"?done="+action, http.StatusSeeOther)
+}
+
+// renderAdmin fills in the users, stats, and log lines of data and renders
+// the admin page.
+func (s *Server) renderAdmin(w http.ResponseWriter, sess *model.Session, code int, data *web.AdminData) {
+	usernames := make([]string, 0, len(config.Conf.Users))
+	for username := range config.Conf.Users {
+		usernames = append(usernames, username)
+	}
+	sort.Strings(usernames)
+
+	var admins, disabled int
+	var avatarTotal int64
+	for _, username := range usernames {
+		u, err := s.adminUserRow(username)
+		if errors.Is(err, db.ErrNotFound) {
+			// Deleted, but still in the config
+			continue
+		}
+		if err != nil {
+			log.Printf("renderAdmin: %s: %v", username, err)
+			web.RenderError(w, http.StatusInternalServerError)
+			return
+		}
+		u.Self = username == sess.Username
+		if u.Role == model.RoleAdmin {
+			admins++
+		}
+		if u.Disabled {
+			disabled++
+		}
+		avatarTotal += u.AvatarSize
+		data.Users = append(data.Users, u)
+	}
+
+	dbSize, err := db.Size()
+	if err != nil {
+		log.Printf("db.Size: %v", err)
+	}
+	pending, err := s.store.CountPendingDeliveries()
+	if err != nil {
+		log.Printf("db.CountPendingDeliveries: %v", err)
+	}
+	streamConnsMu.Lock()
+	streams := 0
+	for _, n := range streamConns {
+		streams += n
+	}
+	streamConnsMu.Unlock()
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	encryption := "off"
+	if db.Encrypted() {
+		encryption = "on"
+	}
+
+	data.Stats = []*web.AdminStat{
+		{Name: "Version", Value: version.UserAgent},
+		{Name: "Go", Value: runtime.Version()},
+		{Name: "Uptime", Value: time.Since(startTime).Round(time.Second).String()},
+		{Name: "Users", Value: fmt.Sprintf("%d (%d admins, %d disabled)", len(usernames), admins, disabled)},
+		{Name: "Status streams", Value: strconv.Itoa(streams)},
+		{Name: "Event subscribers", Value: strconv.Itoa(hub.Default.Subscribers())},
+		{Name: "Pending webhook deliveries", Value: strconv.Itoa(pending)},
+		{Name: "Database size", Value: web.FormatSize(dbSize)},
+		{Name: "Avatar storage", Value: web.FormatSize(avatarTotal)},
+		{Name: "Status cache", Value: cacheStat()},
+		{Name: "Private data encryption", Value: encryption},
+		{Name: "Goroutines", Value: strconv.Itoa(runtime.NumGoroutine())},
+		{Name: "Memory in use", Value: web.FormatSize(int64(mem.HeapAlloc))},
+	}
+	data.Logs = logring.Default.Entries()
+	data.CSRF = sess.CSRF
+	web.Render(w, code, "admin", "Admin", data)
+}
+
+// cacheStat describes the status cache counters for the admin page.
+func cacheStat() string {
+	stats, ok := db.GetCacheStats()
+	if !ok {
+		return "disabled"
+	}
+	hitRate := 0.0
+	if stats.Hits+stats.Misses > 0 {
+		hitRate = float64(stats.Hits) / float64(stats.Hits+stats.Misses) * 100
+	}
+	return fmt.Sprintf("%d users, %s, %.1f%% hits (%d hits, %d misses, %d evicted, %d JSON reused)",
+		stats.Entries, web.FormatSize(stats.Bytes), hitRate, stats.Hits, stats.Misses, stats.Evictions, stats.JSONHits)
+}
+
+// adminUserRow collects what the admin page shows about a user.
+func (s *Server) adminUserRow(username string) (*web.AdminUser, error) {
+	acct, err := s.store.GetAccount(username)
+	if err != nil {
+		return nil, err
+	}
+	status, err := s.store.GetUser(username)
+	if err != nil {
+		return nil, err
+	}
+	fu, err := s.store.GetFollowing(username)
+	if err != nil {
+		return nil, err
+	}
+
+	u := &web.AdminUser{
+		Username:  username,
+		Global:    globalUsername(username),
+		Role:      acct.Role,
+		Disabled:  acct.Disabled,
+		Updated:   status.UpdatedAt,
+		Following: len(fu.Usernames),
+	}
+	// New users have nothing but the time they were created
+	u.HasStatus = *status.Name != "" || *status.Status != "" || *status.Emoji != "" ||
+		*status.Media != "" || *status.URI != ""
+	if status.Avatar.Paths["original"] != "" {
+		fi, err := os.Stat(filepath.Join(config.Conf.Data.Dir, "avatars", username, "original"))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+		if err == nil {
+			u.AvatarSize = fi.Size()
+		}
+	}
+	return u, nil
+}
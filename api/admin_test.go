@@ -0,0 +1,107 @@
+package api
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/makeworld-the-better-one/whatsup/model"
+)
+
+// adminAction posts the action for username to the admin page as sessUser.
+func adminAction(t *testing.T, s *Server, sessUser, action, username string) *http.Response {
+	t.Helper()
+	cookie, csrf := newSession(t, s, sessUser, time.Hour)
+	form := url.Values{"csrf": {csrf}, "action": {action}, "username": {username}}
+	r := httptest.NewRequest("POST", adminPath+"/user", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.AddCookie(cookie)
+	return do(s, r)
+}
+
+func TestAdminForbidden(t *testing.T) {
+	s := newTestServer(t, "alice", "bob")
+
+	cookie, _ := newSession(t, s, "alice", time.Hour)
+	r := httptest.NewRequest("GET", adminPath, nil)
+	r.AddCookie(cookie)
+	if resp := do(s, r); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("admin page: got %d, want 403", resp.StatusCode)
+	}
+	if resp := adminAction(t, s, "alice", "disable", "bob"); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("action: got %d, want 403", resp.StatusCode)
+	}
+	if acct, err := s.store.GetAccount("bob"); err != nil || acct.Disabled {
+		t.Errorf("bob is %+v, %v", acct, err)
+	}
+}
+
+func TestAdminActions(t *testing.T) {
+	s := newTestServer(t, "alice", "bob")
+	if err := s.store.SetRole("alice", model.RoleAdmin); err != nil {
+		t.Fatal(err)
+	}
+	text := "hello"
+	if err := s.store.SetUser("bob", &model.Status{Status: &text}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.store.SetAvatar("bob", []byte("img")); err != nil {
+		t.Fatal(err)
+	}
+
+	redirected := func(resp *http.Response, action string) {
+		t.Helper()
+		if resp.StatusCode != http.StatusSeeOther || resp.Header.Get("Location") != adminPath+"?done="+action {
+			t.Errorf("%s: got %d to %s", action, resp.StatusCode, resp.Header.Get("Location"))
+		}
+	}
+
+	redirected(adminAction(t, s, "alice", "disable", "bob"), "disable")
+	if ok, err := s.verifyPassword("bob", "bob"); err != errAccountDisabled || ok {
+		t.Errorf("disabled bob logging in: %v, %v", ok, err)
+	}
+	redirected(adminAction(t, s, "alice", "enable", "bob"), "enable")
+	if ok, err := s.verifyPassword("bob", "bob"); err != nil || !ok {
+		t.Errorf("enabled bob logging in: %v, %v", ok, err)
+	}
+
+	resp := adminAction(t, s, "alice", "reset_password", "bob")
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), "New password for @bob@example.org") {
+		t.Errorf("reset_password: got %d", resp.StatusCode)
+	}
+	if ok, err := s.verifyPassword("bob", "bob"); err != nil || ok {
+		t.Errorf("old password after reset: %v, %v", ok, err)
+	}
+
+	redirected(adminAction(t, s, "alice", "clear_status", "bob"), "clear_status")
+	redirected(adminAction(t, s, "alice", "clear_avatar", "bob"), "clear_avatar")
+	status, err := s.store.GetUser("bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *status.Status != "" || (status.Avatar != nil && status.Avatar.Paths["original"] != "") {
+		t.Errorf("status after clearing is %+v", status)
+	}
+
+	// Admins can't lock themselves out
+	for _, action := range []string{"disable", "reset_password"} {
+		if resp := adminAction(t, s, "alice", action, "alice"); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s of self: got %d, want 400", action, resp.StatusCode)
+		}
+	}
+	if ok, err := s.verifyPassword("alice", "alice"); err != nil || !ok {
+		t.Errorf("alice logging in: %v, %v", ok, err)
+	}
+
+	if resp := adminAction(t, s, "alice", "explode", "bob"); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("unknown action: got %d, want 400", resp.StatusCode)
+	}
+	if resp := adminAction(t, s, "alice", "disable", "nobody"); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("unknown user: got %d, want 400", resp.StatusCode)
+	}
+}
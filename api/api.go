@@ -1,47 +1,90 @@
 package api
 
 import (
+	"encoding/json"
 	"fmt"
 	_ "image/jpeg"
 	_ "image/png"
 	"net/http"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/makeworld-the-better-one/whatsup/config"
+	"github.com/makeworld-the-better-one/whatsup/db"
+	"github.com/makeworld-the-better-one/whatsup/httpsig"
 	"github.com/makeworld-the-better-one/whatsup/version"
+	"github.com/makeworld-the-better-one/whatsup/websub"
 )
 
 const MaxAvatarSize = 4 * 1024 * 1024 // 4 MiB, from spec
 
+// maxRequestBody is the largest request body any handler accepts, which is
+// the settings form with an avatar. Bodies of signed requests are read up to
+// this size to check them, before handlers apply their own limits.
+const maxRequestBody = MaxAvatarSize * 3
+
 type Server struct {
-	serveMux http.ServeMux
+	store          db.Store
+	serveMux       http.ServeMux
+	timeoutHandler http.Handler
+	keyCache       *httpsig.KeyCache
 }
 
-func NewServer() *Server {
-	s := &Server{}
+// NewServer creates the API server. The keyring holds the server's own keys,
+// which are published for remote servers to verify signed requests.
+// Users' data is read from and written to st, which should have
+// db.WithHooks applied, like db.Default.
+func NewServer(keyring *httpsig.Keyring, st db.Store) *Server {
+	s := &Server{store: st, keyCache: httpsig.NewKeyCache()}
+	if config.Conf.Remote.AllowPrivate {
+		s.keyCache.HTTP = &http.Client{Timeout: 10 * time.Second}
+	}
 
 	// All paths, even non-API ones, are under /fmrl/
 	// So that reverse-proxying can work under a specific path only
 
 	// API calls
-	s.serveMux.HandleFunc("/.well-known/fmrl/user/", userPath)
-	s.serveMux.HandleFunc("/.well-known/fmrl/users", CORS(statusQuery))
+	s.serveMux.HandleFunc("/.well-known/fmrl/user/", s.userPath)
+	s.serveMux.HandleFunc("/.well-known/fmrl/users", CORS(s.statusQuery))
+	s.serveMux.HandleFunc(streamPath, CORS(s.statusStream))
+	s.serveMux.HandleFunc(wsPath, s.wsSubscribe)
+	s.serveMux.HandleFunc(websub.Path, s.websubHub)
+	s.serveMux.HandleFunc(websub.CallbackPath, websubCallback)
 	// File server of avatar images
 	s.serveMux.Handle("/.well-known/fmrl/avatars/",
 		http.StripPrefix("/.well-known/fmrl/avatars/",
-			http.FileServer(http.Dir(filepath.Join(config.Conf.Data.Dir, "avatars"))),
+			s.avatarPrivacy(http.FileServer(http.Dir(filepath.Join(config.Conf.Data.Dir, "avatars")))),
 		),
 	)
+	// Not in the spec, public keys for verifying requests signed by this server
+	s.serveMux.HandleFunc(httpsig.KeysPath, CORS(func(w http.ResponseWriter, r *http.Request) {
+		keysJSON, err := json.Marshal(&httpsig.KeysJSON{Keys: keyring.Public()})
+		if err != nil {
+			writeStatusCodePage(w, http.StatusInternalServerError)
+			return
+		}
+		w.Header().Add("Content-Type", "application/json")
+		w.Write(keysJSON)
+	}))
+	if config.Conf.Web.Settings {
+		s.serveMux.HandleFunc(settingsPath, s.settings)
+		s.serveMux.HandleFunc(settingsPath+"/", s.settings)
+	}
+	// Not in the spec, human-readable landing page and 404s for everything else
+	s.serveMux.HandleFunc("/", s.landingPage)
 	// Not in the spec, just a nice way to see what version people are running
 	s.serveMux.HandleFunc("/.well-known/fmrl/version", func(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprint(w, version.VersionInfo)
 	})
+
+	// Everything except streaming must finish within the timeout
+	s.timeoutHandler = http.TimeoutHandler(&s.serveMux, time.Second*10, http.StatusText(http.StatusServiceUnavailable))
 	return s
 }
 
-func userPath(w http.ResponseWriter, r *http.Request) {
-	if r.Method != "PUT" && r.Method != "PATCH" && r.Method != "DELETE" && r.Method != "GET" {
+func (s *Server) userPath(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "PUT" && r.Method != "PATCH" && r.Method != "DELETE" && r.Method != "GET" && r.Method != "POST" {
 		w.WriteHeader(http.StatusMethodNotAllowed)
 		return
 	}
@@ -55,22 +98,83 @@ func userPath(w http.ResponseWriter, r *http.Request) {
 
 	if r.Method == "PATCH" && strings.Count(r.URL.Path, "/") == 4 {
 		// Right method and right path
-		setStatus(w, r)
+		s.setStatus(w, r)
+		return
+	}
+	if r.Method == "GET" && strings.Count(r.URL.Path, "/") == 4 {
+		s.userProfile(w, r)
+		return
+	}
+	if r.Method == "DELETE" && strings.Count(r.URL.Path, "/") == 4 {
+		s.deleteAccount(w, r)
+		return
+	}
+	if strings.HasSuffix(r.URL.Path, "/takeout") &&
+		len(r.URL.Path) > len("/.well-known/fmrl/user//takeout") {
+		if r.Method != "GET" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		s.userTakeout(w, r)
 		return
 	}
 	if (r.Method == "PUT" || r.Method == "DELETE") && strings.HasSuffix(r.URL.Path, "/avatar") &&
 		len(r.URL.Path) > len("/.well-known/fmrl/user//avatar") {
 		// Right method and path, and username exists in path
-		setAvatar(w, r)
+		s.setAvatar(w, r)
+		return
+	}
+	if parts := strings.Split(r.URL.Path[len("/.well-known/fmrl/user/"):], "/"); (len(parts) == 2 || len(parts) == 3) &&
+		parts[0] != "" && parts[1] == "lists" {
+		// Right path and username exists in path
+		s.listsPath(w, r)
+		return
+	}
+	if parts := strings.Split(r.URL.Path[len("/.well-known/fmrl/user/"):], "/"); len(parts) >= 2 && len(parts) <= 4 &&
+		parts[0] != "" && parts[1] == "webhooks" {
+		// Right path and username exists in path
+		s.webhooksPath(w, r)
+		return
+	}
+	if format, ok := feedFormat(r.URL.Path); ok {
+		if r.Method != "GET" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		s.userFeed(w, r, format)
+		return
+	}
+	if strings.HasSuffix(r.URL.Path, "/privacy") &&
+		len(r.URL.Path) > len("/.well-known/fmrl/user//privacy") {
+		// Right path and username exists in path
+		s.privacyPath(w, r)
+		return
+	}
+	if strings.HasSuffix(r.URL.Path, "/following/export") &&
+		len(r.URL.Path) > len("/.well-known/fmrl/user//following/export") {
+		if r.Method != "GET" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		s.exportFollowing(w, r)
+		return
+	}
+	if strings.HasSuffix(r.URL.Path, "/following/import") &&
+		len(r.URL.Path) > len("/.well-known/fmrl/user//following/import") {
+		if r.Method != "POST" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		s.importFollowing(w, r)
 		return
 	}
 	if strings.HasSuffix(r.URL.Path, "/following") &&
 		len(r.URL.Path) > len("/.well-known/fmrl/user//following") {
 		// Right path and username exists in path
 		if r.Method == "GET" {
-			getFollowing(w, r)
+			s.getFollowing(w, r)
 		} else if r.Method == "PATCH" {
-			setFollowing(w, r)
+			s.setFollowing(w, r)
 		} else {
 			w.WriteHeader(http.StatusMethodNotAllowed)
 		}
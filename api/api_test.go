@@ -0,0 +1,121 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/matthewhartstonge/argon2"
+
+	"github.com/makeworld-the-better-one/whatsup/config"
+	"github.com/makeworld-the-better-one/whatsup/db"
+	"github.com/makeworld-the-better-one/whatsup/httpsig"
+	"github.com/makeworld-the-better-one/whatsup/model"
+	"github.com/makeworld-the-better-one/whatsup/web"
+)
+
+var (
+	hashesMu sync.Mutex
+	// hashes of the test passwords, since hashing is slow on purpose
+	hashes = make(map[string]string)
+)
+
+func passwordHash(t *testing.T, password string) string {
+	t.Helper()
+	hashesMu.Lock()
+	defer hashesMu.Unlock()
+	if h, ok := hashes[password]; ok {
+		return h
+	}
+	argon := argon2.DefaultConfig()
+	h, err := argon.HashEncoded([]byte(password))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hashes[password] = string(h)
+	return string(h)
+}
+
+// newTestServer sets up the database in a temporary data dir with the users,
+// whose passwords are their usernames, and returns a Server using it. The
+// database is closed when the test ends.
+func newTestServer(t *testing.T, users ...string) *Server {
+	t.Helper()
+
+	conf := config.Conf
+	t.Cleanup(func() { config.Conf = conf })
+
+	dir := t.TempDir()
+	config.Conf.Server.URL = "https://example.org"
+	config.Conf.Server.Domain = "example.org"
+	config.Conf.Data = config.DataConf{
+		Dir:         dir,
+		Driver:      "sqlite",
+		Readers:     2,
+		BusyTimeout: config.Duration{Duration: 5 * time.Second},
+	}
+	config.Conf.Cache = config.CacheConf{}
+	config.Conf.Web.Settings = true
+	config.Conf.Web.SessionLifetime.Duration = time.Hour
+	config.Conf.Privacy.DeniedCode = http.StatusNotFound
+	config.Conf.Query.MaxUsers = 100
+	config.Conf.Stream.MaxPerIP = 10
+	config.Conf.Stream.Heartbeat.Duration = 30 * time.Second
+	config.Conf.Users = make(map[string]string, len(users))
+	for _, u := range users {
+		config.Conf.Users[u] = passwordHash(t, u)
+	}
+
+	if err := os.Mkdir(filepath.Join(dir, "avatars"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Init(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := db.Close(); err != nil {
+			t.Error(err)
+		}
+	})
+	if err := web.Init(filepath.Join(dir, "templates")); err != nil {
+		t.Fatal(err)
+	}
+	keyring, err := httpsig.LoadKeyring(filepath.Join(dir, "keys.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewServer(keyring, db.Default)
+}
+
+// do sends the request to the server and returns the response.
+func do(s *Server, r *http.Request) *http.Response {
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	return w.Result()
+}
+
+// newSession logs the user into the settings UI, and returns the session
+// cookie and CSRF token.
+func newSession(t *testing.T, s *Server, username string, lifetime time.Duration) (*http.Cookie, string) {
+	t.Helper()
+	token, err := randomToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	sess := &model.Session{
+		ID:        sessionID(token),
+		Username:  username,
+		CSRF:      "csrf-" + username,
+		CreatedAt: now,
+		ExpiresAt: now.Add(lifetime),
+	}
+	if err := s.store.CreateSession(sess); err != nil {
+		t.Fatal(err)
+	}
+	return &http.Cookie{Name: sessionCookie, Value: token}, sess.CSRF
+}
@@ -0,0 +1,59 @@
+package api
+
+import (
+	"image"
+	"image/color"
+)
+
+// maxCroppedAvatar is the largest width of avatars cropped by the settings UI.
+// Larger images are scaled down, which keeps them well under MaxAvatarSize.
+const maxCroppedAvatar = 512
+
+// cropSquare returns the largest square in the image. x and y position the
+// square along the longer side, from 0 (left or top) to 100 (right or bottom).
+// The result is scaled down to at most maxCroppedAvatar pixels wide.
+func cropSquare(img image.Image, x, y int) image.Image {
+	b := img.Bounds()
+	size := b.Dx()
+	if b.Dy() < size {
+		size = b.Dy()
+	}
+	x0 := b.Min.X + (b.Dx()-size)*clampPercent(x)/100
+	y0 := b.Min.Y + (b.Dy()-size)*clampPercent(y)/100
+
+	out := size
+	if out > maxCroppedAvatar {
+		out = maxCroppedAvatar
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, out, out))
+
+	// Box filter: each output pixel is the average of the source pixels it covers
+	for dy := 0; dy < out; dy++ {
+		sy0, sy1 := y0+dy*size/out, y0+(dy+1)*size/out
+		for dx := 0; dx < out; dx++ {
+			sx0, sx1 := x0+dx*size/out, x0+(dx+1)*size/out
+			var r, g, bl, a, n uint64
+			for sy := sy0; sy < sy1; sy++ {
+				for sx := sx0; sx < sx1; sx++ {
+					cr, cg, cb, ca := img.At(sx, sy).RGBA()
+					r, g, bl, a = r+uint64(cr), g+uint64(cg), bl+uint64(cb), a+uint64(ca)
+					n++
+				}
+			}
+			dst.Set(dx, dy, color.RGBA64{
+				R: uint16(r / n), G: uint16(g / n), B: uint16(bl / n), A: uint16(a / n),
+			})
+		}
+	}
+	return dst
+}
+
+func clampPercent(p int) int {
+	if p < 0 {
+		return 0
+	}
+	if p > 100 {
+		return 100
+	}
+	return p
+}
@@ -0,0 +1,149 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/makeworld-the-better-one/whatsup/config"
+	"github.com/makeworld-the-better-one/whatsup/db"
+	"github.com/makeworld-the-better-one/whatsup/feed"
+	"github.com/makeworld-the-better-one/whatsup/model"
+)
+
+// Feeds
+// Not in the spec, status history for feed readers.
+//
+// GET /.well-known/fmrl/user/<username>/feed.atom
+// GET /.well-known/fmrl/user/<username>/feed.rss
+// GET /.well-known/fmrl/user/<username>/feed.json
+
+// feedFormat returns the feed format if the path is for a feed.
+func feedFormat(path string) (string, bool) {
+	for format := range feed.ContentTypes {
+		suffix := "/feed." + format
+		if strings.HasSuffix(path, suffix) && len(path) > len("/.well-known/fmrl/user/"+suffix) {
+			return format, true
+		}
+	}
+	return "", false
+}
+
+func (s *Server) userFeed(w http.ResponseWriter, r *http.Request, format string) {
+	username := r.URL.Path[len("/.well-known/fmrl/user/") : len(r.URL.Path)-len("/feed."+format)]
+
+	if _, ok := config.Conf.Users[username]; !ok {
+		// User doesn't exist
+		writeStatusCodePage(w, http.StatusNotFound)
+		return
+	}
+	if s.userGone(username) {
+		writeStatusCodePage(w, http.StatusGone)
+		return
+	}
+
+	req, ok := s.getRequester(w, r)
+	if !ok {
+		return
+	}
+	visible, err := s.canSee(username, req)
+	if err != nil {
+		log.Printf("canSee(%s): %v", username, err)
+		writeStatusCodePage(w, http.StatusInternalServerError)
+		return
+	}
+	if !visible {
+		writeStatusCodePage(w, config.Conf.Privacy.DeniedCode)
+		return
+	}
+
+	entries, err := s.store.GetHistory(username, config.Conf.Feed.Entries)
+	if err != nil {
+		log.Printf("store.GetHistory(%s): %v", username, err)
+		writeStatusCodePage(w, http.StatusInternalServerError)
+		return
+	}
+	current, err := s.store.GetUser(username)
+	if errors.Is(err, db.ErrNotFound) && s.userGone(username) {
+		writeStatusCodePage(w, http.StatusGone)
+		return
+	}
+	if err != nil {
+		log.Printf("GetUser(%s): %v", username, err)
+		writeStatusCodePage(w, http.StatusInternalServerError)
+		return
+	}
+	if len(entries) == 0 {
+		// No changes since history started being recorded
+		entries = []*model.StatusEntry{{Username: username, CreatedAt: current.UpdatedAt, Status: current}}
+	}
+
+	f := buildFeed(username, format, current, entries)
+
+	// Same conditional handling as statusQuery, plus an ETag
+	// ETag is a hash of the body so it changes with anything in the feed
+	body, err := f.Render(format)
+	if err != nil {
+		log.Printf("Rendering %s feed for %s: %v", format, username, err)
+		writeStatusCodePage(w, http.StatusInternalServerError)
+		return
+	}
+	h := fnv.New64a()
+	h.Write(body)
+	etag := fmt.Sprintf(`"%x"`, h.Sum64())
+
+	w.Header().Set("Last-Modified", f.Updated.UTC().Format(http.TimeFormat))
+	w.Header().Set("ETag", etag)
+	// Responses depend on who is asking, due to privacy settings
+	w.Header().Add("Vary", "Authorization")
+
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		// Takes precedence over If-Modified-Since
+		if inm == etag || inm == "*" {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	} else if ifModTime, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil {
+		if f.Updated.Before(ifModTime) || f.Updated.Truncate(time.Second).Equal(ifModTime) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", feed.ContentTypes[format])
+	w.Write(body)
+}
+
+func buildFeed(username, format string, current *model.Status, entries []*model.StatusEntry) *feed.Feed {
+	global := globalUsername(username)
+	base := config.Conf.Server.URL + "/.well-known/fmrl/user/" + username + "/feed"
+
+	f := &feed.Feed{
+		Title:   global,
+		Author:  global,
+		Link:    config.Conf.Server.URL + "/.well-known/fmrl/users?user=" + username,
+		FeedURL: base + "." + format,
+		Updated: entries[0].CreatedAt,
+	}
+	if current.Name != nil && *current.Name != "" {
+		f.Title = *current.Name + " (" + global + ")"
+		f.Author = *current.Name
+	}
+	if current.Avatar != nil && current.Avatar.Paths["original"] != "" {
+		f.Icon = current.Avatar.Paths["original"]
+		if strings.HasPrefix(f.Icon, "/") {
+			f.Icon = config.Conf.Server.URL + f.Icon
+		}
+		if current.Avatar.Num != nil {
+			f.Icon += fmt.Sprintf("?%d", *current.Avatar.Num)
+		}
+	}
+	for _, e := range entries {
+		f.Entries = append(f.Entries, feed.NewEntry(feed.EntryID(base, e.ID), e))
+	}
+	return f
+}
@@ -3,21 +3,23 @@ package api
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
-	"regexp"
 	"time"
 
 	"github.com/makeworld-the-better-one/whatsup/config"
 	"github.com/makeworld-the-better-one/whatsup/db"
+	"github.com/makeworld-the-better-one/whatsup/model"
+	"github.com/makeworld-the-better-one/whatsup/remote"
 )
 
 // Following API
 // https://github.com/makeworld-the-better-one/fmrl/blob/main/spec.md#following-api
 
-func getFollowing(w http.ResponseWriter, r *http.Request) {
+func (s *Server) getFollowing(w http.ResponseWriter, r *http.Request) {
 	username := r.URL.Path[len("/.well-known/fmrl/user/") : len(r.URL.Path)-len("/following")]
 
 	if _, ok := config.Conf.Users[username]; !ok {
@@ -26,14 +28,45 @@ func getFollowing(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if !checkAuth(username, w, r) {
+	if !s.checkAuth(username, w, r) {
 		return
 	}
 
-	following, updatedAt, err := db.GetFollowingRaw(username)
-	if err != nil {
-		log.Printf("GetFollowingRaw(%s): %v", username, err)
-		writeStatusCodePage(w, http.StatusInternalServerError)
+	var following []byte
+	var updatedAt time.Time
+	var err error
+
+	if name := r.URL.Query().Get("list"); name != "" {
+		// Only return the usernames in one of the user's lists
+		var list *model.List
+		list, err = s.store.GetList(username, name)
+		if errors.Is(err, db.ErrNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintf(w, "No such list: %s", name)
+			return
+		}
+		if err == nil {
+			updatedAt = list.UpdatedAt
+			following, err = json.Marshal(list.Usernames)
+		}
+		if err != nil {
+			log.Printf("getFollowing list %s for %s: %v", name, username, err)
+			writeStatusCodePage(w, http.StatusInternalServerError)
+			return
+		}
+	} else {
+		following, updatedAt, err = s.store.GetFollowingRaw(username)
+		if err != nil {
+			log.Printf("GetFollowingRaw(%s): %v", username, err)
+			writeStatusCodePage(w, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if r.URL.Query().Get("extended") != "" {
+		// Include the existence state of each user. That state changes without
+		// the following list changing, so there is no Last-Modified.
+		getFollowingExtended(w, username, following)
 		return
 	}
 
@@ -62,14 +95,46 @@ func getFollowing(w http.ResponseWriter, r *http.Request) {
 	w.Write(following)
 }
 
+func getFollowingExtended(w http.ResponseWriter, username string, following []byte) {
+	fu := model.NewFollowingUsernames()
+	if err := json.Unmarshal(following, &fu); err != nil {
+		log.Printf("getFollowingExtended(%s): %v", username, err)
+		writeStatusCodePage(w, http.StatusInternalServerError)
+		return
+	}
+
+	usernames := fu.Sorted()
+	states, err := db.GetRemoteUsers(usernames)
+	if err != nil {
+		log.Printf("db.GetRemoteUsers for %s: %v", username, err)
+		writeStatusCodePage(w, http.StatusInternalServerError)
+		return
+	}
+
+	extended := make([]*model.RemoteUser, len(usernames))
+	for i, u := range usernames {
+		extended[i] = states[u]
+	}
+
+	apiJSON, err := json.Marshal(extended)
+	if err != nil {
+		log.Printf("JSON encoding extended following for %s: %v", username, err)
+		writeStatusCodePage(w, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	w.Write(apiJSON)
+}
+
 type setFollowingJSON struct {
 	Add    []string `json:"add"`
 	Remove []string `json:"remove"`
 }
 
-var followingUsernameRE = regexp.MustCompile(`^@[a-z0-9_\.]{1,40}@[\w\.-]+$`)
+var followingUsernameRE = model.FollowingUsernameRE
 
-func setFollowing(w http.ResponseWriter, r *http.Request) {
+func (s *Server) setFollowing(w http.ResponseWriter, r *http.Request) {
 	// Limit client JSON to 1 MiB, more than enough
 	r.Body = http.MaxBytesReader(w, r.Body, 1*1024*1024)
 
@@ -81,7 +146,7 @@ func setFollowing(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if !checkAuth(username, w, r) {
+	if !s.checkAuth(username, w, r) {
 		return
 	}
 
@@ -120,36 +185,33 @@ func setFollowing(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	fu, err := db.GetFollowing(username)
-	if err != nil {
-		log.Printf("db.GetFollowing(%s): %v", username, err)
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprint(w, "Error retrieving following list, not your fault.\nContact your server administrator or try again later.")
-		return
-	}
-
-	for _, u := range data.Add {
+	for _, u := range append(append([]string{}, data.Add...), data.Remove...) {
 		if !followingUsernameRE.MatchString(u) {
 			w.WriteHeader(http.StatusBadRequest)
 			fmt.Fprintf(w, "Invalid global username: %s", u)
 			return
 		}
-		fu.Usernames[u] = struct{}{}
-	}
-	for _, u := range data.Remove {
-		if !followingUsernameRE.MatchString(u) {
-			w.WriteHeader(http.StatusBadRequest)
-			fmt.Fprintf(w, "Invalid global username: %s", u)
-			return
-		}
-		delete(fu.Usernames, u)
 	}
 
-	err = db.SetFollowing(username, fu)
+	// Read and saved in one go, so changes from another device at the same
+	// time aren't lost
+	_, err = s.store.UpdateFollowing(username, func(fu *model.Following) error {
+		for _, u := range data.Add {
+			fu.Usernames[u] = struct{}{}
+		}
+		for _, u := range data.Remove {
+			delete(fu.Usernames, u)
+		}
+		return nil
+	})
 	if err != nil {
-		log.Printf("db.GetFollowing(%s): %v", username, err)
+		log.Printf("store.UpdateFollowing(%s): %v", username, err)
 		w.WriteHeader(http.StatusInternalServerError)
 		fmt.Fprint(w, "Error saving new following list, not your fault.\nContact your server administrator or try again later.")
 		return
 	}
+
+	if config.Conf.Following.Validate {
+		remote.Check(data.Add)
+	}
 }
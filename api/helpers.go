@@ -1,20 +1,48 @@
 package api
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 
 	"github.com/makeworld-the-better-one/whatsup/config"
+	"github.com/makeworld-the-better-one/whatsup/db"
+	"github.com/makeworld-the-better-one/whatsup/httpsig"
+	"github.com/makeworld-the-better-one/whatsup/model"
 	"github.com/matthewhartstonge/argon2"
 )
 
 // Helper functions and middleware
 
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	s.serveMux.ServeHTTP(w, r)
+	// Verify signed requests from other servers, so handlers can know who
+	// is asking with getRequester
+	id, err := httpsig.Verify(w, r, s.keyCache, maxRequestBody)
+	if errors.Is(err, httpsig.ErrBodyTooLarge) {
+		writeStatusCodePage(w, http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil && !errors.Is(err, httpsig.ErrNoSignature) {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprintf(w, "Could not verify signature: %v", err)
+		return
+	}
+	if id != nil {
+		r = r.WithContext(context.WithValue(r.Context(), identityKey{}, id))
+	}
+
+	if r.URL.Path == streamPath || r.URL.Path == wsPath {
+		// Long-lived responses
+		s.serveMux.ServeHTTP(w, r)
+		return
+	}
+	s.timeoutHandler.ServeHTTP(w, r)
 }
 
+type identityKey struct{}
+
 // writeStatusCodePage returns the status code to the client, and writes the
 // default text describing that status code as the document.
 func writeStatusCodePage(w http.ResponseWriter, code int) {
@@ -31,7 +59,7 @@ func CORS(next http.HandlerFunc) http.HandlerFunc {
 		if r.Method == "OPTIONS" {
 			w.Header().Add("Access-Control-Allow-Origin", "*")
 			w.Header().Add("Access-Control-Allow-Methods", "GET, OPTIONS")
-			w.Header().Add("Access-Control-Allow-Headers", "If-Modified-Since")
+			w.Header().Add("Access-Control-Allow-Headers", "If-Modified-Since, Authorization, Last-Event-ID")
 			w.Header().Add("Access-Control-Max-Age", "86400")
 			w.WriteHeader(http.StatusNoContent)
 			return
@@ -49,7 +77,7 @@ func CORS(next http.HandlerFunc) http.HandlerFunc {
 // checkAuth authenticates the request and returns an error response
 // if needed. If the return value error is false, an error was sent and further
 // processing of the request should stop immediately.
-func checkAuth(username string, w http.ResponseWriter, r *http.Request) bool {
+func (s *Server) checkAuth(username string, w http.ResponseWriter, r *http.Request) bool {
 	authUsername, password, ok := r.BasicAuth()
 	if !ok {
 		writeStatusCodePage(w, http.StatusUnauthorized)
@@ -68,7 +96,16 @@ func checkAuth(username string, w http.ResponseWriter, r *http.Request) bool {
 		return false
 	}
 
-	ok, err := argon2.VerifyEncoded([]byte(password), []byte(config.Conf.Users[username]))
+	ok, err := s.verifyPassword(username, password)
+	if errors.Is(err, errAccountDisabled) {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, "Account is disabled")
+		return false
+	}
+	if errors.Is(err, errAccountDeleted) {
+		writeStatusCodePage(w, http.StatusGone)
+		return false
+	}
 	if err != nil {
 		log.Printf("setStatus: verifying password for %s: %v", username, err)
 		w.WriteHeader(http.StatusInternalServerError)
@@ -85,20 +122,108 @@ func checkAuth(username string, w http.ResponseWriter, r *http.Request) bool {
 	return true
 }
 
-// dedupStringSlice returns the same slice but with no duplicate elements.
-// Order is not preserved.
-// This is unused right now, but could be used to prevent returning duplicate
-// usernames if the client requests it (which is invalid).
-// func dedupStringSlice(ss []string) []string {
-// 	// http://rosettacode.org/wiki/Remove_duplicate_elements#Go
-
-// 	unique := make(map[string]bool, len(ss))
-// 	for _, s := range ss {
-// 		unique[s] = true
-// 	}
-// 	result := make([]string, 0, len(unique))
-// 	for s := range unique {
-// 		result = append(result, s)
-// 	}
-// 	return result
-// }
+// errAccountDisabled is returned by verifyPassword when the password is
+// correct, but an admin has disabled the account.
+var errAccountDisabled = errors.New("account is disabled")
+
+// errAccountDeleted is returned by verifyPassword when the account was
+// deleted, but the user is still in the config.
+var errAccountDeleted = errors.New("account was deleted")
+
+// verifyPassword returns true if the password is correct for the user.
+// The user must exist. A password set by an admin takes the place of the
+// one in the config.
+func (s *Server) verifyPassword(username, password string) (bool, error) {
+	acct, err := s.store.GetAccount(username)
+	if errors.Is(err, db.ErrNotFound) {
+		return false, errAccountDeleted
+	}
+	if err != nil {
+		return false, err
+	}
+	hash := config.Conf.Users[username]
+	if acct.PasswordHash != "" {
+		hash = acct.PasswordHash
+	}
+	ok, err := argon2.VerifyEncoded([]byte(password), []byte(hash))
+	if err != nil || !ok {
+		return ok, err
+	}
+	if acct.Disabled {
+		return false, errAccountDisabled
+	}
+	return true, nil
+}
+
+// globalUsername returns the global username of a user on this server.
+func globalUsername(username string) string {
+	return "@" + username + "@" + config.Conf.Server.Domain
+}
+
+// getRequester works out who is making the request, for privacy checks.
+// Requests can be authenticated with Basic auth as a local user, or signed
+// by a remote server. Unauthenticated requests are anonymous. If the request has invalid
+// credentials, an error response is sent and the return value ok is false.
+func (s *Server) getRequester(w http.ResponseWriter, r *http.Request) (req *model.Requester, ok bool) {
+	username, password, hasAuth := r.BasicAuth()
+	if !hasAuth {
+		if id, ok := r.Context().Value(identityKey{}).(*httpsig.Identity); ok {
+			// Signed by a remote server
+			return &model.Requester{Username: id.User, Server: id.Server}, true
+		}
+		return &model.Requester{}, true
+	}
+
+	if _, exists := config.Conf.Users[username]; !exists {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, "Incorrect username or password")
+		return nil, false
+	}
+	valid, err := s.verifyPassword(username, password)
+	if errors.Is(err, errAccountDisabled) {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, "Account is disabled")
+		return nil, false
+	}
+	if errors.Is(err, errAccountDeleted) {
+		writeStatusCodePage(w, http.StatusGone)
+		return nil, false
+	}
+	if err != nil {
+		log.Printf("getRequester: verifying password for %s: %v", username, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, "Error verifying password, not your fault.\nContact your server administrator or try again later.")
+		return nil, false
+	}
+	if !valid {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, "Incorrect username or password")
+		return nil, false
+	}
+
+	return &model.Requester{Username: globalUsername(username), Local: true}, true
+}
+
+// canSee returns whether the requester is allowed to see the status of the
+// local user, according to the user's privacy settings.
+func (s *Server) canSee(username string, req *model.Requester) (bool, error) {
+	p, err := s.store.GetPrivacy(username)
+	if err != nil {
+		return false, err
+	}
+	return p.Allows(globalUsername(username), req), nil
+}
+
+// dedupStringSlice returns the slice with duplicate elements removed,
+// keeping the first of each in order.
+func dedupStringSlice(ss []string) []string {
+	seen := make(map[string]bool, len(ss))
+	result := make([]string, 0, len(ss))
+	for _, s := range ss {
+		if !seen[s] {
+			seen[s] = true
+			result = append(result, s)
+		}
+	}
+	return result
+}
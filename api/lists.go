@@ -0,0 +1,284 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/makeworld-the-better-one/whatsup/config"
+	"github.com/makeworld-the-better-one/whatsup/db"
+	"github.com/makeworld-the-better-one/whatsup/model"
+)
+
+// Follow lists API
+// Not in the spec, lets users group the people they follow.
+//
+// Lists can also be used as a filter with ?list=<name> by their owner, on
+// the following list and its export, the status query API and stream, and
+// in WebSocket subscribe messages.
+//
+// GET    /.well-known/fmrl/user/<username>/lists         - all lists as a JSON object
+// GET    /.well-known/fmrl/user/<username>/lists/<name>  - list members as a JSON array
+// PUT    /.well-known/fmrl/user/<username>/lists/<name>  - create an empty list
+// PATCH  /.well-known/fmrl/user/<username>/lists/<name>  - rename, add or remove members
+// DELETE /.well-known/fmrl/user/<username>/lists/<name>  - delete the list
+
+var listNameRE = regexp.MustCompile(`^[a-z0-9_\.-]{1,40}$`)
+
+type setListJSON struct {
+	Name   *string  `json:"name"`
+	Add    []string `json:"add"`
+	Remove []string `json:"remove"`
+}
+
+// errNotFollowing is returned by the setList update when a username to add
+// isn't followed by the user.
+var errNotFollowing = errors.New("not following")
+
+func (s *Server) listsPath(w http.ResponseWriter, r *http.Request) {
+	// Path is <username>/lists or <username>/lists/<name>
+	parts := strings.Split(r.URL.Path[len("/.well-known/fmrl/user/"):], "/")
+	username := parts[0]
+
+	if _, ok := config.Conf.Users[username]; !ok {
+		// User doesn't exist
+		writeStatusCodePage(w, http.StatusNotFound)
+		return
+	}
+
+	if !s.checkAuth(username, w, r) {
+		return
+	}
+
+	if len(parts) == 2 {
+		if r.Method != "GET" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		s.getLists(w, username)
+		return
+	}
+
+	name := parts[2]
+	if !listNameRE.MatchString(name) {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Invalid list name: %s", name)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		s.getList(w, r, username, name)
+	case "PUT":
+		err := s.store.CreateList(username, name)
+		if errors.Is(err, db.ErrExists) {
+			// Nothing to do
+			return
+		}
+		if err != nil {
+			log.Printf("store.CreateList(%s, %s): %v", username, name, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(w, "Error creating list, not your fault.\nContact your server administrator or try again later.")
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	case "PATCH":
+		s.setList(w, r, username, name)
+	case "DELETE":
+		err := s.store.DeleteList(username, name)
+		if errors.Is(err, db.ErrNotFound) {
+			writeStatusCodePage(w, http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Printf("store.DeleteList(%s, %s): %v", username, name, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(w, "Error deleting list, not your fault.\nContact your server administrator or try again later.")
+			return
+		}
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) getLists(w http.ResponseWriter, username string) {
+	lists, err := s.store.GetLists(username)
+	if err != nil {
+		log.Printf("store.GetLists(%s): %v", username, err)
+		writeStatusCodePage(w, http.StatusInternalServerError)
+		return
+	}
+
+	m := make(map[string]model.FollowingUsernames, len(lists))
+	for _, list := range lists {
+		m[list.Name] = list.Usernames
+	}
+
+	apiJSON, err := json.Marshal(m)
+	if err != nil {
+		log.Printf("JSON encoding lists for %s: %v", username, err)
+		writeStatusCodePage(w, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	w.Write(apiJSON)
+}
+
+func (s *Server) getList(w http.ResponseWriter, r *http.Request, username, name string) {
+	list, err := s.store.GetList(username, name)
+	if errors.Is(err, db.ErrNotFound) {
+		writeStatusCodePage(w, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("store.GetList(%s, %s): %v", username, name, err)
+		writeStatusCodePage(w, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Add("Last-Modified", list.UpdatedAt.UTC().Format(http.TimeFormat))
+
+	// If-Modified-Since, see getFollowing
+	var ifModTime time.Time
+	if ifm, ok := r.Header["If-Modified-Since"]; ok {
+		ifModTime, _ = http.ParseTime(ifm[0])
+	}
+
+	if list.UpdatedAt.Before(ifModTime) || list.UpdatedAt.Truncate(time.Second).Equal(ifModTime) {
+		// No new updates
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	apiJSON, err := json.Marshal(list.Usernames)
+	if err != nil {
+		log.Printf("JSON encoding list %s for %s: %v", name, username, err)
+		writeStatusCodePage(w, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	w.Write(apiJSON)
+}
+
+func (s *Server) setList(w http.ResponseWriter, r *http.Request, username, name string) {
+	// Limit client JSON to 1 MiB, same as setFollowing
+	r.Body = http.MaxBytesReader(w, r.Body, 1*1024*1024)
+
+	clientJSON, err := io.ReadAll(r.Body)
+	if err != nil {
+		// Most likely that the client body was too large, don't log
+		writeStatusCodePage(w, http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	var data setListJSON
+
+	// See setStatus for why
+	if !json.Valid(clientJSON) {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "Received JSON is invalid")
+		return
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(clientJSON))
+	dec.DisallowUnknownFields()
+
+	if err := dec.Decode(&data); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Bad value type or unrecognized field: %v", err)
+		return
+	}
+
+	if data.Name == nil && len(data.Add) == 0 && len(data.Remove) == 0 {
+		// Request that did nothing
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "No name change or usernames to add or remove")
+		return
+	}
+
+	if data.Name != nil && !listNameRE.MatchString(*data.Name) {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Invalid list name: %s", *data.Name)
+		return
+	}
+	for _, u := range append(data.Add, data.Remove...) {
+		if !followingUsernameRE.MatchString(u) {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "Invalid global username: %s", u)
+			return
+		}
+	}
+
+	// The following list is checked in the same transaction, so a username
+	// can't be unfollowed between the check and the write
+	var notFollowing string
+	_, err = s.store.UpdateList(username, name, func(list *model.List, following model.FollowingUsernames) error {
+		for _, u := range data.Add {
+			if _, ok := following[u]; !ok {
+				// Lists are a subset of the following list
+				notFollowing = u
+				return errNotFollowing
+			}
+			list.Usernames[u] = struct{}{}
+		}
+		for _, u := range data.Remove {
+			delete(list.Usernames, u)
+		}
+		if data.Name != nil {
+			list.Name = *data.Name
+		}
+		return nil
+	})
+	if errors.Is(err, db.ErrNotFound) {
+		writeStatusCodePage(w, http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, errNotFollowing) {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Not following: %s", notFollowing)
+		return
+	}
+	if errors.Is(err, db.ErrExists) {
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprintf(w, "List already exists: %s", *data.Name)
+		return
+	}
+	if err != nil {
+		log.Printf("store.UpdateList(%s, %s): %v", username, name, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, "Error saving list, not your fault.\nContact your server administrator or try again later.")
+		return
+	}
+}
+
+// requesterList returns the follow list with the given name owned by the
+// requester. Returns db.ErrNotFound if the requester isn't a local user or
+// doesn't have that list.
+func (s *Server) requesterList(req *model.Requester, name string) (*model.List, error) {
+	if !req.Local {
+		return nil, db.ErrNotFound
+	}
+	username := strings.TrimSuffix(strings.TrimPrefix(req.Username, "@"), "@"+config.Conf.Server.Domain)
+	return s.store.GetList(username, name)
+}
+
+// localListUsers returns the local usernames of the users in a follow list,
+// sorted.
+func localListUsers(list *model.List) []string {
+	usernames := make([]string, 0, len(list.Usernames))
+	for _, u := range list.Usernames.Sorted() {
+		if strings.HasSuffix(u, "@"+config.Conf.Server.Domain) {
+			usernames = append(usernames, strings.TrimSuffix(strings.TrimPrefix(u, "@"), "@"+config.Conf.Server.Domain))
+		}
+	}
+	return usernames
+}
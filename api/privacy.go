@@ -0,0 +1,126 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/makeworld-the-better-one/whatsup/config"
+	"github.com/makeworld-the-better-one/whatsup/model"
+)
+
+// Privacy API
+// Not in the spec, controls who can see a user's status.
+//
+// GET /.well-known/fmrl/user/<username>/privacy
+// PUT /.well-known/fmrl/user/<username>/privacy
+//
+// Both use the JSON form of model.Privacy:
+// {"mode": "public|local|allowlist", "allow": [...], "block": [...], "finger": true|false}
+
+func (s *Server) privacyPath(w http.ResponseWriter, r *http.Request) {
+	username := r.URL.Path[len("/.well-known/fmrl/user/") : len(r.URL.Path)-len("/privacy")]
+
+	if _, ok := config.Conf.Users[username]; !ok {
+		// User doesn't exist
+		writeStatusCodePage(w, http.StatusNotFound)
+		return
+	}
+
+	if r.Method != "GET" && r.Method != "PUT" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !s.checkAuth(username, w, r) {
+		return
+	}
+
+	if r.Method == "GET" {
+		p, err := s.store.GetPrivacy(username)
+		if err != nil {
+			log.Printf("store.GetPrivacy(%s): %v", username, err)
+			writeStatusCodePage(w, http.StatusInternalServerError)
+			return
+		}
+		apiJSON, err := json.Marshal(p)
+		if err != nil {
+			log.Printf("JSON encoding privacy for %s: %v", username, err)
+			writeStatusCodePage(w, http.StatusInternalServerError)
+			return
+		}
+		w.Header().Add("Content-Type", "application/json")
+		w.Write(apiJSON)
+		return
+	}
+
+	// Limit client JSON to 1 MiB, same as setFollowing
+	r.Body = http.MaxBytesReader(w, r.Body, 1*1024*1024)
+
+	clientJSON, err := io.ReadAll(r.Body)
+	if err != nil {
+		// Most likely that the client body was too large, don't log
+		writeStatusCodePage(w, http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	// See setStatus for why
+	if !json.Valid(clientJSON) {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "Received JSON is invalid")
+		return
+	}
+
+	p := model.NewPrivacy()
+	dec := json.NewDecoder(bytes.NewReader(clientJSON))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(p); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Bad value type or unrecognized field: %v", err)
+		return
+	}
+
+	if err := p.Validate(); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "%v", err)
+		return
+	}
+
+	if err := s.store.SetPrivacy(username, p); err != nil {
+		log.Printf("store.SetPrivacy(%s): %v", username, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, "Error saving privacy settings, not your fault.\nContact your server administrator or try again later.")
+		return
+	}
+}
+
+// avatarPrivacy only serves avatars to requesters that can see the user's status.
+func (s *Server) avatarPrivacy(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Path is <username>/original after prefix stripping
+		username := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)[0]
+
+		if _, ok := config.Conf.Users[username]; ok {
+			req, ok := s.getRequester(w, r)
+			if !ok {
+				return
+			}
+			visible, err := s.canSee(username, req)
+			if err != nil {
+				log.Printf("canSee(%s): %v", username, err)
+				writeStatusCodePage(w, http.StatusInternalServerError)
+				return
+			}
+			if !visible {
+				writeStatusCodePage(w, config.Conf.Privacy.DeniedCode)
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
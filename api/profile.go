@@ -0,0 +1,177 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/makeworld-the-better-one/whatsup/config"
+	"github.com/makeworld-the-better-one/whatsup/model"
+	"github.com/makeworld-the-better-one/whatsup/web"
+)
+
+// Profile pages
+// Not in the spec, human-readable pages for sharing links to.
+//
+// GET /                                  - landing page listing public users
+// GET /.well-known/fmrl/user/<username>  - profile page, or the status query
+//                                          dictionary of the user for clients
+//                                          that prefer JSON
+
+// avatarURL returns the absolute URL of the status avatar, or an empty string.
+func avatarURL(status *model.Status) string {
+	if status.Avatar == nil || status.Avatar.Paths["original"] == "" {
+		return ""
+	}
+	u := status.Avatar.Paths["original"]
+	if strings.HasPrefix(u, "/") {
+		u = config.Conf.Server.URL + u
+	}
+	if status.Avatar.Num != nil {
+		u += fmt.Sprintf("?%d", *status.Avatar.Num)
+	}
+	return u
+}
+
+func (s *Server) userProfile(w http.ResponseWriter, r *http.Request) {
+	username := r.URL.Path[len("/.well-known/fmrl/user/"):]
+	wantsHTML := web.WantsHTML(r)
+	w.Header().Add("Vary", "Accept, Authorization")
+
+	req, ok := s.getRequester(w, r)
+	if !ok {
+		return
+	}
+	user := s.queryUser(username, req, nil, nil, parseIfModifiedSince(r))
+
+	if !wantsHTML {
+		if user.Code == http.StatusOK {
+			w.Header().Set("Last-Modified", user.Data.UpdatedAt.UTC().Format(http.TimeFormat))
+		}
+		apiJSON, err := json.Marshal(user)
+		if err != nil {
+			log.Printf("JSON encoding profile of %s: %v", username, err)
+			writeStatusCodePage(w, http.StatusInternalServerError)
+			return
+		}
+		w.Header().Add("Content-Type", "application/json")
+		w.Write(apiJSON)
+		return
+	}
+
+	if user.Code == http.StatusNotModified {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	if user.Code != http.StatusOK {
+		web.RenderError(w, user.Code)
+		return
+	}
+
+	status := user.Data
+	global := globalUsername(username)
+	data := &web.ProfileData{
+		Global:  global,
+		Title:   global,
+		URL:     config.Conf.Server.URL + r.URL.Path,
+		Avatar:  avatarURL(status),
+		FeedURL: config.Conf.Server.URL + "/.well-known/fmrl/user/" + username + "/feed",
+		Updated: status.UpdatedAt,
+		Status:  status,
+	}
+	if status.Name != nil && *status.Name != "" {
+		data.Title = *status.Name + " (" + global + ")"
+	}
+	data.Description = profileDescription(status)
+
+	w.Header().Set("Last-Modified", status.UpdatedAt.UTC().Format(http.TimeFormat))
+	web.Render(w, http.StatusOK, "profile", data.Title, data)
+}
+
+// profileDescription returns a one line summary of the status, for link previews.
+func profileDescription(status *model.Status) string {
+	var parts []string
+	if line := strings.TrimSpace(derefString(status.Emoji) + " " + derefString(status.Status)); line != "" {
+		parts = append(parts, line)
+	}
+	if media := derefString(status.Media); media != "" {
+		mediaType := 0
+		if status.MediaType != nil {
+			mediaType = *status.MediaType
+		}
+		parts = append(parts, model.MediaTypeLabel(mediaType)+": "+media)
+	}
+	if len(parts) == 0 {
+		return "No status."
+	}
+	return strings.Join(parts, " · ")
+}
+
+func derefString(p *string) string {
+	if p == nil {
+		return ""
+	}
+	return *p
+}
+
+// parseIfModifiedSince returns the time in the If-Modified-Since header, or
+// the zero value.
+func parseIfModifiedSince(r *http.Request) time.Time {
+	t, _ := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	return t
+}
+
+// landingPage serves the landing page at /, and HTML or plain text 404 pages
+// for any other path that isn't handled.
+func (s *Server) landingPage(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		if web.WantsHTML(r) {
+			web.RenderError(w, http.StatusNotFound)
+		} else {
+			writeStatusCodePage(w, http.StatusNotFound)
+		}
+		return
+	}
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	req, ok := s.getRequester(w, r)
+	if !ok {
+		return
+	}
+
+	usernames := make([]string, 0, len(config.Conf.Users))
+	for username := range config.Conf.Users {
+		usernames = append(usernames, username)
+	}
+	sort.Strings(usernames)
+
+	batch, err := s.getUserBatch(usernames)
+	if err != nil {
+		log.Printf("landingPage: getUserBatch: %v", err)
+		web.RenderError(w, http.StatusInternalServerError)
+		return
+	}
+
+	data := &web.IndexData{Domain: config.Conf.Server.Domain, URL: config.Conf.Server.URL + "/"}
+	for _, username := range usernames {
+		user := s.queryUser(username, req, batch, batch.statuses[username], time.Time{})
+		if user.Code != http.StatusOK {
+			// Hidden
+			continue
+		}
+		data.Users = append(data.Users, &web.IndexUser{
+			Global: globalUsername(username),
+			Link:   "/.well-known/fmrl/user/" + username,
+			Status: user.Data,
+		})
+	}
+	w.Header().Add("Vary", "Authorization")
+	web.Render(w, http.StatusOK, "index", config.Conf.Server.Domain, data)
+}
@@ -0,0 +1,452 @@
+package api
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"image"
+	"image/png"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/makeworld-the-better-one/whatsup/config"
+	"github.com/makeworld-the-better-one/whatsup/db"
+	"github.com/makeworld-the-better-one/whatsup/model"
+	"github.com/makeworld-the-better-one/whatsup/remote"
+	"github.com/makeworld-the-better-one/whatsup/web"
+)
+
+// Settings web UI
+// Not in the spec, lets users change their status from a browser, without
+// needing JavaScript. Only enabled if config.Conf.Web.Settings is true.
+//
+// GET  /.well-known/fmrl/settings            - settings page, or redirect to login
+// GET  /.well-known/fmrl/settings/login      - login form
+// POST /.well-known/fmrl/settings/login      - log in with username and password
+// POST /.well-known/fmrl/settings/logout     - log out
+// POST /.well-known/fmrl/settings/status     - set status fields
+// POST /.well-known/fmrl/settings/avatar     - upload and crop, or remove, the avatar
+// POST /.well-known/fmrl/settings/following  - add or remove followed users
+//
+// Admin pages are under /.well-known/fmrl/settings/admin, see admin.go.
+//
+// Logged in browsers have a session cookie, and every form has a CSRF token
+// tied to the session.
+
+const settingsPath = "/.well-known/fmrl/settings"
+
+const sessionCookie = "whatsup_session"
+
+// pickerEmoji are offered as one-click choices on the settings page.
+var pickerEmoji = []string{
+	"😀", "😴", "🤒", "🥳", "😎", "🤔", "💻", "📚", "🎮", "🎧",
+	"🎬", "🍳", "☕", "🍕", "🏃", "🚲", "✈️", "🏠", "🌴", "🎉",
+}
+
+// setSecureHeaders adds headers that lock down what settings pages can do
+// in the browser.
+func setSecureHeaders(w http.ResponseWriter) {
+	w.Header().Set("Content-Security-Policy",
+		"default-src 'none'; img-src 'self' data:; style-src 'unsafe-inline'; form-action 'self'; frame-ancestors 'none'; base-uri 'none'")
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.Header().Set("Referrer-Policy", "same-origin")
+	w.Header().Set("Cache-Control", "no-store")
+	if strings.HasPrefix(config.Conf.Server.URL, "https://") {
+		w.Header().Set("Strict-Transport-Security", "max-age=31536000")
+	}
+}
+
+func (s *Server) settings(w http.ResponseWriter, r *http.Request) {
+	setSecureHeaders(w)
+
+	if r.Method == "POST" && !sameOrigin(r) {
+		web.RenderError(w, http.StatusForbidden)
+		return
+	}
+
+	switch r.URL.Path {
+	case settingsPath + "/login":
+		if r.Method == "GET" {
+			web.Render(w, http.StatusOK, "login", "Log in", &web.LoginData{})
+		} else if r.Method == "POST" {
+			s.login(w, r)
+		} else {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+		return
+	case settingsPath, settingsPath + "/", settingsPath + "/logout", settingsPath + "/status",
+		settingsPath + "/avatar", settingsPath + "/following", adminPath, adminPath + "/user":
+	default:
+		web.RenderError(w, http.StatusNotFound)
+		return
+	}
+
+	sess, err := s.getSession(r)
+	if errors.Is(err, db.ErrNotFound) {
+		http.Redirect(w, r, settingsPath+"/login", http.StatusSeeOther)
+		return
+	}
+	if err != nil {
+		log.Printf("getSession: %v", err)
+		web.RenderError(w, http.StatusInternalServerError)
+		return
+	}
+
+	if r.URL.Path == adminPath && r.Method == "GET" {
+		s.admin(w, r, sess)
+		return
+	}
+	if r.Method == "GET" {
+		if r.URL.Path != settingsPath && r.URL.Path != settingsPath+"/" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		s.renderSettings(w, sess, http.StatusOK, savedMessages[r.URL.Query().Get("saved")], "")
+		return
+	}
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Avatar forms are multipart, and the limit must be set before parsing
+	if r.URL.Path == settingsPath+"/avatar" {
+		r.Body = http.MaxBytesReader(w, r.Body, MaxAvatarSize*3)
+		if err := r.ParseMultipartForm(MaxAvatarSize); err != nil {
+			s.renderSettings(w, sess, http.StatusBadRequest, "", "Image is too large or the upload failed.")
+			return
+		}
+	} else {
+		r.Body = http.MaxBytesReader(w, r.Body, 64*1024)
+	}
+	if !hmac.Equal([]byte(r.FormValue("csrf")), []byte(sess.CSRF)) {
+		web.RenderError(w, http.StatusForbidden)
+		return
+	}
+
+	switch r.URL.Path {
+	case settingsPath + "/logout":
+		if err := s.store.DeleteSession(sess.ID); err != nil {
+			log.Printf("db.DeleteSession: %v", err)
+		}
+		http.SetCookie(w, &http.Cookie{Name: sessionCookie, Path: settingsPath, MaxAge: -1})
+		http.Redirect(w, r, settingsPath+"/login", http.StatusSeeOther)
+	case settingsPath + "/status":
+		s.settingsStatus(w, r, sess)
+	case settingsPath + "/avatar":
+		s.settingsAvatar(w, r, sess)
+	case settingsPath + "/following":
+		s.settingsFollowing(w, r, sess)
+	case adminPath, adminPath + "/user":
+		s.admin(w, r, sess)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+var savedMessages = map[string]string{
+	"status":    "Status saved.",
+	"avatar":    "Avatar saved.",
+	"following": "Following list saved.",
+}
+
+// sameOrigin returns false if the browser says the request came from another
+// site. Older browsers don't send Origin, SameSite cookies and CSRF tokens
+// protect them.
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" || origin == "null" {
+		return origin == ""
+	}
+	u, err := url.Parse(config.Conf.Server.URL)
+	if err != nil {
+		return false
+	}
+	return origin == u.Scheme+"://"+u.Host
+}
+
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func sessionID(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// getSession returns the session of the request's cookie.
+// Returns db.ErrNotFound if there is no valid session.
+func (s *Server) getSession(r *http.Request) (*model.Session, error) {
+	c, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return nil, db.ErrNotFound
+	}
+	sess, err := s.store.GetSession(sessionID(c.Value))
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := config.Conf.Users[sess.Username]; !ok {
+		// User was removed from the config
+		return nil, db.ErrNotFound
+	}
+	return sess, nil
+}
+
+func (s *Server) login(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, 64*1024)
+	username := r.PostFormValue("username")
+	password := r.PostFormValue("password")
+
+	valid := false
+	if _, ok := config.Conf.Users[username]; ok {
+		var err error
+		valid, err = s.verifyPassword(username, password)
+		if errors.Is(err, errAccountDisabled) {
+			web.Render(w, http.StatusForbidden, "login", "Log in",
+				&web.LoginData{Username: username, Error: "This account is disabled."})
+			return
+		}
+		if errors.Is(err, errAccountDeleted) {
+			web.Render(w, http.StatusGone, "login", "Log in",
+				&web.LoginData{Username: username, Error: "This account was deleted."})
+			return
+		}
+		if err != nil {
+			log.Printf("login: verifying password for %s: %v", username, err)
+			web.RenderError(w, http.StatusInternalServerError)
+			return
+		}
+	}
+	if !valid {
+		web.Render(w, http.StatusUnauthorized, "login", "Log in",
+			&web.LoginData{Username: username, Error: "Incorrect username or password."})
+		return
+	}
+
+	token, err := randomToken()
+	if err != nil {
+		log.Printf("login: generating token: %v", err)
+		web.RenderError(w, http.StatusInternalServerError)
+		return
+	}
+	csrf, err := randomToken()
+	if err != nil {
+		log.Printf("login: generating token: %v", err)
+		web.RenderError(w, http.StatusInternalServerError)
+		return
+	}
+	now := time.Now()
+	sess := &model.Session{
+		ID:        sessionID(token),
+		Username:  username,
+		CSRF:      csrf,
+		CreatedAt: now,
+		ExpiresAt: now.Add(config.Conf.Web.SessionLifetime.Duration),
+	}
+	if err := s.store.CreateSession(sess); err != nil {
+		log.Printf("store.CreateSession(%s): %v", username, err)
+		web.RenderError(w, http.StatusInternalServerError)
+		return
+	}
+	// Logins are rare, so this is a fine time to clean up
+	if err := s.store.PruneSessions(); err != nil {
+		log.Printf("db.PruneSessions: %v", err)
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    token,
+		Path:     settingsPath,
+		Expires:  sess.ExpiresAt,
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(config.Conf.Server.URL, "https://"),
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, settingsPath, http.StatusSeeOther)
+}
+
+func (s *Server) renderSettings(w http.ResponseWriter, sess *model.Session, code int, message, errMsg string) {
+	status, err := s.store.GetUser(sess.Username)
+	if err != nil {
+		log.Printf("GetUser(%s): %v", sess.Username, err)
+		web.RenderError(w, http.StatusInternalServerError)
+		return
+	}
+	fu, err := s.store.GetFollowing(sess.Username)
+	if err != nil {
+		log.Printf("store.GetFollowing(%s): %v", sess.Username, err)
+		web.RenderError(w, http.StatusInternalServerError)
+		return
+	}
+	acct, err := s.store.GetAccount(sess.Username)
+	if err != nil {
+		log.Printf("store.GetAccount(%s): %v", sess.Username, err)
+		web.RenderError(w, http.StatusInternalServerError)
+		return
+	}
+
+	data := &web.SettingsData{
+		Username:  sess.Username,
+		Global:    globalUsername(sess.Username),
+		CSRF:      sess.CSRF,
+		Status:    status,
+		Avatar:    avatarURL(status),
+		Emoji:     pickerEmoji,
+		Following: fu.Usernames.Sorted(),
+		Admin:     acct.IsAdmin(),
+		Message:   message,
+		Error:     errMsg,
+	}
+	for i := 0; i <= model.MaxMediaType; i++ {
+		data.MediaTypes = append(data.MediaTypes, &web.MediaTypeOption{Value: i, Label: model.MediaTypeLabel(i)})
+	}
+	web.Render(w, code, "settings", "Settings", data)
+}
+
+func (s *Server) settingsStatus(w http.ResponseWriter, r *http.Request, sess *model.Session) {
+	name := r.PostFormValue("name")
+	text := r.PostFormValue("status")
+	media := r.PostFormValue("media")
+	uri := r.PostFormValue("uri")
+	emoji := strings.TrimSpace(r.PostFormValue("emoji"))
+	if emoji == "" {
+		emoji = r.PostFormValue("emoji_pick")
+	}
+	mediaType, err := strconv.Atoi(r.PostFormValue("media_type"))
+	if err != nil {
+		mediaType = 0
+	}
+
+	status := model.Status{
+		Name:      &name,
+		Status:    &text,
+		Media:     &media,
+		MediaType: &mediaType,
+	}
+	// Empty emoji and URI values aren't valid, so they are left unchanged,
+	// same as if they weren't sent to setStatus
+	if emoji != "" {
+		status.Emoji = &emoji
+	}
+	if uri != "" {
+		status.URI = &uri
+	}
+
+	// Same validation as setStatus
+	if err := status.Validate(); err != nil {
+		s.renderSettings(w, sess, http.StatusBadRequest, "", "Invalid status: "+err.Error())
+		return
+	}
+
+	if err := s.store.SetUser(sess.Username, &status); err != nil {
+		log.Printf("SetUser %s: %v", sess.Username, err)
+		s.renderSettings(w, sess, http.StatusInternalServerError, "", "Error saving new status, not your fault. Contact your server administrator or try again later.")
+		return
+	}
+	http.Redirect(w, r, settingsPath+"?saved=status", http.StatusSeeOther)
+}
+
+func (s *Server) settingsAvatar(w http.ResponseWriter, r *http.Request, sess *model.Session) {
+	if r.FormValue("remove") != "" {
+		if err := s.store.RemoveAvatar(sess.Username); err != nil {
+			// Logging is done within db.RemoveAvatar, not needed here
+			s.renderSettings(w, sess, http.StatusInternalServerError, "", "Error deleting avatar, not your fault. Contact your server administrator or try again later.")
+			return
+		}
+		http.Redirect(w, r, settingsPath+"?saved=avatar", http.StatusSeeOther)
+		return
+	}
+
+	f, _, err := r.FormFile("avatar")
+	if err != nil {
+		s.renderSettings(w, sess, http.StatusBadRequest, "", "No image was uploaded.")
+		return
+	}
+	defer f.Close()
+
+	img, err := decodeAvatar(f)
+	if errors.Is(err, image.ErrFormat) {
+		s.renderSettings(w, sess, http.StatusBadRequest, "", "Image must be JPEG or PNG only.")
+		return
+	}
+	if errors.Is(err, errAvatarPixels) {
+		s.renderSettings(w, sess, http.StatusBadRequest, "", "Image is too large, the maximum is 4096x4096 pixels.")
+		return
+	}
+	if err != nil {
+		s.renderSettings(w, sess, http.StatusBadRequest, "", "Failed to decode image.")
+		return
+	}
+
+	cropX, _ := strconv.Atoi(r.FormValue("crop_x"))
+	cropY, _ := strconv.Atoi(r.FormValue("crop_y"))
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, cropSquare(img, cropX, cropY)); err != nil {
+		log.Printf("settingsAvatar: encoding PNG for %s: %v", sess.Username, err)
+		s.renderSettings(w, sess, http.StatusInternalServerError, "", "Error processing avatar.")
+		return
+	}
+	if buf.Len() > MaxAvatarSize {
+		// Same limit as uploads through the API
+		s.renderSettings(w, sess, http.StatusBadRequest, "", "Cropped avatar is larger than 4 MiB, try a smaller image.")
+		return
+	}
+
+	if err := s.store.SetAvatar(sess.Username, buf.Bytes()); err != nil {
+		// Logging is done within db.SetAvatar, not needed here
+		s.renderSettings(w, sess, http.StatusInternalServerError, "", "Error saving new avatar, not your fault. Contact your server administrator or try again later.")
+		return
+	}
+	http.Redirect(w, r, settingsPath+"?saved=avatar", http.StatusSeeOther)
+}
+
+func (s *Server) settingsFollowing(w http.ResponseWriter, r *http.Request, sess *model.Session) {
+	// Usernames to add can be separated by spaces, commas, or newlines
+	add := strings.FieldsFunc(r.PostFormValue("add"), func(c rune) bool {
+		return c == ',' || c == ' ' || c == '\n' || c == '\r' || c == '\t'
+	})
+	remove := r.PostForm["remove"]
+	if len(add) == 0 && len(remove) == 0 {
+		s.renderSettings(w, sess, http.StatusBadRequest, "", "No usernames to add or remove.")
+		return
+	}
+
+	for _, u := range append(append([]string{}, add...), remove...) {
+		if !followingUsernameRE.MatchString(u) {
+			s.renderSettings(w, sess, http.StatusBadRequest, "", "Invalid global username: "+u)
+			return
+		}
+	}
+
+	_, err := s.store.UpdateFollowing(sess.Username, func(fu *model.Following) error {
+		for _, u := range add {
+			fu.Usernames[u] = struct{}{}
+		}
+		for _, u := range remove {
+			delete(fu.Usernames, u)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("store.UpdateFollowing(%s): %v", sess.Username, err)
+		s.renderSettings(w, sess, http.StatusInternalServerError, "", "Error saving new following list, not your fault. Contact your server administrator or try again later.")
+		return
+	}
+
+	if config.Conf.Following.Validate && len(add) > 0 {
+		remote.Check(add)
+	}
+	http.Redirect(w, r, settingsPath+"?saved=following", http.StatusSeeOther)
+}
@@ -0,0 +1,223 @@
+package api
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// postForm posts the form to the settings path with the session cookie, if
+// it's not nil.
+func postForm(s *Server, path string, cookie *http.Cookie, form url.Values, origin string) *http.Response {
+	r := httptest.NewRequest("POST", path, strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if origin != "" {
+		r.Header.Set("Origin", origin)
+	}
+	if cookie != nil {
+		r.AddCookie(cookie)
+	}
+	return do(s, r)
+}
+
+// statusText returns the status text of the user.
+func statusText(t *testing.T, s *Server, username string) string {
+	t.Helper()
+	status, err := s.store.GetUser(username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Status == nil {
+		return ""
+	}
+	return *status.Status
+}
+
+func TestLogin(t *testing.T) {
+	s := newTestServer(t, "alice", "bob")
+	if err := s.store.SetDisabled("bob", true); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		username string
+		password string
+		code     int
+		body     string
+	}{
+		{"valid", "alice", "alice", http.StatusSeeOther, ""},
+		{"wrong password", "alice", "bob", http.StatusUnauthorized, "Incorrect username or password."},
+		{"unknown user", "nobody", "nobody", http.StatusUnauthorized, "Incorrect username or password."},
+		{"disabled", "bob", "bob", http.StatusForbidden, "This account is disabled."},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			form := url.Values{"username": {tt.username}, "password": {tt.password}}
+			resp := postForm(s, settingsPath+"/login", nil, form, "")
+			if resp.StatusCode != tt.code {
+				t.Fatalf("got %d, want %d", resp.StatusCode, tt.code)
+			}
+			var cookie *http.Cookie
+			for _, c := range resp.Cookies() {
+				if c.Name == sessionCookie {
+					cookie = c
+				}
+			}
+			if tt.code != http.StatusSeeOther {
+				body, _ := io.ReadAll(resp.Body)
+				if !strings.Contains(string(body), tt.body) {
+					t.Errorf("body doesn't say %q", tt.body)
+				}
+				if cookie != nil {
+					t.Error("got a session cookie")
+				}
+				return
+			}
+
+			if cookie == nil || !cookie.HttpOnly || cookie.SameSite != http.SameSiteLaxMode || !cookie.Secure {
+				t.Fatalf("session cookie is %+v", cookie)
+			}
+			r := httptest.NewRequest("GET", settingsPath, nil)
+			r.AddCookie(cookie)
+			if resp := do(s, r); resp.StatusCode != http.StatusOK {
+				t.Errorf("settings page with the new session: got %d", resp.StatusCode)
+			}
+		})
+	}
+}
+
+func TestSettingsCSRF(t *testing.T) {
+	s := newTestServer(t, "alice", "bob")
+	cookie, csrf := newSession(t, s, "alice", time.Hour)
+	_, bobCSRF := newSession(t, s, "bob", time.Hour)
+
+	tests := []struct {
+		name string
+		csrf []string
+	}{
+		{"missing", nil},
+		{"empty", []string{""}},
+		{"wrong", []string{"csrf-nobody"}},
+		{"other session", []string{bobCSRF}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			form := url.Values{"status": {"forged"}, "csrf": tt.csrf}
+			if resp := postForm(s, settingsPath+"/status", cookie, form, ""); resp.StatusCode != http.StatusForbidden {
+				t.Errorf("got %d, want 403", resp.StatusCode)
+			}
+			if text := statusText(t, s, "alice"); text == "forged" {
+				t.Error("the status was changed")
+			}
+		})
+	}
+
+	// Logging out needs it too
+	if resp := postForm(s, settingsPath+"/logout", cookie, url.Values{}, ""); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("logout: got %d, want 403", resp.StatusCode)
+	}
+
+	form := url.Values{"status": {"real"}, "csrf": {csrf}}
+	if resp := postForm(s, settingsPath+"/status", cookie, form, ""); resp.StatusCode != http.StatusSeeOther {
+		t.Errorf("with the token: got %d, want 303", resp.StatusCode)
+	}
+	if text := statusText(t, s, "alice"); text != "real" {
+		t.Errorf("status is %q", text)
+	}
+}
+
+func TestSameOrigin(t *testing.T) {
+	s := newTestServer(t, "alice")
+	cookie, csrf := newSession(t, s, "alice", time.Hour)
+
+	tests := []struct {
+		origin string
+		ok     bool
+	}{
+		{"", true},
+		{"https://example.org", true},
+		{"http://example.org", false},
+		{"https://example.org:8443", false},
+		{"https://evil.example", false},
+		{"https://example.org.evil.example", false},
+		{"null", false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("POST", settingsPath+"/status", nil)
+		if tt.origin != "" {
+			r.Header.Set("Origin", tt.origin)
+		}
+		if ok := sameOrigin(r); ok != tt.ok {
+			t.Errorf("%q: got %v, want %v", tt.origin, ok, tt.ok)
+		}
+	}
+
+	// Refused even with a valid session and token
+	form := url.Values{"status": {"cross-site"}, "csrf": {csrf}}
+	if resp := postForm(s, settingsPath+"/status", cookie, form, "https://evil.example"); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("cross-site post: got %d, want 403", resp.StatusCode)
+	}
+	if text := statusText(t, s, "alice"); text == "cross-site" {
+		t.Error("the status was changed")
+	}
+	form = url.Values{"username": {"alice"}, "password": {"alice"}}
+	if resp := postForm(s, settingsPath+"/login", nil, form, "https://evil.example"); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("cross-site login: got %d, want 403", resp.StatusCode)
+	}
+
+	form = url.Values{"status": {"same-site"}, "csrf": {csrf}}
+	if resp := postForm(s, settingsPath+"/status", cookie, form, "https://example.org"); resp.StatusCode != http.StatusSeeOther {
+		t.Errorf("same-site post: got %d, want 303", resp.StatusCode)
+	}
+}
+
+func TestSessionExpiry(t *testing.T) {
+	s := newTestServer(t, "alice")
+	valid, _ := newSession(t, s, "alice", time.Hour)
+	expired, csrf := newSession(t, s, "alice", -time.Second)
+
+	get := func(cookie *http.Cookie) *http.Response {
+		r := httptest.NewRequest("GET", settingsPath, nil)
+		if cookie != nil {
+			r.AddCookie(cookie)
+		}
+		return do(s, r)
+	}
+	redirectsToLogin := func(resp *http.Response) bool {
+		return resp.StatusCode == http.StatusSeeOther && resp.Header.Get("Location") == settingsPath+"/login"
+	}
+
+	if resp := get(valid); resp.StatusCode != http.StatusOK {
+		t.Errorf("valid session: got %d", resp.StatusCode)
+	}
+	if resp := get(expired); !redirectsToLogin(resp) {
+		t.Errorf("expired session: got %d to %s", resp.StatusCode, resp.Header.Get("Location"))
+	}
+	if resp := get(nil); !redirectsToLogin(resp) {
+		t.Errorf("no session: got %d to %s", resp.StatusCode, resp.Header.Get("Location"))
+	}
+	if resp := get(&http.Cookie{Name: sessionCookie, Value: "made-up"}); !redirectsToLogin(resp) {
+		t.Errorf("unknown session: got %d to %s", resp.StatusCode, resp.Header.Get("Location"))
+	}
+
+	form := url.Values{"status": {"late"}, "csrf": {csrf}}
+	if resp := postForm(s, settingsPath+"/status", expired, form, ""); !redirectsToLogin(resp) {
+		t.Errorf("post with an expired session: got %d", resp.StatusCode)
+	}
+	if text := statusText(t, s, "alice"); text == "late" {
+		t.Error("the status was changed")
+	}
+
+	// Disabling the account logs it out
+	if err := s.store.SetDisabled("alice", true); err != nil {
+		t.Fatal(err)
+	}
+	if resp := get(valid); !redirectsToLogin(resp) {
+		t.Errorf("session of a disabled account: got %d", resp.StatusCode)
+	}
+}
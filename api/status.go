@@ -27,19 +27,44 @@ type statusQueryUser struct {
 	Data     *model.Status `json:"data,omitempty"`
 }
 
-func statusQuery(w http.ResponseWriter, r *http.Request) {
+func (u *statusQueryUser) MarshalJSON() ([]byte, error) {
+	type plain statusQueryUser
+	if u.Data == nil {
+		return json.Marshal((*plain)(u))
+	}
+	// Use the status JSON kept by the cache when there is one
+	data, err := db.StatusJSON(u.Username, u.Data)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(&struct {
+		*plain
+		Data json.RawMessage `json:"data"`
+	}{(*plain)(u), data})
+}
+
+func (s *Server) statusQuery(w http.ResponseWriter, r *http.Request) {
 	if r.URL.Path != "/.well-known/fmrl/users" {
 		// Subpaths not allowed
 		writeStatusCodePage(w, http.StatusNotFound)
 		return
 	}
 
-	values := r.URL.Query()
+	req, ok := s.getRequester(w, r)
+	if !ok {
+		return
+	}
 
-	usernames, ok := values["user"]
+	usernames, ok := s.queryUsernames(w, r, req)
 	if !ok {
-		// No usernames specified
-		writeStatusCodePage(w, http.StatusBadRequest)
+		return
+	}
+
+	batch, err := s.getUserBatch(usernames)
+	if err != nil {
+		log.Printf("getUserBatch for %s : %v", r.URL.RawQuery, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, "Error retrieving statuses, not your fault.\nContact your server administrator or try again later.")
 		return
 	}
 
@@ -57,34 +82,10 @@ func statusQuery(w http.ResponseWriter, r *http.Request) {
 	}
 
 	for i, username := range usernames {
-		user := &statusQueryUser{Username: username}
-
-		if _, ok := config.Conf.Users[username]; !ok {
-			// Username doesn't exist
-			user.Code = http.StatusNotFound
-			user.Msg = http.StatusText(http.StatusNotFound)
-		} else {
-			// Username exists
-			status, err := db.GetUser(username)
-
-			if err != nil {
-				// Log unexpected error
-				log.Printf("GetUser(%s): %v", username, err)
-				user.Code = http.StatusInternalServerError
-				user.Msg = http.StatusText(http.StatusInternalServerError)
-			} else if status.UpdatedAt.Before(ifModTime) || status.UpdatedAt.Truncate(time.Second).Equal(ifModTime) {
-				// Status is already known
-				user.Code = 304
-			} else {
-				user.Code = 200
-				user.Data = status
-
-				if status.UpdatedAt.After(newest) {
-					newest = status.UpdatedAt
-				}
-			}
+		user := s.queryUser(username, req, batch, batch.statuses[username], ifModTime)
+		if user.Code == http.StatusOK && user.Data.UpdatedAt.After(newest) {
+			newest = user.Data.UpdatedAt
 		}
-
 		users[i] = user
 	}
 
@@ -114,11 +115,177 @@ func statusQuery(w http.ResponseWriter, r *http.Request) {
 	// Setting the Content-Type isn't required by the spec, but is nice for checking
 	// out API responses in browsers and stuff
 	w.Header().Add("Content-Type", "application/json")
+	// Responses depend on who is asking, due to privacy settings
+	w.Header().Add("Vary", "Authorization")
+	addHubLinks(w, usernames)
 
 	w.Write(apiJSON)
 }
 
-func setStatus(w http.ResponseWriter, r *http.Request) {
+// queryUsernames returns the usernames asked for with the user parameter,
+// for the status query API and stream. With the list parameter, only the
+// local users in that follow list of the requester are used, which is all of
+// them if no usernames are given. If the usernames are invalid an error
+// response is written and false is returned.
+func (s *Server) queryUsernames(w http.ResponseWriter, r *http.Request, req *model.Requester) ([]string, bool) {
+	values := r.URL.Query()
+
+	usernames, ok := values["user"]
+	name := values.Get("list")
+	if !ok && name == "" {
+		// No usernames specified
+		writeStatusCodePage(w, http.StatusBadRequest)
+		return nil, false
+	}
+
+	if name != "" {
+		list, err := s.requesterList(req, name)
+		if errors.Is(err, db.ErrNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintf(w, "No such list: %s", name)
+			return nil, false
+		}
+		if err != nil {
+			log.Printf("requesterList(%s, %s): %v", req.Username, name, err)
+			writeStatusCodePage(w, http.StatusInternalServerError)
+			return nil, false
+		}
+		members := localListUsers(list)
+		if ok {
+			inList := make(map[string]struct{}, len(members))
+			for _, u := range members {
+				inList[u] = struct{}{}
+			}
+			members = members[:0]
+			for _, u := range usernames {
+				if _, ok := inList[u]; ok {
+					members = append(members, u)
+				}
+			}
+		}
+		usernames = members
+	}
+
+	// Asking for a user twice is invalid, just answer once
+	usernames = dedupStringSlice(usernames)
+	if len(usernames) > config.Conf.Query.MaxUsers {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Too many users requested, the maximum is %d", config.Conf.Query.MaxUsers)
+		return nil, false
+	}
+	return usernames, true
+}
+
+// userBatch is what queryUser needs to know about many local users, fetched
+// with one query for each kind of data.
+type userBatch struct {
+	statuses map[string]*model.Status
+	privacy  map[string]*model.Privacy
+	deleted  map[string]bool
+}
+
+// getUserBatch gets the statuses, privacy settings and tombstones of the
+// local users among usernames. Statuses of deleted users may be missing,
+// queryUser fetches them on its own then, so it can tell what's wrong.
+func (s *Server) getUserBatch(usernames []string) (*userBatch, error) {
+	local := make([]string, 0, len(usernames))
+	for _, username := range usernames {
+		if _, ok := config.Conf.Users[username]; ok {
+			local = append(local, username)
+		}
+	}
+
+	b := &userBatch{}
+	var err error
+	if b.statuses, err = s.store.GetUsers(local); err != nil {
+		return nil, err
+	}
+	if b.privacy, err = s.store.GetPrivacies(local); err != nil {
+		return nil, err
+	}
+	if b.deleted, err = s.store.GetDeleted(local); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// queryUser returns the batch query dictionary for one user, as seen by the
+// requester. The privacy settings and tombstone are taken from batch, which
+// can be nil to look them up. If status is nil, it is retrieved from the
+// database.
+func (s *Server) queryUser(username string, req *model.Requester, batch *userBatch, status *model.Status, ifModTime time.Time) *statusQueryUser {
+	user := &statusQueryUser{Username: username}
+
+	if _, ok := config.Conf.Users[username]; !ok {
+		// Username doesn't exist
+		user.Code = http.StatusNotFound
+		user.Msg = http.StatusText(http.StatusNotFound)
+		return user
+	}
+
+	var gone bool
+	if batch != nil {
+		gone = batch.deleted[username]
+	} else {
+		gone = s.userGone(username)
+	}
+	if gone {
+		// Checked first, the status might not have been removed
+		user.Code = http.StatusGone
+		user.Msg = http.StatusText(http.StatusGone)
+		return user
+	}
+
+	var visible bool
+	var err error
+	if batch != nil && batch.privacy[username] != nil {
+		visible = batch.privacy[username].Allows(globalUsername(username), req)
+	} else {
+		visible, err = s.canSee(username, req)
+	}
+	if err != nil {
+		log.Printf("canSee(%s): %v", username, err)
+		user.Code = http.StatusInternalServerError
+		user.Msg = http.StatusText(http.StatusInternalServerError)
+		return user
+	}
+	if !visible {
+		// Hidden or blocked
+		// With a 404 this is the same as a user that doesn't exist
+		user.Code = config.Conf.Privacy.DeniedCode
+		user.Msg = http.StatusText(config.Conf.Privacy.DeniedCode)
+		return user
+	}
+
+	if status == nil {
+		// Username exists
+		status, err = s.store.GetUser(username)
+		if errors.Is(err, db.ErrNotFound) && s.userGone(username) {
+			// Deleted since the check above
+			user.Code = http.StatusGone
+			user.Msg = http.StatusText(http.StatusGone)
+			return user
+		}
+		if err != nil {
+			// Log unexpected error
+			log.Printf("GetUser(%s): %v", username, err)
+			user.Code = http.StatusInternalServerError
+			user.Msg = http.StatusText(http.StatusInternalServerError)
+			return user
+		}
+	}
+
+	if status.UpdatedAt.Before(ifModTime) || status.UpdatedAt.Truncate(time.Second).Equal(ifModTime) {
+		// Status is already known
+		user.Code = 304
+	} else {
+		user.Code = 200
+		user.Data = status
+	}
+	return user
+}
+
+func (s *Server) setStatus(w http.ResponseWriter, r *http.Request) {
 	// Limit client body to prevent overuse of server resources by malicious
 	// clients. 2 KiB is more than enough for a valid JSON body that sets all
 	// valid fields.
@@ -132,7 +299,7 @@ func setStatus(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if !checkAuth(username, w, r) {
+	if !s.checkAuth(username, w, r) {
 		return
 	}
 
@@ -173,7 +340,7 @@ func setStatus(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = db.SetUser(username, &status)
+	err = s.store.SetUser(username, &status)
 	if err != nil {
 		log.Printf("SetUser %s: %v", username, err)
 		w.WriteHeader(http.StatusInternalServerError)
@@ -184,7 +351,30 @@ func setStatus(w http.ResponseWriter, r *http.Request) {
 	// Success!
 }
 
-func setAvatar(w http.ResponseWriter, r *http.Request) {
+// maxAvatarPixels limits the size of avatar images. Compressed images can
+// be small files that take much more memory once decoded.
+const maxAvatarPixels = 4096 * 4096
+
+var errAvatarPixels = errors.New("image has too many pixels")
+
+// decodeAvatar decodes an avatar image, checking its size from the header
+// first. It returns errAvatarPixels if there are more than maxAvatarPixels.
+func decodeAvatar(rs io.ReadSeeker) (image.Image, error) {
+	cfg, _, err := image.DecodeConfig(rs)
+	if err != nil {
+		return nil, err
+	}
+	if int64(cfg.Width)*int64(cfg.Height) > maxAvatarPixels {
+		return nil, errAvatarPixels
+	}
+	if _, err := rs.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	img, _, err := image.Decode(rs)
+	return img, err
+}
+
+func (s *Server) setAvatar(w http.ResponseWriter, r *http.Request) {
 	// Limit to 4 MiB and one extra byte
 	// Spec says 4 MiB. By allowing one extra byte it can be determined whether the
 	// avatar is too large or just at the limit.
@@ -198,12 +388,12 @@ func setAvatar(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if !checkAuth(username, w, r) {
+	if !s.checkAuth(username, w, r) {
 		return
 	}
 
 	if r.Method == "DELETE" {
-		err := db.RemoveAvatar(username)
+		err := s.store.RemoveAvatar(username)
 		if err != nil {
 			// Logging is done within db.RemoveAvatar, not needed here
 			w.WriteHeader(http.StatusInternalServerError)
@@ -233,13 +423,18 @@ func setAvatar(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	img, _, err := image.Decode(bytes.NewReader(imgdata))
+	img, err := decodeAvatar(bytes.NewReader(imgdata))
 	if errors.Is(err, image.ErrFormat) {
 		// Unsupported file type
 		w.WriteHeader(http.StatusBadRequest)
 		fmt.Fprintf(w, "Image must be JPEG or PNG only")
 		return
 	}
+	if errors.Is(err, errAvatarPixels) {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "Image is too large, the maximum is 4096x4096 pixels")
+		return
+	}
 	if err != nil {
 		// Failed to decode image, assume client error
 		w.WriteHeader(http.StatusBadRequest)
@@ -254,7 +449,7 @@ func setAvatar(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = db.SetAvatar(username, imgdata)
+	err = s.store.SetAvatar(username, imgdata)
 	if err != nil {
 		// Logging is done within db.SetAvatar, not needed here
 		w.WriteHeader(http.StatusInternalServerError)
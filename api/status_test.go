@@ -0,0 +1,168 @@
+package api
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/makeworld-the-better-one/whatsup/config"
+	"github.com/makeworld-the-better-one/whatsup/model"
+)
+
+// query sends a status query for the usernames, authenticated as auth if it
+// isn't empty.
+func query(t *testing.T, s *Server, auth string, usernames ...string) (*http.Response, []*statusQueryUser) {
+	t.Helper()
+	r := httptest.NewRequest("GET", "/.well-known/fmrl/users?user="+strings.Join(usernames, "&user="), nil)
+	if auth != "" {
+		r.SetBasicAuth(auth, auth)
+	}
+	resp := do(s, r)
+	if resp.StatusCode != http.StatusOK {
+		return resp, nil
+	}
+	var users []*statusQueryUser
+	if err := json.NewDecoder(resp.Body).Decode(&users); err != nil {
+		t.Fatal(err)
+	}
+	return resp, users
+}
+
+func setStatusText(t *testing.T, s *Server, username, text string) {
+	t.Helper()
+	if err := s.store.SetUser(username, &model.Status{Status: &text}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestQueryOrder(t *testing.T) {
+	s := newTestServer(t, "alice", "bob", "carol")
+	config.Conf.Query.MaxUsers = 3
+	setStatusText(t, s, "alice", "a")
+	setStatusText(t, s, "bob", "b")
+
+	// Duplicates are answered once, where they first appear, and don't count
+	// towards the limit
+	_, users := query(t, s, "", "bob", "nobody", "bob", "alice", "nobody", "alice")
+	want := []struct {
+		username string
+		code     int
+	}{{"bob", 200}, {"nobody", 404}, {"alice", 200}}
+	if len(users) != len(want) {
+		t.Fatalf("got %d users, want %d", len(users), len(want))
+	}
+	for i, w := range want {
+		if users[i].Username != w.username || users[i].Code != w.code {
+			t.Errorf("user %d is %s with %d, want %s with %d", i, users[i].Username, users[i].Code, w.username, w.code)
+		}
+	}
+	if users[0].Data == nil || *users[0].Data.Status != "b" {
+		t.Errorf("bob's status is %+v", users[0].Data)
+	}
+}
+
+func TestQueryMaxUsers(t *testing.T) {
+	s := newTestServer(t, "alice", "bob", "carol")
+	config.Conf.Query.MaxUsers = 3
+
+	if resp, _ := query(t, s, "", "alice", "bob", "carol"); resp.StatusCode != http.StatusOK {
+		t.Errorf("at the limit: got %d", resp.StatusCode)
+	}
+	resp, _ := query(t, s, "", "alice", "bob", "carol", "@dave@remote.example")
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("over the limit: got %d, want 400", resp.StatusCode)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if !strings.Contains(string(body), "maximum is 3") {
+		t.Errorf("body is %q", body)
+	}
+}
+
+func TestLandingPage(t *testing.T) {
+	s := newTestServer(t, "alice", "bob")
+	setStatusText(t, s, "alice", "visible status")
+	setStatusText(t, s, "bob", "hidden status")
+	p := model.NewPrivacy()
+	p.Mode = model.PrivacyLocal
+	if err := s.store.SetPrivacy("bob", p); err != nil {
+		t.Fatal(err)
+	}
+
+	page := func(auth string) string {
+		r := httptest.NewRequest("GET", "/", nil)
+		if auth != "" {
+			r.SetBasicAuth(auth, auth)
+		}
+		resp := do(s, r)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("got %d", resp.StatusCode)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		return string(body)
+	}
+	if body := page(""); !strings.Contains(body, "visible status") || strings.Contains(body, "hidden status") {
+		t.Errorf("anonymous landing page:\n%s", body)
+	}
+	if body := page("alice"); !strings.Contains(body, "hidden status") {
+		t.Errorf("landing page for alice:\n%s", body)
+	}
+}
+
+func TestQueryPrivacy(t *testing.T) {
+	s := newTestServer(t, "alice", "bob", "carol")
+	setPrivacy := func(username, mode string, allow, block []string) {
+		t.Helper()
+		p := model.NewPrivacy()
+		p.Mode = mode
+		for _, u := range allow {
+			p.Allow[u] = struct{}{}
+		}
+		for _, u := range block {
+			p.Block[u] = struct{}{}
+		}
+		if err := s.store.SetPrivacy(username, p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, u := range []string{"alice", "bob", "carol"} {
+		setStatusText(t, s, u, "status of "+u)
+	}
+	setPrivacy("alice", model.PrivacyLocal, nil, nil)
+	setPrivacy("bob", model.PrivacyAllowList, []string{"@carol@example.org"}, nil)
+	setPrivacy("carol", model.PrivacyPublic, nil, []string{"@bob@example.org"})
+
+	// Who can see alice, bob and carol
+	visible := map[string][3]bool{
+		"":      {false, false, true},
+		"alice": {true, false, true},
+		"bob":   {true, true, false},
+		"carol": {true, true, true},
+	}
+	for _, code := range []int{http.StatusNotFound, http.StatusForbidden} {
+		config.Conf.Privacy.DeniedCode = code
+		for auth, want := range visible {
+			_, users := query(t, s, auth, "alice", "bob", "carol", "nobody")
+			if len(users) != 4 {
+				t.Fatalf("as %q: got %d users", auth, len(users))
+			}
+			for i, u := range users[:3] {
+				if want[i] {
+					if u.Code != http.StatusOK || u.Data == nil || *u.Data.Status != "status of "+u.Username {
+						t.Errorf("as %q with %d: %s got %d, %+v", auth, code, u.Username, u.Code, u.Data)
+					}
+					continue
+				}
+				if u.Code != code || u.Msg != http.StatusText(code) || u.Data != nil {
+					t.Errorf("as %q with %d: %s got %d %q, %+v", auth, code, u.Username, u.Code, u.Msg, u.Data)
+				}
+			}
+			// Users that don't exist get a 404 either way
+			if nobody := users[3]; nobody.Code != http.StatusNotFound {
+				t.Errorf("nobody got %d", nobody.Code)
+			}
+		}
+	}
+}
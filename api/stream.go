@@ -0,0 +1,259 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/makeworld-the-better-one/whatsup/config"
+	"github.com/makeworld-the-better-one/whatsup/hub"
+)
+
+// Status streaming API
+// Not in the spec, pushes status changes with Server-Sent Events.
+//
+// GET /.well-known/fmrl/stream?user=<username>&user=<username>
+// GET /.well-known/fmrl/stream?list=<name>
+//
+// Takes the same parameters and authentication as the status query API.
+// Each event is a "status" event with the same JSON dictionary as a single user
+// in the batch query response. When a stream starts, the current status of
+// each user is sent, unless it's resuming with Last-Event-ID.
+
+const streamPath = "/.well-known/fmrl/stream"
+
+// Limit on concurrent streams per IP address
+var (
+	streamConnsMu sync.Mutex
+	streamConns   = make(map[string]int)
+)
+
+// acquireStreamConn returns false if the IP address already has the maximum
+// number of streams open. Otherwise releaseStreamConn must be called when
+// the stream ends.
+func acquireStreamConn(r *http.Request) bool {
+	ip := remoteIP(r)
+	streamConnsMu.Lock()
+	defer streamConnsMu.Unlock()
+	if streamConns[ip] >= config.Conf.Stream.MaxPerIP {
+		return false
+	}
+	streamConns[ip]++
+	return true
+}
+
+func releaseStreamConn(r *http.Request) {
+	ip := remoteIP(r)
+	streamConnsMu.Lock()
+	defer streamConnsMu.Unlock()
+	streamConns[ip]--
+	if streamConns[ip] <= 0 {
+		delete(streamConns, ip)
+	}
+}
+
+// remoteIP returns the IP address of the client. For requests from trusted
+// proxies it's the last address in X-Forwarded-For that isn't a trusted
+// proxy itself.
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !trustedProxy(host) {
+		return host
+	}
+
+	var forwarded []string
+	for _, h := range r.Header.Values("X-Forwarded-For") {
+		forwarded = append(forwarded, strings.Split(h, ",")...)
+	}
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(forwarded[i]))
+		if ip == nil {
+			// Not set by a trusted proxy, so nothing before it can be trusted
+			break
+		}
+		host = ip.String()
+		if !trustedProxy(host) {
+			break
+		}
+	}
+	return host
+}
+
+// ParseTrustedProxies parses the addresses and CIDR ranges of
+// config.Conf.Stream.TrustedProxies.
+func ParseTrustedProxies(proxies []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(proxies))
+	for _, p := range proxies {
+		if !strings.Contains(p, "/") {
+			ip := net.ParseIP(p)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy address: %s", p)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy range: %s", p)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// trustedProxy returns true if the address is one of the trusted proxies.
+func trustedProxy(addr string) bool {
+	if len(config.Conf.Stream.TrustedProxies) == 0 {
+		return false
+	}
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	// Checked when the server starts
+	nets, _ := ParseTrustedProxies(config.Conf.Stream.TrustedProxies)
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) statusStream(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != streamPath {
+		// Subpaths not allowed
+		writeStatusCodePage(w, http.StatusNotFound)
+		return
+	}
+
+	req, ok := s.getRequester(w, r)
+	if !ok {
+		return
+	}
+
+	// Same parameters and limit as the status query API
+	usernames, ok := s.queryUsernames(w, r, req)
+	if !ok {
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		log.Printf("statusStream: ResponseWriter doesn't support flushing")
+		writeStatusCodePage(w, http.StatusInternalServerError)
+		return
+	}
+
+	if !acquireStreamConn(r) {
+		w.WriteHeader(http.StatusTooManyRequests)
+		fmt.Fprint(w, "Too many streams open from your IP address")
+		return
+	}
+	defer releaseStreamConn(r)
+
+	wanted := make(map[string]struct{}, len(usernames))
+	for _, u := range usernames {
+		wanted[u] = struct{}{}
+	}
+
+	// Subscribe before getting the current state, so no changes are missed
+	sub := hub.Default.Subscribe(64, usernames...)
+	defer sub.Close()
+	startID := hub.Default.LastID()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// Stop nginx from buffering the stream
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	resumed := false
+	if lastID, err := strconv.ParseUint(r.Header.Get("Last-Event-ID"), 10, 64); err == nil {
+		var events []*hub.Event
+		events, resumed = hub.Default.Since(lastID, wanted)
+		for _, e := range events {
+			if e.Type != hub.EventStatus || e.ID > startID {
+				// Later events are in sub.C too, they are sent from there
+				continue
+			}
+			user := s.queryUser(e.Username, req, nil, e.Status, time.Time{})
+			if user.Code != http.StatusOK {
+				continue
+			}
+			if err := writeStatusEvent(w, e.ID, user); err != nil {
+				return
+			}
+		}
+	}
+	if !resumed {
+		// Send current state of every user
+		batch, err := s.getUserBatch(usernames)
+		if err != nil {
+			log.Printf("statusStream: getUserBatch: %v", err)
+			return
+		}
+		for _, u := range usernames {
+			user := s.queryUser(u, req, batch, batch.statuses[u], time.Time{})
+			if err := writeStatusEvent(w, startID, user); err != nil {
+				return
+			}
+		}
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(config.Conf.Stream.Heartbeat.Duration)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case e, ok := <-sub.C:
+			if !ok {
+				// Client was too slow, it can reconnect and resume
+				return
+			}
+			if e.Type != hub.EventStatus || e.ID <= startID {
+				// Already sent, or older than the current state that was sent
+				continue
+			}
+			user := s.queryUser(e.Username, req, nil, e.Status, time.Time{})
+			if user.Code != http.StatusOK {
+				// Don't reveal anything about changes to hidden users
+				continue
+			}
+			if err := writeStatusEvent(w, e.ID, user); err != nil {
+				return
+			}
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
+
+func writeStatusEvent(w http.ResponseWriter, id uint64, user *statusQueryUser) error {
+	data, err := json.Marshal(user)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: status\ndata: %s\n\n", id, data)
+	return err
+}
@@ -0,0 +1,155 @@
+package api
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/makeworld-the-better-one/whatsup/config"
+	"github.com/makeworld-the-better-one/whatsup/hub"
+)
+
+func TestRemoteIP(t *testing.T) {
+	conf := config.Conf
+	defer func() { config.Conf = conf }()
+	config.Conf.Stream.TrustedProxies = []string{"127.0.0.1", "10.0.0.0/8"}
+
+	tests := []struct {
+		name      string
+		peer      string
+		forwarded []string
+		want      string
+	}{
+		{"direct", "203.0.113.1:1234", nil, "203.0.113.1"},
+		{"untrusted peer", "203.0.113.1:1234", []string{"198.51.100.1"}, "203.0.113.1"},
+		{"trusted proxy", "127.0.0.1:1234", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"chain of proxies", "127.0.0.1:1234", []string{"198.51.100.1, 10.1.2.3"}, "198.51.100.1"},
+		{"several headers", "127.0.0.1:1234", []string{"198.51.100.1", "10.1.2.3"}, "198.51.100.1"},
+		{"spoofed by the client", "127.0.0.1:1234", []string{"192.0.2.1, 198.51.100.1"}, "198.51.100.1"},
+		{"invalid", "127.0.0.1:1234", []string{"unknown"}, "127.0.0.1"},
+		{"no header", "127.0.0.1:1234", nil, "127.0.0.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", streamPath, nil)
+			r.RemoteAddr = tt.peer
+			for _, h := range tt.forwarded {
+				r.Header.Add("X-Forwarded-For", h)
+			}
+			if got := remoteIP(r); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := ParseTrustedProxies([]string{"not an address"}); err == nil {
+		t.Error("no error for an invalid address")
+	}
+}
+
+// streamEvent is an event read from a stream.
+type streamEvent struct {
+	id     uint64
+	status string
+}
+
+// openStream starts a stream of the users' statuses, resuming after
+// lastEventID if it's not empty, and sends the events on the returned
+// channel.
+func openStream(t *testing.T, srv *httptest.Server, lastEventID string, usernames ...string) <-chan *streamEvent {
+	t.Helper()
+	r, err := http.NewRequest("GET", srv.URL+streamPath+"?user="+strings.Join(usernames, "&user="), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lastEventID != "" {
+		r.Header.Set("Last-Event-ID", lastEventID)
+	}
+	resp, err := srv.Client().Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got %d", resp.StatusCode)
+	}
+
+	events := make(chan *streamEvent, 10)
+	go func() {
+		defer close(events)
+		scanner := bufio.NewScanner(resp.Body)
+		e := &streamEvent{}
+		for scanner.Scan() {
+			line := scanner.Text()
+			switch {
+			case strings.HasPrefix(line, "id: "):
+				e.id, _ = strconv.ParseUint(line[len("id: "):], 10, 64)
+			case strings.HasPrefix(line, "data: "):
+				var user statusQueryUser
+				if err := json.Unmarshal([]byte(line[len("data: "):]), &user); err == nil && user.Data != nil {
+					e.status = *user.Data.Status
+				}
+			case line == "" && e.id != 0:
+				events <- e
+				e = &streamEvent{}
+			}
+		}
+	}()
+	return events
+}
+
+func nextEvent(t *testing.T, events <-chan *streamEvent) *streamEvent {
+	t.Helper()
+	select {
+	case e, ok := <-events:
+		if !ok {
+			t.Fatal("stream ended")
+		}
+		return e
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event")
+	}
+	return nil
+}
+
+func TestStreamResume(t *testing.T) {
+	s := newTestServer(t, "alice")
+	// Cleanups run last first, so the streams are closed before the server
+	srv := httptest.NewServer(s)
+	t.Cleanup(srv.Close)
+
+	var ids []uint64
+	for _, text := range []string{"one", "two", "three"} {
+		setStatusText(t, s, "alice", text)
+		ids = append(ids, hub.Default.LastID())
+	}
+
+	// A new stream starts with the current status
+	events := openStream(t, srv, "", "alice")
+	if e := nextEvent(t, events); e.status != "three" || e.id != ids[2] {
+		t.Errorf("first event is %+v", e)
+	}
+
+	// Resuming sends what was missed, and then new changes, each once
+	events = openStream(t, srv, strconv.FormatUint(ids[0], 10), "alice")
+	for i, want := range []string{"two", "three"} {
+		if e := nextEvent(t, events); e.status != want || e.id != ids[i+1] {
+			t.Errorf("missed event %d is %+v, want %s", i, e, want)
+		}
+	}
+	setStatusText(t, s, "alice", "four")
+	e := nextEvent(t, events)
+	if e.status != "four" || e.id <= ids[2] {
+		t.Errorf("new event is %+v", e)
+	}
+	select {
+	case e := <-events:
+		t.Errorf("sent again: %+v", e)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -0,0 +1,172 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+
+	"github.com/makeworld-the-better-one/whatsup/config"
+	"github.com/makeworld-the-better-one/whatsup/db"
+	"github.com/makeworld-the-better-one/whatsup/model"
+	"github.com/makeworld-the-better-one/whatsup/remote"
+)
+
+// Import and export of following lists
+// Not in the spec.
+//
+// GET  /.well-known/fmrl/user/<username>/following/export?format=<format>&list=<name>
+// POST /.well-known/fmrl/user/<username>/following/import?format=<format>&mode=<merge|replace>
+//
+// format is json, csv, or opml, and defaults to json.
+
+// importReport is the JSON response for an import.
+type importReport struct {
+	Imported  int                 `json:"imported"`
+	Following int                 `json:"following"`
+	Errors    []*model.EntryError `json:"errors"`
+}
+
+func (s *Server) exportFollowing(w http.ResponseWriter, r *http.Request) {
+	username := r.URL.Path[len("/.well-known/fmrl/user/") : len(r.URL.Path)-len("/following/export")]
+
+	if _, ok := config.Conf.Users[username]; !ok {
+		// User doesn't exist
+		writeStatusCodePage(w, http.StatusNotFound)
+		return
+	}
+
+	if !s.checkAuth(username, w, r) {
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = model.FormatJSON
+	}
+
+	var usernames model.FollowingUsernames
+	if name := r.URL.Query().Get("list"); name != "" {
+		list, err := s.store.GetList(username, name)
+		if errors.Is(err, db.ErrNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintf(w, "No such list: %s", name)
+			return
+		}
+		if err != nil {
+			log.Printf("store.GetList(%s, %s): %v", username, name, err)
+			writeStatusCodePage(w, http.StatusInternalServerError)
+			return
+		}
+		usernames = list.Usernames
+	} else {
+		fu, err := s.store.GetFollowing(username)
+		if err != nil {
+			log.Printf("store.GetFollowing(%s): %v", username, err)
+			writeStatusCodePage(w, http.StatusInternalServerError)
+			return
+		}
+		usernames = fu.Usernames
+	}
+
+	data, err := model.ExportFollowing(usernames, format)
+	if errors.Is(err, model.ErrUnknownFormat) {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, err)
+		return
+	}
+	if err != nil {
+		log.Printf("exportFollowing %s for %s: %v", format, username, err)
+		writeStatusCodePage(w, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Add("Content-Type", model.ContentType(format))
+	w.Header().Add("Content-Disposition", fmt.Sprintf(`attachment; filename="%s-following.%s"`, username, format))
+	w.Write(data)
+}
+
+func (s *Server) importFollowing(w http.ResponseWriter, r *http.Request) {
+	// Limit imports to 1 MiB, same as setFollowing
+	r.Body = http.MaxBytesReader(w, r.Body, 1*1024*1024)
+
+	username := r.URL.Path[len("/.well-known/fmrl/user/") : len(r.URL.Path)-len("/following/import")]
+
+	if _, ok := config.Conf.Users[username]; !ok {
+		// User doesn't exist
+		writeStatusCodePage(w, http.StatusNotFound)
+		return
+	}
+
+	if !s.checkAuth(username, w, r) {
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = model.FormatJSON
+	}
+	mode := r.URL.Query().Get("mode")
+	if mode == "" {
+		mode = "merge"
+	}
+	if mode != "merge" && mode != "replace" {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "Import mode must be merge or replace")
+		return
+	}
+
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		// Most likely that the client body was too large, don't log
+		writeStatusCodePage(w, http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	imported, entryErrs, err := model.ImportFollowing(data, format)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Failed to decode %s: %v", format, err)
+		return
+	}
+
+	fu, err := s.store.UpdateFollowing(username, func(fu *model.Following) error {
+		if mode == "replace" {
+			fu.Usernames = imported
+		} else {
+			fu.Usernames.Merge(imported)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("store.UpdateFollowing(%s): %v", username, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, "Error saving new following list, not your fault.\nContact your server administrator or try again later.")
+		return
+	}
+
+	if config.Conf.Following.Validate {
+		remote.Check(imported.Sorted())
+	}
+
+	report := importReport{
+		Imported:  len(imported),
+		Following: len(fu.Usernames),
+		Errors:    entryErrs,
+	}
+	if report.Errors == nil {
+		report.Errors = make([]*model.EntryError, 0)
+	}
+
+	apiJSON, err := json.Marshal(&report)
+	if err != nil {
+		log.Printf("JSON encoding import report for %s: %v", username, err)
+		writeStatusCodePage(w, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	w.Write(apiJSON)
+}
@@ -0,0 +1,239 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/makeworld-the-better-one/whatsup/config"
+	"github.com/makeworld-the-better-one/whatsup/db"
+	"github.com/makeworld-the-better-one/whatsup/model"
+	"github.com/makeworld-the-better-one/whatsup/webhook"
+)
+
+// Webhooks API
+// Not in the spec, lets users get status and following changes POSTed to a URL.
+//
+// GET    /.well-known/fmrl/user/<username>/webhooks                 - all webhooks as a JSON array
+// POST   /.well-known/fmrl/user/<username>/webhooks                 - register a webhook
+// PATCH  /.well-known/fmrl/user/<username>/webhooks/<id>            - enable or disable it
+// DELETE /.well-known/fmrl/user/<username>/webhooks/<id>            - delete it
+// GET    /.well-known/fmrl/user/<username>/webhooks/<id>/deliveries - recent deliveries
+//
+// The secret is only returned when the webhook is created.
+
+type setWebhookJSON struct {
+	Enabled *bool `json:"enabled"`
+}
+
+func (s *Server) webhooksPath(w http.ResponseWriter, r *http.Request) {
+	// Path is <username>/webhooks, <username>/webhooks/<id>, or <username>/webhooks/<id>/deliveries
+	parts := strings.Split(r.URL.Path[len("/.well-known/fmrl/user/"):], "/")
+	username := parts[0]
+
+	if _, ok := config.Conf.Users[username]; !ok {
+		// User doesn't exist
+		writeStatusCodePage(w, http.StatusNotFound)
+		return
+	}
+
+	if !s.checkAuth(username, w, r) {
+		return
+	}
+
+	if len(parts) == 2 {
+		switch r.Method {
+		case "GET":
+			s.getWebhooks(w, username)
+		case "POST":
+			s.createWebhook(w, r, username)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	id, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil {
+		writeStatusCodePage(w, http.StatusNotFound)
+		return
+	}
+	wh, err := s.store.GetWebhook(username, id)
+	if errors.Is(err, db.ErrNotFound) {
+		writeStatusCodePage(w, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("store.GetWebhook(%s, %d): %v", username, id, err)
+		writeStatusCodePage(w, http.StatusInternalServerError)
+		return
+	}
+
+	if len(parts) == 4 {
+		if parts[3] != "deliveries" {
+			writeStatusCodePage(w, http.StatusNotFound)
+			return
+		}
+		if r.Method != "GET" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		s.getDeliveries(w, wh)
+		return
+	}
+
+	switch r.Method {
+	case "PATCH":
+		s.setWebhook(w, r, wh)
+	case "DELETE":
+		if err := s.store.DeleteWebhook(username, id); err != nil && !errors.Is(err, db.ErrNotFound) {
+			log.Printf("store.DeleteWebhook(%s, %d): %v", username, id, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(w, "Error deleting webhook, not your fault.\nContact your server administrator or try again later.")
+			return
+		}
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, what string, v interface{}) {
+	apiJSON, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("JSON encoding %s: %v", what, err)
+		writeStatusCodePage(w, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	w.Write(apiJSON)
+}
+
+func (s *Server) getWebhooks(w http.ResponseWriter, username string) {
+	webhooks, err := s.store.GetWebhooks(username)
+	if err != nil {
+		log.Printf("store.GetWebhooks(%s): %v", username, err)
+		writeStatusCodePage(w, http.StatusInternalServerError)
+		return
+	}
+	for _, wh := range webhooks {
+		wh.Secret = ""
+	}
+	writeJSON(w, "webhooks for "+username, webhooks)
+}
+
+// readClientJSON reads a JSON body of at most 1 MiB into v, writing an error
+// response and returning false if that fails.
+func readClientJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	// Limit client JSON to 1 MiB, same as setFollowing
+	r.Body = http.MaxBytesReader(w, r.Body, 1*1024*1024)
+
+	clientJSON, err := io.ReadAll(r.Body)
+	if err != nil {
+		// Most likely that the client body was too large, don't log
+		writeStatusCodePage(w, http.StatusRequestEntityTooLarge)
+		return false
+	}
+
+	// See setStatus for why
+	if !json.Valid(clientJSON) {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "Received JSON is invalid")
+		return false
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(clientJSON))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Bad value type or unrecognized field: %v", err)
+		return false
+	}
+	return true
+}
+
+func (s *Server) createWebhook(w http.ResponseWriter, r *http.Request, username string) {
+	var data struct {
+		URL    string   `json:"url"`
+		Secret string   `json:"secret"`
+		Events []string `json:"events"`
+		Users  []string `json:"users"`
+	}
+	if !readClientJSON(w, r, &data) {
+		return
+	}
+
+	wh := &model.Webhook{
+		Owner:   username,
+		URL:     data.URL,
+		Secret:  data.Secret,
+		Events:  data.Events,
+		Users:   data.Users,
+		Enabled: true,
+	}
+	if wh.Events == nil {
+		wh.Events = []string{model.WebhookStatus}
+	}
+	if wh.Users == nil {
+		wh.Users = []string{}
+	}
+	if err := wh.Validate(); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "%v", err)
+		return
+	}
+	if wh.Secret == "" {
+		var err error
+		wh.Secret, err = webhook.NewSecret()
+		if err != nil {
+			log.Printf("webhook.NewSecret: %v", err)
+			writeStatusCodePage(w, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if err := s.store.CreateWebhook(wh); err != nil {
+		log.Printf("store.CreateWebhook(%s): %v", username, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, "Error saving webhook, not your fault.\nContact your server administrator or try again later.")
+		return
+	}
+
+	w.Header().Set("Location", fmt.Sprintf("/.well-known/fmrl/user/%s/webhooks/%d", username, wh.ID))
+	w.WriteHeader(http.StatusCreated)
+	writeJSON(w, "webhook for "+username, wh)
+}
+
+func (s *Server) setWebhook(w http.ResponseWriter, r *http.Request, wh *model.Webhook) {
+	var data setWebhookJSON
+	if !readClientJSON(w, r, &data) {
+		return
+	}
+	if data.Enabled == nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "Missing enabled field")
+		return
+	}
+
+	if err := s.store.SetWebhookEnabled(wh.ID, *data.Enabled); err != nil {
+		log.Printf("store.SetWebhookEnabled(%d): %v", wh.ID, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, "Error saving webhook, not your fault.\nContact your server administrator or try again later.")
+		return
+	}
+}
+
+func (s *Server) getDeliveries(w http.ResponseWriter, wh *model.Webhook) {
+	deliveries, err := s.store.GetDeliveries(wh.ID, 50)
+	if err != nil {
+		log.Printf("store.GetDeliveries(%d): %v", wh.ID, err)
+		writeStatusCodePage(w, http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, "webhook deliveries", deliveries)
+}
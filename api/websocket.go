@@ -0,0 +1,360 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/makeworld-the-better-one/whatsup/config"
+	"github.com/makeworld-the-better-one/whatsup/db"
+	"github.com/makeworld-the-better-one/whatsup/hub"
+	"github.com/makeworld-the-better-one/whatsup/model"
+	"github.com/makeworld-the-better-one/whatsup/remote"
+)
+
+// WebSocket subscription API
+// Not in the spec, pushes status changes for a changing set of users.
+//
+// GET /.well-known/fmrl/ws
+//
+// Clients send JSON messages to choose which users they get events for:
+//
+//	{"type": "subscribe", "users": ["alice", "@bob@example.com"]}
+//	{"type": "unsubscribe", "users": ["alice"]}
+//	{"type": "subscribe", "list": "work"}
+//
+// Users can be local usernames or global usernames of local or remote users.
+// Clients authenticated with Basic auth can also give the name of one of
+// their follow lists, to subscribe to or unsubscribe from its users.
+// The server replies with "subscribed" and "unsubscribed" messages, and sends
+// "status" messages holding the same JSON dictionary as a single user in the
+// batch query response. The current status of each user is sent when they're
+// subscribed to.
+//
+// Clients authenticated with Basic auth also get "following" messages when
+// their following list changes.
+//
+// Any web page can open a connection, and browsers send cached Basic auth
+// credentials with it. So the authentication of connections from pages of
+// other origins is ignored, and they're treated as anonymous.
+
+const wsPath = "/.well-known/fmrl/ws"
+
+const (
+	// Maximum number of users one connection can subscribe to
+	wsMaxSubscriptions = 1000
+	// Maximum number of remote servers one connection can make this server
+	// poll, by subscribing to their users
+	wsMaxRemoteHosts = 20
+	// Maximum size of messages from the client
+	wsMaxMessageSize = 64 * 1024
+	// How many events can be waiting to be sent before the client is
+	// considered too slow and disconnected
+	wsEventBuffer = 256
+)
+
+var wsUpgrader = websocket.Upgrader{
+	// Any origin can connect, like with CORS for the status query API, but
+	// wsSubscribe ignores the authentication of other origins
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+type wsClientMessage struct {
+	Type  string   `json:"type"`
+	Users []string `json:"users"`
+	List  string   `json:"list"`
+}
+
+type wsServerMessage struct {
+	Type      string   `json:"type"`
+	ID        uint64   `json:"id,omitempty"`
+	Users     []string `json:"users,omitempty"`
+	User      *wsUser  `json:"user,omitempty"`
+	Following []string `json:"following,omitempty"`
+	Msg       string   `json:"msg,omitempty"`
+}
+
+// wsUser is the same as statusQueryUser, but the data can be raw JSON from
+// a remote server.
+type wsUser struct {
+	Username string      `json:"username"`
+	Code     int         `json:"code"`
+	Msg      string      `json:"msg,omitempty"`
+	Data     interface{} `json:"data,omitempty"`
+}
+
+func wsStatusUser(u *statusQueryUser) *wsUser {
+	wu := &wsUser{Username: u.Username, Code: u.Code, Msg: u.Msg}
+	if u.Data != nil {
+		wu.Data = u.Data
+	}
+	return wu
+}
+
+func (s *Server) wsSubscribe(w http.ResponseWriter, r *http.Request) {
+	req, ok := s.getRequester(w, r)
+	if !ok {
+		return
+	}
+	if !sameOrigin(r) {
+		// See above, another site's page could be using the user's credentials
+		req = &model.Requester{}
+	}
+
+	if !acquireStreamConn(r) {
+		w.WriteHeader(http.StatusTooManyRequests)
+		w.Write([]byte("Too many streams open from your IP address"))
+		return
+	}
+	defer releaseStreamConn(r)
+
+	conn, err := wsUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgrade already sent an error response
+		return
+	}
+	defer conn.Close()
+
+	// Own username, for following events
+	var ownUsername string
+	if req.Local {
+		ownUsername = strings.TrimSuffix(strings.TrimPrefix(req.Username, "@"), "@"+config.Conf.Server.Domain)
+	}
+
+	sub := hub.Default.Subscribe(wsEventBuffer)
+	defer sub.Close()
+	if ownUsername != "" {
+		sub.Add(ownUsername)
+	}
+
+	// Users this connection wants status events for
+	statuses := make(map[string]struct{})
+
+	// Remote users this connection is watching, and how many of them are on
+	// each remote server
+	watching := make(map[string]struct{})
+	hosts := make(map[string]int)
+	defer func() {
+		for global := range watching {
+			remote.DefaultWatcher.Unwatch(global)
+		}
+	}()
+
+	heartbeat := config.Conf.Stream.Heartbeat.Duration
+	conn.SetReadLimit(wsMaxMessageSize)
+	conn.SetReadDeadline(time.Now().Add(2 * heartbeat))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(2 * heartbeat))
+	})
+
+	// Reading happens in another goroutine, and everything is written here.
+	// done stops the reader if this function returns first.
+	incoming := make(chan *wsClientMessage)
+	readErr := make(chan error, 1)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			var msg wsClientMessage
+			if err := conn.ReadJSON(&msg); err != nil {
+				readErr <- err
+				return
+			}
+			select {
+			case incoming <- &msg:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	ping := time.NewTicker(heartbeat)
+	defer ping.Stop()
+
+	write := func(msg *wsServerMessage) error {
+		conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+		return conn.WriteJSON(msg)
+	}
+
+	for {
+		select {
+		case <-readErr:
+			return
+
+		case msg := <-incoming:
+			if msg.List != "" {
+				// The users of a follow list are added to the ones given
+				list, err := s.requesterList(req, msg.List)
+				if err != nil {
+					if !errors.Is(err, db.ErrNotFound) {
+						log.Printf("wsSubscribe: requesterList(%s, %s): %v", req.Username, msg.List, err)
+					}
+					if err := write(&wsServerMessage{Type: "error", Msg: "No such list: " + msg.List}); err != nil {
+						return
+					}
+					continue
+				}
+				msg.Users = append(msg.Users, list.Usernames.Sorted()...)
+			}
+
+			var replies []*wsServerMessage
+			switch msg.Type {
+			case "subscribe":
+				if len(statuses)+len(msg.Users) > wsMaxSubscriptions {
+					replies = append(replies, &wsServerMessage{Type: "error", Msg: "Too many subscriptions"})
+					break
+				}
+				topics := make([]string, 0, len(msg.Users))
+				for _, u := range msg.Users {
+					topic, ok := wsTopic(u)
+					if !ok {
+						replies = append(replies, &wsServerMessage{Type: "error", Msg: "Invalid username: " + u})
+						continue
+					}
+					if _, ok := watching[topic]; !ok && strings.HasPrefix(topic, "@") {
+						host := strings.ToLower(topic[strings.LastIndexByte(topic, '@')+1:])
+						if hosts[host] == 0 && len(hosts) >= wsMaxRemoteHosts {
+							replies = append(replies, &wsServerMessage{Type: "error", Msg: "Too many remote servers: " + u})
+							continue
+						}
+						hosts[host]++
+						watching[topic] = struct{}{}
+						remote.DefaultWatcher.Watch(topic)
+					}
+					topics = append(topics, topic)
+					statuses[topic] = struct{}{}
+				}
+				sub.Add(topics...)
+				replies = append(replies, &wsServerMessage{Type: "subscribed", Users: topics})
+				id := hub.Default.LastID()
+				for _, topic := range topics {
+					if u := s.wsCurrent(topic, req); u != nil {
+						replies = append(replies, &wsServerMessage{Type: "status", ID: id, User: u})
+					}
+				}
+			case "unsubscribe":
+				topics := make([]string, 0, len(msg.Users))
+				for _, u := range msg.Users {
+					topic, ok := wsTopic(u)
+					if !ok {
+						continue
+					}
+					topics = append(topics, topic)
+					delete(statuses, topic)
+					if _, ok := watching[topic]; ok {
+						delete(watching, topic)
+						remote.DefaultWatcher.Unwatch(topic)
+						host := strings.ToLower(topic[strings.LastIndexByte(topic, '@')+1:])
+						if hosts[host]--; hosts[host] <= 0 {
+							delete(hosts, host)
+						}
+					}
+				}
+				for _, topic := range topics {
+					if topic != ownUsername {
+						// Own username stays subscribed for following events
+						sub.Remove(topic)
+					}
+				}
+				replies = append(replies, &wsServerMessage{Type: "unsubscribed", Users: topics})
+			default:
+				replies = append(replies, &wsServerMessage{Type: "error", Msg: "Unknown message type: " + msg.Type})
+			}
+			for _, reply := range replies {
+				if err := write(reply); err != nil {
+					return
+				}
+			}
+
+		case e, ok := <-sub.C:
+			if !ok {
+				// Client is too slow
+				conn.WriteControl(websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "too slow"),
+					time.Now().Add(time.Second))
+				return
+			}
+			if _, ok := statuses[e.Username]; !ok && e.Type == hub.EventStatus {
+				// Only subscribed for following events
+				continue
+			}
+			msg := s.wsEvent(e, req, ownUsername)
+			if msg == nil {
+				continue
+			}
+			if err := write(msg); err != nil {
+				return
+			}
+
+		case <-ping.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(10*time.Second)); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// wsTopic returns the hub username for a username sent by the client.
+// Global usernames of local users become local usernames.
+func wsTopic(u string) (string, bool) {
+	if model.FollowingUsernameRE.MatchString(u) {
+		if strings.HasSuffix(u, "@"+config.Conf.Server.Domain) {
+			return strings.TrimSuffix(strings.TrimPrefix(u, "@"), "@"+config.Conf.Server.Domain), true
+		}
+		return u, true
+	}
+	if model.ValidUsername(u) {
+		return u, true
+	}
+	return "", false
+}
+
+// wsCurrent returns the current status of a hub username, or nil if it
+// isn't known yet.
+func (s *Server) wsCurrent(topic string, req *model.Requester) *wsUser {
+	if !strings.HasPrefix(topic, "@") {
+		return wsStatusUser(s.queryUser(topic, req, nil, nil, time.Time{}))
+	}
+	last := remote.DefaultWatcher.Last(topic)
+	if last == nil {
+		return nil
+	}
+	wu := &wsUser{Username: topic, Code: last.Code, Msg: last.Msg}
+	if len(last.Data) > 0 {
+		wu.Data = last.Data
+	}
+	return wu
+}
+
+// wsEvent converts a hub event to a message for the client, or returns nil
+// if the client shouldn't get it.
+func (s *Server) wsEvent(e *hub.Event, req *model.Requester, ownUsername string) *wsServerMessage {
+	switch e.Type {
+	case hub.EventFollowing:
+		if e.Username != ownUsername || ownUsername == "" {
+			return nil
+		}
+		return &wsServerMessage{Type: "following", ID: e.ID, Following: e.Following.Usernames.Sorted()}
+	case hub.EventStatus:
+		if strings.HasPrefix(e.Username, "@") {
+			// Remote user
+			return &wsServerMessage{Type: "status", ID: e.ID, User: &wsUser{
+				Username: e.Username,
+				Code:     http.StatusOK,
+				Data:     json.RawMessage(e.Data),
+			}}
+		}
+		user := s.queryUser(e.Username, req, nil, e.Status, time.Time{})
+		if user.Code != http.StatusOK {
+			// Don't reveal anything about changes to hidden users
+			return nil
+		}
+		return &wsServerMessage{Type: "status", ID: e.ID, User: wsStatusUser(user)}
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/makeworld-the-better-one/whatsup/config"
+	"github.com/makeworld-the-better-one/whatsup/remote"
+	"github.com/makeworld-the-better-one/whatsup/websub"
+)
+
+// WebSub API
+// Not in the spec, lets remote servers get statuses pushed instead of polling.
+//
+// POST /.well-known/fmrl/websub                    - hub, takes a form with hub.mode,
+//                                                    hub.topic, hub.callback, and optionally
+//                                                    hub.lease_seconds and hub.secret
+// GET  /.well-known/fmrl/websub/callback/<token>   - hubs verifying our subscriptions
+// POST /.well-known/fmrl/websub/callback/<token>   - hubs pushing to us
+//
+// Topics are status query URLs for a single user, and status query responses
+// advertise the hub with a Link header.
+
+// addHubLinks adds Link headers for discovering the hub. The self link is only
+// added if the query is for a single user.
+func addHubLinks(w http.ResponseWriter, usernames []string) {
+	w.Header().Add("Link", fmt.Sprintf(`<%s>; rel="hub"`, websub.HubURL()))
+	if len(usernames) == 1 {
+		w.Header().Add("Link", fmt.Sprintf(`<%s>; rel="self"`, websub.Topic(usernames[0])))
+	}
+}
+
+func (s *Server) websubHub(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != websub.Path {
+		writeStatusCodePage(w, http.StatusNotFound)
+		return
+	}
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, 64*1024)
+	if err := r.ParseForm(); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Invalid form: %v", err)
+		return
+	}
+
+	req, ok := s.getRequester(w, r)
+	if !ok {
+		return
+	}
+
+	sr := &websub.Request{
+		Mode:      r.PostForm.Get("hub.mode"),
+		Callback:  r.PostForm.Get("hub.callback"),
+		Secret:    r.PostForm.Get("hub.secret"),
+		Lease:     config.Conf.WebSub.Lease.Duration,
+		Requester: *req,
+	}
+	if sr.Mode != websub.ModeSubscribe && sr.Mode != websub.ModeUnsubscribe {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "hub.mode must be subscribe or unsubscribe")
+		return
+	}
+	sr.Username, ok = websub.TopicUser(r.PostForm.Get("hub.topic"))
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "hub.topic is not a topic of this hub")
+		return
+	}
+	u, err := url.Parse(sr.Callback)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || len(sr.Callback) > 2048 {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "hub.callback must be an absolute http or https URL")
+		return
+	}
+	if len(sr.Secret) > 200 {
+		// From the WebSub spec
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "hub.secret must be less than 200 bytes")
+		return
+	}
+	if ls := r.PostForm.Get("hub.lease_seconds"); ls != "" {
+		secs, err := strconv.Atoi(ls)
+		if err != nil || secs <= 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, "hub.lease_seconds must be a positive integer")
+			return
+		}
+		sr.Lease = time.Duration(secs) * time.Second
+	}
+	if sr.Lease < websub.MinLease {
+		sr.Lease = websub.MinLease
+	}
+	if sr.Lease > config.Conf.WebSub.MaxLease.Duration {
+		sr.Lease = config.Conf.WebSub.MaxLease.Duration
+	}
+
+	// Intent is verified after responding, as the subscriber may not be able
+	// to handle the verification request until then
+	if !websub.StartVerify(sr) {
+		w.WriteHeader(http.StatusTooManyRequests)
+		fmt.Fprint(w, "Too many subscription requests are being verified, try again later")
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func websubCallback(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Path[len(websub.CallbackPath):]
+
+	switch r.Method {
+	case "GET":
+		q := r.URL.Query()
+		secs, _ := strconv.Atoi(q.Get("hub.lease_seconds"))
+		if !remote.DefaultWatcher.VerifyIntent(token, q.Get("hub.mode"), q.Get("hub.topic"), time.Duration(secs)*time.Second) {
+			writeStatusCodePage(w, http.StatusNotFound)
+			return
+		}
+		fmt.Fprint(w, q.Get("hub.challenge"))
+	case "POST":
+		// Limit pushes to 1 MiB, much larger than a single status
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 1*1024*1024))
+		if err != nil {
+			writeStatusCodePage(w, http.StatusRequestEntityTooLarge)
+			return
+		}
+		err = remote.DefaultWatcher.Push(token, body, r.Header.Get(remote.HubSignatureHeader))
+		if errors.Is(err, remote.ErrUnknownSubscription) {
+			// Tells the hub to stop pushing
+			writeStatusCodePage(w, http.StatusGone)
+			return
+		}
+		if err != nil {
+			// Hubs aren't told about bad content, as in the WebSub spec
+			log.Printf("websub: push to callback %s: %v", token, err)
+		}
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
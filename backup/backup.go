@@ -0,0 +1,435 @@
+// backup creates and restores archives of the data dir.
+//
+// An archive is a gzipped tarball of everything in the data dir, with a copy
+// of the database made by SQLite so that it's consistent even while the
+// server is running. The last file is manifest.json, which lists the size
+// and SHA-256 checksum of every other file, and is checked before restoring.
+package backup
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/makeworld-the-better-one/whatsup/config"
+	"github.com/makeworld-the-better-one/whatsup/db"
+	"github.com/makeworld-the-better-one/whatsup/version"
+)
+
+// FormatVersion is the version of the archive layout, in the manifest.
+const FormatVersion = 1
+
+const manifestName = "manifest.json"
+
+// dbName is the database file in the data dir and in archives.
+const dbName = "data.db"
+
+var (
+	ErrInvalidArchive = errors.New("invalid backup archive")
+	ErrSchemaTooNew   = errors.New("backup is from a newer version of whatsup")
+	// ErrNotSQLite is returned with other drivers, whose data isn't in the
+	// data dir.
+	ErrNotSQLite = errors.New(`backups only work with the "sqlite" driver`)
+)
+
+// checkDriver returns ErrNotSQLite unless the configured driver is SQLite.
+func checkDriver() error {
+	if d := config.Conf.Data.Driver; d != "" && d != "sqlite" {
+		return fmt.Errorf("%w, not %q", ErrNotSQLite, d)
+	}
+	return nil
+}
+
+// Manifest describes the contents of an archive.
+type Manifest struct {
+	Format        int       `json:"format"`
+	CreatedAt     time.Time `json:"created_at"`
+	Whatsup       string    `json:"whatsup"`
+	SchemaVersion int       `json:"schema_version"`
+	Files         []*File   `json:"files"`
+}
+
+// File is a file in an archive. Path is relative to the data dir, with
+// forward slashes.
+type File struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// skip returns true for files in the data dir that aren't backed up.
+// The database is copied separately, and its journal files and the lock file
+// belong to the running server.
+func skip(rel string) bool {
+	return rel == dbName || strings.HasPrefix(rel, dbName+"-") || rel == db.LockName
+}
+
+// Create writes an archive of dataDir to w. The database must be open with
+// db.Init or db.Open. exclude is a directory inside dataDir to leave out,
+// like the directory backups are written to, or empty.
+func Create(w io.Writer, dataDir, exclude string) (*Manifest, error) {
+	if err := checkDriver(); err != nil {
+		return nil, err
+	}
+	schema, err := db.SchemaVersion()
+	if err != nil {
+		return nil, err
+	}
+
+	tmp, err := os.MkdirTemp("", "whatsup-backup-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmp)
+	dbCopy := filepath.Join(tmp, dbName)
+	if err := db.Backup(dbCopy); err != nil {
+		return nil, fmt.Errorf("copying database: %w", err)
+	}
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	m := &Manifest{
+		Format:        FormatVersion,
+		CreatedAt:     time.Now().UTC(),
+		Whatsup:       version.UserAgent,
+		SchemaVersion: schema,
+		Files:         make([]*File, 0),
+	}
+
+	if err := addFile(tw, m, dbCopy, dbName); err != nil {
+		return nil, err
+	}
+	err = filepath.WalkDir(dataDir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if exclude != "" && p == exclude && d.IsDir() {
+			return filepath.SkipDir
+		}
+		if !d.Type().IsRegular() {
+			// Directories are created from file paths when restoring
+			return nil
+		}
+		rel, err := filepath.Rel(dataDir, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if skip(rel) {
+			return nil
+		}
+		return addFile(tw, m, p, rel)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	mj, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	err = tw.WriteHeader(&tar.Header{
+		Name:    manifestName,
+		Mode:    0644,
+		Size:    int64(len(mj)),
+		ModTime: m.CreatedAt,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tw.Write(mj); err != nil {
+		return nil, err
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	return m, gz.Close()
+}
+
+// addFile writes the file at p to the archive as name, and adds it to the
+// manifest.
+func addFile(tw *tar.Writer, m *Manifest, p, name string) error {
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	err = tw.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    int64(fi.Mode().Perm()),
+		Size:    fi.Size(),
+		ModTime: fi.ModTime(),
+	})
+	if err != nil {
+		return err
+	}
+	h := sha256.New()
+	// The size in the header must be exact, so a file that grows while it's
+	// being copied is cut off, and one that shrinks is an error
+	n, err := io.Copy(tw, io.TeeReader(io.LimitReader(f, fi.Size()), h))
+	if err != nil {
+		return fmt.Errorf("archiving %s: %w", name, err)
+	}
+	if n != fi.Size() {
+		return fmt.Errorf("archiving %s: file changed while it was copied", name)
+	}
+	m.Files = append(m.Files, &File{Path: name, Size: n, SHA256: hex.EncodeToString(h.Sum(nil))})
+	return nil
+}
+
+// CreateFile writes an archive of dataDir to the file at p, which is only
+// created once the archive is complete.
+func CreateFile(p, dataDir, exclude string) (*Manifest, error) {
+	f, err := os.CreateTemp(filepath.Dir(p), "."+filepath.Base(p)+".tmp-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	m, err := Create(f, dataDir, exclude)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.Sync(); err != nil {
+		return nil, err
+	}
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+	return m, os.Rename(f.Name(), p)
+}
+
+// Restore checks the archive at p and replaces dataDir with its contents.
+// The old data dir is renamed, and its new path is returned, so nothing is
+// lost if the wrong backup was restored. The server must not be running.
+//
+// Nothing is changed if the archive is corrupt, or its database schema is
+// newer than this version of whatsup understands.
+func Restore(p, dataDir string) (m *Manifest, oldDir string, err error) {
+	if err := checkDriver(); err != nil {
+		return nil, "", err
+	}
+	dataDir = filepath.Clean(dataDir)
+	staging, err := os.MkdirTemp(filepath.Dir(dataDir), "."+filepath.Base(dataDir)+".restore-")
+	if err != nil {
+		return nil, "", err
+	}
+	defer func() {
+		if err != nil {
+			os.RemoveAll(staging)
+		}
+	}()
+
+	// Same as when main creates the data dir
+	if err := os.Chmod(staging, 0755); err != nil {
+		return nil, "", err
+	}
+	m, err = extract(p, staging)
+	if err != nil {
+		return nil, "", err
+	}
+
+	latest, err := db.LatestSchemaVersion()
+	if err != nil {
+		return nil, "", err
+	}
+	schema, err := db.FileSchemaVersion(filepath.Join(staging, dbName))
+	if err != nil {
+		return nil, "", fmt.Errorf("%w: reading database: %v", ErrInvalidArchive, err)
+	}
+	if schema != m.SchemaVersion {
+		return nil, "", fmt.Errorf("%w: database schema version %d doesn't match manifest", ErrInvalidArchive, schema)
+	}
+	if schema > latest {
+		return nil, "", fmt.Errorf("%w: schema version %d, latest known is %d", ErrSchemaTooNew, schema, latest)
+	}
+
+	if _, err := os.Stat(dataDir); err == nil {
+		stamp := time.Now().Format("20060102-150405")
+		oldDir = dataDir + ".before-restore-" + stamp
+		for i := 1; ; i++ {
+			if _, err := os.Stat(oldDir); errors.Is(err, fs.ErrNotExist) {
+				break
+			}
+			oldDir = fmt.Sprintf("%s.before-restore-%s-%d", dataDir, stamp, i)
+		}
+		if err := os.Rename(dataDir, oldDir); err != nil {
+			return nil, "", err
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return nil, "", err
+	}
+	if err := os.Rename(staging, dataDir); err != nil {
+		if oldDir != "" {
+			os.Rename(oldDir, dataDir)
+		}
+		return nil, "", err
+	}
+	return m, oldDir, nil
+}
+
+// extract writes the files of the archive at p to dir, and checks them
+// against the manifest.
+func extract(p, dir string) (*Manifest, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidArchive, err)
+	}
+	tr := tar.NewReader(gz)
+
+	var m *Manifest
+	got := make(map[string]*File)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidArchive, err)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			return nil, fmt.Errorf("%w: %s is not a regular file", ErrInvalidArchive, hdr.Name)
+		}
+
+		if hdr.Name == manifestName {
+			m = &Manifest{}
+			if err := json.NewDecoder(io.LimitReader(tr, 1<<20)).Decode(m); err != nil {
+				return nil, fmt.Errorf("%w: manifest: %v", ErrInvalidArchive, err)
+			}
+			continue
+		}
+
+		// Don't let paths escape the directory
+		name := path.Clean(hdr.Name)
+		if name != hdr.Name || path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+			return nil, fmt.Errorf("%w: bad path %s", ErrInvalidArchive, hdr.Name)
+		}
+		if _, ok := got[name]; ok {
+			return nil, fmt.Errorf("%w: %s is in the archive twice", ErrInvalidArchive, name)
+		}
+		file, err := extractFile(tr, filepath.Join(dir, filepath.FromSlash(name)), fs.FileMode(hdr.Mode).Perm())
+		if err != nil {
+			return nil, err
+		}
+		file.Path = name
+		got[name] = file
+	}
+
+	if m == nil {
+		return nil, fmt.Errorf("%w: no manifest", ErrInvalidArchive)
+	}
+	if m.Format != FormatVersion {
+		return nil, fmt.Errorf("%w: unknown format version %d", ErrInvalidArchive, m.Format)
+	}
+	if len(m.Files) != len(got) {
+		return nil, fmt.Errorf("%w: manifest lists %d files, archive has %d", ErrInvalidArchive, len(m.Files), len(got))
+	}
+	for _, want := range m.Files {
+		file, ok := got[want.Path]
+		if !ok {
+			return nil, fmt.Errorf("%w: %s is missing", ErrInvalidArchive, want.Path)
+		}
+		if file.Size != want.Size || file.SHA256 != want.SHA256 {
+			return nil, fmt.Errorf("%w: %s doesn't match its checksum", ErrInvalidArchive, want.Path)
+		}
+	}
+	if _, ok := got[dbName]; !ok {
+		return nil, fmt.Errorf("%w: no database", ErrInvalidArchive)
+	}
+	return m, nil
+}
+
+func extractFile(r io.Reader, p string, perm fs.FileMode) (*File, error) {
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	n, err := io.Copy(f, io.TeeReader(r, h))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidArchive, err)
+	}
+	return &File{Size: n, SHA256: hex.EncodeToString(h.Sum(nil))}, f.Close()
+}
+
+// filenameFormat is the name of scheduled backups, with the time.
+const filenameFormat = "whatsup-20060102-150405.tar.gz"
+
+// Start makes a backup of dataDir in dir every interval, and deletes all but
+// the newest keep backups there. Backups are only deleted after a new one
+// was made successfully.
+func Start(ctx context.Context, dataDir, dir string, interval time.Duration, keep int) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			p := filepath.Join(dir, time.Now().UTC().Format(filenameFormat))
+			if _, err := CreateFile(p, dataDir, dir); err != nil {
+				log.Printf("backup: creating %s: %v", p, err)
+				continue
+			}
+			if err := prune(dir, keep); err != nil {
+				log.Printf("backup: deleting old backups: %v", err)
+			}
+		}
+	}()
+}
+
+// prune deletes all but the newest keep scheduled backups in dir.
+func prune(dir string, keep int) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0)
+	for _, e := range entries {
+		if _, err := time.Parse(filenameFormat, e.Name()); err == nil {
+			names = append(names, e.Name())
+		}
+	}
+	// The names sort by time
+	sort.Strings(names)
+	for len(names) > keep {
+		if err := os.Remove(filepath.Join(dir, names[0])); err != nil {
+			return err
+		}
+		names = names[1:]
+	}
+	return nil
+}
@@ -0,0 +1,332 @@
+package backup
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/makeworld-the-better-one/whatsup/config"
+	"github.com/makeworld-the-better-one/whatsup/db"
+	"github.com/makeworld-the-better-one/whatsup/model"
+)
+
+// openTestDB sets up the database in a temporary data dir with the user
+// alice, and returns the data dir. The caller closes the database.
+func openTestDB(t *testing.T) string {
+	t.Helper()
+
+	conf := config.Conf
+	t.Cleanup(func() { config.Conf = conf })
+
+	dataDir := filepath.Join(t.TempDir(), "data")
+	config.Conf.Data = config.DataConf{
+		Dir:         dataDir,
+		Driver:      "sqlite",
+		Readers:     2,
+		BusyTimeout: config.Duration{Duration: 5 * time.Second},
+	}
+	config.Conf.Cache = config.CacheConf{}
+	config.Conf.Users = map[string]string{"alice": ""}
+
+	if err := os.MkdirAll(filepath.Join(dataDir, "avatars"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Init(); err != nil {
+		t.Fatal(err)
+	}
+	return dataDir
+}
+
+// entry is a file in an archive, in order.
+type entry struct {
+	name string
+	data []byte
+}
+
+func readArchive(t *testing.T, p string) []*entry {
+	t.Helper()
+	f, err := os.Open(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(gz)
+	var entries []*entry
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return entries
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, &entry{hdr.Name, data})
+	}
+}
+
+func writeArchive(t *testing.T, p string, entries []*entry) {
+	t.Helper()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for _, e := range entries {
+		if err := tw.WriteHeader(&tar.Header{Name: e.name, Mode: 0644, Size: int64(len(e.data))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(e.data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(p, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// fixManifest makes the manifest match the other entries again, with the
+// schema version given.
+func fixManifest(t *testing.T, entries []*entry, schema int) {
+	t.Helper()
+	m := &Manifest{}
+	last := entries[len(entries)-1]
+	if err := json.Unmarshal(last.data, m); err != nil {
+		t.Fatal(err)
+	}
+	m.SchemaVersion = schema
+	m.Files = nil
+	for _, e := range entries[:len(entries)-1] {
+		sum := sha256.Sum256(e.data)
+		m.Files = append(m.Files, &File{Path: e.name, Size: int64(len(e.data)), SHA256: hex.EncodeToString(sum[:])})
+	}
+	data, err := json.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	last.data = data
+}
+
+// createBackup makes a backup of a data dir where alice has a status and an
+// avatar, and closes the database.
+func createBackup(t *testing.T) (dataDir, archive string) {
+	t.Helper()
+	dataDir = openTestDB(t)
+	defer func() {
+		if err := db.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	text := "backed up"
+	if err := db.Default.SetUser("alice", &model.Status{Status: &text}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Default.SetAvatar("alice", []byte("not really a png")); err != nil {
+		t.Fatal(err)
+	}
+
+	archive = filepath.Join(t.TempDir(), "backup.tar.gz")
+	m, err := CreateFile(archive, dataDir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Files[0].Path != dbName || len(m.Files) < 2 {
+		t.Errorf("manifest files are %+v", m.Files)
+	}
+	return dataDir, archive
+}
+
+func TestRoundTrip(t *testing.T) {
+	dataDir, archive := createBackup(t)
+
+	// Changes after the backup are undone by restoring
+	avatars := filepath.Join(dataDir, "avatars", "alice")
+	if err := os.RemoveAll(avatars); err != nil {
+		t.Fatal(err)
+	}
+	m, oldDir, err := Restore(archive, dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if oldDir == "" {
+		t.Error("old data dir wasn't kept")
+	} else if _, err := os.Stat(oldDir); err != nil {
+		t.Error(err)
+	}
+	latest, err := db.LatestSchemaVersion()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.SchemaVersion != latest {
+		t.Errorf("schema version is %d, want %d", m.SchemaVersion, latest)
+	}
+	if entries, err := os.ReadDir(avatars); err != nil || len(entries) == 0 {
+		t.Errorf("avatar wasn't restored: %v", err)
+	}
+
+	if err := db.Init(); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	status, err := db.Default.GetUser("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Status == nil || *status.Status != "backed up" {
+		t.Errorf("restored status is %+v", status)
+	}
+}
+
+// restoreFails restores the archive, checks that it fails with want, and
+// that the data dir is untouched.
+func restoreFails(t *testing.T, archive, dataDir string, want error) {
+	t.Helper()
+	before, err := os.ReadDir(filepath.Dir(dataDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := Restore(archive, dataDir); !errors.Is(err, want) {
+		t.Errorf("got %v, want %v", err, want)
+	}
+	after, err := os.ReadDir(filepath.Dir(dataDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(after) != len(before) {
+		t.Errorf("%d entries next to the data dir, were %d", len(after), len(before))
+	}
+	if _, err := os.Stat(filepath.Join(dataDir, dbName)); err != nil {
+		t.Errorf("data dir changed: %v", err)
+	}
+}
+
+func TestChecksumMismatch(t *testing.T) {
+	dataDir, archive := createBackup(t)
+	entries := readArchive(t, archive)
+	for _, e := range entries {
+		if filepath.Dir(e.name) == "avatars/alice" {
+			e.data[0] ^= 0xff
+		}
+	}
+	writeArchive(t, archive, entries)
+	restoreFails(t, archive, dataDir, ErrInvalidArchive)
+}
+
+func TestPathTraversal(t *testing.T) {
+	dataDir, archive := createBackup(t)
+	for _, name := range []string{"../evil", "avatars/../../evil", "/evil"} {
+		entries := readArchive(t, archive)
+		entries = append([]*entry{{name, []byte("evil")}}, entries...)
+		fixManifest(t, entries, 0)
+		bad := filepath.Join(t.TempDir(), "bad.tar.gz")
+		writeArchive(t, bad, entries)
+
+		restoreFails(t, bad, dataDir, ErrInvalidArchive)
+		for _, dir := range []string{filepath.Dir(dataDir), filepath.Dir(filepath.Dir(dataDir))} {
+			if _, err := os.Stat(filepath.Join(dir, "evil")); err == nil {
+				t.Errorf("%s was written outside the data dir", name)
+			}
+		}
+	}
+}
+
+func TestSchemaTooNew(t *testing.T) {
+	dataDir, archive := createBackup(t)
+	latest, err := db.LatestSchemaVersion()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Write the archive again with a database from the future
+	tmp := filepath.Join(t.TempDir(), dbName)
+	entries := readArchive(t, archive)
+	if err := os.WriteFile(tmp, entries[0].data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := sql.Open("sqlite", tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.Exec(`INSERT INTO schema_version (version, name, applied_at) VALUES (?, 'future', ?)`, latest+1, time.Now())
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entries[0].data, err = os.ReadFile(tmp); err != nil {
+		t.Fatal(err)
+	}
+	fixManifest(t, entries, latest+1)
+	writeArchive(t, archive, entries)
+
+	restoreFails(t, archive, dataDir, ErrSchemaTooNew)
+}
+
+func TestNotSQLite(t *testing.T) {
+	dataDir, archive := createBackup(t)
+	config.Conf.Data.Driver = "postgres"
+	restoreFails(t, archive, dataDir, ErrNotSQLite)
+	if _, err := Create(io.Discard, dataDir, ""); !errors.Is(err, ErrNotSQLite) {
+		t.Errorf("creating: got %v, want ErrNotSQLite", err)
+	}
+}
+
+func TestPrune(t *testing.T) {
+	dir := t.TempDir()
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	var names []string
+	for i := 0; i < 5; i++ {
+		names = append(names, start.Add(time.Duration(i)*time.Hour).Format(filenameFormat))
+	}
+	// Scheduled backups are made in this order, but the directory isn't sorted
+	for _, name := range append([]string{"manual.tar.gz"}, names[3], names[0], names[4], names[1], names[2]) {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := prune(dir, 2); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, e := range entries {
+		got = append(got, e.Name())
+	}
+	sort.Strings(got)
+	want := []string{"manual.tar.gz", names[3], names[4]}
+	sort.Strings(want)
+	if len(got) != len(want) {
+		t.Fatalf("left %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("left %v, want %v", got, want)
+		}
+	}
+}
@@ -0,0 +1,473 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/makeworld-the-better-one/whatsup/backup"
+	"github.com/makeworld-the-better-one/whatsup/config"
+	"github.com/makeworld-the-better-one/whatsup/db"
+	"github.com/makeworld-the-better-one/whatsup/gemini"
+	"github.com/makeworld-the-better-one/whatsup/httpsig"
+	"github.com/makeworld-the-better-one/whatsup/model"
+	"github.com/makeworld-the-better-one/whatsup/takeout"
+)
+
+// Subcommands that need the config and database.
+// Each returns the exit code for the process.
+
+func runCommand(args []string) int {
+	switch args[0] {
+	case "following":
+		return followingCommand(args[1:])
+	case "keys":
+		return keysCommand(args[1:])
+	case "gemini":
+		return geminiCommand(args[1:])
+	case "admin":
+		return adminCommand(args[1:])
+	case "backup":
+		return backupCommand(args[1:])
+	case "user":
+		return userCommand(args[1:])
+	}
+	fmt.Fprintf(os.Stderr, "unknown command: %s\n", args[0])
+	return 1
+}
+
+func followingCommand(args []string) int {
+	usage := "usage: whatsup following export|import [flags] <user>"
+
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, usage)
+		return 1
+	}
+
+	fs := flag.NewFlagSet("following "+args[0], flag.ContinueOnError)
+	format := fs.String("format", model.FormatJSON, "File format: json, csv, or opml")
+
+	switch args[0] {
+	case "export":
+		list := fs.String("list", "", "Only export the usernames in this list")
+		if err := fs.Parse(args[1:]); err != nil {
+			return 1
+		}
+		if fs.NArg() != 1 {
+			fmt.Fprintln(os.Stderr, usage)
+			return 1
+		}
+		return followingExport(fs.Arg(0), *format, *list)
+	case "import":
+		mode := fs.String("mode", "merge", "Import mode: merge, or replace the existing following list")
+		if err := fs.Parse(args[1:]); err != nil {
+			return 1
+		}
+		if fs.NArg() != 1 || (*mode != "merge" && *mode != "replace") {
+			fmt.Fprintln(os.Stderr, usage)
+			return 1
+		}
+		return followingImport(fs.Arg(0), *format, *mode)
+	}
+
+	fmt.Fprintln(os.Stderr, usage)
+	return 1
+}
+
+// followingExport writes the user's following list to stdout.
+func followingExport(username, format, listName string) int {
+	if _, ok := config.Conf.Users[username]; !ok {
+		fmt.Fprintf(os.Stderr, "user doesn't exist: %s\n", username)
+		return 1
+	}
+
+	var usernames model.FollowingUsernames
+	if listName != "" {
+		list, err := db.Default.GetList(username, listName)
+		if errors.Is(err, db.ErrNotFound) {
+			fmt.Fprintf(os.Stderr, "no such list: %s\n", listName)
+			return 1
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		usernames = list.Usernames
+	} else {
+		fu, err := db.Default.GetFollowing(username)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		usernames = fu.Usernames
+	}
+
+	data, err := model.ExportFollowing(usernames, format)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	os.Stdout.Write(data)
+	return 0
+}
+
+// followingImport reads a following list from stdin and stores it for the user.
+// Invalid entries are reported to stderr and skipped.
+func followingImport(username, format, mode string) int {
+	if _, ok := config.Conf.Users[username]; !ok {
+		fmt.Fprintf(os.Stderr, "user doesn't exist: %s\n", username)
+		return 1
+	}
+
+	data, err := io.ReadAll(os.Stdin)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	imported, entryErrs, err := model.ImportFollowing(data, format)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to decode %s: %v\n", format, err)
+		return 1
+	}
+	for _, e := range entryErrs {
+		fmt.Fprintln(os.Stderr, e)
+	}
+
+	fu, err := db.Default.UpdateFollowing(username, func(fu *model.Following) error {
+		if mode == "replace" {
+			fu.Usernames = imported
+		} else {
+			fu.Usernames.Merge(imported)
+		}
+		return nil
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	fmt.Fprintf(os.Stderr, "imported %d usernames, %d rejected, now following %d\n",
+		len(imported), len(entryErrs), len(fu.Usernames))
+	if len(entryErrs) > 0 {
+		return 1
+	}
+	return 0
+}
+
+func keysCommand(args []string) int {
+	if len(args) != 1 || (args[0] != "list" && args[0] != "rotate") {
+		fmt.Fprintln(os.Stderr, "usage: whatsup keys list|rotate")
+		return 1
+	}
+
+	keyring, err := httpsig.LoadKeyring(filepath.Join(config.Conf.Data.Dir, "server-keys.json"))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	if args[0] == "rotate" {
+		key, err := keyring.Rotate()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		fmt.Fprintf(os.Stderr, "new key is %s, restart the server to start using it\n", key.ID)
+	}
+
+	for _, pk := range keyring.Public() {
+		fmt.Printf("%s\t%s\t%s", pk.ID, pk.Algorithm, base64.StdEncoding.EncodeToString(pk.Key))
+		if pk.Expires != nil {
+			fmt.Printf("\texpires %s", pk.Expires.Format(time.RFC3339))
+		}
+		fmt.Println()
+	}
+	return 0
+}
+
+// geminiCertValidity is how long generated Gemini certificates are valid.
+// Clients trust them on first use, so they shouldn't change often.
+const geminiCertValidity = 20 * 365 * 24 * time.Hour
+
+func geminiCommand(args []string) int {
+	if len(args) < 1 || args[0] != "cert" {
+		fmt.Fprintln(os.Stderr, "usage: whatsup gemini cert [-force]")
+		return 1
+	}
+	fset := flag.NewFlagSet("gemini cert", flag.ContinueOnError)
+	force := fset.Bool("force", false, "replace the existing certificate")
+	if err := fset.Parse(args[1:]); err != nil {
+		return 1
+	}
+
+	conf := config.Conf.Gemini
+	if conf.Cert == config.Conf.Server.Cert {
+		fmt.Fprintln(os.Stderr, "Gemini uses the server certificate, set cert and key under [gemini] to use a self-signed one")
+		return 1
+	}
+	if _, err := os.Stat(conf.Cert); err == nil && !*force {
+		fmt.Fprintf(os.Stderr, "%s already exists, use -force to replace it. Clients that trusted it will warn their users.\n", conf.Cert)
+		return 1
+	}
+
+	if err := gemini.GenerateCert(conf.Cert, conf.Key, conf.Hostname, geminiCertValidity); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fp, err := gemini.Fingerprint(conf.Cert, conf.Key)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Printf("%s\tSHA-256 %s\n", conf.Cert, fp)
+	return 0
+}
+
+func adminCommand(args []string) int {
+	usage := "usage: whatsup admin list|grant|revoke|enable [user]"
+
+	if len(args) == 1 && args[0] == "list" {
+		accounts, err := db.Default.GetAccounts()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		for _, a := range accounts {
+			if _, ok := config.Conf.Users[a.Username]; !ok {
+				// Removed from the config
+				continue
+			}
+			fmt.Printf("%s\t%s", a.Username, a.Role)
+			if a.Disabled {
+				fmt.Print("\tdisabled")
+			}
+			fmt.Println()
+		}
+		return 0
+	}
+	if len(args) != 2 {
+		fmt.Fprintln(os.Stderr, usage)
+		return 1
+	}
+	username := args[1]
+	if _, ok := config.Conf.Users[username]; !ok {
+		fmt.Fprintf(os.Stderr, "user doesn't exist: %s\n", username)
+		return 1
+	}
+
+	var err error
+	switch args[0] {
+	case "grant":
+		err = db.Default.SetRole(username, model.RoleAdmin)
+	case "revoke":
+		err = db.Default.SetRole(username, model.RoleUser)
+	case "enable":
+		// For when the only admin's account was disabled
+		err = db.Default.SetDisabled(username, false)
+	default:
+		fmt.Fprintln(os.Stderr, usage)
+		return 1
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// migrateCommand is run without db.Init, so the database hasn't been
+// migrated yet.
+func migrateCommand(args []string) int {
+	if len(args) != 1 || (args[0] != "up" && args[0] != "status") {
+		fmt.Fprintln(os.Stderr, "usage: whatsup migrate up|status")
+		return 1
+	}
+	if err := db.Open(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer db.Close()
+
+	if args[0] == "up" {
+		// Migrate logs each migration it applies
+		if _, err := db.Migrate(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	}
+
+	migrations, err := db.Migrations()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	for _, m := range migrations {
+		state := "pending"
+		if !m.AppliedAt.IsZero() {
+			state = "applied " + m.AppliedAt.Format(time.RFC3339)
+		}
+		fmt.Printf("%04d\t%s\t%s\n", m.Version, m.Name, state)
+	}
+	return 0
+}
+
+func dbCommand(args []string) int {
+	if len(args) != 1 || (args[0] != "check" && args[0] != "rekey") {
+		fmt.Fprintln(os.Stderr, "usage: whatsup db check|rekey")
+		return 1
+	}
+	if args[0] == "rekey" {
+		// The server only loads the keys when it starts, so it must be
+		// stopped, and must not start until rekeying is done
+		unlock, err := db.LockDataDir()
+		if errors.Is(err, db.ErrLocked) {
+			fmt.Fprintln(os.Stderr, "the server is running, stop it before rekeying")
+			return 1
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		defer unlock()
+	}
+	if err := db.Open(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer db.Close()
+
+	if args[0] == "rekey" {
+		n, err := db.Rekey()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		if db.Encrypted() {
+			fmt.Printf("%d values encrypted with the current key\n", n)
+		} else {
+			fmt.Printf("no data key configured, %d values decrypted\n", n)
+		}
+		return 0
+	}
+
+	problems, err := db.IntegrityCheck(false)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if len(problems) > 0 {
+		for _, p := range problems {
+			fmt.Println(p)
+		}
+		fmt.Fprintf(os.Stderr, "database has %d problems, restore it from a backup with \"whatsup restore\"\n", len(problems))
+		return 1
+	}
+	fmt.Println("ok")
+	return 0
+}
+
+func backupCommand(args []string) int {
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "usage: whatsup backup <file>")
+		return 1
+	}
+
+	// Don't archive the backup into itself
+	exclude := ""
+	if abs, err := filepath.Abs(args[0]); err == nil {
+		exclude = filepath.Dir(abs)
+	}
+	dataDir, err := filepath.Abs(config.Conf.Data.Dir)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if exclude == dataDir {
+		fmt.Fprintln(os.Stderr, "the backup can't be written to the data dir itself")
+		return 1
+	}
+
+	m, err := backup.CreateFile(args[0], dataDir, exclude)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Printf("backed up %d files, schema version %d\n", len(m.Files), m.SchemaVersion)
+	return 0
+}
+
+// restoreCommand is run without db.Init, because it replaces the database.
+func restoreCommand(args []string) int {
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "usage: whatsup restore <file>")
+		return 1
+	}
+
+	m, oldDir, err := backup.Restore(args[0], config.Conf.Data.Dir)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Printf("restored %d files from backup made %s\n", len(m.Files), m.CreatedAt.Format(time.RFC3339))
+	if oldDir != "" {
+		fmt.Printf("previous data dir was moved to %s\n", oldDir)
+	}
+	return 0
+}
+
+func userCommand(args []string) int {
+	usage := "usage: whatsup user export <user> > file.tar.gz\n       whatsup user delete -yes <user>"
+
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, usage)
+		return 1
+	}
+	fs := flag.NewFlagSet("user "+args[0], flag.ContinueOnError)
+	yes := fs.Bool("yes", false, "Really delete the user")
+	if err := fs.Parse(args[1:]); err != nil {
+		return 1
+	}
+	if fs.NArg() != 1 || (args[0] != "export" && args[0] != "delete") {
+		fmt.Fprintln(os.Stderr, usage)
+		return 1
+	}
+	username := fs.Arg(0)
+	if _, ok := config.Conf.Users[username]; !ok {
+		fmt.Fprintf(os.Stderr, "user doesn't exist: %s\n", username)
+		return 1
+	}
+	deleted, err := db.Default.IsDeleted(username)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if deleted {
+		fmt.Fprintf(os.Stderr, "user was deleted already: %s\n", username)
+		return 1
+	}
+
+	if args[0] == "export" {
+		if err := takeout.Write(os.Stdout, db.Default, username); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		return 0
+	}
+
+	if !*yes {
+		fmt.Fprintf(os.Stderr, "this deletes everything stored about %s for good, run again with -yes to do it\n", username)
+		return 1
+	}
+	if err := db.DeleteAccount(db.Default, username); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Fprintf(os.Stderr, "deleted %s, remove them from the config too\n", username)
+	return 0
+}
@@ -1,20 +1,147 @@
 package config
 
+import "time"
+
+// Duration is a time.Duration that can be decoded from a TOML string
+// like "1h30m".
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	var err error
+	d.Duration, err = time.ParseDuration(string(text))
+	return err
+}
+
 type ServerConf struct {
-	Host string
-	Port uint16
-	Cert string
-	Key  string
+	Host   string
+	Port   uint16
+	Cert   string
+	Key    string
+	Domain string
+	URL    string
 }
 
 type DataConf struct {
-	Dir string
+	Dir         string
+	Driver      string
+	DSN         string `toml:"dsn"`
+	Readers     int
+	BusyTimeout Duration `toml:"busy_timeout"`
+	KeyFile     string   `toml:"key_file"`
+	OldKeyFiles []string `toml:"old_key_files"`
+}
+
+type FollowingConf struct {
+	Validate        bool
+	RecheckInterval Duration `toml:"recheck_interval"`
+}
+
+type PrivacyConf struct {
+	DeniedCode int `toml:"denied_code"`
+}
+
+type KeysConf struct {
+	RotateAfter Duration `toml:"rotate_after"`
+}
+
+type StreamConf struct {
+	MaxPerIP       int      `toml:"max_per_ip"`
+	TrustedProxies []string `toml:"trusted_proxies"`
+	Heartbeat      Duration `toml:"heartbeat"`
+	RemotePoll     Duration `toml:"remote_poll"`
+}
+
+type WebhooksConf struct {
+	MaxAttempts  int  `toml:"max_attempts"`
+	DisableAfter int  `toml:"disable_after"`
+	AllowPrivate bool `toml:"allow_private"`
+	Server       []ServerWebhookConf
+}
+
+// ServerWebhookConf is a server-wide webhook, which gets events for all users.
+type ServerWebhookConf struct {
+	URL    string
+	Secret string
+	Events []string
+}
+
+type WebSubConf struct {
+	Lease        Duration
+	MaxLease     Duration `toml:"max_lease"`
+	Subscribe    bool
+	MaxPerHost   int  `toml:"max_per_host"`
+	AllowPrivate bool `toml:"allow_private"`
+}
+
+type RemoteConf struct {
+	AllowPrivate bool `toml:"allow_private"`
+}
+
+type FeedConf struct {
+	Entries int
+}
+
+type FingerConf struct {
+	Enabled   bool
+	Host      string
+	Port      uint16
+	Verbose   bool
+	ListUsers bool `toml:"list_users"`
+	MaxConns  int  `toml:"max_conns"`
+	MaxPerIP  int  `toml:"max_per_ip"`
+}
+
+type GeminiConf struct {
+	Enabled  bool
+	Host     string
+	Port     uint16
+	Hostname string
+	Cert     string
+	Key      string
+	History  bool
+	MaxConns int `toml:"max_conns"`
+}
+
+type WebConf struct {
+	Settings        bool
+	SessionLifetime Duration `toml:"session_lifetime"`
+}
+
+type BackupConf struct {
+	Dir      string
+	Interval Duration
+	Keep     int
+}
+
+type QueryConf struct {
+	MaxUsers int `toml:"max_users"`
+}
+
+type CacheConf struct {
+	Entries int
+	TTL     Duration `toml:"ttl"`
 }
 
 type TomlConfig struct {
-	Server ServerConf
-	Data   DataConf
-	Users  map[string]string
+	Server    ServerConf
+	Data      DataConf
+	Following FollowingConf
+	Privacy   PrivacyConf
+	Keys      KeysConf
+	Stream    StreamConf
+	Webhooks  WebhooksConf
+	WebSub    WebSubConf `toml:"websub"`
+	Remote    RemoteConf
+	Feed      FeedConf
+	Finger    FingerConf
+	Gemini    GeminiConf
+	Web       WebConf
+	Backup    BackupConf
+	Query     QueryConf
+	Cache     CacheConf
+	Users     map[string]string
 }
 
 var Conf TomlConfig
@@ -0,0 +1,218 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/makeworld-the-better-one/whatsup/config"
+	"github.com/makeworld-the-better-one/whatsup/model"
+)
+
+// AccountStore keeps the accounts of local users, and the tombstones of
+// deleted ones. Accounts are created along with the user by CreateUser.
+type AccountStore interface {
+	// GetAccount returns the account of a local user.
+	// Returns ErrNotFound if the user doesn't exist.
+	GetAccount(username string) (*model.Account, error)
+
+	// GetAccounts returns all accounts, sorted by username. This includes
+	// accounts of users that have since been removed from the config.
+	GetAccounts() ([]*model.Account, error)
+
+	// SetRole sets the role of the account, model.RoleUser or model.RoleAdmin.
+	// Returns ErrNotFound if the user doesn't exist.
+	SetRole(username, role string) error
+
+	// SetDisabled disables or enables the account. Disabling also logs the
+	// user out of the settings UI.
+	// Returns ErrNotFound if the user doesn't exist.
+	SetDisabled(username string, disabled bool) error
+
+	// SetPasswordHash replaces the user's password hash from the config file.
+	// All of the user's sessions are logged out.
+	// Returns ErrNotFound if the user doesn't exist.
+	SetPasswordHash(username, hash string) error
+
+	// IsDeleted returns true if the user was deleted with DeleteUser.
+	IsDeleted(username string) (bool, error)
+
+	// GetDeleted returns which of the usernames were deleted with DeleteUser.
+	// Only deleted users are in the map.
+	GetDeleted(usernames []string) (map[string]bool, error)
+}
+
+// newAccount returns the account CreateUser creates.
+func newAccount(username string) *model.Account {
+	return &model.Account{Username: username, Role: model.RoleUser, CreatedAt: time.Now().UTC()}
+}
+
+func scanAccount(row interface{ Scan(...interface{}) error }) (*model.Account, error) {
+	var a model.Account
+	err := row.Scan(&a.Username, &a.Role, &a.Disabled, &a.PasswordHash, &a.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &a, nil
+}
+
+func (s *SQLiteStore) GetAccount(username string) (*model.Account, error) {
+	a, err := scanAccount(db.QueryRow(`
+	SELECT username, role, disabled, password_hash, created_at
+	FROM accounts WHERE username=?
+	`, username))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	return a, err
+}
+
+func (s *SQLiteStore) GetAccounts() ([]*model.Account, error) {
+	rows, err := db.Query(`
+	SELECT username, role, disabled, password_hash, created_at
+	FROM accounts ORDER BY username
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	accounts := make([]*model.Account, 0)
+	for rows.Next() {
+		a, err := scanAccount(rows)
+		if err != nil {
+			return nil, err
+		}
+		accounts = append(accounts, a)
+	}
+	return accounts, rows.Err()
+}
+
+// updateAccount runs an UPDATE of one column on the account.
+// Returns ErrNotFound if the user doesn't exist.
+func (s *SQLiteStore) updateAccount(username, col string, value interface{}) error {
+	res, err := db.Exec(`UPDATE accounts SET `+col+`=? WHERE username=?`, value, username)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *SQLiteStore) SetRole(username, role string) error {
+	return s.updateAccount(username, "role", role)
+}
+
+func (s *SQLiteStore) SetDisabled(username string, disabled bool) error {
+	if err := s.updateAccount(username, "disabled", disabled); err != nil {
+		return err
+	}
+	if disabled {
+		return s.deleteUserSessions(username)
+	}
+	return nil
+}
+
+func (s *SQLiteStore) SetPasswordHash(username, hash string) error {
+	if err := s.updateAccount(username, "password_hash", hash); err != nil {
+		return err
+	}
+	return s.deleteUserSessions(username)
+}
+
+func (s *SQLiteStore) IsDeleted(username string) (bool, error) {
+	var tmp string
+	err := rdb.QueryRow(`SELECT username FROM deleted_users WHERE username=?`, username).Scan(&tmp)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *SQLiteStore) GetDeleted(usernames []string) (map[string]bool, error) {
+	deleted := make(map[string]bool)
+	if len(usernames) == 0 {
+		return deleted, nil
+	}
+
+	args := make([]interface{}, len(usernames))
+	for i, u := range usernames {
+		args[i] = u
+	}
+	rows, err := rdb.Query(`
+	SELECT username FROM deleted_users
+	WHERE username IN (?`+strings.Repeat(",?", len(usernames)-1)+`)
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var username string
+		if err := rows.Scan(&username); err != nil {
+			return nil, err
+		}
+		deleted[username] = true
+	}
+	return deleted, rows.Err()
+}
+
+// DeleteAccount removes everything stored about a local user with
+// st.DeleteUser, which leaves a tombstone so the user isn't created again
+// from the config. What this server keeps about the user apart from st goes
+// too: their WebSub subscribers, their avatar, and the state of remote users
+// nobody follows anymore.
+//
+// The user is locked for the whole deletion, so that no write to the user
+// can happen in between and leave something behind, like an avatar.
+//
+// Errors removing the avatar directory and remote users are logged, the
+// account is deleted anyway.
+func DeleteAccount(st Store, username string) error {
+	unlock, err := st.LockUser(username)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	// The hooked DeleteUser locks the user too, and locks aren't reentrant
+	if h, ok := st.(*hookedStore); ok {
+		err = h.deleteUser(username)
+	} else {
+		err = st.DeleteUser(username)
+	}
+	if err != nil {
+		return err
+	}
+
+	if _, err := db.Exec(`DELETE FROM websub_subscriptions WHERE username=?`, username); err != nil {
+		return err
+	}
+
+	// Users they followed that nobody else does, and the user themselves
+	all, err := st.AllFollowing()
+	if err == nil {
+		delete(all, "@"+username+"@"+config.Conf.Server.Domain)
+		err = DeleteRemoteUsersExcept(all)
+	}
+	if err != nil {
+		log.Printf("DeleteAccount: removing remote users: %v", err)
+	}
+
+	dir := filepath.Join(config.Conf.Data.Dir, "avatars", username)
+	if err := os.RemoveAll(dir); err != nil {
+		log.Printf("DeleteAccount: removing %s: %v", dir, err)
+	}
+	return nil
+}
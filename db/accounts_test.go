@@ -0,0 +1,255 @@
+package db
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/makeworld-the-better-one/whatsup/config"
+	"github.com/makeworld-the-better-one/whatsup/model"
+)
+
+func TestAccountsAndSessions(t *testing.T) {
+	testStores(t, func(t *testing.T, s Store) {
+		alice := testUsername("alice")
+		if err := s.CreateUser(alice); err != nil {
+			t.Fatal(err)
+		}
+
+		acc, err := s.GetAccount(alice)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if acc.Role != model.RoleUser || acc.Disabled {
+			t.Errorf("new account is %+v", acc)
+		}
+		if err := s.SetRole(alice, model.RoleAdmin); err != nil {
+			t.Fatal(err)
+		}
+		if acc, err := s.GetAccount(alice); err != nil || !acc.IsAdmin() {
+			t.Errorf("account after SetRole is %+v, %v", acc, err)
+		}
+		if err := s.SetRole(testUsername("nobody"), model.RoleAdmin); !errors.Is(err, ErrNotFound) {
+			t.Errorf("SetRole of missing user: got %v, want ErrNotFound", err)
+		}
+
+		newSession := func(id string, expires time.Time) {
+			t.Helper()
+			err := s.CreateSession(&model.Session{
+				ID:        id,
+				Username:  alice,
+				CSRF:      "csrf",
+				CreatedAt: time.Now(),
+				ExpiresAt: expires,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		live, expired := testUsername("live"), testUsername("expired")
+		newSession(live, time.Now().Add(time.Hour))
+		newSession(expired, time.Now().Add(-time.Minute))
+
+		if sess, err := s.GetSession(live); err != nil || sess.Username != alice || sess.CSRF != "csrf" {
+			t.Errorf("session is %+v, %v", sess, err)
+		}
+		if _, err := s.GetSession(expired); !errors.Is(err, ErrNotFound) {
+			t.Errorf("expired session: got %v, want ErrNotFound", err)
+		}
+		if err := s.PruneSessions(); err != nil {
+			t.Fatal(err)
+		}
+
+		// Disabling logs out, and so does changing the password
+		if err := s.SetDisabled(alice, true); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.GetSession(live); !errors.Is(err, ErrNotFound) {
+			t.Errorf("session after disabling: got %v, want ErrNotFound", err)
+		}
+		if acc, err := s.GetAccount(alice); err != nil || !acc.Disabled || acc.IsAdmin() {
+			t.Errorf("disabled account is %+v, %v", acc, err)
+		}
+		newSession(live, time.Now().Add(time.Hour))
+		if err := s.SetPasswordHash(alice, "hash"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.GetSession(live); !errors.Is(err, ErrNotFound) {
+			t.Errorf("session after password change: got %v, want ErrNotFound", err)
+		}
+		if acc, err := s.GetAccount(alice); err != nil || acc.PasswordHash != "hash" {
+			t.Errorf("account after password change is %+v, %v", acc, err)
+		}
+	})
+}
+
+func TestDeleteUser(t *testing.T) {
+	testStores(t, func(t *testing.T, s Store) {
+		alice, bob := testUsername("alice"), testUsername("bob")
+		for _, u := range []string{alice, bob} {
+			if err := s.CreateUser(u); err != nil {
+				t.Fatal(err)
+			}
+		}
+		text := "hi"
+		if err := s.SetUser(alice, &model.Status{Status: &text}); err != nil {
+			t.Fatal(err)
+		}
+		for u, followed := range map[string]string{alice: "a@remote.example", bob: "b@remote.example"} {
+			if err := s.SetFollowing(u, &model.Following{Usernames: model.FollowingUsernames{followed: {}}}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := s.CreateList(alice, "work"); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.AddHistory(alice, &model.Status{Status: &text}); err != nil {
+			t.Fatal(err)
+		}
+		wh := &model.Webhook{Owner: alice, URL: "https://hooks.example/", Events: []string{model.WebhookStatus}, Enabled: true}
+		if err := s.CreateWebhook(wh); err != nil {
+			t.Fatal(err)
+		}
+
+		all, err := s.AllFollowing()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, u := range []string{"a@remote.example", "b@remote.example"} {
+			if _, ok := all[u]; !ok {
+				t.Errorf("%s isn't in AllFollowing", u)
+			}
+		}
+
+		if err := s.DeleteUser(alice); err != nil {
+			t.Fatal(err)
+		}
+		if deleted, err := s.IsDeleted(alice); err != nil || !deleted {
+			t.Errorf("IsDeleted is %v, %v", deleted, err)
+		}
+		if deleted, err := s.GetDeleted([]string{alice, bob}); err != nil || len(deleted) != 1 || !deleted[alice] {
+			t.Errorf("GetDeleted is %v, %v", deleted, err)
+		}
+		if _, err := s.GetUser(alice); !errors.Is(err, ErrNotFound) {
+			t.Errorf("status: got %v, want ErrNotFound", err)
+		}
+		if _, err := s.GetFollowing(alice); !errors.Is(err, ErrNotFound) {
+			t.Errorf("following: got %v, want ErrNotFound", err)
+		}
+		if _, err := s.GetAccount(alice); !errors.Is(err, ErrNotFound) {
+			t.Errorf("account: got %v, want ErrNotFound", err)
+		}
+		if lists, err := s.GetLists(alice); err != nil || len(lists) != 0 {
+			t.Errorf("lists are %v, %v", lists, err)
+		}
+		if entries, err := s.GetHistory(alice, 10); err != nil || len(entries) != 0 {
+			t.Errorf("history is %v, %v", entries, err)
+		}
+		if _, err := s.GetWebhookByID(wh.ID); !errors.Is(err, ErrNotFound) {
+			t.Errorf("webhook: got %v, want ErrNotFound", err)
+		}
+		all, err = s.AllFollowing()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := all["a@remote.example"]; ok {
+			t.Error("users followed by the deleted user are still in AllFollowing")
+		}
+		if _, err := s.GetUser(bob); err != nil {
+			t.Errorf("other user: %v", err)
+		}
+	})
+}
+
+func TestDeleteAccount(t *testing.T) {
+	testStores(t, func(t *testing.T, s Store) {
+		s = WithHooks(s)
+		alice := testUsername("alice")
+		if err := s.CreateUser(alice); err != nil {
+			t.Fatal(err)
+		}
+		dir := filepath.Join(config.Conf.Data.Dir, "avatars", alice)
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		// Waits for writes to the user to finish
+		unlock, err := s.LockUser(alice)
+		if err != nil {
+			t.Fatal(err)
+		}
+		done := make(chan error, 1)
+		go func() { done <- DeleteAccount(s, alice) }()
+		select {
+		case err := <-done:
+			t.Fatalf("deleted while the user was locked: %v", err)
+		case <-time.After(100 * time.Millisecond):
+		}
+		unlock()
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("not deleted after unlocking")
+		}
+
+		if deleted, err := s.IsDeleted(alice); err != nil || !deleted {
+			t.Errorf("IsDeleted is %v, %v", deleted, err)
+		}
+		if _, err := os.Stat(dir); !os.IsNotExist(err) {
+			t.Errorf("avatar dir: got %v, want it removed", err)
+		}
+
+		// And the user can be locked again
+		unlock, err = s.LockUser(alice)
+		if err != nil {
+			t.Fatal(err)
+		}
+		unlock()
+	})
+}
+
+func TestLockUser(t *testing.T) {
+	testStores(t, func(t *testing.T, s Store) {
+		alice := testUsername("alice")
+		unlock, err := s.LockUser(alice)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		locked := make(chan struct{})
+		go func() {
+			unlock, err := s.LockUser(alice)
+			if err != nil {
+				t.Error(err)
+				close(locked)
+				return
+			}
+			close(locked)
+			unlock()
+		}()
+
+		// Other users aren't locked
+		unlockBob, err := s.LockUser(testUsername("bob"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		unlockBob()
+
+		select {
+		case <-locked:
+			t.Fatal("the user was locked twice")
+		case <-time.After(100 * time.Millisecond):
+		}
+		unlock()
+		select {
+		case <-locked:
+		case <-time.After(5 * time.Second):
+			t.Fatal("the user wasn't locked after unlocking")
+		}
+	})
+}
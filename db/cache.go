@@ -0,0 +1,241 @@
+package db
+
+import (
+	"container/list"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/makeworld-the-better-one/whatsup/model"
+)
+
+// statusCache is the cache in front of the Store, or nil if it's disabled.
+// It's set by Init.
+var statusCache *cachedStore
+
+// cachedStore is a Store that keeps recently read statuses in memory, along
+// with their JSON encoding. Any change to a user through it drops the user
+// from the cache, so the next read gets the new status from the Store below.
+//
+// The statuses it returns are shared, and must not be modified.
+type cachedStore struct {
+	Store
+
+	max int           // Most entries kept
+	ttl time.Duration // Zero for no expiry
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List // Of *cacheEntry, most recently used first
+	stats   CacheStats
+
+	// gen changes whenever a user is dropped. A status read from the Store
+	// is only cached if gen didn't change while reading it, otherwise it
+	// might be older than a change that happened in the meantime.
+	gen uint64
+}
+
+type cacheEntry struct {
+	username string
+	status   *model.Status
+	json     []byte
+	cachedAt time.Time
+}
+
+// CacheStats are counters for the status cache.
+type CacheStats struct {
+	Entries   int
+	Bytes     int64 // Size of the cached JSON
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+
+	// Requests for the JSON of a status, which hit if the status came
+	// from the cache and is still in it
+	JSONHits   uint64
+	JSONMisses uint64
+}
+
+func newCachedStore(s Store, max int, ttl time.Duration) *cachedStore {
+	return &cachedStore{
+		Store:   s,
+		max:     max,
+		ttl:     ttl,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// get returns the cached status of the user, or nil and the current
+// generation to pass to put.
+func (c *cachedStore) get(username string) (*model.Status, uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[username]
+	if ok && c.ttl > 0 && time.Since(el.Value.(*cacheEntry).cachedAt) > c.ttl {
+		c.remove(el)
+		ok = false
+	}
+	if !ok {
+		c.stats.Misses++
+		return nil, c.gen
+	}
+	c.stats.Hits++
+	c.lru.MoveToFront(el)
+	return el.Value.(*cacheEntry).status, 0
+}
+
+// put caches the status of the user, unless the generation changed since it
+// was read.
+func (c *cachedStore) put(username string, status *model.Status, gen uint64) {
+	// Encoding is done outside the lock, it's the slow part
+	b, err := json.Marshal(status)
+	if err != nil {
+		return
+	}
+	e := &cacheEntry{username: username, status: status, json: b, cachedAt: time.Now()}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.gen != gen {
+		return
+	}
+	if el, ok := c.entries[username]; ok {
+		c.remove(el)
+	}
+	c.entries[username] = c.lru.PushFront(e)
+	c.stats.Bytes += int64(len(b))
+
+	for c.lru.Len() > c.max {
+		c.remove(c.lru.Back())
+		c.stats.Evictions++
+	}
+}
+
+// invalidate drops the user from the cache.
+func (c *cachedStore) invalidate(username string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.gen++
+	if el, ok := c.entries[username]; ok {
+		c.remove(el)
+	}
+}
+
+// remove drops an entry. The caller must hold c.mu.
+func (c *cachedStore) remove(el *list.Element) {
+	e := c.lru.Remove(el).(*cacheEntry)
+	delete(c.entries, e.username)
+	c.stats.Bytes -= int64(len(e.json))
+}
+
+// json returns the cached JSON for the status, or nil if the status isn't
+// the one in the cache.
+func (c *cachedStore) json(username string, status *model.Status) []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.entries[username]; ok && el.Value.(*cacheEntry).status == status {
+		c.stats.JSONHits++
+		return el.Value.(*cacheEntry).json
+	}
+	c.stats.JSONMisses++
+	return nil
+}
+
+func (c *cachedStore) GetUser(username string) (*model.Status, error) {
+	status, gen := c.get(username)
+	if status != nil {
+		return status, nil
+	}
+	status, err := c.Store.GetUser(username)
+	if err != nil {
+		return nil, err
+	}
+	c.put(username, status, gen)
+	return status, nil
+}
+
+func (c *cachedStore) GetUsers(usernames []string) (map[string]*model.Status, error) {
+	statuses := make(map[string]*model.Status, len(usernames))
+	var missing []string
+	var gen uint64
+	for _, username := range usernames {
+		status, g := c.get(username)
+		if status != nil {
+			statuses[username] = status
+			continue
+		}
+		if missing == nil {
+			// The first miss has the oldest generation
+			gen = g
+		}
+		missing = append(missing, username)
+	}
+	if len(missing) == 0 {
+		return statuses, nil
+	}
+
+	fetched, err := c.Store.GetUsers(missing)
+	if err != nil {
+		return nil, err
+	}
+	for username, status := range fetched {
+		statuses[username] = status
+		c.put(username, status, gen)
+	}
+	return statuses, nil
+}
+
+func (c *cachedStore) CreateUser(username string) error {
+	defer c.invalidate(username)
+	return c.Store.CreateUser(username)
+}
+
+func (c *cachedStore) SetUser(username string, data *model.Status) error {
+	defer c.invalidate(username)
+	return c.Store.SetUser(username, data)
+}
+
+func (c *cachedStore) SetAvatar(username string, img []byte) error {
+	defer c.invalidate(username)
+	return c.Store.SetAvatar(username, img)
+}
+
+func (c *cachedStore) RemoveAvatar(username string) error {
+	defer c.invalidate(username)
+	return c.Store.RemoveAvatar(username)
+}
+
+func (c *cachedStore) DeleteUser(username string) error {
+	defer c.invalidate(username)
+	return c.Store.DeleteUser(username)
+}
+
+// GetCacheStats returns the status cache counters. It returns false if the
+// cache is disabled.
+func GetCacheStats() (CacheStats, bool) {
+	if statusCache == nil {
+		return CacheStats{}, false
+	}
+	statusCache.mu.Lock()
+	defer statusCache.mu.Unlock()
+
+	stats := statusCache.stats
+	stats.Entries = statusCache.lru.Len()
+	return stats, true
+}
+
+// StatusJSON returns the JSON encoding of a status of the user. If the status
+// is the one in the cache its JSON is already there, otherwise it's encoded.
+func StatusJSON(username string, status *model.Status) ([]byte, error) {
+	if statusCache != nil {
+		if b := statusCache.json(username, status); b != nil {
+			return b, nil
+		}
+	}
+	return json.Marshal(status)
+}
@@ -0,0 +1,157 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/makeworld-the-better-one/whatsup/model"
+)
+
+// Run these with -race, the cache is shared by all requests.
+
+func TestCacheConcurrent(t *testing.T) {
+	backend := NewMemoryStore()
+	c := newCachedStore(backend, 5, 0)
+	users := []string{"u0", "u1", "u2", "u3", "u4", "u5", "u6", "u7"}
+	for _, u := range users {
+		if err := c.CreateUser(u); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				text := fmt.Sprintf("%d-%d", w, i)
+				if err := c.SetUser(users[(w+i)%len(users)], &model.Status{Status: &text}); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(w)
+	}
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func(r int) {
+			defer wg.Done()
+			for i := 0; i < 500; i++ {
+				u := users[(r+i)%len(users)]
+				status, err := c.GetUser(u)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if _, err := StatusJSON(u, status); err != nil {
+					t.Error(err)
+					return
+				}
+				if _, err := c.GetUsers(users[:3]); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(r)
+	}
+	wg.Wait()
+
+	// Nothing stale was left in the cache by a read racing a write
+	for _, u := range users {
+		cached, err := c.GetUser(u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stored, err := backend.GetUser(u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if *cached.Status != *stored.Status {
+			t.Errorf("%s: cached %q, stored %q", u, *cached.Status, *stored.Status)
+		}
+	}
+	if n := c.lru.Len(); n > 5 {
+		t.Errorf("%d entries cached, max is 5", n)
+	}
+}
+
+func TestCacheJSON(t *testing.T) {
+	statusCache = newCachedStore(NewMemoryStore(), 10, 0)
+	defer func() { statusCache = nil }()
+
+	if err := statusCache.CreateUser("alice"); err != nil {
+		t.Fatal(err)
+	}
+	status, err := statusCache.GetUser("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := StatusJSON("alice", status)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, _ := json.Marshal(status)
+	if string(got) != string(want) {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	if stats, _ := GetCacheStats(); stats.JSONHits != 1 {
+		t.Errorf("%d JSON hits, want 1", stats.JSONHits)
+	}
+
+	// A status that isn't the cached one is encoded
+	other := &model.Status{}
+	if _, err := StatusJSON("alice", other); err != nil {
+		t.Fatal(err)
+	}
+	if stats, _ := GetCacheStats(); stats.JSONMisses != 1 {
+		t.Errorf("%d JSON misses, want 1", stats.JSONMisses)
+	}
+}
+
+// Changes that don't go through the cache, like from whatsup commands or
+// other servers, are only seen after the TTL.
+func TestCacheTTL(t *testing.T) {
+	backend := NewMemoryStore()
+	c := newCachedStore(backend, 10, 50*time.Millisecond)
+	if err := c.CreateUser("alice"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.GetUser("alice"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := backend.DeleteUser("alice"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.GetUser("alice"); err != nil {
+		t.Errorf("cached user not served before the TTL: %v", err)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if _, err := c.GetUser("alice"); err != ErrNotFound {
+		t.Errorf("got %v after the TTL, want ErrNotFound", err)
+	}
+}
+
+func TestCacheEviction(t *testing.T) {
+	c := newCachedStore(NewMemoryStore(), 3, 0)
+	for i := 0; i < 10; i++ {
+		u := "u" + strconv.Itoa(i)
+		if err := c.CreateUser(u); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := c.GetUser(u); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if c.lru.Len() != 3 || c.stats.Evictions != 7 {
+		t.Errorf("%d entries and %d evictions, want 3 and 7", c.lru.Len(), c.stats.Evictions)
+	}
+	if _, ok := c.entries["u9"]; !ok {
+		t.Error("most recent user was evicted")
+	}
+}
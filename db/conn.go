@@ -0,0 +1,176 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/makeworld-the-better-one/whatsup/config"
+)
+
+// rdb is the pool of read-only connections to the database. db is a single
+// connection that does all the writing, so writers wait on each other in Go
+// instead of failing with SQLITE_BUSY. With WAL, readers don't block the
+// writer or each other.
+//
+// Only the hot queries use rdb, reading from db is fine everywhere else.
+var rdb *sql.DB
+
+// optimizeInterval is how often PRAGMA optimize is run while the server runs.
+const optimizeInterval = 6 * time.Hour
+
+// sqliteDSN returns the data source name for the database file, with the
+// pragmas every connection needs.
+func sqliteDSN(readOnly bool) string {
+	q := url.Values{}
+	q.Add("_pragma", fmt.Sprintf("busy_timeout(%d)", config.Conf.Data.BusyTimeout.Milliseconds()))
+	if readOnly {
+		q.Add("_pragma", "query_only(1)")
+	} else {
+		// WAL is kept in the file, but setting it on every writer connection
+		// also covers new and restored databases
+		q.Add("_pragma", "journal_mode(WAL)")
+		q.Add("_pragma", "synchronous(NORMAL)")
+	}
+	return filepath.Join(config.Conf.Data.Dir, "data.db") + "?" + q.Encode()
+}
+
+// connect opens the writer connection and the reader pool.
+func connect() error {
+	var err error
+	db, err = sql.Open("sqlite", sqliteDSN(false))
+	if err != nil {
+		return err
+	}
+	db.SetMaxOpenConns(1)
+	// Opening the writer first makes sure the database is in WAL mode
+	// before any reader connects
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return err
+	}
+
+	rdb, err = sql.Open("sqlite", sqliteDSN(true))
+	if err != nil {
+		db.Close()
+		return err
+	}
+	rdb.SetMaxOpenConns(config.Conf.Data.Readers)
+	rdb.SetMaxIdleConns(config.Conf.Data.Readers)
+	return nil
+}
+
+// stmts holds the prepared statements of the hot queries, by connection and
+// query text.
+var stmts = struct {
+	sync.Mutex
+	m map[stmtKey]*sql.Stmt
+}{m: make(map[stmtKey]*sql.Stmt)}
+
+type stmtKey struct {
+	conn  *sql.DB
+	query string
+}
+
+// prepare returns the prepared statement for the query, preparing it the
+// first time. Queries must come from a fixed set, like the ones built from
+// statusColumns, so that the number of statements stays small.
+func prepare(conn *sql.DB, query string) (*sql.Stmt, error) {
+	stmts.Lock()
+	defer stmts.Unlock()
+
+	key := stmtKey{conn, query}
+	if stmt, ok := stmts.m[key]; ok {
+		return stmt, nil
+	}
+	stmt, err := conn.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	stmts.m[key] = stmt
+	return stmt, nil
+}
+
+// closeStmts closes all prepared statements, before the connections are closed.
+func closeStmts() {
+	stmts.Lock()
+	defer stmts.Unlock()
+
+	for key, stmt := range stmts.m {
+		stmt.Close()
+		delete(stmts.m, key)
+	}
+}
+
+// IntegrityCheck runs SQLite's integrity check on the database, and returns
+// the problems found. If quick is true the faster but less thorough
+// quick_check is done instead.
+func IntegrityCheck(quick bool) ([]string, error) {
+	pragma := "integrity_check"
+	if quick {
+		pragma = "quick_check"
+	}
+	rows, err := db.Query(`PRAGMA ` + pragma)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var problems []string
+	for rows.Next() {
+		var line string
+		if err := rows.Scan(&line); err != nil {
+			return nil, err
+		}
+		if line != "ok" {
+			problems = append(problems, line)
+		}
+	}
+	return problems, rows.Err()
+}
+
+// Optimize lets SQLite update the statistics it uses to plan queries, when
+// they are out of date. It's usually quick.
+func Optimize() error {
+	_, err := db.Exec(`PRAGMA optimize`)
+	return err
+}
+
+// StartOptimize runs Optimize in the background every optimizeInterval,
+// until ctx is done.
+func StartOptimize(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(optimizeInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := Optimize(); err != nil {
+					log.Printf("db: optimize: %v", err)
+				}
+			}
+		}
+	}()
+}
+
+// checkOnStart does a quick integrity check, so a damaged database is found
+// before the server starts using it.
+func checkOnStart() error {
+	problems, err := IntegrityCheck(true)
+	if err != nil {
+		return err
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("database failed integrity check with %d problems, first: %s\nRun \"whatsup db check\" for all of them",
+			len(problems), strings.TrimSpace(problems[0]))
+	}
+	return nil
+}
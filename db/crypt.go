@@ -0,0 +1,331 @@
+package db
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/makeworld-the-better-one/whatsup/config"
+)
+
+// Encryption at rest
+//
+// Private data in the SQLite database, currently following lists, follow
+// lists and status history, can be encrypted with a key that's kept outside of it. Each value
+// is encrypted with its own random data key, and that data key is encrypted
+// with the configured key. Changing the configured key only means encrypting
+// the data keys again, which is what Rekey does.
+//
+// Sealed values look like this:
+//
+//	sealMagic | key ID (8) | nonce (12) | wrapped data key (32 + 16) | nonce (12) | ciphertext
+//
+// Values without sealMagic at the start are plaintext. JSON never starts with
+// it, so data from before encryption was turned on can still be read.
+//
+// Other tables aren't encrypted yet. Notably webhook_deliveries and
+// remote_users can contain followed usernames, privacy has the usernames
+// on allow and block lists, and webhooks has the webhook secrets.
+
+// KeyEnv is the environment variable that can hold the data key, instead of
+// the key file in the config.
+const KeyEnv = "WHATSUP_DATA_KEY"
+
+var sealMagic = []byte("wenc1")
+
+const (
+	keyIDSize      = 8
+	dataKeySize    = 32
+	wrappedKeySize = 12 + dataKeySize + 16
+	sealHeaderSize = 5 + keyIDSize + wrappedKeySize + 12
+)
+
+var ErrNoDataKey = errors.New("data is encrypted with a key that isn't configured")
+
+type dataKey struct {
+	id   []byte
+	aead cipher.AEAD
+}
+
+// sealKey encrypts new values, it's nil if encryption is off.
+// openKeys decrypts values, it has sealKey and any old keys, by ID.
+var (
+	sealKey  *dataKey
+	openKeys map[string]*dataKey
+)
+
+// newDataKey makes a dataKey from the base64 encoded text of a key file.
+func newDataKey(text string) (*dataKey, error) {
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(text))
+	if err != nil {
+		return nil, fmt.Errorf("key isn't valid base64: %w", err)
+	}
+	if len(raw) != 32 {
+		return nil, fmt.Errorf("key must be 32 bytes, not %d", len(raw))
+	}
+	aead, err := newAEAD(raw)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(raw)
+	return &dataKey{id: sum[:keyIDSize], aead: aead}, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// loadKeys sets up the keys from config.Conf.Data and the environment.
+func loadKeys() error {
+	sealKey = nil
+	openKeys = make(map[string]*dataKey)
+
+	text := os.Getenv(KeyEnv)
+	if text == "" && config.Conf.Data.KeyFile != "" {
+		b, err := os.ReadFile(config.Conf.Data.KeyFile)
+		if err != nil {
+			return err
+		}
+		text = string(b)
+	}
+	if text != "" {
+		k, err := newDataKey(text)
+		if err != nil {
+			return fmt.Errorf("data key: %w", err)
+		}
+		sealKey = k
+		openKeys[string(k.id)] = k
+	}
+
+	for _, path := range config.Conf.Data.OldKeyFiles {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		k, err := newDataKey(string(b))
+		if err != nil {
+			return fmt.Errorf("old data key %s: %w", path, err)
+		}
+		openKeys[string(k.id)] = k
+	}
+	return nil
+}
+
+// Encrypted returns true if new private data is being encrypted.
+func Encrypted() bool {
+	return sealKey != nil
+}
+
+// seal encrypts a value of the user if encryption is on, and returns it
+// unchanged otherwise. The user and the kind of value, like "following", are
+// authenticated with it, so it can't be moved to another row.
+func seal(plaintext []byte, kind, username string) ([]byte, error) {
+	if sealKey == nil {
+		return plaintext, nil
+	}
+
+	dek := make([]byte, dataKeySize)
+	if _, err := io.ReadFull(rand.Reader, dek); err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(dek)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]byte, 0, sealHeaderSize+len(plaintext)+aead.Overhead())
+	out = append(out, sealMagic...)
+	out = append(out, sealKey.id...)
+	out, err = wrapKey(out, sealKey, dek)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	out = append(out, nonce...)
+	return aead.Seal(out, nonce, plaintext, []byte(kind+"/"+username)), nil
+}
+
+// unseal decrypts a value made by seal. Plaintext values are returned as is.
+func unseal(data []byte, kind, username string) ([]byte, error) {
+	if !bytes.HasPrefix(data, sealMagic) {
+		return data, nil
+	}
+	if len(data) < sealHeaderSize {
+		return nil, errors.New("encrypted value is too short")
+	}
+
+	dek, err := unwrapKey(data)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(dek)
+	if err != nil {
+		return nil, err
+	}
+	nonce := data[sealHeaderSize-12 : sealHeaderSize]
+	plaintext, err := aead.Open(nil, nonce, data[sealHeaderSize:], []byte(kind+"/"+username))
+	if err != nil {
+		return nil, fmt.Errorf("decrypting %s of %s: %w", kind, username, err)
+	}
+	return plaintext, nil
+}
+
+// wrapKey appends the data key encrypted with k to out.
+func wrapKey(out []byte, k *dataKey, dek []byte) ([]byte, error) {
+	nonce := make([]byte, k.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	out = append(out, nonce...)
+	return k.aead.Seal(out, nonce, dek, k.id), nil
+}
+
+// unwrapKey returns the data key of a sealed value.
+func unwrapKey(data []byte) ([]byte, error) {
+	id := data[len(sealMagic) : len(sealMagic)+keyIDSize]
+	k, ok := openKeys[string(id)]
+	if !ok {
+		return nil, ErrNoDataKey
+	}
+	wrapped := data[len(sealMagic)+keyIDSize : len(sealMagic)+keyIDSize+wrappedKeySize]
+	dek, err := k.aead.Open(nil, wrapped[:12], wrapped[12:], k.id)
+	if err != nil {
+		return nil, fmt.Errorf("decrypting data key: %w", err)
+	}
+	return dek, nil
+}
+
+// rekeyValue returns the value as it should be stored with the current keys:
+// sealed values get their data key wrapped with sealKey, plaintext ones are
+// sealed. If encryption is off, values are decrypted. The second return value
+// is false if nothing changed.
+func rekeyValue(data []byte, kind, username string) ([]byte, bool, error) {
+	sealed := bytes.HasPrefix(data, sealMagic)
+	switch {
+	case !sealed && sealKey == nil:
+		return data, false, nil
+	case !sealed:
+		out, err := seal(data, kind, username)
+		return out, true, err
+	case sealKey == nil:
+		out, err := unseal(data, kind, username)
+		return out, true, err
+	}
+
+	if len(data) < sealHeaderSize {
+		return nil, false, errors.New("encrypted value is too short")
+	}
+	if bytes.Equal(data[len(sealMagic):len(sealMagic)+keyIDSize], sealKey.id) {
+		return data, false, nil
+	}
+	dek, err := unwrapKey(data)
+	if err != nil {
+		return nil, false, fmt.Errorf("%s of %s: %w", kind, username, err)
+	}
+	out := make([]byte, 0, len(data))
+	out = append(out, sealMagic...)
+	out = append(out, sealKey.id...)
+	out, err = wrapKey(out, sealKey, dek)
+	if err != nil {
+		return nil, false, err
+	}
+	// The data nonce and ciphertext stay the same
+	return append(out, data[sealHeaderSize-12:]...), true, nil
+}
+
+// Rekey brings all private data in line with the configured keys. Values
+// sealed with an old key are moved to the current key, plaintext values are
+// encrypted, and if there's no current key everything is decrypted. It
+// returns the number of values changed.
+//
+// The server must be stopped first, the caller should hold LockDataDir. The
+// server only loads the keys when it starts, so it would keep encrypting with
+// the old key, and couldn't read values moved to a new one. Everything happens in one transaction, so a failure leaves
+// the data as it was. Afterwards the database is vacuumed, so old copies of
+// the values don't stay in unused pages of the file.
+func Rekey() (int, error) {
+	changed := 0
+	err := WithTx(func(tx *Tx) error {
+		changed = 0
+		for _, c := range []struct {
+			kind, table, column string
+		}{
+			{"following", "following", "usernames"},
+			{"list", "lists", "usernames"},
+			{"history", "status_history", "status"},
+		} {
+			n, err := rekeyColumn(tx, c.kind, c.table, c.column)
+			if err != nil {
+				return err
+			}
+			changed += n
+		}
+		return nil
+	})
+	if err != nil {
+		return changed, err
+	}
+
+	if _, err := db.Exec(`VACUUM`); err != nil {
+		return changed, err
+	}
+	_, err = db.Exec(`PRAGMA wal_checkpoint(TRUNCATE)`)
+	return changed, err
+}
+
+func rekeyColumn(tx *Tx, kind, table, column string) (int, error) {
+	type update struct {
+		rowid int64
+		value []byte
+	}
+	var updates []update
+
+	rows, err := tx.Query(`SELECT rowid, username, ` + column + ` FROM ` + table)
+	if err != nil {
+		return 0, err
+	}
+	for rows.Next() {
+		var rowid int64
+		var username string
+		var value []byte
+		if err := rows.Scan(&rowid, &username, &value); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		out, changed, err := rekeyValue(value, kind, username)
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+		if changed {
+			updates = append(updates, update{rowid, out})
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, u := range updates {
+		_, err := tx.Exec(`UPDATE `+table+` SET `+column+`=? WHERE rowid=?`, u.value, u.rowid)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(updates), nil
+}
@@ -0,0 +1,103 @@
+package db
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/makeworld-the-better-one/whatsup/config"
+	"github.com/makeworld-the-better-one/whatsup/model"
+)
+
+// setTestKey makes a new data key and configures it for the next
+// openTestDB.
+func setTestKey(t *testing.T) {
+	t.Helper()
+
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "data.key")
+	if err := os.WriteFile(path, []byte(base64.StdEncoding.EncodeToString(key)), 0600); err != nil {
+		t.Fatal(err)
+	}
+	keyFile := config.Conf.Data.KeyFile
+	config.Conf.Data.KeyFile = path
+	t.Cleanup(func() { config.Conf.Data.KeyFile = keyFile })
+}
+
+func TestEncryptedOnDisk(t *testing.T) {
+	setTestKey(t)
+	openTestDB(t, "sqlite", "alice")
+	if !Encrypted() {
+		t.Fatal("key not loaded")
+	}
+
+	// Followed usernames are what must not leak. The status itself isn't
+	// private, it's in the statuses table as is.
+	secrets := []string{"secretfriend@remote.example", "otherfriend@remote.example"}
+	status := "new status"
+
+	_, err := Default.UpdateFollowing("alice", func(fw *model.Following) error {
+		fw.Usernames[secrets[0]] = struct{}{}
+		fw.Usernames[secrets[1]] = struct{}{}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Default.CreateList("alice", "friends"); err != nil {
+		t.Fatal(err)
+	}
+	_, err = Default.UpdateList("alice", "friends", func(list *model.List, following model.FollowingUsernames) error {
+		list.Usernames[secrets[0]] = struct{}{}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Default.SetUser("alice", &model.Status{Status: &status}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Everything still reads back
+	fw, err := Default.GetFollowing("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := fw.Usernames[secrets[1]]; !ok {
+		t.Errorf("following is %v", fw.Usernames)
+	}
+	got, err := Default.GetList("alice", "friends")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := got.Usernames[secrets[0]]; !ok {
+		t.Errorf("list is %v", got.Usernames)
+	}
+	history, err := Default.GetHistory("alice", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) == 0 || *history[0].Status.Status != status {
+		t.Errorf("history is %v", history)
+	}
+
+	// Neither the database nor the WAL, where the writes are until a
+	// checkpoint, contain any of it
+	for _, name := range []string{"data.db", "data.db-wal"} {
+		b, err := os.ReadFile(filepath.Join(config.Conf.Data.Dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, s := range secrets {
+			if bytes.Contains(b, []byte(s)) {
+				t.Errorf("%s contains %q", name, s)
+			}
+		}
+	}
+}
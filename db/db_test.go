@@ -0,0 +1,45 @@
+package db
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/makeworld-the-better-one/whatsup/config"
+)
+
+// openTestDB sets up the database in a temporary data dir, with the given
+// driver and users. It's closed when the test ends. Tests using it can't run
+// in parallel, since the database is global.
+func openTestDB(t *testing.T, driver string, users ...string) {
+	t.Helper()
+
+	conf := config.Conf
+	t.Cleanup(func() { config.Conf = conf })
+
+	config.Conf.Data = config.DataConf{
+		Dir:         t.TempDir(),
+		Driver:      driver,
+		Readers:     2,
+		BusyTimeout: config.Duration{Duration: 5 * time.Second},
+		KeyFile:     conf.Data.KeyFile,
+	}
+	config.Conf.Cache = config.CacheConf{}
+	config.Conf.Users = make(map[string]string, len(users))
+	for _, u := range users {
+		config.Conf.Users[u] = ""
+	}
+
+	if err := os.Mkdir(filepath.Join(config.Conf.Data.Dir, "avatars"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := Init(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := Close(); err != nil {
+			t.Error(err)
+		}
+	})
+}
@@ -0,0 +1,94 @@
+package db
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+
+	"github.com/makeworld-the-better-one/whatsup/model"
+)
+
+// MaxHistory is how many past statuses are kept for each user.
+const MaxHistory = 1000
+
+// HistoryStore keeps the past statuses of users, up to MaxHistory each.
+type HistoryStore interface {
+	// AddHistory records the status as the newest entry in the user's
+	// history, and removes the oldest entries over MaxHistory. It's called
+	// by the hooks of WithHooks.
+	AddHistory(username string, status *model.Status) error
+
+	// GetHistory returns the user's past statuses, newest first, up to limit
+	// entries. The first entry is the current status.
+	GetHistory(username string, limit int) ([]*model.StatusEntry, error)
+}
+
+func (s *SQLiteStore) AddHistory(username string, status *model.Status) error {
+	snapshot, err := json.Marshal(status)
+	if err != nil {
+		return err
+	}
+	snapshot, err = seal(snapshot, "history", username)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`
+	INSERT INTO status_history (username, created_at, status)
+	VALUES (?,?,?)
+	`, username, status.UpdatedAt.UTC(), snapshot)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`
+	DELETE FROM status_history WHERE username=? AND id NOT IN
+	(SELECT id FROM status_history WHERE username=? ORDER BY id DESC LIMIT ?)
+	`, username, username, MaxHistory)
+	return err
+}
+
+func (s *SQLiteStore) GetHistory(username string, limit int) ([]*model.StatusEntry, error) {
+	rows, err := db.Query(`
+	SELECT id, created_at, status FROM status_history
+	WHERE username=? ORDER BY id DESC LIMIT ?
+	`, username, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []*model.StatusEntry
+	for rows.Next() {
+		var snapshot []byte
+		e := &model.StatusEntry{Username: username, Status: &model.Status{}}
+		if err := rows.Scan(&e.ID, &e.CreatedAt, &snapshot); err != nil {
+			return nil, err
+		}
+		snapshot, err = unseal(snapshot, "history", username)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(snapshot, e.Status); err != nil {
+			return nil, err
+		}
+		e.Status.UpdatedAt = e.CreatedAt
+		splitAvatarNum(e.Status.Avatar)
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// splitAvatarNum moves the avatar number from the query string of the avatar
+// paths, where it is in JSON, back into Num.
+func splitAvatarNum(av *model.AvatarMap) {
+	if av == nil {
+		return
+	}
+	num := 0
+	for k, v := range av.Paths {
+		if i := strings.LastIndexByte(v, '?'); i != -1 {
+			num, _ = strconv.Atoi(v[i+1:])
+			av.Paths[k] = v[:i]
+		}
+	}
+	av.Num = &num
+}
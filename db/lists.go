@@ -0,0 +1,250 @@
+package db
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/makeworld-the-better-one/whatsup/model"
+)
+
+// ErrExists is returned when an object that is being created already exists.
+var ErrExists = errors.New("object already exists in database")
+
+// ListStore keeps the follow lists of users, which group some of the
+// usernames they follow.
+type ListStore interface {
+	// GetLists returns all the follow lists owned by the given username,
+	// sorted by name.
+	GetLists(username string) ([]*model.List, error)
+
+	// GetList returns the follow list with the given name.
+	// Returns ErrNotFound if the list doesn't exist.
+	GetList(username, name string) (*model.List, error)
+
+	// CreateList creates a new empty follow list.
+	// Returns ErrExists if a list with that name already exists.
+	CreateList(username, name string) error
+
+	// UpdateList changes the follow list with the given name. fn is called
+	// with the list and the usernames the user follows, and can change the
+	// name and usernames of the list. The list is saved unless fn returns an
+	// error, which is returned as is.
+	//
+	// Reading the list and following list and saving the list is one atomic
+	// step, so the following list can't change under fn. fn must not use
+	// the Store.
+	//
+	// Returns ErrNotFound if the list doesn't exist, and ErrExists if it was
+	// renamed and there is already a list with the new name.
+	UpdateList(username, name string, fn func(list *model.List, following model.FollowingUsernames) error) (*model.List, error)
+
+	// DeleteList deletes a follow list.
+	// Returns ErrNotFound if the list doesn't exist.
+	DeleteList(username, name string) error
+}
+
+func (s *SQLiteStore) GetLists(username string) ([]*model.List, error) {
+	rows, err := db.Query(`
+	SELECT name, updated_at, usernames
+	FROM lists
+	WHERE username=?
+	ORDER BY name
+	`, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	lists := make([]*model.List, 0)
+	for rows.Next() {
+		list := model.List{Usernames: model.NewFollowingUsernames()}
+		var jsonArray []byte
+
+		if err := rows.Scan(&list.Name, &list.UpdatedAt, &jsonArray); err != nil {
+			return nil, err
+		}
+		jsonArray, err = unseal(jsonArray, "list", username)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(jsonArray, &list.Usernames); err != nil {
+			return nil, err
+		}
+		lists = append(lists, &list)
+	}
+	return lists, rows.Err()
+}
+
+func (s *SQLiteStore) GetList(username, name string) (*model.List, error) {
+	row := db.QueryRow(`
+	SELECT updated_at, usernames
+	FROM lists
+	WHERE username=? AND name=?
+	`, username, name)
+
+	list := model.List{Name: name, Usernames: model.NewFollowingUsernames()}
+	var jsonArray []byte
+
+	err := row.Scan(&list.UpdatedAt, &jsonArray)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	jsonArray, err = unseal(jsonArray, "list", username)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(jsonArray, &list.Usernames); err != nil {
+		return nil, err
+	}
+	return &list, nil
+}
+
+func (s *SQLiteStore) CreateList(username, name string) error {
+	jsonArray, err := seal([]byte(`[]`), "list", username)
+	if err != nil {
+		return err
+	}
+	res, err := db.Exec(`
+	INSERT OR IGNORE INTO lists
+	(username, name, updated_at, usernames)
+	VALUES (?,?,?,?)
+	`, username, name, time.Now(), jsonArray)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrExists
+	}
+	return nil
+}
+
+func (s *SQLiteStore) UpdateList(username, name string, fn func(list *model.List, following model.FollowingUsernames) error) (*model.List, error) {
+	list := &model.List{Name: name, Usernames: model.NewFollowingUsernames()}
+	err := WithTx(func(tx *Tx) error {
+		var jsonArray []byte
+		err := tx.QueryRow(`
+		SELECT usernames
+		FROM lists
+		WHERE username=? AND name=?
+		`, username, name).Scan(&jsonArray)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrNotFound
+		}
+		if err != nil {
+			return err
+		}
+		jsonArray, err = unseal(jsonArray, "list", username)
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(jsonArray, &list.Usernames); err != nil {
+			return err
+		}
+
+		following := model.NewFollowingUsernames()
+		err = tx.QueryRow(`SELECT usernames FROM following WHERE username=?`, username).Scan(&jsonArray)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrNotFound
+		}
+		if err != nil {
+			return err
+		}
+		jsonArray, err = unseal(jsonArray, "following", username)
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(jsonArray, &following); err != nil {
+			return err
+		}
+
+		if err := fn(list, following); err != nil {
+			return err
+		}
+
+		if list.Name != name {
+			var n int
+			err := tx.QueryRow(`SELECT COUNT(*) FROM lists WHERE username=? AND name=?`,
+				username, list.Name).Scan(&n)
+			if err != nil {
+				return err
+			}
+			if n > 0 {
+				return ErrExists
+			}
+		}
+
+		jsonArray, err = json.Marshal(&list.Usernames)
+		if err != nil {
+			return err
+		}
+		jsonArray, err = seal(jsonArray, "list", username)
+		if err != nil {
+			return err
+		}
+		list.UpdatedAt = time.Now()
+		_, err = tx.Exec(`
+		UPDATE lists
+		SET name=?, updated_at=?, usernames=?
+		WHERE username=? AND name=?
+		`, list.Name, list.UpdatedAt, jsonArray, username, name)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+func (s *SQLiteStore) DeleteList(username, name string) error {
+	res, err := db.Exec(`DELETE FROM lists WHERE username=? AND name=?`, username, name)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// pruneLists removes any usernames from the user's lists that aren't in
+// the provided following usernames.
+func pruneLists(st Store, username string, following model.FollowingUsernames) error {
+	lists, err := st.GetLists(username)
+	if err != nil {
+		return err
+	}
+	for _, list := range lists {
+		changed := false
+		for u := range list.Usernames {
+			if _, ok := following[u]; !ok {
+				changed = true
+				break
+			}
+		}
+		if !changed {
+			continue
+		}
+		_, err := st.UpdateList(username, list.Name, func(list *model.List, _ model.FollowingUsernames) error {
+			for u := range list.Usernames {
+				if _, ok := following[u]; !ok {
+					delete(list.Usernames, u)
+				}
+			}
+			return nil
+		})
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package db
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/makeworld-the-better-one/whatsup/model"
+)
+
+func TestUpdateList(t *testing.T) {
+	testStores(t, func(t *testing.T, s Store) {
+		alice := testUsername("alice")
+		if err := s.CreateUser(alice); err != nil {
+			t.Fatal(err)
+		}
+
+		const friend = "friend@remote.example"
+		_, err := s.UpdateFollowing(alice, func(fw *model.Following) error {
+			fw.Usernames[friend] = struct{}{}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range []string{"work", "family"} {
+			if err := s.CreateList(alice, name); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := s.CreateList(alice, "work"); !errors.Is(err, ErrExists) {
+			t.Errorf("creating existing list: got %v, want ErrExists", err)
+		}
+
+		// Renaming and adding happen together
+		list, err := s.UpdateList(alice, "work", func(list *model.List, following model.FollowingUsernames) error {
+			if _, ok := following[friend]; !ok {
+				t.Errorf("following is %v", following)
+			}
+			list.Name = "job"
+			list.Usernames[friend] = struct{}{}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if list.Name != "job" || list.UpdatedAt.IsZero() {
+			t.Errorf("returned list is %+v", list)
+		}
+		if _, err := s.GetList(alice, "work"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("old name: got %v, want ErrNotFound", err)
+		}
+		got, err := s.GetList(alice, "job")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := got.Usernames[friend]; !ok {
+			t.Errorf("list is %v", got.Usernames)
+		}
+		lists, err := s.GetLists(alice)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(lists) != 2 || lists[0].Name != "family" || lists[1].Name != "job" {
+			t.Errorf("lists are %+v", lists)
+		}
+
+		// A failed update changes nothing
+		errTest := errors.New("test")
+		_, err = s.UpdateList(alice, "job", func(list *model.List, following model.FollowingUsernames) error {
+			list.Name = "other"
+			delete(list.Usernames, friend)
+			return errTest
+		})
+		if !errors.Is(err, errTest) {
+			t.Errorf("got %v, want the error from fn", err)
+		}
+		got, err = s.GetList(alice, "job")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := got.Usernames[friend]; !ok {
+			t.Errorf("list changed by failed update: %v", got.Usernames)
+		}
+
+		// Renaming to an existing list fails, and so does a missing list
+		_, err = s.UpdateList(alice, "job", func(list *model.List, following model.FollowingUsernames) error {
+			list.Name = "family"
+			return nil
+		})
+		if !errors.Is(err, ErrExists) {
+			t.Errorf("rename to existing: got %v, want ErrExists", err)
+		}
+		_, err = s.UpdateList(alice, "missing", func(list *model.List, following model.FollowingUsernames) error {
+			return nil
+		})
+		if !errors.Is(err, ErrNotFound) {
+			t.Errorf("missing list: got %v, want ErrNotFound", err)
+		}
+
+		// Unfollowing removes the user from lists, through the hooks
+		_, err = WithHooks(s).UpdateFollowing(alice, func(fw *model.Following) error {
+			delete(fw.Usernames, friend)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, err := s.GetList(alice, "job"); err != nil || len(got.Usernames) != 0 {
+			t.Errorf("list after unfollowing is %v, %v", got, err)
+		}
+
+		if err := s.DeleteList(alice, "job"); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.DeleteList(alice, "job"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("deleting again: got %v, want ErrNotFound", err)
+		}
+	})
+}
@@ -0,0 +1,38 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/makeworld-the-better-one/whatsup/config"
+)
+
+// LockName is the file in the data dir that the server holds a lock on while
+// it runs.
+const LockName = "server.lock"
+
+// ErrLocked is returned by LockDataDir when the lock is already held, by a
+// running server or a command that can't run alongside one.
+var ErrLocked = errors.New("the data dir is in use by a running server")
+
+// LockDataDir takes the exclusive lock on the data dir. The server holds it
+// while it runs, and commands that must not run at the same time take it
+// too, so whichever comes second gets ErrLocked. The lock is released by
+// unlock, or when the process exits.
+func LockDataDir() (unlock func() error, err error) {
+	p := filepath.Join(config.Conf.Data.Dir, LockName)
+	f, err := os.OpenFile(p, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := lockFile(f); err != nil {
+		f.Close()
+		if errors.Is(err, ErrLocked) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("locking %s: %w", p, err)
+	}
+	return f.Close, nil
+}
@@ -0,0 +1,26 @@
+package db
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestLockDataDir(t *testing.T) {
+	openTestDB(t, "sqlite")
+
+	unlock, err := LockDataDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LockDataDir(); !errors.Is(err, ErrLocked) {
+		t.Errorf("locking twice: got %v, want ErrLocked", err)
+	}
+	if err := unlock(); err != nil {
+		t.Fatal(err)
+	}
+	unlock, err = LockDataDir()
+	if err != nil {
+		t.Fatalf("locking after unlocking: %v", err)
+	}
+	unlock()
+}
@@ -0,0 +1,844 @@
+package db
+
+import (
+	"encoding/json"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/makeworld-the-better-one/whatsup/config"
+	"github.com/makeworld-the-better-one/whatsup/model"
+)
+
+// MemoryStore is the Store that keeps everything in memory, and loses it when
+// the server stops. It's meant for trying things out and for tests.
+type MemoryStore struct {
+	mu    sync.Mutex
+	users map[string]*memoryUser
+
+	// Values are copied in and out, so callers can't change stored data
+	lists      map[string]map[string]*memoryList // By username, then name
+	privacy    map[string][]byte                 // JSON, like the database column
+	accounts   map[string]model.Account
+	deleted    map[string]bool
+	sessions   map[string]model.Session
+	history    map[string][]*memoryHistory // Oldest first
+	webhooks   map[int64]*model.Webhook
+	deliveries map[int64]*model.WebhookDelivery
+	lastID     int64 // For history, webhooks, and deliveries
+}
+
+type memoryUser struct {
+	status             model.Status
+	avatar             string
+	avatarNum          int
+	following          []byte // JSON, like the database column
+	followingUpdatedAt time.Time
+}
+
+type memoryList struct {
+	updatedAt time.Time
+	usernames []byte // JSON
+}
+
+type memoryHistory struct {
+	id        int64
+	createdAt time.Time
+	status    []byte // JSON
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		users:      make(map[string]*memoryUser),
+		lists:      make(map[string]map[string]*memoryList),
+		privacy:    make(map[string][]byte),
+		accounts:   make(map[string]model.Account),
+		deleted:    make(map[string]bool),
+		sessions:   make(map[string]model.Session),
+		history:    make(map[string][]*memoryHistory),
+		webhooks:   make(map[int64]*model.Webhook),
+		deliveries: make(map[int64]*model.WebhookDelivery),
+	}
+}
+
+// nextID returns a new ID. The caller must hold s.mu.
+func (s *MemoryStore) nextID() int64 {
+	s.lastID++
+	return s.lastID
+}
+
+func (s *MemoryStore) CreateUser(username string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.accounts[username]; !ok {
+		s.accounts[username] = *newAccount(username)
+	}
+	if _, ok := s.users[username]; ok {
+		return nil
+	}
+	empty := ""
+	zero := 0
+	now := time.Now()
+	s.users[username] = &memoryUser{
+		status: model.Status{
+			Name: &empty, Status: &empty, Emoji: &empty, Media: &empty, MediaType: &zero, URI: &empty,
+			UpdatedAt: now,
+		},
+		following:          []byte(`[]`),
+		followingUpdatedAt: now,
+	}
+	return nil
+}
+
+func (s *MemoryStore) GetUser(username string) (*model.Status, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := s.users[username]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return u.copyStatus(), nil
+}
+
+func (s *MemoryStore) GetUsers(usernames []string) (map[string]*model.Status, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	statuses := make(map[string]*model.Status, len(usernames))
+	for _, username := range usernames {
+		if u, ok := s.users[username]; ok {
+			statuses[username] = u.copyStatus()
+		}
+	}
+	return statuses, nil
+}
+
+// copyStatus copies everything so callers can't change the stored status.
+func (u *memoryUser) copyStatus() *model.Status {
+	name, text, emoji, media, mediaType, uri := *u.status.Name, *u.status.Status,
+		*u.status.Emoji, *u.status.Media, *u.status.MediaType, *u.status.URI
+	num := u.avatarNum
+	return &model.Status{
+		Avatar:    &model.AvatarMap{Paths: map[string]string{"original": u.avatar}, Num: &num},
+		Name:      &name,
+		Status:    &text,
+		Emoji:     &emoji,
+		Media:     &media,
+		MediaType: &mediaType,
+		URI:       &uri,
+		UpdatedAt: u.status.UpdatedAt,
+	}
+}
+
+func (s *MemoryStore) SetUser(username string, data *model.Status) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.setUser(username, data)
+}
+
+// setUser is SetUser with s.mu already locked.
+func (s *MemoryStore) setUser(username string, data *model.Status) error {
+	u, ok := s.users[username]
+	if !ok {
+		// Like an UPDATE that matches no rows
+		return nil
+	}
+
+	if data.Avatar != nil {
+		u.avatar = data.Avatar.Paths["original"]
+		if data.Avatar.Num != nil {
+			u.avatarNum = *data.Avatar.Num
+		}
+	}
+	if data.Name != nil {
+		v := *data.Name
+		u.status.Name = &v
+	}
+	if data.Status != nil {
+		v := *data.Status
+		u.status.Status = &v
+	}
+	if data.Emoji != nil {
+		v := *data.Emoji
+		u.status.Emoji = &v
+	}
+	if data.Media != nil {
+		v := *data.Media
+		u.status.Media = &v
+	}
+	if data.MediaType != nil {
+		v := *data.MediaType
+		u.status.MediaType = &v
+	}
+	if data.URI != nil {
+		v := *data.URI
+		u.status.URI = &v
+	}
+	u.status.UpdatedAt = time.Now()
+	return nil
+}
+
+func (s *MemoryStore) SetAvatar(username string, img []byte) error {
+	if err := writeAvatar(username, img); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[username]
+	if !ok {
+		log.Printf("SetAvatar: no user %s", username)
+		return ErrNotFound
+	}
+	num := u.avatarNum + 1
+	return s.setUser(username, &model.Status{Avatar: &model.AvatarMap{Paths: avatarPaths(username), Num: &num}})
+}
+
+func (s *MemoryStore) RemoveAvatar(username string) error {
+	if err := deleteAvatar(username); err != nil {
+		return err
+	}
+	return s.SetUser(username, &model.Status{Avatar: &model.AvatarMap{Paths: map[string]string{}}})
+}
+
+func (s *MemoryStore) GetFollowing(username string) (*model.Following, error) {
+	jsonArray, updatedAt, err := s.GetFollowingRaw(username)
+	if err != nil {
+		return nil, err
+	}
+
+	fw := model.Following{UpdatedAt: updatedAt, Usernames: model.NewFollowingUsernames()}
+	if err := json.Unmarshal(jsonArray, &fw.Usernames); err != nil {
+		return nil, err
+	}
+	return &fw, nil
+}
+
+func (s *MemoryStore) GetFollowingRaw(username string) ([]byte, time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := s.users[username]
+	if !ok {
+		return nil, time.Time{}, ErrNotFound
+	}
+	return append([]byte{}, u.following...), u.followingUpdatedAt, nil
+}
+
+func (s *MemoryStore) SetFollowing(username string, data *model.Following) error {
+	if data.Usernames == nil {
+		return nil
+	}
+
+	jsonArray, err := json.Marshal(&data.Usernames)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if u, ok := s.users[username]; ok {
+		u.following = jsonArray
+		u.followingUpdatedAt = time.Now()
+	}
+	return nil
+}
+
+func (s *MemoryStore) UpdateFollowing(username string, fn func(fw *model.Following) error) (*model.Following, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := s.users[username]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	fw := &model.Following{UpdatedAt: u.followingUpdatedAt, Usernames: model.NewFollowingUsernames()}
+	if err := json.Unmarshal(u.following, &fw.Usernames); err != nil {
+		return nil, err
+	}
+	if err := fn(fw); err != nil {
+		return nil, err
+	}
+	jsonArray, err := json.Marshal(&fw.Usernames)
+	if err != nil {
+		return nil, err
+	}
+	fw.UpdatedAt = time.Now()
+	u.following = jsonArray
+	u.followingUpdatedAt = fw.UpdatedAt
+	return fw, nil
+}
+
+func (s *MemoryStore) AllFollowing() (model.FollowingUsernames, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	all := model.NewFollowingUsernames()
+	for _, u := range s.users {
+		if err := json.Unmarshal(u.following, &all); err != nil {
+			return nil, err
+		}
+	}
+	return all, nil
+}
+
+func (s *MemoryStore) DeleteUser(username string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.users, username)
+	delete(s.lists, username)
+	delete(s.privacy, username)
+	delete(s.history, username)
+	delete(s.accounts, username)
+	for id, session := range s.sessions {
+		if session.Username == username {
+			delete(s.sessions, id)
+		}
+	}
+	for id, wh := range s.webhooks {
+		if wh.Owner == username {
+			s.deleteWebhook(id)
+		}
+	}
+	global := "@" + username + "@" + config.Conf.Server.Domain
+	for id, d := range s.deliveries {
+		var p struct{ Username string }
+		if json.Unmarshal(d.Payload, &p) == nil && p.Username == global {
+			delete(s.deliveries, id)
+		}
+	}
+	s.deleted[username] = true
+	return nil
+}
+
+func (s *MemoryStore) LockUser(username string) (func(), error) {
+	return userLocks.Lock(username), nil
+}
+
+func (s *MemoryStore) Close() error {
+	return nil
+}
+
+func (s *MemoryStore) GetLists(username string) ([]*model.List, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	lists := make([]*model.List, 0, len(s.lists[username]))
+	for name, l := range s.lists[username] {
+		list, err := l.copyList(name)
+		if err != nil {
+			return nil, err
+		}
+		lists = append(lists, list)
+	}
+	sort.Slice(lists, func(i, j int) bool { return lists[i].Name < lists[j].Name })
+	return lists, nil
+}
+
+func (l *memoryList) copyList(name string) (*model.List, error) {
+	list := &model.List{Name: name, UpdatedAt: l.updatedAt, Usernames: model.NewFollowingUsernames()}
+	if err := json.Unmarshal(l.usernames, &list.Usernames); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+func (s *MemoryStore) GetList(username, name string) (*model.List, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	l, ok := s.lists[username][name]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return l.copyList(name)
+}
+
+func (s *MemoryStore) CreateList(username, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.lists[username][name]; ok {
+		return ErrExists
+	}
+	if s.lists[username] == nil {
+		s.lists[username] = make(map[string]*memoryList)
+	}
+	s.lists[username][name] = &memoryList{updatedAt: time.Now(), usernames: []byte(`[]`)}
+	return nil
+}
+
+func (s *MemoryStore) UpdateList(username, name string, fn func(list *model.List, following model.FollowingUsernames) error) (*model.List, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	l, ok := s.lists[username][name]
+	u, uok := s.users[username]
+	if !ok || !uok {
+		return nil, ErrNotFound
+	}
+	list, err := l.copyList(name)
+	if err != nil {
+		return nil, err
+	}
+	following := model.NewFollowingUsernames()
+	if err := json.Unmarshal(u.following, &following); err != nil {
+		return nil, err
+	}
+
+	if err := fn(list, following); err != nil {
+		return nil, err
+	}
+	if _, ok := s.lists[username][list.Name]; ok && list.Name != name {
+		return nil, ErrExists
+	}
+	jsonArray, err := json.Marshal(&list.Usernames)
+	if err != nil {
+		return nil, err
+	}
+	list.UpdatedAt = time.Now()
+	delete(s.lists[username], name)
+	s.lists[username][list.Name] = &memoryList{updatedAt: list.UpdatedAt, usernames: jsonArray}
+	return list, nil
+}
+
+func (s *MemoryStore) DeleteList(username, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.lists[username][name]; !ok {
+		return ErrNotFound
+	}
+	delete(s.lists[username], name)
+	return nil
+}
+
+func (s *MemoryStore) GetPrivacy(username string) (*model.Privacy, error) {
+	m, err := s.GetPrivacies([]string{username})
+	if err != nil {
+		return nil, err
+	}
+	return m[username], nil
+}
+
+func (s *MemoryStore) GetPrivacies(usernames []string) (map[string]*model.Privacy, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m := make(map[string]*model.Privacy, len(usernames))
+	for _, u := range usernames {
+		p := model.NewPrivacy()
+		if settings, ok := s.privacy[u]; ok {
+			if err := json.Unmarshal(settings, p); err != nil {
+				return nil, err
+			}
+		}
+		m[u] = p
+	}
+	return m, nil
+}
+
+func (s *MemoryStore) SetPrivacy(username string, p *model.Privacy) error {
+	settings, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.privacy[username] = settings
+	return nil
+}
+
+func (s *MemoryStore) GetAccount(username string) (*model.Account, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	a, ok := s.accounts[username]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &a, nil
+}
+
+func (s *MemoryStore) GetAccounts() ([]*model.Account, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	accounts := make([]*model.Account, 0, len(s.accounts))
+	for _, a := range s.accounts {
+		a := a
+		accounts = append(accounts, &a)
+	}
+	sort.Slice(accounts, func(i, j int) bool { return accounts[i].Username < accounts[j].Username })
+	return accounts, nil
+}
+
+// updateAccount calls fn with the account and stores it.
+// Returns ErrNotFound if the user doesn't exist.
+func (s *MemoryStore) updateAccount(username string, fn func(a *model.Account)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	a, ok := s.accounts[username]
+	if !ok {
+		return ErrNotFound
+	}
+	fn(&a)
+	s.accounts[username] = a
+	return nil
+}
+
+// deleteUserSessions logs the user out everywhere.
+func (s *MemoryStore) deleteUserSessions(username string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id, session := range s.sessions {
+		if session.Username == username {
+			delete(s.sessions, id)
+		}
+	}
+}
+
+func (s *MemoryStore) SetRole(username, role string) error {
+	return s.updateAccount(username, func(a *model.Account) { a.Role = role })
+}
+
+func (s *MemoryStore) SetDisabled(username string, disabled bool) error {
+	if err := s.updateAccount(username, func(a *model.Account) { a.Disabled = disabled }); err != nil {
+		return err
+	}
+	if disabled {
+		s.deleteUserSessions(username)
+	}
+	return nil
+}
+
+func (s *MemoryStore) SetPasswordHash(username, hash string) error {
+	if err := s.updateAccount(username, func(a *model.Account) { a.PasswordHash = hash }); err != nil {
+		return err
+	}
+	s.deleteUserSessions(username)
+	return nil
+}
+
+func (s *MemoryStore) IsDeleted(username string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.deleted[username], nil
+}
+
+func (s *MemoryStore) GetDeleted(usernames []string) (map[string]bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	deleted := make(map[string]bool)
+	for _, u := range usernames {
+		if s.deleted[u] {
+			deleted[u] = true
+		}
+	}
+	return deleted, nil
+}
+
+func (s *MemoryStore) CreateSession(session *model.Session) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sessions[session.ID] = *session
+	return nil
+}
+
+func (s *MemoryStore) GetSession(id string) (*model.Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	session, ok := s.sessions[id]
+	if !ok || !session.ExpiresAt.After(time.Now()) {
+		return nil, ErrNotFound
+	}
+	return &session, nil
+}
+
+func (s *MemoryStore) DeleteSession(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, id)
+	return nil
+}
+
+func (s *MemoryStore) PruneSessions() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for id, session := range s.sessions {
+		if !session.ExpiresAt.After(now) {
+			delete(s.sessions, id)
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) AddHistory(username string, status *model.Status) error {
+	snapshot, err := json.Marshal(status)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entries := append(s.history[username], &memoryHistory{id: s.nextID(), createdAt: status.UpdatedAt, status: snapshot})
+	if len(entries) > MaxHistory {
+		entries = entries[len(entries)-MaxHistory:]
+	}
+	s.history[username] = entries
+	return nil
+}
+
+func (s *MemoryStore) GetHistory(username string, limit int) ([]*model.StatusEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var entries []*model.StatusEntry
+	h := s.history[username]
+	for i := len(h) - 1; i >= 0 && len(entries) < limit; i-- {
+		e := &model.StatusEntry{ID: h[i].id, Username: username, CreatedAt: h[i].createdAt, Status: &model.Status{}}
+		if err := json.Unmarshal(h[i].status, e.Status); err != nil {
+			return nil, err
+		}
+		e.Status.UpdatedAt = e.CreatedAt
+		splitAvatarNum(e.Status.Avatar)
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// copyWebhook copies everything so callers can't change the stored webhook.
+func copyWebhook(wh *model.Webhook) *model.Webhook {
+	c := *wh
+	c.Events = append([]string(nil), wh.Events...)
+	c.Users = append([]string(nil), wh.Users...)
+	return &c
+}
+
+// findWebhooks returns copies of the webhooks fn returns true for, sorted
+// by ID.
+func (s *MemoryStore) findWebhooks(fn func(wh *model.Webhook) bool) []*model.Webhook {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	webhooks := make([]*model.Webhook, 0)
+	for _, wh := range s.webhooks {
+		if fn(wh) {
+			webhooks = append(webhooks, copyWebhook(wh))
+		}
+	}
+	sort.Slice(webhooks, func(i, j int) bool { return webhooks[i].ID < webhooks[j].ID })
+	return webhooks
+}
+
+func (s *MemoryStore) GetWebhooks(username string) ([]*model.Webhook, error) {
+	return s.findWebhooks(func(wh *model.Webhook) bool { return wh.Owner == username }), nil
+}
+
+func (s *MemoryStore) GetEnabledWebhooks() ([]*model.Webhook, error) {
+	return s.findWebhooks(func(wh *model.Webhook) bool { return wh.Enabled }), nil
+}
+
+func (s *MemoryStore) GetWebhook(username string, id int64) (*model.Webhook, error) {
+	webhooks := s.findWebhooks(func(wh *model.Webhook) bool { return wh.ID == id && wh.Owner == username })
+	if len(webhooks) == 0 {
+		return nil, ErrNotFound
+	}
+	return webhooks[0], nil
+}
+
+func (s *MemoryStore) GetWebhookByID(id int64) (*model.Webhook, error) {
+	webhooks := s.findWebhooks(func(wh *model.Webhook) bool { return wh.ID == id })
+	if len(webhooks) == 0 {
+		return nil, ErrNotFound
+	}
+	return webhooks[0], nil
+}
+
+func (s *MemoryStore) CreateWebhook(wh *model.Webhook) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	wh.ID = s.nextID()
+	wh.CreatedAt = time.Now()
+	s.webhooks[wh.ID] = copyWebhook(wh)
+	return nil
+}
+
+func (s *MemoryStore) UpdateWebhook(wh *model.Webhook) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if old, ok := s.webhooks[wh.ID]; ok {
+		c := copyWebhook(wh)
+		old.Secret, old.Events, old.Users = c.Secret, c.Events, c.Users
+	}
+	return nil
+}
+
+func (s *MemoryStore) SetWebhookEnabled(id int64, enabled bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if wh, ok := s.webhooks[id]; ok {
+		wh.Enabled = enabled
+		wh.Failures = 0
+	}
+	return nil
+}
+
+func (s *MemoryStore) DeleteWebhook(username string, id int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if wh, ok := s.webhooks[id]; !ok || wh.Owner != username {
+		return ErrNotFound
+	}
+	s.deleteWebhook(id)
+	return nil
+}
+
+// deleteWebhook deletes a webhook and its deliveries. The caller must hold
+// s.mu.
+func (s *MemoryStore) deleteWebhook(id int64) {
+	delete(s.webhooks, id)
+	for did, d := range s.deliveries {
+		if d.WebhookID == id {
+			delete(s.deliveries, did)
+		}
+	}
+}
+
+func (s *MemoryStore) RecordWebhookResult(id int64, success bool, disableAfter int) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	wh, ok := s.webhooks[id]
+	if !ok {
+		return false, nil
+	}
+	if success {
+		wh.Failures = 0
+		return false, nil
+	}
+	wh.Failures++
+	if wh.Enabled && wh.Failures >= disableAfter {
+		wh.Enabled = false
+		return true, nil
+	}
+	return false, nil
+}
+
+// copyDelivery copies everything so callers can't change the stored delivery.
+func copyDelivery(d *model.WebhookDelivery) *model.WebhookDelivery {
+	c := *d
+	c.Payload = append([]byte(nil), d.Payload...)
+	return &c
+}
+
+func (s *MemoryStore) EnqueueDeliveries(webhookIDs []int64, event string, payload []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now().UTC()
+	for _, id := range webhookIDs {
+		d := &model.WebhookDelivery{
+			ID:          s.nextID(),
+			WebhookID:   id,
+			Event:       event,
+			Payload:     append([]byte(nil), payload...),
+			State:       model.DeliveryPending,
+			NextAttempt: now,
+			CreatedAt:   now,
+			UpdatedAt:   now,
+		}
+		s.deliveries[d.ID] = d
+	}
+	return nil
+}
+
+func (s *MemoryStore) DueDeliveries(limit int) ([]*model.WebhookDelivery, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	var due []*model.WebhookDelivery
+	for _, d := range s.deliveries {
+		if d.State == model.DeliveryPending && !d.NextAttempt.After(now) {
+			due = append(due, d)
+		}
+	}
+	sort.Slice(due, func(i, j int) bool { return due[i].NextAttempt.Before(due[j].NextAttempt) })
+	if len(due) > limit {
+		due = due[:limit]
+	}
+	deliveries := make([]*model.WebhookDelivery, len(due))
+	for i, d := range due {
+		deliveries[i] = copyDelivery(d)
+		d.NextAttempt = now.Add(deliveryClaim)
+	}
+	return deliveries, nil
+}
+
+func (s *MemoryStore) GetDeliveries(webhookID int64, limit int) ([]*model.WebhookDelivery, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	deliveries := make([]*model.WebhookDelivery, 0)
+	for _, d := range s.deliveries {
+		if d.WebhookID == webhookID {
+			deliveries = append(deliveries, copyDelivery(d))
+		}
+	}
+	sort.Slice(deliveries, func(i, j int) bool { return deliveries[i].ID > deliveries[j].ID })
+	if len(deliveries) > limit {
+		deliveries = deliveries[:limit]
+	}
+	return deliveries, nil
+}
+
+func (s *MemoryStore) UpdateDelivery(d *model.WebhookDelivery) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	d.UpdatedAt = time.Now().UTC()
+	if _, ok := s.deliveries[d.ID]; ok {
+		s.deliveries[d.ID] = copyDelivery(d)
+	}
+	return nil
+}
+
+func (s *MemoryStore) PruneDeliveries(before time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id, d := range s.deliveries {
+		if d.State != model.DeliveryPending && d.UpdatedAt.Before(before) {
+			delete(s.deliveries, id)
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) CountPendingDeliveries() (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := 0
+	for _, d := range s.deliveries {
+		if d.State == model.DeliveryPending {
+			n++
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,223 @@
+package db
+
+import (
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schema migrations
+//
+// Each change to the schema is a numbered migration, either an SQL file in
+// migrations/ named like 0002_add_something.sql, or a Go function in
+// goMigrations for changes SQL can't do alone. Versions are shared between
+// the two and must count up from 1 without gaps. Applied versions are
+// recorded in the schema_version table.
+//
+// Every migration runs in its own transaction, together with recording its
+// version, so a failed migration leaves the database as it was. Released
+// migrations must never be edited, add a new one instead.
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// goMigrations are migrations written in Go.
+var goMigrations = []*Migration{
+	{Version: 3, Name: "websub_callback_host", fn: migrateWebSubCallbackHost},
+}
+
+// Migration is one numbered change to the database schema.
+type Migration struct {
+	Version   int
+	Name      string
+	AppliedAt time.Time // Zero if it hasn't been applied
+
+	sql string
+	fn  func(tx *Tx) error
+}
+
+var ErrSchemaTooNew = errors.New("database schema is newer than this version of whatsup understands")
+
+// loadMigrations returns all known migrations, sorted by version.
+func loadMigrations() ([]*Migration, error) {
+	migrations := make([]*Migration, 0, len(goMigrations))
+	for _, m := range goMigrations {
+		m2 := *m
+		migrations = append(migrations, &m2)
+	}
+
+	files, err := migrationFiles.ReadDir("migrations")
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		name := strings.TrimSuffix(f.Name(), ".sql")
+		parts := strings.SplitN(name, "_", 2)
+		version, err := strconv.Atoi(parts[0])
+		if err != nil || len(parts) != 2 {
+			return nil, fmt.Errorf("badly named migration file %s", f.Name())
+		}
+		b, err := migrationFiles.ReadFile("migrations/" + f.Name())
+		if err != nil {
+			return nil, err
+		}
+		migrations = append(migrations, &Migration{Version: version, Name: parts[1], sql: string(b)})
+	}
+
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	for i, m := range migrations {
+		if m.Version != i+1 {
+			return nil, fmt.Errorf("migration versions must count up from 1, found %d after %d", m.Version, i)
+		}
+	}
+	return migrations, nil
+}
+
+// Open opens the database and makes sure this version of whatsup can use
+// it. It doesn't change the schema, see Init and Migrate for that.
+// Returns an error wrapping ErrSchemaTooNew if the database was migrated
+// by a newer version of whatsup.
+func Open() error {
+	if err := loadKeys(); err != nil {
+		return err
+	}
+	if err := connect(); err != nil {
+		return err
+	}
+
+	_, err := db.Exec(`
+	CREATE TABLE IF NOT EXISTS schema_version
+	(
+		version INTEGER PRIMARY KEY,
+		name TEXT NOT NULL,
+		applied_at DATETIME NOT NULL
+	)
+	`)
+	if err != nil {
+		return err
+	}
+
+	current, err := SchemaVersion()
+	if err != nil {
+		return err
+	}
+	migrations, err := loadMigrations()
+	if err != nil {
+		return err
+	}
+	if current > len(migrations) {
+		return fmt.Errorf("%w: database is at version %d, latest known is %d",
+			ErrSchemaTooNew, current, len(migrations))
+	}
+	return nil
+}
+
+// SchemaVersion returns the version of the latest applied migration, or
+// zero for a new database.
+func SchemaVersion() (int, error) {
+	var version int
+	err := db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_version`).Scan(&version)
+	return version, err
+}
+
+// LatestSchemaVersion returns the version the database will be at once all
+// migrations known to this version of whatsup are applied.
+func LatestSchemaVersion() (int, error) {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return 0, err
+	}
+	return len(migrations), nil
+}
+
+// Migrations returns all known migrations, with AppliedAt set for the ones
+// that have been applied.
+func Migrations() ([]*Migration, error) {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(`SELECT version, applied_at FROM schema_version`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var version int
+		var appliedAt time.Time
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, err
+		}
+		if version >= 1 && version <= len(migrations) {
+			migrations[version-1].AppliedAt = appliedAt
+		}
+	}
+	return migrations, rows.Err()
+}
+
+// Migrate applies all pending migrations in order, and returns the ones that
+// were applied. It stops at the first one that fails.
+//
+// Each applied migration is logged.
+func Migrate() ([]*Migration, error) {
+	migrations, err := Migrations()
+	if err != nil {
+		return nil, err
+	}
+
+	applied := make([]*Migration, 0)
+	for _, m := range migrations {
+		if !m.AppliedAt.IsZero() {
+			continue
+		}
+		if err := applyMigration(m); err != nil {
+			return applied, fmt.Errorf("migration %d (%s): %w", m.Version, m.Name, err)
+		}
+		log.Printf("applied database migration %d (%s)", m.Version, m.Name)
+		applied = append(applied, m)
+	}
+	return applied, nil
+}
+
+func applyMigration(m *Migration) error {
+	return WithTx(func(tx *Tx) error {
+		var err error
+		if m.fn != nil {
+			err = m.fn(tx)
+		} else {
+			_, err = tx.Exec(m.sql)
+		}
+		if err != nil {
+			return err
+		}
+
+		m.AppliedAt = time.Now().UTC()
+		_, err = tx.Exec(`
+		INSERT INTO schema_version (version, name, applied_at)
+		VALUES (?,?,?)
+		`, m.Version, m.Name, m.AppliedAt)
+		return err
+	})
+}
+
+// FileSchemaVersion returns the schema version of the SQLite database file
+// at path, which isn't the one opened by Open. Used to check backups before
+// restoring them.
+func FileSchemaVersion(path string) (int, error) {
+	f, err := sql.Open("sqlite", path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	var version int
+	err = f.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_version`).Scan(&version)
+	return version, err
+}
@@ -0,0 +1,103 @@
+package db
+
+import (
+	"errors"
+	"testing"
+)
+
+// addMigration adds a Go migration after the known ones, until the test ends.
+func addMigration(t *testing.T, fn func(tx *Tx) error) *Migration {
+	t.Helper()
+	latest, err := LatestSchemaVersion()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &Migration{Version: latest + 1, Name: "test", fn: fn}
+	old := goMigrations
+	goMigrations = append(append([]*Migration(nil), old...), m)
+	t.Cleanup(func() { goMigrations = old })
+	return m
+}
+
+func TestSchemaTooNew(t *testing.T) {
+	openTestDB(t, "sqlite")
+	if err := Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A newer version of whatsup migrates the database
+	old := goMigrations
+	addMigration(t, func(tx *Tx) error {
+		_, err := tx.Exec(`CREATE TABLE newer (id INTEGER PRIMARY KEY)`)
+		return err
+	})
+	if err := Open(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// And this one won't use it
+	goMigrations = old
+	if err := Open(); !errors.Is(err, ErrSchemaTooNew) {
+		t.Errorf("got %v, want ErrSchemaTooNew", err)
+	}
+}
+
+func TestMigrationRollback(t *testing.T) {
+	errTest := errors.New("test")
+	tests := []struct {
+		name string
+		fn   func(tx *Tx) error
+	}{
+		{"migration fails", func(tx *Tx) error {
+			if _, err := tx.Exec(`CREATE TABLE partial (id INTEGER PRIMARY KEY)`); err != nil {
+				return err
+			}
+			if _, err := tx.Exec(`INSERT INTO partial (id) VALUES (1)`); err != nil {
+				return err
+			}
+			return errTest
+		}},
+		{"recording the version fails", func(tx *Tx) error {
+			if _, err := tx.Exec(`CREATE TABLE partial (id INTEGER PRIMARY KEY)`); err != nil {
+				return err
+			}
+			// Taken already when the version is recorded
+			_, err := tx.Exec(`INSERT INTO schema_version (version, name, applied_at) VALUES ((SELECT MAX(version) + 1 FROM schema_version), 'early', CURRENT_TIMESTAMP)`)
+			return err
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			openTestDB(t, "sqlite")
+			before, err := SchemaVersion()
+			if err != nil {
+				t.Fatal(err)
+			}
+			m := addMigration(t, tt.fn)
+
+			if _, err := Migrate(); err == nil {
+				t.Fatal("no error")
+			}
+			if after, err := SchemaVersion(); err != nil || after != before {
+				t.Errorf("schema version is %d, was %d: %v", after, before, err)
+			}
+			var n int
+			if err := db.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE name='partial'`).Scan(&n); err != nil || n != 0 {
+				t.Errorf("table of the failed migration exists: %v", err)
+			}
+			migrations, err := Migrations()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if last := migrations[len(migrations)-1]; last.Version != m.Version || !last.AppliedAt.IsZero() {
+				t.Errorf("last migration is %+v", last)
+			}
+		})
+	}
+}
@@ -0,0 +1,128 @@
+-- Tables from before schema versioning. Everything is IF NOT EXISTS, so this
+-- also works for databases created by older versions of whatsup.
+
+CREATE TABLE IF NOT EXISTS statuses
+(
+	username TEXT PRIMARY KEY,
+	updated_at DATETIME NOT NULL,
+	avatar TEXT NOT NULL,
+	avatar_num INT NOT NULL,
+	name TEXT NOT NULL,
+	status TEXT NOT NULL,
+	emoji TEXT NOT NULL,
+	media TEXT NOT NULL,
+	media_type INT NOT NULL,
+	uri TEXT NOT NULL
+);
+
+-- Table for following API
+-- "usernames" column is JSON array of global usernames
+CREATE TABLE IF NOT EXISTS following
+(
+	username TEXT PRIMARY KEY,
+	updated_at DATETIME NOT NULL,
+	usernames BLOB NOT NULL
+);
+
+-- Table for follow lists
+-- "usernames" column is JSON array of global usernames, like the following table
+CREATE TABLE IF NOT EXISTS lists
+(
+	username TEXT NOT NULL,
+	name TEXT NOT NULL,
+	updated_at DATETIME NOT NULL,
+	usernames BLOB NOT NULL,
+	PRIMARY KEY (username, name)
+);
+
+-- Existence state of remote users, for validating the following list
+CREATE TABLE IF NOT EXISTS remote_users
+(
+	username TEXT PRIMARY KEY,
+	state TEXT NOT NULL,
+	checked_at DATETIME NOT NULL
+);
+
+-- Privacy settings, "settings" column is JSON of model.Privacy
+CREATE TABLE IF NOT EXISTS privacy
+(
+	username TEXT PRIMARY KEY,
+	updated_at DATETIME NOT NULL,
+	settings BLOB NOT NULL
+);
+
+-- Webhooks, "events" and "users" columns are JSON arrays of strings
+CREATE TABLE IF NOT EXISTS webhooks
+(
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	owner TEXT NOT NULL,
+	url TEXT NOT NULL,
+	secret TEXT NOT NULL,
+	events BLOB NOT NULL,
+	users BLOB NOT NULL,
+	enabled BOOLEAN NOT NULL,
+	failures INT NOT NULL,
+	created_at DATETIME NOT NULL
+);
+
+-- Queue and log of webhook deliveries
+CREATE TABLE IF NOT EXISTS webhook_deliveries
+(
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	webhook_id INT NOT NULL,
+	event TEXT NOT NULL,
+	payload BLOB NOT NULL,
+	state TEXT NOT NULL,
+	attempts INT NOT NULL,
+	next_attempt DATETIME NOT NULL,
+	last_code INT NOT NULL,
+	last_error TEXT NOT NULL,
+	created_at DATETIME NOT NULL,
+	updated_at DATETIME NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS webhook_deliveries_due
+ON webhook_deliveries (state, next_attempt);
+
+CREATE TABLE IF NOT EXISTS status_history
+(
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	username TEXT NOT NULL,
+	created_at DATETIME NOT NULL,
+	status BLOB NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS status_history_username
+ON status_history (username, id);
+
+CREATE TABLE IF NOT EXISTS sessions
+(
+	id TEXT PRIMARY KEY,
+	username TEXT NOT NULL,
+	csrf TEXT NOT NULL,
+	created_at DATETIME NOT NULL,
+	expires_at DATETIME NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS websub_subscriptions
+(
+	username TEXT NOT NULL,
+	callback TEXT NOT NULL,
+	secret TEXT NOT NULL,
+	requester_server TEXT NOT NULL,
+	requester_user TEXT NOT NULL,
+	expires DATETIME NOT NULL,
+	created_at DATETIME NOT NULL,
+	PRIMARY KEY (username, callback)
+);
+
+-- Roles and moderation state of local users
+-- "password_hash" is empty unless an admin reset the password
+CREATE TABLE IF NOT EXISTS accounts
+(
+	username TEXT PRIMARY KEY,
+	role TEXT NOT NULL,
+	disabled BOOLEAN NOT NULL,
+	password_hash TEXT NOT NULL,
+	created_at DATETIME NOT NULL
+);
@@ -0,0 +1,7 @@
+-- Tombstones of deleted accounts, so their usernames aren't recreated from
+-- the config and queries for them get 410 Gone
+CREATE TABLE deleted_users
+(
+	username TEXT PRIMARY KEY,
+	deleted_at DATETIME NOT NULL
+);
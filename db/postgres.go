@@ -0,0 +1,1117 @@
+package db
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"hash/fnv"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+
+	"github.com/makeworld-the-better-one/whatsup/config"
+	"github.com/makeworld-the-better-one/whatsup/model"
+)
+
+// PostgresStore is the Store that keeps data in a PostgreSQL database.
+// Several servers can share one, each with its own data dir: user locks are
+// held in PostgreSQL, and changes are relayed to the other servers with
+// LISTEN and NOTIFY so that their streaming clients get them too.
+type PostgresStore struct {
+	db  *sql.DB
+	dsn string
+	// id tells the changes made by this server apart from relayed ones
+	id       string
+	listener *pq.Listener
+}
+
+// postgresSchema has the same columns as the SQLite tables. The ones
+// holding JSON are BYTEA, like BLOB in SQLite.
+const postgresSchema = `
+CREATE TABLE IF NOT EXISTS statuses
+(
+	username TEXT PRIMARY KEY,
+	updated_at TIMESTAMPTZ NOT NULL,
+	avatar TEXT NOT NULL,
+	avatar_num INT NOT NULL,
+	name TEXT NOT NULL,
+	status TEXT NOT NULL,
+	emoji TEXT NOT NULL,
+	media TEXT NOT NULL,
+	media_type INT NOT NULL,
+	uri TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS following
+(
+	username TEXT PRIMARY KEY,
+	updated_at TIMESTAMPTZ NOT NULL,
+	usernames BYTEA NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS lists
+(
+	username TEXT NOT NULL,
+	name TEXT NOT NULL,
+	updated_at TIMESTAMPTZ NOT NULL,
+	usernames BYTEA NOT NULL,
+	PRIMARY KEY (username, name)
+);
+
+CREATE TABLE IF NOT EXISTS privacy
+(
+	username TEXT PRIMARY KEY,
+	updated_at TIMESTAMPTZ NOT NULL,
+	settings BYTEA NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS accounts
+(
+	username TEXT PRIMARY KEY,
+	role TEXT NOT NULL,
+	disabled BOOLEAN NOT NULL,
+	password_hash TEXT NOT NULL,
+	created_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS deleted_users
+(
+	username TEXT PRIMARY KEY,
+	deleted_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS sessions
+(
+	id TEXT PRIMARY KEY,
+	username TEXT NOT NULL,
+	csrf TEXT NOT NULL,
+	created_at TIMESTAMPTZ NOT NULL,
+	expires_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS status_history
+(
+	id BIGSERIAL PRIMARY KEY,
+	username TEXT NOT NULL,
+	created_at TIMESTAMPTZ NOT NULL,
+	status BYTEA NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS status_history_username
+ON status_history (username, id);
+
+CREATE TABLE IF NOT EXISTS webhooks
+(
+	id BIGSERIAL PRIMARY KEY,
+	owner TEXT NOT NULL,
+	url TEXT NOT NULL,
+	secret TEXT NOT NULL,
+	events BYTEA NOT NULL,
+	users BYTEA NOT NULL,
+	enabled BOOLEAN NOT NULL,
+	failures INT NOT NULL,
+	created_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS webhook_deliveries
+(
+	id BIGSERIAL PRIMARY KEY,
+	webhook_id BIGINT NOT NULL,
+	event TEXT NOT NULL,
+	payload BYTEA NOT NULL,
+	state TEXT NOT NULL,
+	attempts INT NOT NULL,
+	next_attempt TIMESTAMPTZ NOT NULL,
+	last_code INT NOT NULL,
+	last_error TEXT NOT NULL,
+	created_at TIMESTAMPTZ NOT NULL,
+	updated_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS webhook_deliveries_due
+ON webhook_deliveries (state, next_attempt);
+`
+
+// NewPostgresStore connects to the database at the libpq connection string
+// or URL, and creates the tables if they don't exist.
+func NewPostgresStore(dsn string) (*PostgresStore, error) {
+	pg, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, err
+	}
+	if err := pg.Ping(); err != nil {
+		pg.Close()
+		return nil, err
+	}
+	if _, err := pg.Exec(postgresSchema); err != nil {
+		pg.Close()
+		return nil, err
+	}
+
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		pg.Close()
+		return nil, err
+	}
+	return &PostgresStore{db: pg, dsn: dsn, id: hex.EncodeToString(id)}, nil
+}
+
+// pgParams returns the parameters for an IN clause with the values, starting
+// at $first, and the values as arguments.
+func pgParams(first int, values []string) (string, []interface{}) {
+	params := make([]string, len(values))
+	args := make([]interface{}, len(values))
+	for i := range values {
+		params[i] = "$" + strconv.Itoa(first+i)
+		args[i] = values[i]
+	}
+	return strings.Join(params, ","), args
+}
+
+func (s *PostgresStore) CreateUser(username string) error {
+	now := time.Now().UTC()
+	_, err := s.db.Exec(`
+	INSERT INTO statuses
+	(username, updated_at, avatar, avatar_num, name, status, emoji, media, media_type, uri)
+	VALUES ($1,$2,'',0,'','','','',0,'')
+	ON CONFLICT (username) DO NOTHING
+	`, username, now)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(`
+	INSERT INTO following (username, updated_at, usernames)
+	VALUES ($1,$2,$3)
+	ON CONFLICT (username) DO NOTHING
+	`, username, now, []byte(`[]`))
+	if err != nil {
+		return err
+	}
+	a := newAccount(username)
+	_, err = s.db.Exec(`
+	INSERT INTO accounts (username, role, disabled, password_hash, created_at)
+	VALUES ($1,$2,$3,$4,$5)
+	ON CONFLICT (username) DO NOTHING
+	`, a.Username, a.Role, a.Disabled, a.PasswordHash, a.CreatedAt)
+	return err
+}
+
+func (s *PostgresStore) GetUser(username string) (*model.Status, error) {
+	row := s.db.QueryRow(`
+	SELECT updated_at, avatar, avatar_num, name, status, emoji, media, media_type, uri
+	FROM statuses
+	WHERE username=$1
+	`, username)
+
+	var status = model.Status{Avatar: &model.AvatarMap{}}
+	var avatarOriginal string
+
+	err := row.Scan(&status.UpdatedAt, &avatarOriginal, &status.Avatar.Num, &status.Name, &status.Status,
+		&status.Emoji, &status.Media, &status.MediaType, &status.URI)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	status.Avatar.Paths = map[string]string{"original": avatarOriginal}
+	return &status, nil
+}
+
+func (s *PostgresStore) GetUsers(usernames []string) (map[string]*model.Status, error) {
+	statuses := make(map[string]*model.Status, len(usernames))
+	if len(usernames) == 0 {
+		return statuses, nil
+	}
+
+	params, args := pgParams(1, usernames)
+	rows, err := s.db.Query(`
+	SELECT username, updated_at, avatar, avatar_num, name, status, emoji, media, media_type, uri
+	FROM statuses
+	WHERE username IN (`+params+`)
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var username, avatarOriginal string
+		var status = model.Status{Avatar: &model.AvatarMap{}}
+
+		err := rows.Scan(&username, &status.UpdatedAt, &avatarOriginal, &status.Avatar.Num, &status.Name,
+			&status.Status, &status.Emoji, &status.Media, &status.MediaType, &status.URI)
+		if err != nil {
+			return nil, err
+		}
+		status.Avatar.Paths = map[string]string{"original": avatarOriginal}
+		statuses[username] = &status
+	}
+	return statuses, rows.Err()
+}
+
+func (s *PostgresStore) SetUser(username string, data *model.Status) error {
+	cols, args := statusColumns(data)
+	cols = append(cols, "updated_at")
+	args = append(args, time.Now().UTC(), username)
+
+	sets := make([]string, len(cols))
+	for i, col := range cols {
+		sets[i] = col + "=$" + strconv.Itoa(i+1)
+	}
+	stmt := `UPDATE statuses SET ` + strings.Join(sets, ", ") +
+		` WHERE username=$` + strconv.Itoa(len(args))
+
+	_, err := s.db.Exec(stmt, args...)
+	return err
+}
+
+func (s *PostgresStore) SetAvatar(username string, img []byte) error {
+	if err := writeAvatar(username, img); err != nil {
+		return err
+	}
+
+	// Incremented in the database, in case another server is setting it too
+	_, err := s.db.Exec(`
+	UPDATE statuses
+	SET avatar=$1, avatar_num=avatar_num+1, updated_at=$2
+	WHERE username=$3
+	`, avatarPaths(username)["original"], time.Now().UTC(), username)
+	if err != nil {
+		log.Printf("SetAvatar: updating avatar for %s: %v", username, err)
+		return err
+	}
+	return nil
+}
+
+func (s *PostgresStore) RemoveAvatar(username string) error {
+	if err := deleteAvatar(username); err != nil {
+		return err
+	}
+	err := s.SetUser(username, &model.Status{Avatar: &model.AvatarMap{Paths: map[string]string{}}})
+	if err != nil {
+		log.Printf("RemoveAvatar: SetUser for %s: %v", username, err)
+		return err
+	}
+	return nil
+}
+
+func (s *PostgresStore) GetFollowing(username string) (*model.Following, error) {
+	jsonArray, updatedAt, err := s.GetFollowingRaw(username)
+	if err != nil {
+		return nil, err
+	}
+
+	fw := model.Following{UpdatedAt: updatedAt, Usernames: model.NewFollowingUsernames()}
+	if err := json.Unmarshal(jsonArray, &fw.Usernames); err != nil {
+		return nil, err
+	}
+	return &fw, nil
+}
+
+func (s *PostgresStore) GetFollowingRaw(username string) ([]byte, time.Time, error) {
+	var usernames []byte
+	var updatedAt time.Time
+	err := s.db.QueryRow(`
+	SELECT updated_at, usernames
+	FROM following
+	WHERE username=$1
+	`, username).Scan(&updatedAt, &usernames)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, time.Time{}, ErrNotFound
+	}
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	return usernames, updatedAt, nil
+}
+
+func (s *PostgresStore) SetFollowing(username string, data *model.Following) error {
+	if data.Usernames == nil {
+		return nil
+	}
+
+	jsonArray, err := json.Marshal(&data.Usernames)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(`
+	UPDATE following
+	SET updated_at=$1, usernames=$2
+	WHERE username=$3
+	`, time.Now().UTC(), jsonArray, username)
+	return err
+}
+
+func (s *PostgresStore) UpdateFollowing(username string, fn func(fw *model.Following) error) (*model.Following, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// FOR UPDATE locks the row until the transaction ends, so other
+	// connections, like from whatsup commands, wait too
+	var jsonArray []byte
+	fw := &model.Following{Usernames: model.NewFollowingUsernames()}
+	err = tx.QueryRow(`SELECT updated_at, usernames FROM following WHERE username=$1 FOR UPDATE`, username).
+		Scan(&fw.UpdatedAt, &jsonArray)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(jsonArray, &fw.Usernames); err != nil {
+		return nil, err
+	}
+
+	if err := fn(fw); err != nil {
+		return nil, err
+	}
+
+	jsonArray, err = json.Marshal(&fw.Usernames)
+	if err != nil {
+		return nil, err
+	}
+	fw.UpdatedAt = time.Now().UTC()
+	_, err = tx.Exec(`
+	UPDATE following
+	SET updated_at=$1, usernames=$2
+	WHERE username=$3
+	`, fw.UpdatedAt, jsonArray, username)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return fw, nil
+}
+
+func (s *PostgresStore) AllFollowing() (model.FollowingUsernames, error) {
+	rows, err := s.db.Query(`SELECT usernames FROM following`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	all := model.NewFollowingUsernames()
+	for rows.Next() {
+		var jsonArray []byte
+		if err := rows.Scan(&jsonArray); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(jsonArray, &all); err != nil {
+			return nil, err
+		}
+	}
+	return all, rows.Err()
+}
+
+func (s *PostgresStore) DeleteUser(username string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmts := []string{
+		`DELETE FROM statuses WHERE username=$1`,
+		`DELETE FROM following WHERE username=$1`,
+		`DELETE FROM webhook_deliveries WHERE webhook_id IN (SELECT id FROM webhooks WHERE owner=$1)`,
+		`DELETE FROM webhooks WHERE owner=$1`,
+		`DELETE FROM lists WHERE username=$1`,
+		`DELETE FROM privacy WHERE username=$1`,
+		`DELETE FROM status_history WHERE username=$1`,
+		`DELETE FROM sessions WHERE username=$1`,
+		`DELETE FROM accounts WHERE username=$1`,
+	}
+	for _, stmt := range stmts {
+		if _, err := tx.Exec(stmt, username); err != nil {
+			return err
+		}
+	}
+
+	// Payloads are always JSON with the global username
+	_, err = tx.Exec(`
+	DELETE FROM webhook_deliveries
+	WHERE convert_from(payload, 'UTF8')::jsonb->>'username'=$1
+	`, "@"+username+"@"+config.Conf.Server.Domain)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+	INSERT INTO deleted_users (username, deleted_at)
+	VALUES ($1,$2)
+	ON CONFLICT (username) DO NOTHING
+	`, username, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// LockUser locks the user in this process first, so that only one
+// connection per server waits for the lock in PostgreSQL. That lock is a
+// transaction-level advisory lock, so it's released even if the connection
+// is lost.
+func (s *PostgresStore) LockUser(username string) (func(), error) {
+	unlock := userLocks.Lock(username)
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		unlock()
+		return nil, err
+	}
+	h := fnv.New64a()
+	h.Write([]byte(username))
+	if _, err := tx.Exec(`SELECT pg_advisory_xact_lock($1)`, int64(h.Sum64())); err != nil {
+		tx.Rollback()
+		unlock()
+		return nil, err
+	}
+	return func() {
+		tx.Rollback()
+		unlock()
+	}, nil
+}
+
+func (s *PostgresStore) Close() error {
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	return s.db.Close()
+}
+
+func (s *PostgresStore) GetLists(username string) ([]*model.List, error) {
+	rows, err := s.db.Query(`
+	SELECT name, updated_at, usernames
+	FROM lists
+	WHERE username=$1
+	ORDER BY name
+	`, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	lists := make([]*model.List, 0)
+	for rows.Next() {
+		list := model.List{Usernames: model.NewFollowingUsernames()}
+		var jsonArray []byte
+		if err := rows.Scan(&list.Name, &list.UpdatedAt, &jsonArray); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(jsonArray, &list.Usernames); err != nil {
+			return nil, err
+		}
+		lists = append(lists, &list)
+	}
+	return lists, rows.Err()
+}
+
+func (s *PostgresStore) GetList(username, name string) (*model.List, error) {
+	list := model.List{Name: name, Usernames: model.NewFollowingUsernames()}
+	var jsonArray []byte
+	err := s.db.QueryRow(`
+	SELECT updated_at, usernames
+	FROM lists
+	WHERE username=$1 AND name=$2
+	`, username, name).Scan(&list.UpdatedAt, &jsonArray)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(jsonArray, &list.Usernames); err != nil {
+		return nil, err
+	}
+	return &list, nil
+}
+
+func (s *PostgresStore) CreateList(username, name string) error {
+	res, err := s.db.Exec(`
+	INSERT INTO lists (username, name, updated_at, usernames)
+	VALUES ($1,$2,$3,$4)
+	ON CONFLICT (username, name) DO NOTHING
+	`, username, name, time.Now().UTC(), []byte(`[]`))
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrExists
+	}
+	return nil
+}
+
+func (s *PostgresStore) UpdateList(username, name string, fn func(list *model.List, following model.FollowingUsernames) error) (*model.List, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// Both rows are locked until the transaction ends, like in UpdateFollowing
+	list := &model.List{Name: name, Usernames: model.NewFollowingUsernames()}
+	var jsonArray []byte
+	err = tx.QueryRow(`SELECT usernames FROM lists WHERE username=$1 AND name=$2 FOR UPDATE`, username, name).
+		Scan(&jsonArray)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(jsonArray, &list.Usernames); err != nil {
+		return nil, err
+	}
+	following := model.NewFollowingUsernames()
+	err = tx.QueryRow(`SELECT usernames FROM following WHERE username=$1 FOR SHARE`, username).Scan(&jsonArray)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(jsonArray, &following); err != nil {
+		return nil, err
+	}
+
+	if err := fn(list, following); err != nil {
+		return nil, err
+	}
+
+	if list.Name != name {
+		var n int
+		err := tx.QueryRow(`SELECT COUNT(*) FROM lists WHERE username=$1 AND name=$2`, username, list.Name).Scan(&n)
+		if err != nil {
+			return nil, err
+		}
+		if n > 0 {
+			return nil, ErrExists
+		}
+	}
+	jsonArray, err = json.Marshal(&list.Usernames)
+	if err != nil {
+		return nil, err
+	}
+	list.UpdatedAt = time.Now().UTC()
+	_, err = tx.Exec(`
+	UPDATE lists
+	SET name=$1, updated_at=$2, usernames=$3
+	WHERE username=$4 AND name=$5
+	`, list.Name, list.UpdatedAt, jsonArray, username, name)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+func (s *PostgresStore) DeleteList(username, name string) error {
+	res, err := s.db.Exec(`DELETE FROM lists WHERE username=$1 AND name=$2`, username, name)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *PostgresStore) GetPrivacy(username string) (*model.Privacy, error) {
+	m, err := s.GetPrivacies([]string{username})
+	if err != nil {
+		return nil, err
+	}
+	return m[username], nil
+}
+
+func (s *PostgresStore) GetPrivacies(usernames []string) (map[string]*model.Privacy, error) {
+	m := make(map[string]*model.Privacy, len(usernames))
+	for _, u := range usernames {
+		m[u] = model.NewPrivacy()
+	}
+	if len(usernames) == 0 {
+		return m, nil
+	}
+
+	params, args := pgParams(1, usernames)
+	rows, err := s.db.Query(`SELECT username, settings FROM privacy WHERE username IN (`+params+`)`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var username string
+		var settings []byte
+		if err := rows.Scan(&username, &settings); err != nil {
+			return nil, err
+		}
+		p := model.NewPrivacy()
+		if err := json.Unmarshal(settings, p); err != nil {
+			return nil, err
+		}
+		m[username] = p
+	}
+	return m, rows.Err()
+}
+
+func (s *PostgresStore) SetPrivacy(username string, p *model.Privacy) error {
+	settings, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(`
+	INSERT INTO privacy (username, updated_at, settings)
+	VALUES ($1,$2,$3)
+	ON CONFLICT (username) DO UPDATE SET updated_at=excluded.updated_at, settings=excluded.settings
+	`, username, time.Now().UTC(), settings)
+	return err
+}
+
+func (s *PostgresStore) GetAccount(username string) (*model.Account, error) {
+	a, err := scanAccount(s.db.QueryRow(`
+	SELECT username, role, disabled, password_hash, created_at
+	FROM accounts WHERE username=$1
+	`, username))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	return a, err
+}
+
+func (s *PostgresStore) GetAccounts() ([]*model.Account, error) {
+	rows, err := s.db.Query(`
+	SELECT username, role, disabled, password_hash, created_at
+	FROM accounts ORDER BY username
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	accounts := make([]*model.Account, 0)
+	for rows.Next() {
+		a, err := scanAccount(rows)
+		if err != nil {
+			return nil, err
+		}
+		accounts = append(accounts, a)
+	}
+	return accounts, rows.Err()
+}
+
+// updateAccount runs an UPDATE of one column on the account, and logs the
+// user out everywhere if logout is true.
+// Returns ErrNotFound if the user doesn't exist.
+func (s *PostgresStore) updateAccount(username, col string, value interface{}, logout bool) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`UPDATE accounts SET `+col+`=$1 WHERE username=$2`, value, username)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrNotFound
+	}
+	if logout {
+		if _, err := tx.Exec(`DELETE FROM sessions WHERE username=$1`, username); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *PostgresStore) SetRole(username, role string) error {
+	return s.updateAccount(username, "role", role, false)
+}
+
+func (s *PostgresStore) SetDisabled(username string, disabled bool) error {
+	return s.updateAccount(username, "disabled", disabled, disabled)
+}
+
+func (s *PostgresStore) SetPasswordHash(username, hash string) error {
+	return s.updateAccount(username, "password_hash", hash, true)
+}
+
+func (s *PostgresStore) IsDeleted(username string) (bool, error) {
+	deleted, err := s.GetDeleted([]string{username})
+	return deleted[username], err
+}
+
+func (s *PostgresStore) GetDeleted(usernames []string) (map[string]bool, error) {
+	deleted := make(map[string]bool)
+	if len(usernames) == 0 {
+		return deleted, nil
+	}
+
+	params, args := pgParams(1, usernames)
+	rows, err := s.db.Query(`SELECT username FROM deleted_users WHERE username IN (`+params+`)`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var username string
+		if err := rows.Scan(&username); err != nil {
+			return nil, err
+		}
+		deleted[username] = true
+	}
+	return deleted, rows.Err()
+}
+
+func (s *PostgresStore) CreateSession(session *model.Session) error {
+	_, err := s.db.Exec(`
+	INSERT INTO sessions (id, username, csrf, created_at, expires_at)
+	VALUES ($1,$2,$3,$4,$5)
+	`, session.ID, session.Username, session.CSRF, session.CreatedAt.UTC(), session.ExpiresAt.UTC())
+	return err
+}
+
+func (s *PostgresStore) GetSession(id string) (*model.Session, error) {
+	session := &model.Session{ID: id}
+	err := s.db.QueryRow(`
+	SELECT username, csrf, created_at, expires_at FROM sessions
+	WHERE id=$1 AND expires_at > $2
+	`, id, time.Now().UTC()).Scan(&session.Username, &session.CSRF, &session.CreatedAt, &session.ExpiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+func (s *PostgresStore) DeleteSession(id string) error {
+	_, err := s.db.Exec(`DELETE FROM sessions WHERE id=$1`, id)
+	return err
+}
+
+func (s *PostgresStore) PruneSessions() error {
+	_, err := s.db.Exec(`DELETE FROM sessions WHERE expires_at <= $1`, time.Now().UTC())
+	return err
+}
+
+func (s *PostgresStore) AddHistory(username string, status *model.Status) error {
+	snapshot, err := json.Marshal(status)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(`
+	INSERT INTO status_history (username, created_at, status)
+	VALUES ($1,$2,$3)
+	`, username, status.UpdatedAt.UTC(), snapshot)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(`
+	DELETE FROM status_history WHERE username=$1 AND id NOT IN
+	(SELECT id FROM status_history WHERE username=$1 ORDER BY id DESC LIMIT $2)
+	`, username, MaxHistory)
+	return err
+}
+
+func (s *PostgresStore) GetHistory(username string, limit int) ([]*model.StatusEntry, error) {
+	rows, err := s.db.Query(`
+	SELECT id, created_at, status FROM status_history
+	WHERE username=$1 ORDER BY id DESC LIMIT $2
+	`, username, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []*model.StatusEntry
+	for rows.Next() {
+		var snapshot []byte
+		e := &model.StatusEntry{Username: username, Status: &model.Status{}}
+		if err := rows.Scan(&e.ID, &e.CreatedAt, &snapshot); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(snapshot, e.Status); err != nil {
+			return nil, err
+		}
+		e.Status.UpdatedAt = e.CreatedAt
+		splitAvatarNum(e.Status.Avatar)
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+func (s *PostgresStore) queryWebhooks(query string, args ...interface{}) ([]*model.Webhook, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	webhooks := make([]*model.Webhook, 0)
+	for rows.Next() {
+		wh, err := scanWebhook(rows)
+		if err != nil {
+			return nil, err
+		}
+		webhooks = append(webhooks, wh)
+	}
+	return webhooks, rows.Err()
+}
+
+func (s *PostgresStore) GetWebhooks(username string) ([]*model.Webhook, error) {
+	return s.queryWebhooks(`SELECT `+webhookColumns+` FROM webhooks WHERE owner=$1 ORDER BY id`, username)
+}
+
+func (s *PostgresStore) GetEnabledWebhooks() ([]*model.Webhook, error) {
+	return s.queryWebhooks(`SELECT ` + webhookColumns + ` FROM webhooks WHERE enabled ORDER BY id`)
+}
+
+func (s *PostgresStore) GetWebhook(username string, id int64) (*model.Webhook, error) {
+	wh, err := scanWebhook(s.db.QueryRow(`SELECT `+webhookColumns+` FROM webhooks WHERE owner=$1 AND id=$2`, username, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	return wh, err
+}
+
+func (s *PostgresStore) GetWebhookByID(id int64) (*model.Webhook, error) {
+	wh, err := scanWebhook(s.db.QueryRow(`SELECT `+webhookColumns+` FROM webhooks WHERE id=$1`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	return wh, err
+}
+
+func (s *PostgresStore) CreateWebhook(wh *model.Webhook) error {
+	events, err := json.Marshal(wh.Events)
+	if err != nil {
+		return err
+	}
+	users, err := json.Marshal(wh.Users)
+	if err != nil {
+		return err
+	}
+
+	wh.CreatedAt = time.Now().UTC()
+	return s.db.QueryRow(`
+	INSERT INTO webhooks
+	(owner, url, secret, events, users, enabled, failures, created_at)
+	VALUES ($1,$2,$3,$4,$5,$6,$7,$8)
+	RETURNING id
+	`, wh.Owner, wh.URL, wh.Secret, events, users, wh.Enabled, wh.Failures, wh.CreatedAt).Scan(&wh.ID)
+}
+
+func (s *PostgresStore) UpdateWebhook(wh *model.Webhook) error {
+	events, err := json.Marshal(wh.Events)
+	if err != nil {
+		return err
+	}
+	users, err := json.Marshal(wh.Users)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(`UPDATE webhooks SET secret=$1, events=$2, users=$3 WHERE id=$4`,
+		wh.Secret, events, users, wh.ID)
+	return err
+}
+
+func (s *PostgresStore) SetWebhookEnabled(id int64, enabled bool) error {
+	_, err := s.db.Exec(`UPDATE webhooks SET enabled=$1, failures=0 WHERE id=$2`, enabled, id)
+	return err
+}
+
+func (s *PostgresStore) DeleteWebhook(username string, id int64) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`DELETE FROM webhooks WHERE owner=$1 AND id=$2`, username, id)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrNotFound
+	}
+	if _, err := tx.Exec(`DELETE FROM webhook_deliveries WHERE webhook_id=$1`, id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *PostgresStore) RecordWebhookResult(id int64, success bool, disableAfter int) (bool, error) {
+	if success {
+		_, err := s.db.Exec(`UPDATE webhooks SET failures=0 WHERE id=$1`, id)
+		return false, err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	// Locked, so that failures from several servers all count
+	var failures int
+	var enabled bool
+	err = tx.QueryRow(`SELECT failures, enabled FROM webhooks WHERE id=$1 FOR UPDATE`, id).Scan(&failures, &enabled)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	failures++
+	disable := enabled && failures >= disableAfter
+	_, err = tx.Exec(`UPDATE webhooks SET failures=$1, enabled=$2 WHERE id=$3`, failures, enabled && !disable, id)
+	if err != nil {
+		return false, err
+	}
+	return disable, tx.Commit()
+}
+
+func (s *PostgresStore) EnqueueDeliveries(webhookIDs []int64, event string, payload []byte) error {
+	if len(webhookIDs) == 0 {
+		return nil
+	}
+	// One statement, so it's one transaction
+	now := time.Now().UTC()
+	_, err := s.db.Exec(`
+	INSERT INTO webhook_deliveries
+	(webhook_id, event, payload, state, attempts, next_attempt, last_code, last_error, created_at, updated_at)
+	SELECT id, $2, $3, $4, 0, $5, 0, '', $5, $5 FROM unnest($1::BIGINT[]) AS id
+	`, pq.Array(webhookIDs), event, payload, model.DeliveryPending, now)
+	return err
+}
+
+func (s *PostgresStore) DueDeliveries(limit int) ([]*model.WebhookDelivery, error) {
+	// SKIP LOCKED leaves out the ones another server is claiming right now
+	now := time.Now().UTC()
+	rows, err := s.db.Query(`
+	UPDATE webhook_deliveries SET next_attempt=$1
+	WHERE id IN (
+		SELECT id FROM webhook_deliveries
+		WHERE state=$2 AND next_attempt<=$3
+		ORDER BY next_attempt
+		LIMIT $4
+		FOR UPDATE SKIP LOCKED
+	)
+	RETURNING `+deliveryColumns, now.Add(deliveryClaim), model.DeliveryPending, now, limit)
+	if err != nil {
+		return nil, err
+	}
+	deliveries, err := scanDeliveries(rows)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(deliveries, func(i, j int) bool { return deliveries[i].ID < deliveries[j].ID })
+	return deliveries, nil
+}
+
+func (s *PostgresStore) GetDeliveries(webhookID int64, limit int) ([]*model.WebhookDelivery, error) {
+	rows, err := s.db.Query(`
+	SELECT `+deliveryColumns+`
+	FROM webhook_deliveries
+	WHERE webhook_id=$1
+	ORDER BY id DESC
+	LIMIT $2
+	`, webhookID, limit)
+	if err != nil {
+		return nil, err
+	}
+	return scanDeliveries(rows)
+}
+
+func (s *PostgresStore) UpdateDelivery(d *model.WebhookDelivery) error {
+	d.UpdatedAt = time.Now().UTC()
+	_, err := s.db.Exec(`
+	UPDATE webhook_deliveries
+	SET state=$1, attempts=$2, next_attempt=$3, last_code=$4, last_error=$5, updated_at=$6
+	WHERE id=$7
+	`, d.State, d.Attempts, d.NextAttempt.UTC(), d.LastCode, d.LastError, d.UpdatedAt, d.ID)
+	return err
+}
+
+func (s *PostgresStore) PruneDeliveries(before time.Time) error {
+	_, err := s.db.Exec(`DELETE FROM webhook_deliveries WHERE state!=$1 AND updated_at<$2`,
+		model.DeliveryPending, before.UTC())
+	return err
+}
+
+func (s *PostgresStore) CountPendingDeliveries() (int, error) {
+	var n int
+	err := s.db.QueryRow(`SELECT COUNT(*) FROM webhook_deliveries WHERE state=$1`, model.DeliveryPending).Scan(&n)
+	return n, err
+}
+
+// notify tells the other servers sharing the database about a change.
+func (s *PostgresStore) notify(eventType, username string) error {
+	b, err := json.Marshal(&relayMessage{Server: s.id, Type: eventType, Username: username})
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(`SELECT pg_notify($1, $2)`, relayChannel, string(b))
+	return err
+}
+
+// listen calls fn with the changes made by the other servers sharing the
+// database, until the Store is closed.
+func (s *PostgresStore) listen(fn func(eventType, username string)) error {
+	l := pq.NewListener(s.dsn, time.Second, time.Minute, func(ev pq.ListenerEventType, err error) {
+		switch ev {
+		case pq.ListenerEventDisconnected:
+			log.Printf("db: listening for changes by other servers: %v", err)
+		case pq.ListenerEventReconnected:
+			log.Printf("db: listening for changes by other servers again, the ones made while disconnected were missed")
+		}
+	})
+	if err := l.Listen(relayChannel); err != nil {
+		l.Close()
+		return err
+	}
+	s.listener = l
+
+	go func() {
+		// Closed by Close
+		for n := range l.Notify {
+			if n == nil {
+				// Reconnected
+				continue
+			}
+			var m relayMessage
+			if err := json.Unmarshal([]byte(n.Extra), &m); err != nil || m.Server == s.id {
+				continue
+			}
+			fn(m.Type, m.Username)
+		}
+	}()
+	return nil
+}
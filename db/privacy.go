@@ -0,0 +1,95 @@
+package db
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/makeworld-the-better-one/whatsup/model"
+)
+
+// PrivacyStore keeps the privacy settings of users.
+type PrivacyStore interface {
+	// GetPrivacy returns the privacy settings for the given username.
+	// If none have been set, the default public settings are returned.
+	GetPrivacy(username string) (*model.Privacy, error)
+
+	// GetPrivacies returns the privacy settings of many users at once, keyed
+	// by username. Users without settings get the default public ones.
+	GetPrivacies(usernames []string) (map[string]*model.Privacy, error)
+
+	// SetPrivacy replaces the privacy settings for the given username.
+	SetPrivacy(username string, p *model.Privacy) error
+}
+
+func (s *SQLiteStore) GetPrivacy(username string) (*model.Privacy, error) {
+	row := db.QueryRow(`SELECT settings FROM privacy WHERE username=?`, username)
+
+	var settings []byte
+	err := row.Scan(&settings)
+	if errors.Is(err, sql.ErrNoRows) {
+		return model.NewPrivacy(), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	p := model.NewPrivacy()
+	if err := json.Unmarshal(settings, p); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (s *SQLiteStore) GetPrivacies(usernames []string) (map[string]*model.Privacy, error) {
+	m := make(map[string]*model.Privacy, len(usernames))
+	for _, u := range usernames {
+		m[u] = model.NewPrivacy()
+	}
+	if len(usernames) == 0 {
+		return m, nil
+	}
+
+	args := make([]interface{}, len(usernames))
+	for i, u := range usernames {
+		args[i] = u
+	}
+	rows, err := rdb.Query(`
+	SELECT username, settings FROM privacy
+	WHERE username IN (?`+strings.Repeat(",?", len(usernames)-1)+`)
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var username string
+		var settings []byte
+		if err := rows.Scan(&username, &settings); err != nil {
+			return nil, err
+		}
+		p := model.NewPrivacy()
+		if err := json.Unmarshal(settings, p); err != nil {
+			return nil, err
+		}
+		m[username] = p
+	}
+	return m, rows.Err()
+}
+
+func (s *SQLiteStore) SetPrivacy(username string, p *model.Privacy) error {
+	settings, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`
+	INSERT INTO privacy (username, updated_at, settings)
+	VALUES (?,?,?)
+	ON CONFLICT(username) DO UPDATE SET updated_at=excluded.updated_at, settings=excluded.settings
+	`, username, time.Now(), settings)
+	return err
+}
@@ -0,0 +1,73 @@
+package db
+
+import (
+	"errors"
+	"log"
+
+	"github.com/makeworld-the-better-one/whatsup/hub"
+)
+
+// relay is implemented by Stores that several servers can share. Each server
+// tells the others about the changes it makes, so that their hub subscribers
+// get them too.
+type relay interface {
+	// notify tells the other servers about a change.
+	notify(eventType, username string) error
+	// listen calls fn with the changes the other servers make, until the
+	// Store is closed.
+	listen(fn func(eventType, username string)) error
+}
+
+// relayOf returns the relay of the Store, if it has one, which can be under
+// the status cache.
+func relayOf(s Store) relay {
+	if c, ok := s.(*cachedStore); ok {
+		s = c.Store
+	}
+	r, _ := s.(relay)
+	return r
+}
+
+// relayChannel is the PostgreSQL notification channel changes are sent on.
+const relayChannel = "whatsup_changes"
+
+// relayDeleted is the change type sent for deleted users, which isn't a hub
+// event but drops them from the status cache.
+const relayDeleted = "deleted"
+
+type relayMessage struct {
+	Server   string `json:"server"`
+	Type     string `json:"type"`
+	Username string `json:"username"`
+}
+
+// relayChanges starts publishing the changes other servers make to hub
+// subscribers, after dropping the user from the status cache. The data is
+// read again from Default, the message only says what changed.
+func relayChanges(r relay) error {
+	return r.listen(func(eventType, username string) {
+		if statusCache != nil {
+			statusCache.invalidate(username)
+		}
+
+		e := &hub.Event{Type: eventType, Username: username, Relayed: true}
+		var err error
+		switch eventType {
+		case hub.EventStatus:
+			e.Status, err = Default.GetUser(username)
+		case hub.EventFollowing:
+			e.Following, err = Default.GetFollowing(username)
+		default:
+			return
+		}
+		if errors.Is(err, ErrNotFound) {
+			// Deleted since
+			return
+		}
+		if err != nil {
+			log.Printf("db: reading relayed %s change of %s: %v", eventType, username, err)
+			return
+		}
+		hub.Publish(e)
+	})
+}
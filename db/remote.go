@@ -0,0 +1,89 @@
+package db
+
+import (
+	"strings"
+	"time"
+
+	"github.com/makeworld-the-better-one/whatsup/model"
+)
+
+// GetRemoteUsers returns the last known existence state for each of the
+// provided global usernames. Usernames that have never been checked have the
+// model.RemoteUnchecked state.
+func GetRemoteUsers(usernames []string) (map[string]*model.RemoteUser, error) {
+	m := make(map[string]*model.RemoteUser, len(usernames))
+	for _, u := range usernames {
+		m[u] = &model.RemoteUser{Username: u, State: model.RemoteUnchecked}
+	}
+	if len(usernames) == 0 {
+		return m, nil
+	}
+
+	args := make([]interface{}, len(usernames))
+	for i, u := range usernames {
+		args[i] = u
+	}
+
+	rows, err := db.Query(`
+	SELECT username, state, checked_at
+	FROM remote_users
+	WHERE username IN (?`+strings.Repeat(",?", len(usernames)-1)+`)
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var ru model.RemoteUser
+		var checkedAt time.Time
+		if err := rows.Scan(&ru.Username, &ru.State, &checkedAt); err != nil {
+			return nil, err
+		}
+		ru.CheckedAt = &checkedAt
+		m[ru.Username] = &ru
+	}
+	return m, rows.Err()
+}
+
+// SetRemoteUser stores the existence state of a global username, and sets
+// the time it was checked to now.
+func SetRemoteUser(username, state string) error {
+	_, err := db.Exec(`
+	INSERT INTO remote_users (username, state, checked_at)
+	VALUES (?,?,?)
+	ON CONFLICT(username) DO UPDATE SET state=excluded.state, checked_at=excluded.checked_at
+	`, username, state, time.Now())
+	return err
+}
+
+// DeleteRemoteUsersExcept removes the stored state for all global usernames
+// except the provided ones.
+func DeleteRemoteUsersExcept(keep model.FollowingUsernames) error {
+	rows, err := db.Query(`SELECT username FROM remote_users`)
+	if err != nil {
+		return err
+	}
+	var remove []string
+	for rows.Next() {
+		var u string
+		if err := rows.Scan(&u); err != nil {
+			rows.Close()
+			return err
+		}
+		if _, ok := keep[u]; !ok {
+			remove = append(remove, u)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, u := range remove {
+		if _, err := db.Exec(`DELETE FROM remote_users WHERE username=?`, u); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/makeworld-the-better-one/whatsup/model"
+)
+
+// SessionStore keeps the sessions of the settings UI.
+type SessionStore interface {
+	// CreateSession stores a new session.
+	CreateSession(session *model.Session) error
+
+	// GetSession returns the unexpired session with the ID.
+	// Returns ErrNotFound if there is no such session.
+	GetSession(id string) (*model.Session, error)
+
+	// DeleteSession removes the session, if it exists.
+	DeleteSession(id string) error
+
+	// PruneSessions deletes expired sessions.
+	PruneSessions() error
+}
+
+func (s *SQLiteStore) CreateSession(session *model.Session) error {
+	_, err := db.Exec(`
+	INSERT INTO sessions (id, username, csrf, created_at, expires_at)
+	VALUES (?,?,?,?,?)
+	`, session.ID, session.Username, session.CSRF, session.CreatedAt.UTC(), session.ExpiresAt.UTC())
+	return err
+}
+
+func (s *SQLiteStore) GetSession(id string) (*model.Session, error) {
+	row := db.QueryRow(`
+	SELECT username, csrf, created_at, expires_at FROM sessions
+	WHERE id=? AND expires_at > ?
+	`, id, time.Now().UTC())
+
+	session := &model.Session{ID: id}
+	err := row.Scan(&session.Username, &session.CSRF, &session.CreatedAt, &session.ExpiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+func (s *SQLiteStore) DeleteSession(id string) error {
+	_, err := db.Exec(`DELETE FROM sessions WHERE id=?`, id)
+	return err
+}
+
+func (s *SQLiteStore) PruneSessions() error {
+	_, err := db.Exec(`DELETE FROM sessions WHERE expires_at <= ?`, time.Now().UTC())
+	return err
+}
+
+// deleteUserSessions logs the user out everywhere.
+func (s *SQLiteStore) deleteUserSessions(username string) error {
+	_, err := db.Exec(`DELETE FROM sessions WHERE username=?`, username)
+	return err
+}
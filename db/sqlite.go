@@ -0,0 +1,378 @@
+package db
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/makeworld-the-better-one/whatsup/config"
+	"github.com/makeworld-the-better-one/whatsup/model"
+)
+
+// SQLiteStore is the Store that uses the SQLite database in the data dir,
+// the same one as all other data. It's the default.
+type SQLiteStore struct{}
+
+func (s *SQLiteStore) userExists(username string) (bool, error) {
+	row := db.QueryRow(`SELECT username FROM statuses WHERE username=?`, username)
+	var tmp string
+	err := row.Scan(&tmp)
+	if err == nil {
+		return true, nil
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	return false, err
+}
+
+func (s *SQLiteStore) CreateUser(username string) error {
+	exists, err := s.userExists(username)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		_, err = db.Exec(`
+		INSERT INTO statuses
+		(username, updated_at, avatar, avatar_num, name, status, emoji, media, media_type, uri)
+		VALUES (?,?,?,?,?,?,?,?,?,?)
+		`, username, time.Now(), "", 0, "", "", "", "", 0, "")
+		if err != nil {
+			return err
+		}
+
+		empty, err := seal([]byte(`[]`), "following", username)
+		if err != nil {
+			return err
+		}
+		_, err = db.Exec(`
+		INSERT INTO following
+		(username, updated_at, usernames)
+		VALUES (?,?,?)
+		`, username, time.Now(), empty)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Users from before accounts existed get one too
+	a := newAccount(username)
+	_, err = db.Exec(`
+	INSERT OR IGNORE INTO accounts (username, role, disabled, password_hash, created_at)
+	VALUES (?,?,?,?,?)
+	`, a.Username, a.Role, a.Disabled, a.PasswordHash, a.CreatedAt)
+	return err
+}
+
+func (s *SQLiteStore) GetUser(username string) (*model.Status, error) {
+	stmt, err := prepare(rdb, `
+	SELECT updated_at, avatar, avatar_num, name, status, emoji, media, media_type, uri
+	FROM statuses
+	WHERE username=?
+	`)
+	if err != nil {
+		return nil, err
+	}
+	row := stmt.QueryRow(username)
+
+	var status = model.Status{Avatar: &model.AvatarMap{}}
+	var avatarOriginal string
+
+	err = row.Scan(&status.UpdatedAt, &avatarOriginal, &status.Avatar.Num, &status.Name, &status.Status,
+		&status.Emoji, &status.Media, &status.MediaType, &status.URI)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	status.Avatar.Paths = make(map[string]string)
+	status.Avatar.Paths["original"] = avatarOriginal
+
+	return &status, nil
+}
+
+func (s *SQLiteStore) GetUsers(usernames []string) (map[string]*model.Status, error) {
+	statuses := make(map[string]*model.Status, len(usernames))
+	if len(usernames) == 0 {
+		return statuses, nil
+	}
+
+	args := make([]interface{}, len(usernames))
+	for i := range usernames {
+		args[i] = usernames[i]
+	}
+	// Not prepared, since there's a statement for each number of users
+	rows, err := rdb.Query(`
+	SELECT username, updated_at, avatar, avatar_num, name, status, emoji, media, media_type, uri
+	FROM statuses
+	WHERE username IN (?`+strings.Repeat(`,?`, len(usernames)-1)+`)
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var username, avatarOriginal string
+		var status = model.Status{Avatar: &model.AvatarMap{}}
+
+		err := rows.Scan(&username, &status.UpdatedAt, &avatarOriginal, &status.Avatar.Num, &status.Name,
+			&status.Status, &status.Emoji, &status.Media, &status.MediaType, &status.URI)
+		if err != nil {
+			return nil, err
+		}
+		status.Avatar.Paths = map[string]string{"original": avatarOriginal}
+		statuses[username] = &status
+	}
+	return statuses, rows.Err()
+}
+
+func (s *SQLiteStore) SetUser(username string, data *model.Status) error {
+	// Column names and values to be set
+	cols, args := statusColumns(data)
+
+	cols = append(cols, "updated_at")
+	args = append(args, time.Now(), username) // Add username for "WHERE" in statement
+
+	// Construct SQL statement
+	stmt := `UPDATE statuses SET `
+	stmt += strings.Join(cols, `=?, `) + `=? WHERE username=?`
+
+	// There are a few statements, one for each set of fields that's changed
+	prepared, err := prepare(db, stmt)
+	if err != nil {
+		return err
+	}
+	_, err = prepared.Exec(args...)
+	return err
+}
+
+func (s *SQLiteStore) SetAvatar(username string, img []byte) error {
+	if err := writeAvatar(username, img); err != nil {
+		return err
+	}
+
+	// Set user avatar field in case it was blank before, and increment avatar
+	// num. Done in one statement so concurrent uploads can't get the same num.
+	_, err := db.Exec(`
+	UPDATE statuses
+	SET avatar=?, avatar_num=avatar_num+1, updated_at=?
+	WHERE username=?
+	`, avatarPaths(username)["original"], time.Now(), username)
+	if err != nil {
+		log.Printf("SetAvatar: updating avatar for %s: %v", username, err)
+		return err
+	}
+	return nil
+}
+
+func (s *SQLiteStore) RemoveAvatar(username string) error {
+	if err := deleteAvatar(username); err != nil {
+		return err
+	}
+
+	// Even if image does not exist on the filesystem, remove avatar entry in DB
+	// just in case
+
+	status := model.Status{
+		Avatar: &model.AvatarMap{
+			Paths: make(map[string]string), // "original" key will be empty
+		},
+	}
+
+	err := s.SetUser(username, &status)
+	if err != nil {
+		log.Printf("RemoveAvatar: SetUser for %s: %v", username, err)
+		return err
+	}
+
+	return nil
+}
+
+func (s *SQLiteStore) GetFollowing(username string) (*model.Following, error) {
+	jsonArray, updatedAt, err := s.GetFollowingRaw(username)
+	if err != nil {
+		return nil, err
+	}
+
+	fw := model.Following{UpdatedAt: updatedAt, Usernames: model.NewFollowingUsernames()}
+	if err := json.Unmarshal(jsonArray, &fw.Usernames); err != nil {
+		return nil, err
+	}
+	return &fw, nil
+}
+
+func (s *SQLiteStore) GetFollowingRaw(username string) ([]byte, time.Time, error) {
+	stmt, err := prepare(rdb, `
+	SELECT updated_at, usernames
+	FROM following
+	WHERE username=?
+	`)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	row := stmt.QueryRow(username)
+
+	var usernames []byte
+	var updatedAt time.Time
+
+	err = row.Scan(&updatedAt, &usernames)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, time.Time{}, ErrNotFound
+	}
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	usernames, err = unseal(usernames, "following", username)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	return usernames, updatedAt, nil
+}
+
+func (s *SQLiteStore) SetFollowing(username string, data *model.Following) error {
+	if data.Usernames == nil {
+		return nil
+	}
+
+	jsonArray, err := json.Marshal(&data.Usernames)
+	if err != nil {
+		return err
+	}
+	jsonArray, err = seal(jsonArray, "following", username)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`
+	UPDATE following
+	SET updated_at=?, usernames=?
+	WHERE username=?
+	`, time.Now(), jsonArray, username)
+	return err
+}
+
+func (s *SQLiteStore) UpdateFollowing(username string, fn func(fw *model.Following) error) (*model.Following, error) {
+	var fw *model.Following
+	err := WithTx(func(tx *Tx) error {
+		var jsonArray []byte
+		fw = &model.Following{Usernames: model.NewFollowingUsernames()}
+		err := tx.QueryRow(`SELECT updated_at, usernames FROM following WHERE username=?`, username).
+			Scan(&fw.UpdatedAt, &jsonArray)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrNotFound
+		}
+		if err != nil {
+			return err
+		}
+		jsonArray, err = unseal(jsonArray, "following", username)
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(jsonArray, &fw.Usernames); err != nil {
+			return err
+		}
+
+		if err := fn(fw); err != nil {
+			return err
+		}
+
+		jsonArray, err = json.Marshal(&fw.Usernames)
+		if err != nil {
+			return err
+		}
+		jsonArray, err = seal(jsonArray, "following", username)
+		if err != nil {
+			return err
+		}
+		fw.UpdatedAt = time.Now()
+		_, err = tx.Exec(`
+		UPDATE following
+		SET updated_at=?, usernames=?
+		WHERE username=?
+		`, fw.UpdatedAt, jsonArray, username)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return fw, nil
+}
+
+func (s *SQLiteStore) AllFollowing() (model.FollowingUsernames, error) {
+	rows, err := rdb.Query(`SELECT username, usernames FROM following`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	all := model.NewFollowingUsernames()
+	for rows.Next() {
+		var username string
+		var jsonArray []byte
+		if err := rows.Scan(&username, &jsonArray); err != nil {
+			return nil, err
+		}
+		jsonArray, err = unseal(jsonArray, "following", username)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(jsonArray, &all); err != nil {
+			return nil, err
+		}
+	}
+	return all, rows.Err()
+}
+
+func (s *SQLiteStore) DeleteUser(username string) error {
+	return WithTx(func(tx *Tx) error {
+		stmts := []string{
+			`DELETE FROM statuses WHERE username=?`,
+			`DELETE FROM following WHERE username=?`,
+			`DELETE FROM webhook_deliveries WHERE webhook_id IN (SELECT id FROM webhooks WHERE owner=?)`,
+			`DELETE FROM webhooks WHERE owner=?`,
+			`DELETE FROM lists WHERE username=?`,
+			`DELETE FROM privacy WHERE username=?`,
+			`DELETE FROM status_history WHERE username=?`,
+			`DELETE FROM sessions WHERE username=?`,
+			`DELETE FROM accounts WHERE username=?`,
+		}
+		for _, stmt := range stmts {
+			if _, err := tx.Exec(stmt, username); err != nil {
+				return err
+			}
+		}
+
+		// Payloads have the global username
+		_, err := tx.Exec(`
+		DELETE FROM webhook_deliveries
+		WHERE json_valid(CAST(payload AS TEXT)) AND json_extract(CAST(payload AS TEXT), '$.username')=?
+		`, "@"+username+"@"+config.Conf.Server.Domain)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(`
+		INSERT OR IGNORE INTO deleted_users (username, deleted_at)
+		VALUES (?,?)
+		`, username, time.Now().UTC())
+		return err
+	})
+}
+
+// LockUser only locks the user in this process. Other processes using the
+// database, like whatsup commands, only make changes that are atomic on
+// their own.
+func (s *SQLiteStore) LockUser(username string) (func(), error) {
+	return userLocks.Lock(username), nil
+}
+
+// Close does nothing, the SQLite database is closed by the package-level Close.
+func (s *SQLiteStore) Close() error {
+	return nil
+}
@@ -0,0 +1,368 @@
+package db
+
+import (
+	"errors"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/makeworld-the-better-one/whatsup/config"
+	"github.com/makeworld-the-better-one/whatsup/hub"
+	"github.com/makeworld-the-better-one/whatsup/model"
+)
+
+// Store keeps the data of local users: statuses and following lists, follow
+// lists, privacy settings, accounts and sessions, status history, and
+// webhooks with their deliveries. Init picks the implementation from
+// config.Conf.Data.Driver: SQLiteStore, PostgresStore, or MemoryStore.
+//
+// What only matters to one server is always kept in the SQLite database in
+// the data dir: the state of remote users and WebSub subscriptions. Avatar
+// images are files in the data dir no matter the Store, only their paths and
+// numbers are stored.
+//
+// Implementations only store data. Recording history and notifying hub
+// subscribers is added by WithHooks, so that it's the same for all of them.
+// WithHooks also makes the writes for each user happen one at a time, using
+// LockUser.
+type Store interface {
+	// CreateUser creates a new user with empty data and an account with the
+	// user role, only if the user doesn't already exist.
+	CreateUser(username string) error
+
+	// GetUser returns the status of the user.
+	// Returns ErrNotFound if the user doesn't exist.
+	GetUser(username string) (*model.Status, error)
+
+	// GetUsers returns the statuses of many users at once, keyed by username.
+	// Users that don't exist are left out of the map, it's not an error.
+	GetUsers(usernames []string) (map[string]*model.Status, error)
+
+	// SetUser sets the fields for a user that already exists.
+	// Fields with nil pointers means the existing data will remain unchanged.
+	//
+	// UpdatedAt is always ignored and always set here.
+	SetUser(username string, data *model.Status) error
+
+	// SetAvatar sets the avatar image for a user, and increments the avatar
+	// number. The user must exist already.
+	//
+	// Due to the diverse set of possible issues this function could encounter,
+	// it does logging of errors internally. If it returns an error, it doesn't
+	// need to be logged, because this function will have already logged it.
+	SetAvatar(username string, img []byte) error
+
+	// RemoveAvatar removes the avatar image for a user. The user must exist
+	// already. The avatar number is left as is, so the avatar URL won't repeat
+	// if a new avatar is set later.
+	//
+	// Like SetAvatar, errors are logged internally.
+	RemoveAvatar(username string) error
+
+	// GetFollowing returns the following list for the given username.
+	// Returns ErrNotFound if the user doesn't exist.
+	GetFollowing(username string) (*model.Following, error)
+
+	// GetFollowingRaw is like GetFollowing but it returns the JSON-encoded
+	// usernames array, unparsed.
+	GetFollowingRaw(username string) ([]byte, time.Time, error)
+
+	// SetFollowing sets the following usernames for a user that already exists.
+	// If data.Usernames is nil it is ignored.
+	//
+	// UpdatedAt is always ignored and always set here.
+	SetFollowing(username string, data *model.Following) error
+
+	// UpdateFollowing changes the following list of a user that already
+	// exists. fn is called with the current list, and the usernames it leaves
+	// in it are saved. Reading and saving is one atomic step, so concurrent
+	// updates don't overwrite each other. If fn returns an error nothing is
+	// saved and the error is returned.
+	//
+	// The saved list is returned. fn must not use the Store.
+	UpdateFollowing(username string, fn func(fw *model.Following) error) (*model.Following, error)
+
+	// AllFollowing returns every global username followed by any user.
+	AllFollowing() (model.FollowingUsernames, error)
+
+	// DeleteUser removes everything the Store has about the user: status,
+	// following list, follow lists, privacy settings, history, account,
+	// sessions, and webhooks with their deliveries, along with pending
+	// deliveries to server-wide webhooks about the user. It leaves a
+	// tombstone in the same step, so IsDeleted is true from then on.
+	// The avatar image file is left for the caller.
+	DeleteUser(username string) error
+
+	// LockUser locks the data of the user, so that writes by anyone else who
+	// locks it wait until unlock is called. Stores that can be shared by
+	// several servers lock it for all of them.
+	LockUser(username string) (unlock func(), err error)
+
+	ListStore
+	PrivacyStore
+	AccountStore
+	SessionStore
+	HistoryStore
+	WebhookStore
+
+	Close() error
+}
+
+// Default is the Store of the server, set by Init.
+var Default Store
+
+// WithHooks wraps a Store so that status changes are added to the user's
+// history and sent to hub subscribers, and following changes prune the
+// user's lists and are sent to hub subscribers.
+//
+// Writes hold the user's lock from LockUser until the hooks are done, so
+// history and events are in the same order as the changes.
+func WithHooks(s Store) Store {
+	return &hookedStore{Store: s, relay: relayOf(s)}
+}
+
+type hookedStore struct {
+	Store
+	// relay is set if the Store can be shared by several servers, to tell
+	// the others about changes
+	relay relay
+}
+
+func (h *hookedStore) lock(username string) (func(), error) {
+	return h.Store.LockUser(username)
+}
+
+func (h *hookedStore) CreateUser(username string) error {
+	unlock, err := h.lock(username)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return h.Store.CreateUser(username)
+}
+
+func (h *hookedStore) SetUser(username string, data *model.Status) error {
+	unlock, err := h.lock(username)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if err := h.Store.SetUser(username, data); err != nil {
+		return err
+	}
+	return h.statusChanged(username)
+}
+
+func (h *hookedStore) SetAvatar(username string, img []byte) error {
+	unlock, err := h.lock(username)
+	if err != nil {
+		log.Printf("SetAvatar: locking %s: %v", username, err)
+		return err
+	}
+	defer unlock()
+	if err := h.Store.SetAvatar(username, img); err != nil {
+		return err
+	}
+	if err := h.statusChanged(username); err != nil {
+		log.Printf("SetAvatar: statusChanged for %s: %v", username, err)
+		return err
+	}
+	return nil
+}
+
+func (h *hookedStore) RemoveAvatar(username string) error {
+	unlock, err := h.lock(username)
+	if err != nil {
+		log.Printf("RemoveAvatar: locking %s: %v", username, err)
+		return err
+	}
+	defer unlock()
+	if err := h.Store.RemoveAvatar(username); err != nil {
+		return err
+	}
+	if err := h.statusChanged(username); err != nil {
+		log.Printf("RemoveAvatar: statusChanged for %s: %v", username, err)
+		return err
+	}
+	return nil
+}
+
+func (h *hookedStore) SetFollowing(username string, data *model.Following) error {
+	if data.Usernames == nil {
+		return nil
+	}
+	unlock, err := h.lock(username)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if err := h.Store.SetFollowing(username, data); err != nil {
+		return err
+	}
+	fw, err := h.Store.GetFollowing(username)
+	if err != nil {
+		return err
+	}
+	return h.followingChanged(username, fw)
+}
+
+func (h *hookedStore) UpdateFollowing(username string, fn func(fw *model.Following) error) (*model.Following, error) {
+	unlock, err := h.lock(username)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	fw, err := h.Store.UpdateFollowing(username, fn)
+	if err != nil {
+		return nil, err
+	}
+	return fw, h.followingChanged(username, fw)
+}
+
+func (h *hookedStore) DeleteUser(username string) error {
+	unlock, err := h.lock(username)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return h.deleteUser(username)
+}
+
+// deleteUser is DeleteUser for callers that already hold the user's lock.
+func (h *hookedStore) deleteUser(username string) error {
+	if err := h.Store.DeleteUser(username); err != nil {
+		return err
+	}
+	if h.relay != nil {
+		if err := h.relay.notify(relayDeleted, username); err != nil {
+			log.Printf("db: relaying deletion of %s: %v", username, err)
+		}
+	}
+	return nil
+}
+
+// followingChanged prunes the user's lists, which can only contain followed
+// usernames, and notifies hub subscribers of the new following list.
+func (h *hookedStore) followingChanged(username string, fw *model.Following) error {
+	if err := pruneLists(h.Store, username, fw.Usernames); err != nil {
+		return err
+	}
+	h.publish(&hub.Event{Type: hub.EventFollowing, Username: username, Following: fw})
+	return nil
+}
+
+// statusChanged records the current status of the user in their history,
+// and notifies hub subscribers of it.
+func (h *hookedStore) statusChanged(username string) error {
+	status, err := h.Store.GetUser(username)
+	if err != nil {
+		return err
+	}
+	if err := h.Store.AddHistory(username, status); err != nil {
+		return err
+	}
+	h.publish(&hub.Event{Type: hub.EventStatus, Username: username, Status: status})
+	return nil
+}
+
+// publish sends the event to hub subscribers, and to other servers sharing
+// the Store. Failing to tell the other servers is only logged, the change
+// was made.
+func (h *hookedStore) publish(e *hub.Event) {
+	hub.Publish(e)
+	if h.relay == nil {
+		return
+	}
+	if err := h.relay.notify(e.Type, e.Username); err != nil {
+		log.Printf("db: relaying %s event of %s: %v", e.Type, e.Username, err)
+	}
+}
+
+// Helpers shared by the Store implementations
+
+// avatarPaths returns the avatar paths of a user that has an avatar.
+func avatarPaths(username string) map[string]string {
+	return map[string]string{"original": "/.well-known/fmrl/avatars/" + username + "/original"}
+}
+
+// writeAvatar saves the avatar image file of a user, logging any errors.
+func writeAvatar(username string, img []byte) error {
+	dir := filepath.Join(config.Conf.Data.Dir, "avatars", username)
+	err := os.Mkdir(dir, 0755)
+	if err != nil && !errors.Is(err, fs.ErrExist) {
+		log.Printf("SetAvatar: creating %s : %v", dir, err)
+		return err
+	}
+
+	imgpath := filepath.Join(dir, "original")
+	f, err := os.OpenFile(imgpath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		log.Printf("SetAvatar: creating %s : %v", imgpath, err)
+		return err
+	}
+	defer f.Close()
+
+	_, err = f.Write(img)
+	if err != nil {
+		log.Printf("SetAvatar: writing to file for %s: %v", username, err)
+		return err
+	}
+	return nil
+}
+
+// deleteAvatar removes the avatar image file of a user if it exists,
+// logging any errors.
+func deleteAvatar(username string) error {
+	imgpath := filepath.Join(config.Conf.Data.Dir, "avatars", username, "original")
+	err := os.Remove(imgpath)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		// Unexpected error
+		log.Printf("RemoveAvatar: removing %s : %v", imgpath, err)
+		return err
+	}
+	return nil
+}
+
+// statusColumns returns the columns and values to update for the fields
+// of data that are set, in SetUser. updated_at is not included.
+func statusColumns(data *model.Status) ([]string, []interface{}) {
+	cols := make([]string, 0)
+	args := make([]interface{}, 0)
+
+	if data.Avatar != nil {
+		cols = append(cols, "avatar")
+		args = append(args, data.Avatar.Paths["original"])
+
+		if data.Avatar.Num != nil {
+			cols = append(cols, "avatar_num")
+			args = append(args, *data.Avatar.Num)
+		}
+	}
+	if data.Name != nil {
+		cols = append(cols, "name")
+		args = append(args, *data.Name)
+	}
+	if data.Status != nil {
+		cols = append(cols, "status")
+		args = append(args, *data.Status)
+	}
+	if data.Emoji != nil {
+		cols = append(cols, "emoji")
+		args = append(args, *data.Emoji)
+	}
+	if data.Media != nil {
+		cols = append(cols, "media")
+		args = append(args, *data.Media)
+	}
+	if data.MediaType != nil {
+		cols = append(cols, "media_type")
+		args = append(args, *data.MediaType)
+	}
+	if data.URI != nil {
+		cols = append(cols, "uri")
+		args = append(args, *data.URI)
+	}
+	return cols, args
+}
@@ -0,0 +1,325 @@
+package db
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/makeworld-the-better-one/whatsup/model"
+)
+
+// PostgresTestDSN is the environment variable with the connection string of
+// a PostgreSQL database the tests can use. They are skipped if it's not set.
+const PostgresTestDSN = "WHATSUP_TEST_POSTGRES_DSN"
+
+// testStores runs fn with each Store implementation. The SQLite database is
+// set up for all of them, since what only matters to one server is always
+// there.
+func testStores(t *testing.T, fn func(t *testing.T, s Store)) {
+	t.Run("sqlite", func(t *testing.T) {
+		openTestDB(t, "sqlite")
+		fn(t, &SQLiteStore{})
+	})
+	t.Run("memory", func(t *testing.T) {
+		openTestDB(t, "sqlite")
+		fn(t, NewMemoryStore())
+	})
+	t.Run("postgres", func(t *testing.T) {
+		dsn := os.Getenv(PostgresTestDSN)
+		if dsn == "" {
+			t.Skip(PostgresTestDSN + " not set")
+		}
+		openTestDB(t, "sqlite")
+		s, err := NewPostgresStore(dsn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+		fn(t, s)
+	})
+}
+
+// testUsername returns a username that isn't used yet, since the PostgreSQL
+// database is kept between test runs.
+func testUsername(name string) string {
+	return name + strconv.FormatInt(time.Now().UnixNano(), 36)
+}
+
+func TestStore(t *testing.T) {
+	testStores(t, testStore)
+}
+
+func testStore(t *testing.T, s Store) {
+	alice := testUsername("alice")
+	nobody := testUsername("nobody")
+
+	if _, err := s.GetUser(nobody); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetUser of missing user: got %v, want ErrNotFound", err)
+	}
+	if _, err := s.GetFollowing(nobody); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetFollowing of missing user: got %v, want ErrNotFound", err)
+	}
+	if _, err := s.UpdateFollowing(nobody, func(*model.Following) error { return nil }); !errors.Is(err, ErrNotFound) {
+		t.Errorf("UpdateFollowing of missing user: got %v, want ErrNotFound", err)
+	}
+
+	// New users are empty
+	if err := s.CreateUser(alice); err != nil {
+		t.Fatal(err)
+	}
+	status, err := s.GetUser(alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *status.Name != "" || *status.Status != "" || *status.MediaType != 0 {
+		t.Errorf("new user has status %+v", status)
+	}
+	if raw, _, err := s.GetFollowingRaw(alice); err != nil || string(raw) != "[]" {
+		t.Errorf("new user follows %s, %v", raw, err)
+	}
+
+	// Fields that aren't set are left as they are
+	name, text := "Alice", "hello"
+	if err := s.SetUser(alice, &model.Status{Name: &name}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetUser(alice, &model.Status{Status: &text}); err != nil {
+		t.Fatal(err)
+	}
+	status, err = s.GetUser(alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *status.Name != name || *status.Status != text {
+		t.Errorf("got name %q and status %q", *status.Name, *status.Status)
+	}
+	if time.Since(status.UpdatedAt) > time.Minute {
+		t.Errorf("UpdatedAt is %v", status.UpdatedAt)
+	}
+
+	// Creating an existing user changes nothing
+	if err := s.CreateUser(alice); err != nil {
+		t.Fatal(err)
+	}
+	if status, err := s.GetUser(alice); err != nil || *status.Status != text {
+		t.Errorf("CreateUser reset the status: %v", err)
+	}
+
+	statuses, err := s.GetUsers([]string{alice, nobody})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(statuses) != 1 || statuses[alice] == nil || *statuses[alice].Name != name {
+		t.Errorf("GetUsers returned %v", statuses)
+	}
+	if statuses, err := s.GetUsers(nil); err != nil || len(statuses) != 0 {
+		t.Errorf("GetUsers of no users returned %v, %v", statuses, err)
+	}
+
+	// Avatar numbers only go up
+	for i := 1; i <= 2; i++ {
+		if err := s.SetAvatar(alice, []byte("img")); err != nil {
+			t.Fatal(err)
+		}
+		status, err := s.GetUser(alice)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if *status.Avatar.Num != i || status.Avatar.Paths["original"] == "" {
+			t.Errorf("avatar after %d uploads is %v %d", i, status.Avatar.Paths, *status.Avatar.Num)
+		}
+	}
+	if err := s.RemoveAvatar(alice); err != nil {
+		t.Fatal(err)
+	}
+	status, err = s.GetUser(alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *status.Avatar.Num != 2 || status.Avatar.Paths["original"] != "" {
+		t.Errorf("removed avatar is %v %d", status.Avatar.Paths, *status.Avatar.Num)
+	}
+
+	// Following
+	fu := model.NewFollowingUsernames()
+	fu["bob@example.com"] = struct{}{}
+	if err := s.SetFollowing(alice, &model.Following{Usernames: fu}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetFollowing(alice, &model.Following{}); err != nil {
+		t.Fatal(err)
+	}
+	fw, err := s.UpdateFollowing(alice, func(fw *model.Following) error {
+		if _, ok := fw.Usernames["bob@example.com"]; !ok {
+			t.Errorf("UpdateFollowing got %v", fw.Usernames)
+		}
+		fw.Usernames["carol@example.com"] = struct{}{}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fw.Usernames) != 2 {
+		t.Errorf("UpdateFollowing returned %v", fw.Usernames)
+	}
+	errTest := errors.New("test")
+	_, err = s.UpdateFollowing(alice, func(fw *model.Following) error {
+		fw.Usernames = model.NewFollowingUsernames()
+		return errTest
+	})
+	if err != errTest {
+		t.Errorf("UpdateFollowing returned %v, want the error from fn", err)
+	}
+	raw, _, err := s.GetFollowingRaw(alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var usernames []string
+	if err := json.Unmarshal(raw, &usernames); err != nil || len(usernames) != 2 {
+		t.Errorf("following is %s, %v", raw, err)
+	}
+
+	if err := s.DeleteUser(alice); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.GetUser(alice); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetUser of deleted user: got %v, want ErrNotFound", err)
+	}
+	if _, err := s.GetFollowing(alice); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetFollowing of deleted user: got %v, want ErrNotFound", err)
+	}
+}
+
+// Concurrent changes to one user must all be kept. The server serializes
+// them with WithHooks, but commands and other connections don't go through
+// it, so the stores have to be atomic on their own.
+func TestStoreConcurrent(t *testing.T) {
+	testStores(t, func(t *testing.T, s Store) {
+		alice := testUsername("alice")
+		if err := s.CreateUser(alice); err != nil {
+			t.Fatal(err)
+		}
+
+		// Start out following some users, which are all unfollowed
+		const workers, each = 8, 10
+		fu := model.NewFollowingUsernames()
+		for w := 0; w < workers; w++ {
+			for i := 0; i < each; i++ {
+				fu["old"+strconv.Itoa(w*each+i)+"@example.com"] = struct{}{}
+			}
+		}
+		if err := s.SetFollowing(alice, &model.Following{Usernames: fu}); err != nil {
+			t.Fatal(err)
+		}
+
+		var wg sync.WaitGroup
+		for w := 0; w < workers; w++ {
+			wg.Add(2)
+			go func(w int) {
+				defer wg.Done()
+				for i := 0; i < each; i++ {
+					n := strconv.Itoa(w*each + i)
+					_, err := s.UpdateFollowing(alice, func(fw *model.Following) error {
+						fw.Usernames["new"+n+"@example.com"] = struct{}{}
+						delete(fw.Usernames, "old"+n+"@example.com")
+						return nil
+					})
+					if err != nil {
+						t.Error(err)
+						return
+					}
+				}
+			}(w)
+			go func() {
+				defer wg.Done()
+				for i := 0; i < each; i++ {
+					if err := s.SetAvatar(alice, []byte("img")); err != nil {
+						t.Error(err)
+						return
+					}
+				}
+			}()
+		}
+		wg.Wait()
+
+		fw, err := s.GetFollowing(alice)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(fw.Usernames) != workers*each {
+			t.Errorf("following %d users, want %d", len(fw.Usernames), workers*each)
+		}
+		for u := range fw.Usernames {
+			if strings.HasPrefix(u, "old") {
+				t.Errorf("%s wasn't unfollowed", u)
+				break
+			}
+		}
+
+		status, err := s.GetUser(alice)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if *status.Avatar.Num != workers*each {
+			t.Errorf("avatar number is %d, want %d", *status.Avatar.Num, workers*each)
+		}
+	})
+}
+
+func TestPrivacyAndHistory(t *testing.T) {
+	testStores(t, func(t *testing.T, s Store) {
+		alice, bob := testUsername("alice"), testUsername("bob")
+		for _, u := range []string{alice, bob} {
+			if err := s.CreateUser(u); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// Users without settings are public
+		p, err := s.GetPrivacy(alice)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.Mode != model.PrivacyPublic {
+			t.Errorf("default mode is %s", p.Mode)
+		}
+		p.Mode = model.PrivacyAllowList
+		p.Allow["friend@remote.example"] = struct{}{}
+		if err := s.SetPrivacy(alice, p); err != nil {
+			t.Fatal(err)
+		}
+		ps, err := s.GetPrivacies([]string{alice, bob})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ps) != 2 || ps[alice].Mode != model.PrivacyAllowList || ps[bob].Mode != model.PrivacyPublic {
+			t.Errorf("privacies are %+v", ps)
+		}
+		if _, ok := ps[alice].Allow["friend@remote.example"]; !ok {
+			t.Errorf("allow list is %v", ps[alice].Allow)
+		}
+
+		// History is newest first, and limited
+		for _, text := range []string{"one", "two", "three"} {
+			text := text
+			if err := s.AddHistory(alice, &model.Status{Status: &text}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		entries, err := s.GetHistory(alice, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 2 || *entries[0].Status.Status != "three" || *entries[1].Status.Status != "two" {
+			t.Errorf("history is %+v", entries)
+		}
+		if entries, err := s.GetHistory(bob, 10); err != nil || len(entries) != 0 {
+			t.Errorf("history of bob is %v, %v", entries, err)
+		}
+	})
+}
@@ -0,0 +1,65 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+)
+
+// Tx is a transaction on the SQLite database. It takes the write lock when it
+// begins, so that what's read in it can't be changed by anyone else before it
+// writes, including other processes like whatsup commands.
+//
+// database/sql can only begin deferred transactions with SQLite, which take
+// the lock at the first write, and fail instead of waiting if the database
+// was written to since they first read from it. That's why Tx uses BEGIN
+// IMMEDIATE on a connection of its own.
+type Tx struct {
+	conn *sql.Conn
+}
+
+func (tx *Tx) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return tx.conn.ExecContext(context.Background(), query, args...)
+}
+
+func (tx *Tx) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return tx.conn.QueryContext(context.Background(), query, args...)
+}
+
+func (tx *Tx) QueryRow(query string, args ...interface{}) *sql.Row {
+	return tx.conn.QueryRowContext(context.Background(), query, args...)
+}
+
+// WithTx runs fn in a transaction, which is committed if fn returns nil and
+// rolled back otherwise. The error from fn is returned as is.
+//
+// fn must only use tx for the database. The transaction holds the one
+// connection used for writing, so other functions in this package that write
+// would wait for it forever.
+func WithTx(fn func(tx *Tx) error) error {
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, `BEGIN IMMEDIATE`); err != nil {
+		return err
+	}
+	done := false
+	defer func() {
+		if !done {
+			// fn failed or panicked
+			conn.ExecContext(ctx, `ROLLBACK`)
+		}
+	}()
+
+	if err := fn(&Tx{conn}); err != nil {
+		return err
+	}
+	if _, err := conn.ExecContext(ctx, `COMMIT`); err != nil {
+		return err
+	}
+	done = true
+	return nil
+}
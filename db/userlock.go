@@ -0,0 +1,48 @@
+package db
+
+import "sync"
+
+// userLocks makes writes to the data of one user happen one at a time, for
+// any user, including ones created or deleted while the server runs.
+var userLocks = newKeyedMutex()
+
+// keyedMutex is a set of mutexes by key. Mutexes are created when first
+// locked, and removed when nothing holds or waits for them, so it doesn't
+// grow with every key ever used.
+type keyedMutex struct {
+	mu    sync.Mutex
+	locks map[string]*refMutex
+}
+
+type refMutex struct {
+	sync.Mutex
+	refs int // Holders and waiters, protected by keyedMutex.mu
+}
+
+func newKeyedMutex() *keyedMutex {
+	return &keyedMutex{locks: make(map[string]*refMutex)}
+}
+
+// Lock locks the mutex for key, and returns the function that unlocks it.
+func (k *keyedMutex) Lock(key string) (unlock func()) {
+	k.mu.Lock()
+	m, ok := k.locks[key]
+	if !ok {
+		m = &refMutex{}
+		k.locks[key] = m
+	}
+	m.refs++
+	k.mu.Unlock()
+
+	m.Lock()
+	return func() {
+		m.Unlock()
+
+		k.mu.Lock()
+		m.refs--
+		if m.refs == 0 {
+			delete(k.locks, key)
+		}
+		k.mu.Unlock()
+	}
+}
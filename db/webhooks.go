@@ -0,0 +1,364 @@
+package db
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/makeworld-the-better-one/whatsup/model"
+)
+
+// WebhookStore keeps webhooks, and the queue and log of their deliveries.
+type WebhookStore interface {
+	// GetWebhooks returns the webhooks owned by the username, or the
+	// server-wide webhooks if username is empty.
+	GetWebhooks(username string) ([]*model.Webhook, error)
+
+	// GetEnabledWebhooks returns all enabled webhooks.
+	GetEnabledWebhooks() ([]*model.Webhook, error)
+
+	// GetWebhook returns the webhook with the ID, owned by the username.
+	// Returns ErrNotFound if there is no such webhook.
+	GetWebhook(username string, id int64) (*model.Webhook, error)
+
+	// GetWebhookByID returns the webhook with the ID, no matter who owns it.
+	// Returns ErrNotFound if there is no such webhook.
+	GetWebhookByID(id int64) (*model.Webhook, error)
+
+	// CreateWebhook stores a new webhook, and sets its ID and creation time.
+	CreateWebhook(wh *model.Webhook) error
+
+	// UpdateWebhook sets the secret, events and users of the webhook with
+	// the ID of wh.
+	UpdateWebhook(wh *model.Webhook) error
+
+	// SetWebhookEnabled enables or disables a webhook, and resets its
+	// failure count.
+	SetWebhookEnabled(id int64, enabled bool) error
+
+	// DeleteWebhook deletes a webhook and its deliveries.
+	// Returns ErrNotFound if there is no such webhook owned by the username.
+	DeleteWebhook(username string, id int64) error
+
+	// RecordWebhookResult updates the consecutive failure count of a webhook
+	// after a delivery attempt, and disables it once the count reaches
+	// disableAfter. It returns true if the webhook was disabled.
+	RecordWebhookResult(id int64, success bool, disableAfter int) (bool, error)
+
+	// EnqueueDeliveries adds a pending delivery of the payload for each of
+	// the webhooks, to be attempted now. They are added in one transaction.
+	EnqueueDeliveries(webhookIDs []int64, event string, payload []byte) error
+
+	// DueDeliveries returns up to limit pending deliveries whose next attempt
+	// is due, oldest first. They are claimed by moving their next attempt a
+	// minute ahead, so that servers sharing the Store don't send them at the
+	// same time. UpdateDelivery stores the real next attempt.
+	DueDeliveries(limit int) ([]*model.WebhookDelivery, error)
+
+	// GetDeliveries returns the most recent deliveries for a webhook, newest
+	// first.
+	GetDeliveries(webhookID int64, limit int) ([]*model.WebhookDelivery, error)
+
+	// UpdateDelivery stores the result of a delivery attempt.
+	UpdateDelivery(d *model.WebhookDelivery) error
+
+	// PruneDeliveries deletes finished deliveries last updated before the
+	// time.
+	PruneDeliveries(before time.Time) error
+
+	// CountPendingDeliveries returns how many deliveries are waiting to be
+	// sent.
+	CountPendingDeliveries() (int, error)
+}
+
+// deliveryClaim is how long DueDeliveries holds back the deliveries it
+// returns. Sending one takes at most the webhook client timeout.
+const deliveryClaim = time.Minute
+
+const webhookColumns = `id, owner, url, secret, events, users, enabled, failures, created_at`
+
+func scanWebhook(row interface{ Scan(...interface{}) error }) (*model.Webhook, error) {
+	var wh model.Webhook
+	var events, users []byte
+	err := row.Scan(&wh.ID, &wh.Owner, &wh.URL, &wh.Secret, &events, &users, &wh.Enabled, &wh.Failures, &wh.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(events, &wh.Events); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(users, &wh.Users); err != nil {
+		return nil, err
+	}
+	return &wh, nil
+}
+
+func (s *SQLiteStore) queryWebhooks(query string, args ...interface{}) ([]*model.Webhook, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	webhooks := make([]*model.Webhook, 0)
+	for rows.Next() {
+		wh, err := scanWebhook(rows)
+		if err != nil {
+			return nil, err
+		}
+		webhooks = append(webhooks, wh)
+	}
+	return webhooks, rows.Err()
+}
+
+func (s *SQLiteStore) GetWebhooks(username string) ([]*model.Webhook, error) {
+	return s.queryWebhooks(`SELECT `+webhookColumns+` FROM webhooks WHERE owner=? ORDER BY id`, username)
+}
+
+func (s *SQLiteStore) GetEnabledWebhooks() ([]*model.Webhook, error) {
+	return s.queryWebhooks(`SELECT ` + webhookColumns + ` FROM webhooks WHERE enabled=1 ORDER BY id`)
+}
+
+func (s *SQLiteStore) GetWebhook(username string, id int64) (*model.Webhook, error) {
+	row := db.QueryRow(`SELECT `+webhookColumns+` FROM webhooks WHERE owner=? AND id=?`, username, id)
+	wh, err := scanWebhook(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	return wh, err
+}
+
+func (s *SQLiteStore) GetWebhookByID(id int64) (*model.Webhook, error) {
+	row := db.QueryRow(`SELECT `+webhookColumns+` FROM webhooks WHERE id=?`, id)
+	wh, err := scanWebhook(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	return wh, err
+}
+
+func (s *SQLiteStore) CreateWebhook(wh *model.Webhook) error {
+	events, err := json.Marshal(wh.Events)
+	if err != nil {
+		return err
+	}
+	users, err := json.Marshal(wh.Users)
+	if err != nil {
+		return err
+	}
+
+	wh.CreatedAt = time.Now()
+	res, err := db.Exec(`
+	INSERT INTO webhooks
+	(owner, url, secret, events, users, enabled, failures, created_at)
+	VALUES (?,?,?,?,?,?,?,?)
+	`, wh.Owner, wh.URL, wh.Secret, events, users, wh.Enabled, wh.Failures, wh.CreatedAt)
+	if err != nil {
+		return err
+	}
+	wh.ID, err = res.LastInsertId()
+	return err
+}
+
+func (s *SQLiteStore) UpdateWebhook(wh *model.Webhook) error {
+	events, err := json.Marshal(wh.Events)
+	if err != nil {
+		return err
+	}
+	users, err := json.Marshal(wh.Users)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`UPDATE webhooks SET secret=?, events=?, users=? WHERE id=?`,
+		wh.Secret, events, users, wh.ID)
+	return err
+}
+
+func (s *SQLiteStore) SetWebhookEnabled(id int64, enabled bool) error {
+	_, err := db.Exec(`UPDATE webhooks SET enabled=?, failures=0 WHERE id=?`, enabled, id)
+	return err
+}
+
+func (s *SQLiteStore) DeleteWebhook(username string, id int64) error {
+	res, err := db.Exec(`DELETE FROM webhooks WHERE owner=? AND id=?`, username, id)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrNotFound
+	}
+	_, err = db.Exec(`DELETE FROM webhook_deliveries WHERE webhook_id=?`, id)
+	return err
+}
+
+func (s *SQLiteStore) RecordWebhookResult(id int64, success bool, disableAfter int) (bool, error) {
+	if success {
+		_, err := db.Exec(`UPDATE webhooks SET failures=0 WHERE id=?`, id)
+		return false, err
+	}
+
+	_, err := db.Exec(`UPDATE webhooks SET failures=failures+1 WHERE id=?`, id)
+	if err != nil {
+		return false, err
+	}
+	res, err := db.Exec(`UPDATE webhooks SET enabled=0 WHERE id=? AND enabled=1 AND failures>=?`, id, disableAfter)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+const deliveryColumns = `id, webhook_id, event, payload, state, attempts, next_attempt, last_code, last_error, created_at, updated_at`
+
+func scanDeliveries(rows *sql.Rows) ([]*model.WebhookDelivery, error) {
+	defer rows.Close()
+
+	deliveries := make([]*model.WebhookDelivery, 0)
+	for rows.Next() {
+		var d model.WebhookDelivery
+		var payload []byte
+		err := rows.Scan(&d.ID, &d.WebhookID, &d.Event, &payload, &d.State, &d.Attempts,
+			&d.NextAttempt, &d.LastCode, &d.LastError, &d.CreatedAt, &d.UpdatedAt)
+		if err != nil {
+			return nil, err
+		}
+		d.Payload = payload
+		deliveries = append(deliveries, &d)
+	}
+	return deliveries, rows.Err()
+}
+
+func (s *SQLiteStore) EnqueueDeliveries(webhookIDs []int64, event string, payload []byte) error {
+	if len(webhookIDs) == 0 {
+		return nil
+	}
+	// Times are in UTC so they compare correctly as strings in SQLite
+	now := time.Now().UTC()
+	return WithTx(func(tx *Tx) error {
+		for _, id := range webhookIDs {
+			_, err := tx.Exec(`
+			INSERT INTO webhook_deliveries
+			(webhook_id, event, payload, state, attempts, next_attempt, last_code, last_error, created_at, updated_at)
+			VALUES (?,?,?,?,?,?,?,?,?,?)
+			`, id, event, payload, model.DeliveryPending, 0, now, 0, "", now, now)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *SQLiteStore) DueDeliveries(limit int) ([]*model.WebhookDelivery, error) {
+	var deliveries []*model.WebhookDelivery
+	err := WithTx(func(tx *Tx) error {
+		now := time.Now().UTC()
+		rows, err := tx.Query(`
+		SELECT `+deliveryColumns+`
+		FROM webhook_deliveries
+		WHERE state=? AND next_attempt<=?
+		ORDER BY next_attempt
+		LIMIT ?
+		`, model.DeliveryPending, now, limit)
+		if err != nil {
+			return err
+		}
+		deliveries, err = scanDeliveries(rows)
+		if err != nil {
+			return err
+		}
+		for _, d := range deliveries {
+			_, err := tx.Exec(`UPDATE webhook_deliveries SET next_attempt=? WHERE id=?`, now.Add(deliveryClaim), d.ID)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return deliveries, nil
+}
+
+func (s *SQLiteStore) GetDeliveries(webhookID int64, limit int) ([]*model.WebhookDelivery, error) {
+	rows, err := db.Query(`
+	SELECT `+deliveryColumns+`
+	FROM webhook_deliveries
+	WHERE webhook_id=?
+	ORDER BY id DESC
+	LIMIT ?
+	`, webhookID, limit)
+	if err != nil {
+		return nil, err
+	}
+	return scanDeliveries(rows)
+}
+
+func (s *SQLiteStore) UpdateDelivery(d *model.WebhookDelivery) error {
+	d.UpdatedAt = time.Now().UTC()
+	_, err := db.Exec(`
+	UPDATE webhook_deliveries
+	SET state=?, attempts=?, next_attempt=?, last_code=?, last_error=?, updated_at=?
+	WHERE id=?
+	`, d.State, d.Attempts, d.NextAttempt.UTC(), d.LastCode, d.LastError, d.UpdatedAt, d.ID)
+	return err
+}
+
+func (s *SQLiteStore) PruneDeliveries(before time.Time) error {
+	_, err := db.Exec(`DELETE FROM webhook_deliveries WHERE state!=? AND updated_at<?`,
+		model.DeliveryPending, before.UTC())
+	return err
+}
+
+// SyncServerWebhooks makes the server-wide webhooks in st match the provided
+// ones, which come from the config. Existing webhooks with the same URL are
+// kept, so their delivery log isn't lost, but the rest of their fields are
+// updated.
+func SyncServerWebhooks(st Store, webhooks []*model.Webhook) error {
+	existing, err := st.GetWebhooks("")
+	if err != nil {
+		return err
+	}
+	byURL := make(map[string]*model.Webhook, len(existing))
+	for _, wh := range existing {
+		byURL[wh.URL] = wh
+	}
+
+	for _, wh := range webhooks {
+		wh.Owner = ""
+		wh.Users = nil
+		old, ok := byURL[wh.URL]
+		if !ok {
+			wh.Enabled = true
+			if err := st.CreateWebhook(wh); err != nil {
+				return err
+			}
+			continue
+		}
+		delete(byURL, wh.URL)
+
+		wh.ID = old.ID
+		if err := st.UpdateWebhook(wh); err != nil {
+			return err
+		}
+	}
+
+	// Remove webhooks no longer in the config
+	for _, wh := range byURL {
+		if err := st.DeleteWebhook("", wh.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *SQLiteStore) CountPendingDeliveries() (int, error) {
+	var n int
+	err := db.QueryRow(`SELECT COUNT(*) FROM webhook_deliveries WHERE state=?`, model.DeliveryPending).Scan(&n)
+	return n, err
+}
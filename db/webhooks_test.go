@@ -0,0 +1,131 @@
+package db
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/makeworld-the-better-one/whatsup/model"
+)
+
+func TestWebhookStore(t *testing.T) {
+	testStores(t, func(t *testing.T, s Store) {
+		alice := testUsername("alice")
+		if err := s.CreateUser(alice); err != nil {
+			t.Fatal(err)
+		}
+
+		wh := &model.Webhook{Owner: alice, URL: "https://hooks.example/", Events: []string{model.WebhookStatus}, Enabled: true}
+		if err := s.CreateWebhook(wh); err != nil {
+			t.Fatal(err)
+		}
+		if wh.ID == 0 || wh.CreatedAt.IsZero() {
+			t.Errorf("created webhook is %+v", wh)
+		}
+		wh.Secret = "s3cret"
+		wh.Events = []string{model.WebhookStatus, model.WebhookFollowing}
+		if err := s.UpdateWebhook(wh); err != nil {
+			t.Fatal(err)
+		}
+		got, err := s.GetWebhook(alice, wh.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Secret != "s3cret" || len(got.Events) != 2 || !got.Enabled {
+			t.Errorf("webhook is %+v", got)
+		}
+		if _, err := s.GetWebhook(testUsername("bob"), wh.ID); !errors.Is(err, ErrNotFound) {
+			t.Errorf("webhook of someone else: got %v, want ErrNotFound", err)
+		}
+
+		// Failures disable the webhook once they reach the limit, and a
+		// success resets the count
+		for i, want := range []bool{false, false, true} {
+			if i == 1 {
+				if _, err := s.RecordWebhookResult(wh.ID, true, 2); err != nil {
+					t.Fatal(err)
+				}
+			}
+			disabled, err := s.RecordWebhookResult(wh.ID, false, 2)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if disabled != want {
+				t.Errorf("failure %d: disabled is %v", i, disabled)
+			}
+		}
+		if got, err := s.GetWebhookByID(wh.ID); err != nil || got.Enabled || got.Failures != 2 {
+			t.Errorf("webhook after failures is %+v, %v", got, err)
+		}
+		if err := s.SetWebhookEnabled(wh.ID, true); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := s.GetWebhookByID(wh.ID); err != nil || !got.Enabled || got.Failures != 0 {
+			t.Errorf("webhook after enabling is %+v, %v", got, err)
+		}
+
+		// Due deliveries are claimed, so they aren't due again right away
+		pending, err := s.CountPendingDeliveries()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := s.EnqueueDeliveries([]int64{wh.ID}, model.WebhookStatus, []byte(`{"n":1}`)); err != nil {
+			t.Fatal(err)
+		}
+		if n, err := s.CountPendingDeliveries(); err != nil || n != pending+1 {
+			t.Errorf("%d pending deliveries, want %d: %v", n, pending+1, err)
+		}
+		due := dueFor(t, s, wh.ID)
+		if len(due) != 1 || string(due[0].Payload) != `{"n":1}` || due[0].State != model.DeliveryPending {
+			t.Fatalf("due deliveries are %+v", due)
+		}
+		if again := dueFor(t, s, wh.ID); len(again) != 0 {
+			t.Errorf("claimed deliveries are due again: %+v", again)
+		}
+
+		d := due[0]
+		d.State = model.DeliveryDelivered
+		d.Attempts = 1
+		d.LastCode = 200
+		if err := s.UpdateDelivery(d); err != nil {
+			t.Fatal(err)
+		}
+		ds, err := s.GetDeliveries(wh.ID, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ds) != 1 || ds[0].State != model.DeliveryDelivered || ds[0].LastCode != 200 {
+			t.Errorf("deliveries are %+v", ds)
+		}
+		if err := s.PruneDeliveries(time.Now().Add(time.Minute)); err != nil {
+			t.Fatal(err)
+		}
+		if ds, err := s.GetDeliveries(wh.ID, 10); err != nil || len(ds) != 0 {
+			t.Errorf("deliveries after pruning are %+v, %v", ds, err)
+		}
+
+		if err := s.DeleteWebhook(alice, wh.ID); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.DeleteWebhook(alice, wh.ID); !errors.Is(err, ErrNotFound) {
+			t.Errorf("deleting again: got %v, want ErrNotFound", err)
+		}
+	})
+}
+
+// dueFor returns the due deliveries of one webhook, since a shared database
+// can have others.
+func dueFor(t *testing.T, s Store, webhookID int64) []*model.WebhookDelivery {
+	t.Helper()
+	due, err := s.DueDeliveries(1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ds []*model.WebhookDelivery
+	for _, d := range due {
+		if d.WebhookID == webhookID {
+			ds = append(ds, d)
+		}
+	}
+	return ds
+}
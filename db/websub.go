@@ -0,0 +1,152 @@
+package db
+
+import (
+	"errors"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/makeworld-the-better-one/whatsup/model"
+)
+
+// ErrLimit is returned when creating an object would go over a limit.
+var ErrLimit = errors.New("limit reached")
+
+// callbackHost returns the host that subscriptions are counted by, without
+// the port.
+func callbackHost(callback string) string {
+	u, err := url.Parse(callback)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(u.Hostname())
+}
+
+// SetWebSubSubscription creates a subscription, or renews it if the callback
+// is already subscribed to the user.
+//
+// A new subscription isn't created if there are already max subscriptions for
+// its callback host, or max from its requester, and ErrLimit is returned.
+// Anonymous requesters are only limited by callback host.
+func SetWebSubSubscription(sub *model.WebSubSubscription, max int) error {
+	host := callbackHost(sub.Callback)
+	return WithTx(func(tx *Tx) error {
+		var n int
+		err := tx.QueryRow(`SELECT COUNT(*) FROM websub_subscriptions WHERE username=? AND callback=?`,
+			sub.Username, sub.Callback).Scan(&n)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			// New subscription, expired ones don't count
+			now := time.Now().UTC()
+			err := tx.QueryRow(`SELECT COUNT(*) FROM websub_subscriptions WHERE callback_host=? AND expires > ?`,
+				host, now).Scan(&n)
+			if err != nil {
+				return err
+			}
+			if n >= max {
+				return ErrLimit
+			}
+
+			if sub.Requester.Server != "" || sub.Requester.Username != "" {
+				// Local users have no server, so they're counted by username
+				err := tx.QueryRow(`
+				SELECT COUNT(*) FROM websub_subscriptions
+				WHERE requester_server=? AND (requester_server!='' OR requester_user=?) AND expires > ?
+				`, sub.Requester.Server, sub.Requester.Username, now).Scan(&n)
+				if err != nil {
+					return err
+				}
+				if n >= max {
+					return ErrLimit
+				}
+			}
+		}
+
+		_, err = tx.Exec(`
+		INSERT INTO websub_subscriptions
+		(username, callback, callback_host, secret, requester_server, requester_user, expires, created_at)
+		VALUES (?,?,?,?,?,?,?,?)
+		ON CONFLICT(username, callback) DO UPDATE SET
+			secret=excluded.secret, requester_server=excluded.requester_server,
+			requester_user=excluded.requester_user, expires=excluded.expires
+		`, sub.Username, sub.Callback, host, sub.Secret, sub.Requester.Server, sub.Requester.Username,
+			sub.Expires.UTC(), time.Now().UTC())
+		return err
+	})
+}
+
+// migrateWebSubCallbackHost adds the callback_host column, for limiting
+// subscriptions per host, and fills it in for existing subscriptions.
+func migrateWebSubCallbackHost(tx *Tx) error {
+	_, err := tx.Exec(`ALTER TABLE websub_subscriptions ADD COLUMN callback_host TEXT NOT NULL DEFAULT ''`)
+	if err != nil {
+		return err
+	}
+
+	rows, err := tx.Query(`SELECT DISTINCT callback FROM websub_subscriptions`)
+	if err != nil {
+		return err
+	}
+	var callbacks []string
+	for rows.Next() {
+		var callback string
+		if err := rows.Scan(&callback); err != nil {
+			rows.Close()
+			return err
+		}
+		callbacks = append(callbacks, callback)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, callback := range callbacks {
+		_, err := tx.Exec(`UPDATE websub_subscriptions SET callback_host=? WHERE callback=?`,
+			callbackHost(callback), callback)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = tx.Exec(`CREATE INDEX websub_subscriptions_host ON websub_subscriptions (callback_host)`)
+	return err
+}
+
+// DeleteWebSubSubscription removes the callback's subscription to the user,
+// if there is one.
+func DeleteWebSubSubscription(username, callback string) error {
+	_, err := db.Exec(`DELETE FROM websub_subscriptions WHERE username=? AND callback=?`, username, callback)
+	return err
+}
+
+// GetWebSubSubscriptions returns the unexpired subscriptions to the user.
+func GetWebSubSubscriptions(username string) ([]*model.WebSubSubscription, error) {
+	rows, err := db.Query(`
+	SELECT callback, secret, requester_server, requester_user, expires, created_at
+	FROM websub_subscriptions WHERE username=? AND expires > ?
+	`, username, time.Now().UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var subs []*model.WebSubSubscription
+	for rows.Next() {
+		sub := &model.WebSubSubscription{Username: username}
+		err := rows.Scan(&sub.Callback, &sub.Secret, &sub.Requester.Server, &sub.Requester.Username,
+			&sub.Expires, &sub.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		subs = append(subs, sub)
+	}
+	return subs, rows.Err()
+}
+
+// PruneWebSubSubscriptions deletes expired subscriptions.
+func PruneWebSubSubscriptions() error {
+	_, err := db.Exec(`DELETE FROM websub_subscriptions WHERE expires <= ?`, time.Now().UTC())
+	return err
+}
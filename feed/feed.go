@@ -0,0 +1,286 @@
+// feed renders a user's status history as Atom, RSS 2.0, and JSON Feed
+// documents, for following people with feed readers.
+package feed
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"html"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/makeworld-the-better-one/whatsup/model"
+)
+
+// Formats, which are also the file extensions of feed URLs
+const (
+	FormatAtom = "atom"
+	FormatRSS  = "rss"
+	FormatJSON = "json"
+)
+
+// ContentTypes maps formats to their media types.
+var ContentTypes = map[string]string{
+	FormatAtom: "application/atom+xml; charset=utf-8",
+	FormatRSS:  "application/rss+xml; charset=utf-8",
+	FormatJSON: "application/feed+json; charset=utf-8",
+}
+
+// ErrUnknownFormat is returned when rendering a format that isn't supported.
+var ErrUnknownFormat = errors.New("unknown feed format, must be atom, rss, or json")
+
+// Feed is the format-independent data of a feed.
+type Feed struct {
+	Title   string
+	Author  string
+	Link    string // Where the user's status can be seen
+	FeedURL string // Absolute URL of the feed itself
+	Icon    string // Absolute URL of the avatar, or empty
+	Updated time.Time
+	Entries []*Entry
+}
+
+// Entry is a single status change.
+type Entry struct {
+	ID        string
+	Title     string
+	Text      string
+	HTML      string
+	URI       string
+	Published time.Time
+}
+
+// NewEntry creates an entry from a past status. id must be unique and
+// permanent for the entry, and is used as-is in the feed.
+func NewEntry(id string, e *model.StatusEntry) *Entry {
+	s := e.Status
+	str := func(p *string) string {
+		if p == nil {
+			return ""
+		}
+		return *p
+	}
+
+	title := strings.TrimSpace(str(s.Emoji) + " " + str(s.Status))
+	if title == "" {
+		title = "(No status)"
+	}
+
+	var text, htm []string
+	if str(s.Status) != "" || str(s.Emoji) != "" {
+		t := strings.TrimSpace(str(s.Emoji) + " " + str(s.Status))
+		text = append(text, t)
+		htm = append(htm, "<p>"+html.EscapeString(t)+"</p>")
+	}
+	if str(s.Media) != "" {
+		mediaType := 0
+		if s.MediaType != nil {
+			mediaType = *s.MediaType
+		}
+		t := model.MediaTypeLabel(mediaType) + ": " + *s.Media
+		text = append(text, t)
+		htm = append(htm, "<p>"+html.EscapeString(t)+"</p>")
+	}
+	if str(s.URI) != "" {
+		text = append(text, *s.URI)
+		htm = append(htm, `<p><a href="`+html.EscapeString(*s.URI)+`">`+html.EscapeString(*s.URI)+"</a></p>")
+	}
+	if len(text) == 0 {
+		text = append(text, title)
+		htm = append(htm, "<p>"+html.EscapeString(title)+"</p>")
+	}
+
+	return &Entry{
+		ID:        id,
+		Title:     title,
+		Text:      strings.Join(text, "\n"),
+		HTML:      strings.Join(htm, "\n"),
+		URI:       str(s.URI),
+		Published: e.CreatedAt,
+	}
+}
+
+// Render returns the feed in the format.
+func (f *Feed) Render(format string) ([]byte, error) {
+	switch format {
+	case FormatAtom:
+		return f.atom()
+	case FormatRSS:
+		return f.rss()
+	case FormatJSON:
+		return f.json()
+	}
+	return nil, ErrUnknownFormat
+}
+
+type atomLink struct {
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+	Href string `xml:"href,attr"`
+}
+
+type atomText struct {
+	Type string `xml:"type,attr,omitempty"`
+	Body string `xml:",chardata"`
+}
+
+type atomEntry struct {
+	ID      string     `xml:"id"`
+	Title   string     `xml:"title"`
+	Updated string     `xml:"updated"`
+	Links   []atomLink `xml:"link"`
+	Content atomText   `xml:"content"`
+}
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Author  string      `xml:"author>name"`
+	Links   []atomLink  `xml:"link"`
+	Icon    string      `xml:"icon,omitempty"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+func (f *Feed) atom() ([]byte, error) {
+	af := &atomFeed{
+		ID:      f.FeedURL,
+		Title:   f.Title,
+		Updated: f.Updated.UTC().Format(time.RFC3339),
+		Author:  f.Author,
+		Links: []atomLink{
+			{Rel: "self", Type: ContentTypes[FormatAtom], Href: f.FeedURL},
+			{Rel: "alternate", Href: f.Link},
+		},
+		Icon: f.Icon,
+	}
+	for _, e := range f.Entries {
+		ae := atomEntry{
+			ID:      e.ID,
+			Title:   e.Title,
+			Updated: e.Published.UTC().Format(time.RFC3339),
+			Content: atomText{Type: "html", Body: e.HTML},
+		}
+		if e.URI != "" {
+			ae.Links = []atomLink{{Rel: "related", Href: e.URI}}
+		}
+		af.Entries = append(af.Entries, ae)
+	}
+	return marshalXML(af)
+}
+
+type rssImage struct {
+	URL   string `xml:"url"`
+	Title string `xml:"title"`
+	Link  string `xml:"link"`
+}
+
+type rssGUID struct {
+	IsPermaLink string `xml:"isPermaLink,attr"`
+	ID          string `xml:",chardata"`
+}
+
+type rssItem struct {
+	Title       string  `xml:"title"`
+	Link        string  `xml:"link,omitempty"`
+	Description string  `xml:"description"`
+	GUID        rssGUID `xml:"guid"`
+	PubDate     string  `xml:"pubDate"`
+}
+
+type rssFeed struct {
+	XMLName xml.Name `xml:"rss"`
+	Version string   `xml:"version,attr"`
+	Channel struct {
+		Title         string    `xml:"title"`
+		Link          string    `xml:"link"`
+		Description   string    `xml:"description"`
+		LastBuildDate string    `xml:"lastBuildDate"`
+		Image         *rssImage `xml:"image,omitempty"`
+		Items         []rssItem `xml:"item"`
+	} `xml:"channel"`
+}
+
+func (f *Feed) rss() ([]byte, error) {
+	rf := &rssFeed{Version: "2.0"}
+	rf.Channel.Title = f.Title
+	rf.Channel.Link = f.Link
+	rf.Channel.Description = "Status changes of " + f.Author
+	rf.Channel.LastBuildDate = f.Updated.UTC().Format(time.RFC1123Z)
+	if f.Icon != "" {
+		rf.Channel.Image = &rssImage{URL: f.Icon, Title: f.Title, Link: f.Link}
+	}
+	for _, e := range f.Entries {
+		rf.Channel.Items = append(rf.Channel.Items, rssItem{
+			Title:       e.Title,
+			Link:        e.URI,
+			Description: e.HTML,
+			GUID:        rssGUID{IsPermaLink: "false", ID: e.ID},
+			PubDate:     e.Published.UTC().Format(time.RFC1123Z),
+		})
+	}
+	return marshalXML(rf)
+}
+
+func marshalXML(v interface{}) ([]byte, error) {
+	b, err := xml.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), b...), nil
+}
+
+type jsonAuthor struct {
+	Name string `json:"name"`
+}
+
+type jsonItem struct {
+	ID            string `json:"id"`
+	Title         string `json:"title"`
+	ContentHTML   string `json:"content_html"`
+	ContentText   string `json:"content_text"`
+	ExternalURL   string `json:"external_url,omitempty"`
+	DatePublished string `json:"date_published"`
+}
+
+type jsonFeed struct {
+	Version     string       `json:"version"`
+	Title       string       `json:"title"`
+	HomePageURL string       `json:"home_page_url"`
+	FeedURL     string       `json:"feed_url"`
+	Icon        string       `json:"icon,omitempty"`
+	Authors     []jsonAuthor `json:"authors"`
+	Items       []jsonItem   `json:"items"`
+}
+
+func (f *Feed) json() ([]byte, error) {
+	jf := &jsonFeed{
+		Version:     "https://jsonfeed.org/version/1.1",
+		Title:       f.Title,
+		HomePageURL: f.Link,
+		FeedURL:     f.FeedURL,
+		Icon:        f.Icon,
+		Authors:     []jsonAuthor{{Name: f.Author}},
+		Items:       make([]jsonItem, 0, len(f.Entries)),
+	}
+	for _, e := range f.Entries {
+		jf.Items = append(jf.Items, jsonItem{
+			ID:            e.ID,
+			Title:         e.Title,
+			ContentHTML:   e.HTML,
+			ContentText:   e.Text,
+			ExternalURL:   e.URI,
+			DatePublished: e.Published.UTC().Format(time.RFC3339),
+		})
+	}
+	return json.MarshalIndent(jf, "", "  ")
+}
+
+// EntryID returns a permanent ID for a history entry, which is the same for
+// all formats. base is the feed URL without the format extension.
+func EntryID(base string, id int64) string {
+	return base + "#" + strconv.FormatInt(id, 10)
+}
@@ -0,0 +1,312 @@
+// finger answers finger protocol (RFC 1288) queries with user statuses.
+//
+// Only anonymous, public information is given out: users whose privacy
+// settings don't make their status public, or who opted out of finger,
+// are treated as if they don't exist.
+package finger
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/makeworld-the-better-one/whatsup/config"
+	"github.com/makeworld-the-better-one/whatsup/db"
+	"github.com/makeworld-the-better-one/whatsup/model"
+)
+
+// timeout is how long a connection can take, from accepting to closing.
+const timeout = 10 * time.Second
+
+// Server is a finger server.
+type Server struct {
+	// Verbose allows the /W token to add more detail
+	Verbose bool
+	// ListUsers lists users when the query is empty
+	ListUsers bool
+	// MaxConns limits the number of connections handled at once
+	MaxConns int
+	// MaxPerIP limits the number of connections from one IP address
+	MaxPerIP int
+	// Store is where statuses and privacy settings are read from
+	Store db.Store
+
+	mu     sync.Mutex
+	conns  int
+	perIP  map[string]int
+	ln     net.Listener
+	closed bool
+}
+
+// ErrServerClosed is returned by Serve after Close is called.
+var ErrServerClosed = errors.New("finger: server closed")
+
+// Serve accepts connections on the listener until Close is called.
+func (s *Server) Serve(ln net.Listener) error {
+	s.mu.Lock()
+	s.ln = ln
+	s.perIP = make(map[string]int)
+	s.mu.Unlock()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return ErrServerClosed
+			}
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Temporary() {
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+
+		ip := remoteIP(conn)
+		if !s.acquire(ip) {
+			// Over the limits, drop immediately
+			conn.Close()
+			continue
+		}
+		go func() {
+			defer s.release(ip)
+			s.handle(conn)
+		}()
+	}
+}
+
+// Close stops the server from accepting connections.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	if s.ln == nil {
+		return nil
+	}
+	return s.ln.Close()
+}
+
+func (s *Server) acquire(ip string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conns >= s.MaxConns || s.perIP[ip] >= s.MaxPerIP {
+		return false
+	}
+	s.conns++
+	s.perIP[ip]++
+	return true
+}
+
+func (s *Server) release(ip string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.conns--
+	s.perIP[ip]--
+	if s.perIP[ip] <= 0 {
+		delete(s.perIP, ip)
+	}
+}
+
+func remoteIP(conn net.Conn) string {
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return conn.RemoteAddr().String()
+	}
+	return host
+}
+
+func (s *Server) handle(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	// Queries are a single short line, RFC 1288 section 2.3
+	line, err := bufio.NewReader(io.LimitReader(conn, 512)).ReadString('\n')
+	if err != nil {
+		return
+	}
+	line = strings.TrimRight(line, "\r\n")
+
+	w := &crlfWriter{w: bufio.NewWriter(conn)}
+	s.answer(w, line)
+	w.w.Flush()
+}
+
+// answer writes the reply to the query.
+func (s *Server) answer(w *crlfWriter, query string) {
+	verbose := false
+	if strings.HasPrefix(query, "/W") {
+		verbose = s.Verbose
+		query = strings.TrimPrefix(query, "/W")
+	}
+	query = strings.TrimSpace(query)
+
+	if strings.Contains(query, "@") {
+		// {Q2} queries ask this server to finger another one
+		w.Println("Finger forwarding is not supported.")
+		return
+	}
+	if query == "" {
+		s.listUsers(w)
+		return
+	}
+
+	status, ok := s.visibleStatus(query)
+	if !ok {
+		w.Printf("%s: no such user.", query)
+		return
+	}
+	writeStatus(w, query, status, verbose)
+}
+
+// visibleStatus returns the status of the user, if it can be shown over finger.
+func (s *Server) visibleStatus(username string) (*model.Status, bool) {
+	if _, ok := config.Conf.Users[username]; !ok {
+		return nil, false
+	}
+	deleted, err := s.Store.IsDeleted(username)
+	if err != nil {
+		log.Printf("finger: db.IsDeleted(%s): %v", username, err)
+		return nil, false
+	}
+	if deleted {
+		// The status might still be there if removing it failed
+		return nil, false
+	}
+	p, err := s.Store.GetPrivacy(username)
+	if err != nil {
+		log.Printf("finger: db.GetPrivacy(%s): %v", username, err)
+		return nil, false
+	}
+	if !p.Finger || !p.Allows(globalUsername(username), &model.Requester{}) {
+		return nil, false
+	}
+	status, err := s.Store.GetUser(username)
+	if errors.Is(err, db.ErrNotFound) {
+		// Deleted, but still in the config
+		return nil, false
+	}
+	if err != nil {
+		log.Printf("finger: GetUser(%s): %v", username, err)
+		return nil, false
+	}
+	return status, true
+}
+
+func globalUsername(username string) string {
+	return "@" + username + "@" + config.Conf.Server.Domain
+}
+
+func (s *Server) listUsers(w *crlfWriter) {
+	if !s.ListUsers {
+		w.Println("Listing users is disabled, finger a username instead.")
+		return
+	}
+
+	usernames := make([]string, 0, len(config.Conf.Users))
+	for username := range config.Conf.Users {
+		usernames = append(usernames, username)
+	}
+	sort.Strings(usernames)
+
+	n := 0
+	for _, username := range usernames {
+		status, ok := s.visibleStatus(username)
+		if !ok {
+			continue
+		}
+		w.Printf("%-20s %s", username, statusLine(status))
+		n++
+	}
+	if n == 0 {
+		w.Println("No users.")
+	}
+}
+
+func str(p *string) string {
+	if p == nil {
+		return ""
+	}
+	return *p
+}
+
+// statusLine returns the emoji and status text.
+func statusLine(s *model.Status) string {
+	return strings.TrimSpace(str(s.Emoji) + " " + str(s.Status))
+}
+
+func writeStatus(w *crlfWriter, username string, s *model.Status, verbose bool) {
+	w.Printf("Login: %-30s Name: %s", username, str(s.Name))
+	if verbose {
+		w.Printf("Global username: %s", globalUsername(username))
+	}
+	if line := statusLine(s); line != "" {
+		w.Printf("Status: %s", line)
+	} else {
+		w.Println("No status.")
+	}
+	if str(s.Media) != "" {
+		mediaType := 0
+		if s.MediaType != nil {
+			mediaType = *s.MediaType
+		}
+		w.Printf("%s: %s", model.MediaTypeLabel(mediaType), *s.Media)
+	}
+	if str(s.URI) != "" {
+		w.Printf("URI: %s", *s.URI)
+	}
+	if verbose && s.Avatar != nil && s.Avatar.Paths["original"] != "" {
+		avatar := s.Avatar.Paths["original"]
+		if strings.HasPrefix(avatar, "/") {
+			avatar = config.Conf.Server.URL + avatar
+		}
+		w.Printf("Avatar: %s", avatar)
+	}
+	w.Printf("Last update: %s", s.UpdatedAt.UTC().Format("Mon Jan 2 15:04 2006 (MST)"))
+	if verbose {
+		w.Printf("fmrl: %s/.well-known/fmrl/users?user=%s", config.Conf.Server.URL, username)
+	}
+}
+
+// crlfWriter ends lines with CRLF as finger requires, and strips control
+// characters so statuses can't mess with terminals.
+type crlfWriter struct {
+	w *bufio.Writer
+}
+
+func (c *crlfWriter) Println(s string) {
+	c.w.WriteString(strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7F || (r >= 0x80 && r <= 0x9F) {
+			return -1
+		}
+		return r
+	}, s))
+	c.w.WriteString("\r\n")
+}
+
+func (c *crlfWriter) Printf(format string, a ...interface{}) {
+	c.Println(fmt.Sprintf(format, a...))
+}
+
+// ListenAndServe listens on the address and serves until ctx is done.
+func (s *Server) ListenAndServe(ctx context.Context, addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	go func() {
+		<-ctx.Done()
+		s.Close()
+	}()
+	return s.Serve(ln)
+}
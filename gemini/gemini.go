@@ -0,0 +1,157 @@
+// gemini serves user statuses over the Gemini protocol, as gemtext pages.
+//
+// Like finger, only public statuses are shown, since Gemini requests are
+// anonymous.
+package gemini
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/makeworld-the-better-one/whatsup/db"
+)
+
+// timeout is how long a connection can take, from accepting to closing.
+const timeout = 30 * time.Second
+
+// Server is a Gemini server.
+type Server struct {
+	// Hostname is the host requests must be for
+	Hostname string
+	// History enables the status history page of each user
+	History bool
+	// MaxConns limits the number of connections handled at once
+	MaxConns int
+	// Store is where statuses, history and privacy settings are read from
+	Store db.Store
+
+	TLSConfig *tls.Config
+
+	mu     sync.Mutex
+	conns  int
+	ln     net.Listener
+	closed bool
+}
+
+// ErrServerClosed is returned by Serve after Close is called.
+var ErrServerClosed = errors.New("gemini: server closed")
+
+// Response status codes used, from the Gemini spec
+const (
+	statusSuccess          = 20
+	statusSlowDown         = 44
+	statusTemporaryFailure = 40
+	statusNotFound         = 51
+	statusProxyRefused     = 53
+	statusBadRequest       = 59
+)
+
+// ListenAndServe listens on the address and serves until ctx is done.
+func (s *Server) ListenAndServe(ctx context.Context, addr string) error {
+	ln, err := tls.Listen("tcp", addr, s.TLSConfig)
+	if err != nil {
+		return err
+	}
+	go func() {
+		<-ctx.Done()
+		s.Close()
+	}()
+	return s.Serve(ln)
+}
+
+// Serve accepts connections on the TLS listener until Close is called.
+func (s *Server) Serve(ln net.Listener) error {
+	s.mu.Lock()
+	s.ln = ln
+	s.mu.Unlock()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return ErrServerClosed
+			}
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Temporary() {
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+		go s.handle(conn)
+	}
+}
+
+// Close stops the server from accepting connections.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	if s.ln == nil {
+		return nil
+	}
+	return s.ln.Close()
+}
+
+func (s *Server) handle(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	s.mu.Lock()
+	full := s.conns >= s.MaxConns
+	if !full {
+		s.conns++
+	}
+	s.mu.Unlock()
+	if full {
+		writeHeader(conn, statusSlowDown, "5")
+		return
+	}
+	defer func() {
+		s.mu.Lock()
+		s.conns--
+		s.mu.Unlock()
+	}()
+
+	// Requests are an absolute URL of at most 1024 bytes, then CRLF
+	line, err := bufio.NewReader(io.LimitReader(conn, 1024+2)).ReadString('\n')
+	if err != nil {
+		writeHeader(conn, statusBadRequest, "Request too long or incomplete")
+		return
+	}
+	u, err := url.Parse(strings.TrimRight(line, "\r\n"))
+	if err != nil || u.Scheme == "" {
+		writeHeader(conn, statusBadRequest, "Invalid URL")
+		return
+	}
+	if u.Scheme != "gemini" || !strings.EqualFold(u.Hostname(), s.Hostname) {
+		writeHeader(conn, statusProxyRefused, "Only gemini://"+s.Hostname+"/ is served here")
+		return
+	}
+
+	page, status, meta := s.route(u.Path)
+	if status != statusSuccess {
+		writeHeader(conn, status, meta)
+		return
+	}
+	w := bufio.NewWriter(conn)
+	writeHeader(w, statusSuccess, "text/gemini; charset=utf-8")
+	w.WriteString(page)
+	w.Flush()
+}
+
+func writeHeader(w io.Writer, status int, meta string) {
+	fmt.Fprintf(w, "%d %s\r\n", status, meta)
+}
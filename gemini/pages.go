@@ -0,0 +1,197 @@
+package gemini
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/makeworld-the-better-one/whatsup/config"
+	"github.com/makeworld-the-better-one/whatsup/db"
+	"github.com/makeworld-the-better-one/whatsup/model"
+)
+
+// historyEntries is how many past statuses the history page shows.
+const historyEntries = 50
+
+// route returns the gemtext page for the path, or a non-success status and
+// its meta line.
+func (s *Server) route(path string) (string, int, string) {
+	path = strings.TrimSuffix(path, "/")
+	if path == "" {
+		return s.index()
+	}
+	if !strings.HasPrefix(path, "/user/") {
+		return "", statusNotFound, "Not found"
+	}
+
+	parts := strings.Split(path[len("/user/"):], "/")
+	username := parts[0]
+	status, ok, err := s.visibleStatus(username)
+	if err != nil {
+		return "", statusTemporaryFailure, "Error getting status"
+	}
+	if !ok || len(parts) > 2 || (len(parts) == 2 && (parts[1] != "history" || !s.History)) {
+		return "", statusNotFound, "Not found"
+	}
+	if len(parts) == 2 {
+		return s.history(username, status)
+	}
+	return s.profile(username, status), statusSuccess, ""
+}
+
+// visibleStatus returns the status of the user, if it is public.
+func (s *Server) visibleStatus(username string) (*model.Status, bool, error) {
+	if _, ok := config.Conf.Users[username]; !ok {
+		return nil, false, nil
+	}
+	deleted, err := s.Store.IsDeleted(username)
+	if err != nil {
+		log.Printf("gemini: db.IsDeleted(%s): %v", username, err)
+		return nil, false, err
+	}
+	if deleted {
+		// The status might still be there if removing it failed
+		return nil, false, nil
+	}
+	p, err := s.Store.GetPrivacy(username)
+	if err != nil {
+		log.Printf("gemini: db.GetPrivacy(%s): %v", username, err)
+		return nil, false, err
+	}
+	if !p.Allows(globalUsername(username), &model.Requester{}) {
+		return nil, false, nil
+	}
+	status, err := s.Store.GetUser(username)
+	if errors.Is(err, db.ErrNotFound) {
+		// Deleted, but still in the config
+		return nil, false, nil
+	}
+	if err != nil {
+		log.Printf("gemini: GetUser(%s): %v", username, err)
+		return nil, false, err
+	}
+	return status, true, nil
+}
+
+func globalUsername(username string) string {
+	return "@" + username + "@" + config.Conf.Server.Domain
+}
+
+func str(p *string) string {
+	if p == nil {
+		return ""
+	}
+	return *p
+}
+
+// statusLine returns the emoji and status text.
+func statusLine(s *model.Status) string {
+	return strings.TrimSpace(str(s.Emoji) + " " + str(s.Status))
+}
+
+func (s *Server) index() (string, int, string) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# %s\n\n", config.Conf.Server.Domain)
+	b.WriteString("Statuses of the people on this fmrl server.\n\n")
+
+	usernames := make([]string, 0, len(config.Conf.Users))
+	for username := range config.Conf.Users {
+		usernames = append(usernames, username)
+	}
+	sort.Strings(usernames)
+
+	n := 0
+	for _, username := range usernames {
+		status, ok, err := s.visibleStatus(username)
+		if err != nil {
+			return "", statusTemporaryFailure, "Error getting statuses"
+		}
+		if !ok {
+			continue
+		}
+		desc := username
+		if line := statusLine(status); line != "" {
+			desc += " - " + line
+		}
+		fmt.Fprintf(&b, "=> /user/%s %s\n", url.PathEscape(username), desc)
+		n++
+	}
+	if n == 0 {
+		b.WriteString("No one here yet.\n")
+	}
+	return b.String(), statusSuccess, ""
+}
+
+// writeStatus writes the parts of a status other than the name.
+func writeStatus(b *strings.Builder, s *model.Status) {
+	if line := statusLine(s); line != "" {
+		fmt.Fprintf(b, "Status: %s\n", line)
+	} else {
+		b.WriteString("No status.\n")
+	}
+	if str(s.Media) != "" {
+		mediaType := 0
+		if s.MediaType != nil {
+			mediaType = *s.MediaType
+		}
+		fmt.Fprintf(b, "%s: %s\n", model.MediaTypeLabel(mediaType), *s.Media)
+	}
+	if str(s.URI) != "" {
+		fmt.Fprintf(b, "=> %s %s\n", *s.URI, *s.URI)
+	}
+}
+
+func (s *Server) profile(username string, status *model.Status) string {
+	var b strings.Builder
+	global := globalUsername(username)
+
+	if name := str(status.Name); name != "" {
+		fmt.Fprintf(&b, "# %s\n\n%s\n\n", name, global)
+	} else {
+		fmt.Fprintf(&b, "# %s\n\n", global)
+	}
+	writeStatus(&b, status)
+	if status.Avatar != nil && status.Avatar.Paths["original"] != "" {
+		avatar := status.Avatar.Paths["original"]
+		if strings.HasPrefix(avatar, "/") {
+			avatar = config.Conf.Server.URL + avatar
+		}
+		if status.Avatar.Num != nil {
+			avatar += fmt.Sprintf("?%d", *status.Avatar.Num)
+		}
+		fmt.Fprintf(&b, "=> %s Avatar\n", avatar)
+	}
+	fmt.Fprintf(&b, "\nLast update: %s\n\n", status.UpdatedAt.UTC().Format("2006-01-02 15:04 MST"))
+
+	if s.History {
+		fmt.Fprintf(&b, "=> /user/%s/history Status history\n", url.PathEscape(username))
+	}
+	fmt.Fprintf(&b, "=> %s/.well-known/fmrl/user/%s/feed.atom Atom feed\n", config.Conf.Server.URL, url.PathEscape(username))
+	b.WriteString("=> / All users\n")
+	return b.String()
+}
+
+func (s *Server) history(username string, status *model.Status) (string, int, string) {
+	entries, err := s.Store.GetHistory(username, historyEntries)
+	if err != nil {
+		log.Printf("gemini: db.GetHistory(%s): %v", username, err)
+		return "", statusTemporaryFailure, "Error getting history"
+	}
+	if len(entries) == 0 {
+		// No changes since history started being recorded
+		entries = []*model.StatusEntry{{Username: username, CreatedAt: status.UpdatedAt, Status: status}}
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "# Status history of %s\n\n", globalUsername(username))
+	for _, e := range entries {
+		fmt.Fprintf(&b, "## %s\n\n", e.CreatedAt.UTC().Format("2006-01-02 15:04 MST"))
+		writeStatus(&b, e.Status)
+		b.WriteString("\n")
+	}
+	fmt.Fprintf(&b, "=> /user/%s Back to profile\n", url.PathEscape(username))
+	return b.String(), statusSuccess, ""
+}
@@ -4,9 +4,11 @@ go 1.16
 
 require (
 	github.com/BurntSushi/toml v0.4.1
+	github.com/gorilla/websocket v1.5.0
+	github.com/lib/pq v1.10.9
 	github.com/makeworld-the-better-one/go-isemoji v1.3.0
 	github.com/matthewhartstonge/argon2 v0.1.5
-	golang.org/x/sys v0.0.0-20211216021012-1d35b9e2eb4e // indirect
+	golang.org/x/sys v0.0.0-20211216021012-1d35b9e2eb4e
 	golang.org/x/term v0.0.0-20210927222741-03fcf44c2211
 	modernc.org/sqlite v1.14.4
 )
@@ -0,0 +1,190 @@
+package httpsig
+
+import (
+	"container/list"
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/makeworld-the-better-one/whatsup/netguard"
+	"github.com/makeworld-the-better-one/whatsup/version"
+)
+
+// KeysJSON is the document published at KeysPath.
+type KeysJSON struct {
+	Keys []*PublicKey `json:"keys"`
+}
+
+// KeyCache fetches and caches the public keys of remote servers.
+type KeyCache struct {
+	HTTP *http.Client
+	// TTL is how long fetched keys are used before fetching them again
+	TTL time.Duration
+	// AllowHTTP allows key IDs with http URLs, for testing only
+	AllowHTTP bool
+
+	mu      sync.Mutex
+	servers map[string]*list.Element // Keyed by host
+	lru     *list.List               // Of *cachedKeys, most recently used first
+}
+
+// cachedKeys are the keys of a server, or the error from fetching them.
+type cachedKeys struct {
+	host string
+	// done is closed when the fetch is finished, the fields below are only
+	// set after that
+	done    chan struct{}
+	fetched time.Time
+	keys    map[string]ed25519.PublicKey
+	err     error
+}
+
+// minRefetch limits how often unknown key IDs or failed fetches cause a
+// refetch, so that invalid requests can't be used to make this server spam
+// another.
+const minRefetch = 10 * time.Second
+
+// maxServers is the most servers whose keys are cached. Failed fetches count
+// too, so requests with made up key IDs can't grow the cache forever.
+const maxServers = 10000
+
+// NewKeyCache returns a KeyCache with reasonable defaults. Its HTTP client
+// refuses to connect to loopback and private addresses, since the key IDs
+// come from whoever made the request.
+func NewKeyCache() *KeyCache {
+	return &KeyCache{
+		HTTP: netguard.NewClient(10 * time.Second),
+		TTL:  time.Hour,
+	}
+}
+
+// Get returns the public key for the key ID, and the host of the server it
+// belongs to. Keys are fetched if they aren't cached, have expired, or the
+// key ID is unknown, which happens after the remote server rotates its key.
+func (kc *KeyCache) Get(ctx context.Context, keyID string) (string, ed25519.PublicKey, error) {
+	u, err := url.Parse(keyID)
+	if err != nil || u.Host == "" || u.Fragment == "" || u.Path != KeysPath {
+		return "", nil, fmt.Errorf("%w: bad key ID %s", ErrBadSignature, keyID)
+	}
+	if u.Scheme != "https" && !(kc.AllowHTTP && u.Scheme == "http") {
+		return "", nil, fmt.Errorf("%w: key ID must be https: %s", ErrBadSignature, keyID)
+	}
+	host := strings.ToLower(u.Host)
+	id := u.Fragment
+	u.Fragment = ""
+	u.Host = host
+	keysURL := u.String()
+
+	for {
+		ck, fetching := kc.entry(host, id)
+		if fetching {
+			// This request fetches the keys for everyone waiting on it. The
+			// request's context isn't used, so that its cancellation doesn't
+			// end up cached as a failure.
+			ck.keys, ck.err = kc.fetch(context.Background(), keysURL)
+			ck.fetched = time.Now()
+			close(ck.done)
+		}
+		select {
+		case <-ck.done:
+		case <-ctx.Done():
+			return "", nil, ctx.Err()
+		}
+
+		if ck.err != nil {
+			if time.Since(ck.fetched) < minRefetch {
+				return "", nil, ck.err
+			}
+			// Failed a while ago and another request just expired it
+			continue
+		}
+		pub, ok := ck.keys[id]
+		if !ok {
+			return "", nil, fmt.Errorf("%w: unknown key %s", ErrBadSignature, keyID)
+		}
+		return host, pub, nil
+	}
+}
+
+// entry returns the cached keys of the host. If they need to be fetched, a
+// new entry is added and true is returned, and the caller must fetch them.
+func (kc *KeyCache) entry(host, id string) (*cachedKeys, bool) {
+	kc.mu.Lock()
+	defer kc.mu.Unlock()
+
+	if kc.servers == nil {
+		kc.servers = make(map[string]*list.Element)
+		kc.lru = list.New()
+	}
+
+	if el, ok := kc.servers[host]; ok {
+		ck := el.Value.(*cachedKeys)
+		kc.lru.MoveToFront(el)
+		select {
+		case <-ck.done:
+		default:
+			// Still being fetched
+			return ck, false
+		}
+		age := time.Since(ck.fetched)
+		_, known := ck.keys[id]
+		if age < minRefetch || (known && age < kc.TTL) {
+			return ck, false
+		}
+		kc.lru.Remove(el)
+		delete(kc.servers, host)
+	}
+
+	ck := &cachedKeys{host: host, done: make(chan struct{})}
+	kc.servers[host] = kc.lru.PushFront(ck)
+	for kc.lru.Len() > maxServers {
+		old := kc.lru.Remove(kc.lru.Back()).(*cachedKeys)
+		delete(kc.servers, old.host)
+	}
+	return ck, true
+}
+
+func (kc *KeyCache) fetch(ctx context.Context, keysURL string) (map[string]ed25519.PublicKey, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", keysURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", version.UserAgent)
+
+	resp, err := kc.HTTP.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("fetching keys: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching keys: status code %d from %s", resp.StatusCode, keysURL)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err != nil {
+		return nil, fmt.Errorf("fetching keys: %w", err)
+	}
+	var kj KeysJSON
+	if err := json.Unmarshal(body, &kj); err != nil {
+		return nil, fmt.Errorf("fetching keys: %w", err)
+	}
+
+	keys := make(map[string]ed25519.PublicKey, len(kj.Keys))
+	for _, pk := range kj.Keys {
+		if pk.Algorithm != "ed25519" || len(pk.Key) != ed25519.PublicKeySize {
+			continue
+		}
+		if pk.Expires != nil && time.Now().After(*pk.Expires) {
+			continue
+		}
+		keys[pk.ID] = pk.Key
+	}
+	return keys, nil
+}
@@ -0,0 +1,322 @@
+// httpsig implements the subset of HTTP Message Signatures (RFC 9421) that
+// fmrl servers use to identify themselves to each other.
+//
+// Requests are signed with ed25519 keys. The key ID is a URL pointing to the
+// signing server's published keys, with the key's ID as the fragment:
+//
+//	https://example.com/.well-known/fmrl/server-keys#3f2a9c1b7d4e5a60
+//
+// The server a request came from is the host of that URL. A request can
+// optionally be made on behalf of a user of the signing server, by setting
+// the Fmrl-User header to their global username.
+package httpsig
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// KeysPath is where servers publish their public keys.
+const KeysPath = "/.well-known/fmrl/server-keys"
+
+// UserHeader holds the global username of the user a signed request is
+// made on behalf of.
+const UserHeader = "Fmrl-User"
+
+// MaxSkew is how far the signature creation time can be from now.
+const MaxSkew = 5 * time.Minute
+
+const sigLabel = "sig1"
+
+var (
+	ErrNoSignature  = errors.New("request is not signed")
+	ErrBadSignature = errors.New("invalid signature")
+	ErrBodyTooLarge = errors.New("request body too large")
+)
+
+// Signer signs outgoing requests with the active key of a keyring.
+type Signer struct {
+	Keyring *Keyring
+	// BaseURL is the public URL of this server, like https://example.com
+	BaseURL string
+}
+
+// KeyID returns the key ID for a key of this server.
+func (s *Signer) KeyID(k *Key) string {
+	return s.BaseURL + KeysPath + "#" + k.ID
+}
+
+// Sign signs the request. body must be the same as the request body, and can
+// be nil if there isn't one. If user is not empty, it is set as the
+// Fmrl-User header and covered by the signature.
+func (s *Signer) Sign(r *http.Request, body []byte, user string) error {
+	components := []string{"@method", "@authority", "@path", "@query"}
+
+	if body != nil {
+		sum := sha256.Sum256(body)
+		r.Header.Set("Content-Digest", "sha-256=:"+base64.StdEncoding.EncodeToString(sum[:])+":")
+		components = append(components, "content-digest")
+	}
+	if user != "" {
+		r.Header.Set(UserHeader, user)
+		components = append(components, strings.ToLower(UserHeader))
+	}
+
+	key := s.Keyring.Active()
+	params := signatureParams(components, time.Now().Unix(), s.KeyID(key))
+
+	base, err := signatureBase(r, components, params)
+	if err != nil {
+		return err
+	}
+	sig := ed25519.Sign(key.Private, []byte(base))
+
+	r.Header.Set("Signature-Input", sigLabel+"="+params)
+	r.Header.Set("Signature", sigLabel+"=:"+base64.StdEncoding.EncodeToString(sig)+":")
+	return nil
+}
+
+func signatureParams(components []string, created int64, keyID string) string {
+	quoted := make([]string, len(components))
+	for i, c := range components {
+		quoted[i] = strconv.Quote(c)
+	}
+	return fmt.Sprintf(`(%s);created=%d;keyid=%s;alg="ed25519"`,
+		strings.Join(quoted, " "), created, strconv.Quote(keyID))
+}
+
+// signatureBase creates the signature base from the request, as defined in
+// section 2.5 of RFC 9421.
+func signatureBase(r *http.Request, components []string, params string) (string, error) {
+	var b strings.Builder
+	for _, c := range components {
+		var v string
+		switch c {
+		case "@method":
+			v = r.Method
+		case "@authority":
+			v = strings.ToLower(r.Host)
+			if v == "" {
+				v = strings.ToLower(r.URL.Host)
+			}
+		case "@path":
+			v = r.URL.EscapedPath()
+			if v == "" {
+				v = "/"
+			}
+		case "@query":
+			v = "?" + r.URL.RawQuery
+		default:
+			if strings.HasPrefix(c, "@") {
+				return "", fmt.Errorf("unsupported derived component: %s", c)
+			}
+			vals := r.Header.Values(c)
+			if len(vals) == 0 {
+				return "", fmt.Errorf("covered header missing: %s", c)
+			}
+			for i := range vals {
+				vals[i] = strings.TrimSpace(vals[i])
+			}
+			v = strings.Join(vals, ", ")
+		}
+		fmt.Fprintf(&b, "%q: %s\n", c, v)
+	}
+	fmt.Fprintf(&b, "%q: %s", "@signature-params", params)
+	return b.String(), nil
+}
+
+// Identity is who made a verified request.
+type Identity struct {
+	// Server is the host of the signing server
+	Server string
+	// User is the global username of the user the request was made on behalf
+	// of, or empty. It is always a user of Server.
+	User string
+}
+
+// Verify checks the signature of a request and returns who made it.
+// Keys are looked up using the cache. If the request isn't signed,
+// ErrNoSignature is returned. Other errors wrap ErrBadSignature or are
+// errors fetching the key.
+//
+// If the signature covers a Content-Digest, the body is read to check it and
+// replaced so it can still be read by later handlers. That happens after the
+// signature is verified, and at most maxBody bytes are read, otherwise
+// ErrBodyTooLarge is returned.
+func Verify(w http.ResponseWriter, r *http.Request, cache *KeyCache, maxBody int64) (*Identity, error) {
+	input := r.Header.Get("Signature-Input")
+	sigHeader := r.Header.Get("Signature")
+	if input == "" && sigHeader == "" {
+		return nil, ErrNoSignature
+	}
+
+	params, ok := dictMember(input, sigLabel)
+	if !ok {
+		return nil, fmt.Errorf("%w: no %s in Signature-Input", ErrBadSignature, sigLabel)
+	}
+	sigValue, ok := dictMember(sigHeader, sigLabel)
+	if !ok || !strings.HasPrefix(sigValue, ":") || !strings.HasSuffix(sigValue, ":") || len(sigValue) < 2 {
+		return nil, fmt.Errorf("%w: no %s in Signature", ErrBadSignature, sigLabel)
+	}
+	sig, err := base64.StdEncoding.DecodeString(sigValue[1 : len(sigValue)-1])
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBadSignature, err)
+	}
+
+	components, created, keyID, alg, err := parseParams(params)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBadSignature, err)
+	}
+	if alg != "" && alg != "ed25519" {
+		return nil, fmt.Errorf("%w: unsupported algorithm %s", ErrBadSignature, alg)
+	}
+	if d := time.Since(time.Unix(created, 0)); d > MaxSkew || d < -MaxSkew {
+		return nil, fmt.Errorf("%w: signature too old or in the future", ErrBadSignature)
+	}
+
+	covered := make(map[string]bool, len(components))
+	for _, c := range components {
+		covered[c] = true
+	}
+	for _, c := range []string{"@method", "@authority", "@path", "@query"} {
+		if !covered[c] {
+			return nil, fmt.Errorf("%w: %s must be covered", ErrBadSignature, c)
+		}
+	}
+	if r.Header.Get(UserHeader) != "" && !covered[strings.ToLower(UserHeader)] {
+		return nil, fmt.Errorf("%w: %s must be covered", ErrBadSignature, UserHeader)
+	}
+
+	if !covered["content-digest"] && r.ContentLength != 0 && r.Body != nil && r.Body != http.NoBody {
+		return nil, fmt.Errorf("%w: request body must be covered by Content-Digest", ErrBadSignature)
+	}
+
+	server, pub, err := cache.Get(r.Context(), keyID)
+	if err != nil {
+		return nil, err
+	}
+
+	base, err := signatureBase(r, components, params)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBadSignature, err)
+	}
+	if !ed25519.Verify(pub, []byte(base), sig) {
+		return nil, ErrBadSignature
+	}
+
+	// The body is only read once the signature is known to be good, so
+	// anyone can't make this server read large bodies
+	if covered["content-digest"] {
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBody+1))
+		if int64(len(body)) > maxBody {
+			return nil, ErrBodyTooLarge
+		}
+		if err != nil {
+			return nil, err
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		sum := sha256.Sum256(body)
+		if r.Header.Get("Content-Digest") != "sha-256=:"+base64.StdEncoding.EncodeToString(sum[:])+":" {
+			return nil, fmt.Errorf("%w: Content-Digest doesn't match body", ErrBadSignature)
+		}
+	}
+
+	id := &Identity{Server: server}
+	if user := r.Header.Get(UserHeader); user != "" {
+		if !strings.HasSuffix(user, "@"+server) {
+			return nil, fmt.Errorf("%w: %s is not a user of %s", ErrBadSignature, user, server)
+		}
+		id.User = user
+	}
+	return id, nil
+}
+
+// dictMember returns the raw value of a member of a structured field
+// dictionary, like the Signature and Signature-Input headers.
+func dictMember(field, key string) (string, bool) {
+	for _, member := range splitTopLevel(field, ',') {
+		member = strings.TrimSpace(member)
+		if strings.HasPrefix(member, key+"=") {
+			return member[len(key)+1:], true
+		}
+	}
+	return "", false
+}
+
+// splitTopLevel splits s on sep, ignoring separators inside quotes or parentheses.
+func splitTopLevel(s string, sep rune) []string {
+	var parts []string
+	depth := 0
+	quoted := false
+	start := 0
+	for i, c := range s {
+		switch {
+		case c == '"' && (i == 0 || s[i-1] != '\\'):
+			quoted = !quoted
+		case quoted:
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+		case c == sep && depth == 0:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// parseParams parses the inner list and parameters of a Signature-Input member.
+func parseParams(params string) (components []string, created int64, keyID, alg string, err error) {
+	if !strings.HasPrefix(params, "(") {
+		return nil, 0, "", "", errors.New("signature input is not an inner list")
+	}
+	end := strings.Index(params, ")")
+	if end == -1 {
+		return nil, 0, "", "", errors.New("unterminated inner list")
+	}
+	for _, c := range strings.Fields(params[1:end]) {
+		c, err := strconv.Unquote(c)
+		if err != nil {
+			return nil, 0, "", "", fmt.Errorf("bad component identifier: %v", err)
+		}
+		components = append(components, c)
+	}
+
+	for _, p := range splitTopLevel(params[end+1:], ';') {
+		kv := strings.SplitN(strings.TrimSpace(p), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "created":
+			created, err = strconv.ParseInt(kv[1], 10, 64)
+			if err != nil {
+				return nil, 0, "", "", errors.New("bad created parameter")
+			}
+		case "keyid":
+			keyID, err = strconv.Unquote(kv[1])
+			if err != nil {
+				return nil, 0, "", "", errors.New("bad keyid parameter")
+			}
+		case "alg":
+			alg, err = strconv.Unquote(kv[1])
+			if err != nil {
+				return nil, 0, "", "", errors.New("bad alg parameter")
+			}
+		}
+	}
+	if created == 0 || keyID == "" {
+		return nil, 0, "", "", errors.New("created and keyid parameters are required")
+	}
+	return components, created, keyID, alg, nil
+}
@@ -0,0 +1,270 @@
+package httpsig
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testServers are a signing server publishing its keys, and a verifying
+// server that replies with who made each request.
+type testServers struct {
+	keyring  *Keyring
+	signer   *Signer
+	cache    *KeyCache
+	keys     *httptest.Server
+	verifier *httptest.Server
+	fetches  int32 // Requests for the keys
+}
+
+func newTestServers(t *testing.T) *testServers {
+	t.Helper()
+
+	kr, err := LoadKeyring(filepath.Join(t.TempDir(), "keys.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := &testServers{keyring: kr}
+
+	ts.keys = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&ts.fetches, 1)
+		if r.URL.Path != KeysPath {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(&KeysJSON{Keys: kr.Public()})
+	}))
+	t.Cleanup(ts.keys.Close)
+	ts.signer = &Signer{Keyring: kr, BaseURL: ts.keys.URL}
+
+	// The test servers are on loopback, which NewKeyCache refuses
+	ts.cache = &KeyCache{HTTP: &http.Client{Timeout: 5 * time.Second}, TTL: time.Hour, AllowHTTP: true}
+
+	ts.verifier = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, err := Verify(w, r, ts.cache, 1024)
+		if errors.Is(err, ErrBodyTooLarge) {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, err)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		fmt.Fprintf(w, "%s %s %s", id.Server, id.User, body)
+	}))
+	t.Cleanup(ts.verifier.Close)
+	return ts
+}
+
+// do signs and sends a request to the verifying server. tamper can change
+// the request after it's signed.
+func (ts *testServers) do(t *testing.T, body []byte, user string, tamper func(*http.Request)) (int, string) {
+	t.Helper()
+
+	method := "GET"
+	var rd io.Reader
+	if body != nil {
+		method = "POST"
+		rd = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(method, ts.verifier.URL+"/path?q=1", rd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ts.signer.Sign(req, body, user); err != nil {
+		t.Fatal(err)
+	}
+	if tamper != nil {
+		tamper(req)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(b)
+}
+
+// expire makes the cached keys old enough to be fetched again.
+func (kc *KeyCache) expire() {
+	kc.mu.Lock()
+	defer kc.mu.Unlock()
+	for _, el := range kc.servers {
+		el.Value.(*cachedKeys).fetched = time.Now().Add(-minRefetch)
+	}
+}
+
+func TestSignVerify(t *testing.T) {
+	ts := newTestServers(t)
+	host := strings.TrimPrefix(ts.keys.URL, "http://")
+
+	code, body := ts.do(t, []byte("hello"), "alice@"+host, nil)
+	if code != http.StatusOK {
+		t.Fatalf("got %d: %s", code, body)
+	}
+	if want := host + " alice@" + host + " hello"; body != want {
+		t.Errorf("got %q, want %q", body, want)
+	}
+
+	code, body = ts.do(t, nil, "", nil)
+	if code != http.StatusOK {
+		t.Fatalf("got %d: %s", code, body)
+	}
+	if n := atomic.LoadInt32(&ts.fetches); n != 1 {
+		t.Errorf("keys fetched %d times, want 1", n)
+	}
+}
+
+func TestVerifyRejects(t *testing.T) {
+	ts := newTestServers(t)
+	host := strings.TrimPrefix(ts.keys.URL, "http://")
+
+	for _, tc := range []struct {
+		name   string
+		body   []byte
+		user   string
+		tamper func(*http.Request)
+		code   int
+	}{
+		{"bad digest", []byte("hello"), "", func(r *http.Request) {
+			r.Body = io.NopCloser(strings.NewReader("hellO"))
+		}, http.StatusUnauthorized},
+		{"changed path", nil, "", func(r *http.Request) {
+			r.URL.Path = "/other"
+		}, http.StatusUnauthorized},
+		{"user of another server", nil, "alice@example.com", nil, http.StatusUnauthorized},
+		{"changed user", nil, "alice@" + host, func(r *http.Request) {
+			r.Header.Set(UserHeader, "bob@"+host)
+		}, http.StatusUnauthorized},
+		{"body too large", bytes.Repeat([]byte("a"), 2048), "", nil, http.StatusRequestEntityTooLarge},
+		{"body too large and bad signature", bytes.Repeat([]byte("a"), 2048), "", func(r *http.Request) {
+			r.Header.Set("Signature", sigLabel+"=:AAAA:")
+		}, http.StatusUnauthorized},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			code, body := ts.do(t, tc.body, tc.user, tc.tamper)
+			if code != tc.code {
+				t.Errorf("got %d: %s, want %d", code, body, tc.code)
+			}
+		})
+	}
+}
+
+func TestUnknownKey(t *testing.T) {
+	ts := newTestServers(t)
+	unknown := func(r *http.Request) {
+		r.Header.Set("Signature-Input", strings.Replace(r.Header.Get("Signature-Input"),
+			"#"+ts.keyring.Active().ID, "#0000000000000000", 1))
+	}
+
+	for i := 0; i < 3; i++ {
+		code, body := ts.do(t, nil, "", unknown)
+		if code != http.StatusUnauthorized || !strings.Contains(body, "unknown key") {
+			t.Fatalf("got %d: %s", code, body)
+		}
+	}
+	// Only the first request fetched, the others were within minRefetch
+	if n := atomic.LoadInt32(&ts.fetches); n != 1 {
+		t.Errorf("keys fetched %d times, want 1", n)
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	ts := newTestServers(t)
+
+	if code, body := ts.do(t, nil, "", nil); code != http.StatusOK {
+		t.Fatalf("got %d: %s", code, body)
+	}
+	old := ts.keyring.Active()
+	if _, err := ts.keyring.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The new key is unknown, and the keys were just fetched
+	if code, _ := ts.do(t, nil, "", nil); code != http.StatusUnauthorized {
+		t.Fatalf("new key accepted within minRefetch, got %d", code)
+	}
+	ts.cache.expire()
+	if code, body := ts.do(t, nil, "", nil); code != http.StatusOK {
+		t.Fatalf("new key: got %d: %s", code, body)
+	}
+
+	// Requests signed just before the rotation still verify
+	code, body := ts.do(t, nil, "", func(r *http.Request) {
+		signer := &Signer{Keyring: &Keyring{keys: []*Key{old}}, BaseURL: ts.keys.URL}
+		r.Header.Del("Signature")
+		r.Header.Del("Signature-Input")
+		if err := signer.Sign(r, nil, ""); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if code != http.StatusOK {
+		t.Fatalf("retired key: got %d: %s", code, body)
+	}
+}
+
+func TestFailedFetchCached(t *testing.T) {
+	ts := newTestServers(t)
+	var fetches int32
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer broken.Close()
+
+	forged := func(r *http.Request) {
+		r.Header.Set("Signature-Input", strings.Replace(r.Header.Get("Signature-Input"),
+			ts.keys.URL, broken.URL, 1))
+	}
+	for i := 0; i < 3; i++ {
+		if code, body := ts.do(t, nil, "", forged); code != http.StatusUnauthorized {
+			t.Fatalf("got %d: %s", code, body)
+		}
+	}
+	if n := atomic.LoadInt32(&fetches); n != 1 {
+		t.Errorf("broken server fetched %d times, want 1", n)
+	}
+}
+
+func TestKeyCacheRefusesLoopback(t *testing.T) {
+	ts := newTestServers(t)
+	kc := NewKeyCache()
+	kc.AllowHTTP = true
+
+	_, _, err := kc.Get(httptest.NewRequest("GET", "/", nil).Context(),
+		ts.signer.KeyID(ts.keyring.Active()))
+	if err == nil || !strings.Contains(err.Error(), "not public") {
+		t.Errorf("got %v, want an error about the address", err)
+	}
+	if n := atomic.LoadInt32(&ts.fetches); n != 0 {
+		t.Errorf("keys fetched %d times, want 0", n)
+	}
+}
+
+func TestKeyCacheBounded(t *testing.T) {
+	kc := &KeyCache{HTTP: &http.Client{Timeout: time.Second}, TTL: time.Hour, AllowHTTP: true}
+	for i := 0; i < maxServers+10; i++ {
+		ck, fetching := kc.entry(fmt.Sprintf("host%d.invalid", i), "id")
+		if !fetching {
+			t.Fatal("new host not fetched")
+		}
+		ck.err = errors.New("failed")
+		ck.fetched = time.Now()
+		close(ck.done)
+	}
+	if n := len(kc.servers); n != maxServers {
+		t.Errorf("%d servers cached, want %d", n, maxServers)
+	}
+}
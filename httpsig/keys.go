@@ -0,0 +1,149 @@
+package httpsig
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"sync"
+	"time"
+)
+
+// RetiredGrace is how long retired keys are still published after rotation,
+// so that remote servers can verify requests signed just before it.
+const RetiredGrace = 7 * 24 * time.Hour
+
+// Key is an ed25519 key pair used to sign requests.
+type Key struct {
+	ID      string             `json:"id"`
+	Created time.Time          `json:"created"`
+	Retired *time.Time         `json:"retired,omitempty"`
+	Private ed25519.PrivateKey `json:"private"`
+}
+
+// PublicKey is the published form of a key.
+type PublicKey struct {
+	ID        string            `json:"id"`
+	Algorithm string            `json:"alg"`
+	Key       ed25519.PublicKey `json:"key"`
+	Created   time.Time         `json:"created"`
+	Expires   *time.Time        `json:"expires,omitempty"`
+}
+
+// Keyring holds the server's keys. The newest key is active and used for
+// signing, and retired keys are kept for RetiredGrace.
+// It is stored as JSON in a file.
+type Keyring struct {
+	mu   sync.RWMutex
+	path string
+	keys []*Key // Oldest first
+}
+
+// LoadKeyring loads the keyring from the file at path. If the file doesn't
+// exist, a new keyring with one key is created and saved there.
+func LoadKeyring(path string) (*Keyring, error) {
+	kr := &Keyring{path: path}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		if _, err := kr.Rotate(); err != nil {
+			return nil, err
+		}
+		return kr, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, &kr.keys); err != nil {
+		return nil, err
+	}
+	if len(kr.keys) == 0 {
+		if _, err := kr.Rotate(); err != nil {
+			return nil, err
+		}
+	}
+	return kr, nil
+}
+
+func (kr *Keyring) save() error {
+	data, err := json.MarshalIndent(kr.keys, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := kr.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, kr.path)
+}
+
+// Rotate creates a new active key, retires the previous one, and removes
+// keys that were retired more than RetiredGrace ago. The keyring is saved.
+func (kr *Keyring) Rotate() (*Key, error) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+
+	// The ID is derived from the public key so it's always unique
+	sum := sha256.Sum256(pub)
+	now := time.Now().UTC()
+	key := &Key{
+		ID:      hex.EncodeToString(sum[:8]),
+		Created: now,
+		Private: priv,
+	}
+
+	keys := make([]*Key, 0, len(kr.keys)+1)
+	for _, k := range kr.keys {
+		if k.Retired == nil {
+			k.Retired = &now
+		}
+		if now.Sub(*k.Retired) < RetiredGrace {
+			keys = append(keys, k)
+		}
+	}
+	kr.keys = append(keys, key)
+
+	return key, kr.save()
+}
+
+// Active returns the key to sign with.
+func (kr *Keyring) Active() *Key {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+	return kr.keys[len(kr.keys)-1]
+}
+
+// Public returns the public keys that should be published.
+func (kr *Keyring) Public() []*PublicKey {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+
+	pks := make([]*PublicKey, 0, len(kr.keys))
+	for _, k := range kr.keys {
+		pk := &PublicKey{
+			ID:        k.ID,
+			Algorithm: "ed25519",
+			Key:       k.Private.Public().(ed25519.PublicKey),
+			Created:   k.Created,
+		}
+		if k.Retired != nil {
+			expires := k.Retired.Add(RetiredGrace)
+			if time.Now().After(expires) {
+				continue
+			}
+			pk.Expires = &expires
+		}
+		pks = append(pks, pk)
+	}
+	return pks
+}
@@ -0,0 +1,264 @@
+// hub is an in-process publish/subscribe hub for changes to user data.
+// The db package publishes events whenever data is written, and streaming
+// APIs subscribe to them.
+package hub
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/makeworld-the-better-one/whatsup/model"
+)
+
+// Event types
+const (
+	// EventStatus means the status of a user changed, including the avatar
+	EventStatus = "status"
+	// EventFollowing means the following list of a local user changed.
+	// It is private to that user.
+	EventFollowing = "following"
+)
+
+// Event is a change to a user's data.
+type Event struct {
+	// ID increases for each event, and is unique across restarts
+	ID   uint64
+	Type string
+	// Username is the local username, or the global username for remote users
+	Username string
+
+	// Status is set for status events of local users
+	Status *model.Status
+	// Data is set for status events of remote users instead of Status. It holds
+	// the status JSON as received from the remote server.
+	Data json.RawMessage
+	// Following is set for following events
+	Following *model.Following
+
+	// Relayed is true for changes made by another server sharing the
+	// database. That server already queued webhook deliveries for them.
+	Relayed bool
+}
+
+// Subscription receives events for a set of usernames.
+// Subscriptions that don't receive events fast enough are closed, which
+// closes C.
+type Subscription struct {
+	C <-chan *Event
+
+	c         chan *Event
+	hub       *Hub
+	usernames map[string]struct{}
+	all       bool
+	closed    bool
+}
+
+// Hub distributes events to subscriptions and keeps a backlog of recent
+// events so that clients can resume.
+type Hub struct {
+	mu       sync.Mutex
+	subs     map[*Subscription]struct{}
+	handlers map[*handler]struct{}
+	backlog  []*Event // Ring buffer
+	next     int      // Index in backlog for the next event
+	lastID   uint64
+
+	startID   uint64 // Events before this happened before the hub was created
+	evictedID uint64 // ID of the newest event no longer in the backlog
+}
+
+// New creates a hub that keeps the given number of recent events.
+func New(backlog int) *Hub {
+	return &Hub{
+		subs:     make(map[*Subscription]struct{}),
+		handlers: make(map[*handler]struct{}),
+		backlog:  make([]*Event, backlog),
+		startID:  uint64(time.Now().UnixNano()),
+	}
+}
+
+// Default is the hub used by the package-level functions.
+var Default = New(1000)
+
+// Publish sends an event to all subscribers for its username, after
+// setting its ID, and then calls the handlers with it.
+func (h *Hub) Publish(e *Event) {
+	h.mu.Lock()
+
+	// IDs are based on the time so that they increase across restarts
+	e.ID = uint64(time.Now().UnixNano())
+	if e.ID <= h.lastID {
+		e.ID = h.lastID + 1
+	}
+	h.lastID = e.ID
+
+	if old := h.backlog[h.next]; old != nil {
+		h.evictedID = old.ID
+	}
+	h.backlog[h.next] = e
+	h.next = (h.next + 1) % len(h.backlog)
+
+	for sub := range h.subs {
+		if !sub.matches(e.Username) {
+			continue
+		}
+		select {
+		case sub.c <- e:
+		default:
+			// Subscriber is too slow
+			sub.close()
+		}
+	}
+
+	handlers := make([]*handler, 0, len(h.handlers))
+	for hd := range h.handlers {
+		handlers = append(handlers, hd)
+	}
+	h.mu.Unlock()
+
+	// Outside the lock, handlers can take a while
+	for _, hd := range handlers {
+		hd.fn(e)
+	}
+}
+
+type handler struct {
+	fn func(e *Event)
+}
+
+// Handle calls fn with every event, in the goroutine that publishes it,
+// before Publish returns. Unlike subscriptions, handlers never miss events,
+// but they slow down whatever made the change. The returned function removes
+// the handler.
+func (h *Hub) Handle(fn func(e *Event)) (remove func()) {
+	hd := &handler{fn}
+	h.mu.Lock()
+	h.handlers[hd] = struct{}{}
+	h.mu.Unlock()
+	return func() {
+		h.mu.Lock()
+		delete(h.handlers, hd)
+		h.mu.Unlock()
+	}
+}
+
+// Subscribe creates a subscription for the given usernames, which can be
+// changed later. buffer is how many events can be waiting for the subscriber
+// before it is considered too slow and closed.
+func (h *Hub) Subscribe(buffer int, usernames ...string) *Subscription {
+	c := make(chan *Event, buffer)
+	sub := &Subscription{
+		C:         c,
+		c:         c,
+		hub:       h,
+		usernames: make(map[string]struct{}, len(usernames)),
+	}
+	for _, u := range usernames {
+		sub.usernames[u] = struct{}{}
+	}
+
+	h.mu.Lock()
+	h.subs[sub] = struct{}{}
+	h.mu.Unlock()
+	return sub
+}
+
+// SubscribeAll creates a subscription for events about all usernames.
+func (h *Hub) SubscribeAll(buffer int) *Subscription {
+	sub := h.Subscribe(buffer)
+	h.mu.Lock()
+	sub.all = true
+	h.mu.Unlock()
+	return sub
+}
+
+// Subscribers returns the number of open subscriptions.
+func (h *Hub) Subscribers() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.subs)
+}
+
+// Since returns the events after the given ID for the usernames, oldest first.
+// If ok is false, some events after that ID are no longer in the backlog, or
+// happened before this process started, and the caller should get the current
+// state some other way.
+func (h *Hub) Since(id uint64, usernames map[string]struct{}) (events []*Event, ok bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if id < h.startID || id < h.evictedID {
+		return nil, false
+	}
+
+	for i := 0; i < len(h.backlog); i++ {
+		e := h.backlog[(h.next+i)%len(h.backlog)]
+		if e == nil || e.ID <= id {
+			continue
+		}
+		if _, want := usernames[e.Username]; want {
+			events = append(events, e)
+		}
+	}
+	return events, true
+}
+
+// LastID returns the ID of the latest event, or a starting ID if there
+// haven't been any yet.
+func (h *Hub) LastID() uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.lastID == 0 {
+		return h.startID
+	}
+	return h.lastID
+}
+
+// Add adds usernames to the subscription.
+func (s *Subscription) Add(usernames ...string) {
+	s.hub.mu.Lock()
+	defer s.hub.mu.Unlock()
+	for _, u := range usernames {
+		s.usernames[u] = struct{}{}
+	}
+}
+
+// Remove removes usernames from the subscription.
+func (s *Subscription) Remove(usernames ...string) {
+	s.hub.mu.Lock()
+	defer s.hub.mu.Unlock()
+	for _, u := range usernames {
+		delete(s.usernames, u)
+	}
+}
+
+// Close ends the subscription. It is safe to call more than once.
+func (s *Subscription) Close() {
+	s.hub.mu.Lock()
+	defer s.hub.mu.Unlock()
+	s.close()
+}
+
+// close must be called with the hub lock held
+func (s *Subscription) close() {
+	if s.closed {
+		return
+	}
+	s.closed = true
+	delete(s.hub.subs, s)
+	close(s.c)
+}
+
+func (s *Subscription) matches(username string) bool {
+	if s.all {
+		return true
+	}
+	_, ok := s.usernames[username]
+	return ok
+}
+
+// Publish publishes an event on the default hub.
+func Publish(e *Event) {
+	Default.Publish(e)
+}
@@ -0,0 +1,65 @@
+// logring keeps the most recent log lines in memory, so admins can see
+// errors in the browser without access to the server's logs.
+package logring
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// Entry is one logged line. The line includes the log package's own
+// timestamp prefix, Time is when it was received.
+type Entry struct {
+	Time time.Time
+	Line string
+}
+
+// Ring is an io.Writer that keeps the last lines written to it.
+// It's safe for concurrent use.
+type Ring struct {
+	mu      sync.Mutex
+	entries []Entry // Ring buffer
+	next    int     // Index in entries for the next line
+	full    bool
+}
+
+// New creates a ring that keeps the given number of lines.
+func New(size int) *Ring {
+	return &Ring{entries: make([]Entry, size)}
+}
+
+// Default is the ring that main sends the log output to.
+var Default = New(200)
+
+// Write stores each line of p. The log package calls Write once per
+// message, messages with newlines in them become several entries.
+func (r *Ring) Write(p []byte) (int, error) {
+	now := time.Now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		r.entries[r.next] = Entry{Time: now, Line: line}
+		r.next = (r.next + 1) % len(r.entries)
+		if r.next == 0 {
+			r.full = true
+		}
+	}
+	return len(p), nil
+}
+
+// Entries returns the stored lines, newest first.
+func (r *Ring) Entries() []Entry {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	n := r.next
+	if r.full {
+		n = len(r.entries)
+	}
+	entries := make([]Entry, 0, n)
+	for i := 1; i <= n; i++ {
+		entries = append(entries, r.entries[(r.next-i+len(r.entries))%len(r.entries)])
+	}
+	return entries
+}
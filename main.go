@@ -2,9 +2,11 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"io/fs"
 	"log"
 	"net"
@@ -13,6 +15,7 @@ import (
 	"os/signal"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
@@ -21,9 +24,19 @@ import (
 	"golang.org/x/term"
 
 	"github.com/makeworld-the-better-one/whatsup/api"
+	"github.com/makeworld-the-better-one/whatsup/backup"
 	"github.com/makeworld-the-better-one/whatsup/config"
 	"github.com/makeworld-the-better-one/whatsup/db"
+	"github.com/makeworld-the-better-one/whatsup/finger"
+	"github.com/makeworld-the-better-one/whatsup/gemini"
+	"github.com/makeworld-the-better-one/whatsup/httpsig"
+	"github.com/makeworld-the-better-one/whatsup/logring"
+	"github.com/makeworld-the-better-one/whatsup/model"
+	"github.com/makeworld-the-better-one/whatsup/remote"
 	"github.com/makeworld-the-better-one/whatsup/version"
+	"github.com/makeworld-the-better-one/whatsup/web"
+	"github.com/makeworld-the-better-one/whatsup/webhook"
+	"github.com/makeworld-the-better-one/whatsup/websub"
 )
 
 var (
@@ -46,12 +59,18 @@ func main() {
 		os.Exit(passwordHash())
 	}
 
-	log.Println("started")
+	// Recent log lines are shown to admins in the settings web UI
+	log.SetOutput(io.MultiWriter(os.Stderr, logring.Default))
 
 	if _, err := toml.DecodeFile(confFlag, &config.Conf); err != nil {
 		log.Fatal(err)
 	}
 
+	if flag.Arg(0) == "restore" {
+		// Replaces the data dir, so it can't be created or opened first
+		os.Exit(restoreCommand(flag.Args()[1:]))
+	}
+
 	err := os.Mkdir(config.Conf.Data.Dir, 0755)
 	if err != nil && !errors.Is(err, fs.ErrExist) {
 		log.Fatal(err)
@@ -62,25 +81,242 @@ func main() {
 		log.Fatal(err)
 	}
 
+	if config.Conf.Data.Readers <= 0 {
+		config.Conf.Data.Readers = 4
+	}
+	if config.Conf.Data.BusyTimeout.Duration <= 0 {
+		config.Conf.Data.BusyTimeout.Duration = 5 * time.Second
+	}
+
+	if config.Conf.Following.RecheckInterval.Duration <= 0 {
+		config.Conf.Following.RecheckInterval.Duration = 24 * time.Hour
+	}
+
+	if config.Conf.Privacy.DeniedCode == 0 {
+		config.Conf.Privacy.DeniedCode = http.StatusNotFound
+	}
+	if config.Conf.Privacy.DeniedCode != http.StatusNotFound && config.Conf.Privacy.DeniedCode != http.StatusForbidden {
+		log.Fatal("privacy.denied_code must be 403 or 404")
+	}
+	if config.Conf.Query.MaxUsers <= 0 {
+		config.Conf.Query.MaxUsers = 100
+	}
+	if config.Conf.Cache.Entries > 0 && config.Conf.Data.Driver == "postgres" && config.Conf.Cache.TTL.Duration <= 0 {
+		// The database can be changed without going through this server
+		config.Conf.Cache.TTL.Duration = 5 * time.Second
+	}
+	if config.Conf.Server.Domain == "" {
+		config.Conf.Server.Domain = config.Conf.Server.Host
+	}
+
+	if config.Conf.Server.URL == "" {
+		config.Conf.Server.URL = "https://" + config.Conf.Server.Domain
+	}
+	config.Conf.Server.URL = strings.TrimSuffix(config.Conf.Server.URL, "/")
+	if config.Conf.Keys.RotateAfter.Duration <= 0 {
+		config.Conf.Keys.RotateAfter.Duration = 90 * 24 * time.Hour
+	}
+
+	if config.Conf.Stream.MaxPerIP <= 0 {
+		config.Conf.Stream.MaxPerIP = 10
+	}
+	if _, err := api.ParseTrustedProxies(config.Conf.Stream.TrustedProxies); err != nil {
+		log.Fatal(err)
+	}
+	if config.Conf.Stream.Heartbeat.Duration <= 0 {
+		config.Conf.Stream.Heartbeat.Duration = 30 * time.Second
+	}
+	if config.Conf.Stream.RemotePoll.Duration <= 0 {
+		config.Conf.Stream.RemotePoll.Duration = time.Minute
+	}
+
+	if config.Conf.Webhooks.MaxAttempts <= 0 {
+		config.Conf.Webhooks.MaxAttempts = 8
+	}
+	if config.Conf.Webhooks.DisableAfter <= 0 {
+		config.Conf.Webhooks.DisableAfter = 20
+	}
+	if config.Conf.WebSub.MaxLease.Duration <= 0 {
+		config.Conf.WebSub.MaxLease.Duration = 30 * 24 * time.Hour
+	}
+	if config.Conf.WebSub.Lease.Duration <= 0 {
+		config.Conf.WebSub.Lease.Duration = 10 * 24 * time.Hour
+	}
+	if config.Conf.WebSub.Lease.Duration > config.Conf.WebSub.MaxLease.Duration {
+		config.Conf.WebSub.Lease.Duration = config.Conf.WebSub.MaxLease.Duration
+	}
+	if config.Conf.WebSub.MaxPerHost <= 0 {
+		config.Conf.WebSub.MaxPerHost = 100
+	}
+
+	if config.Conf.Feed.Entries <= 0 {
+		config.Conf.Feed.Entries = 20
+	}
+
+	if config.Conf.Finger.Host == "" {
+		config.Conf.Finger.Host = config.Conf.Server.Host
+	}
+	if config.Conf.Finger.Port == 0 {
+		config.Conf.Finger.Port = 79
+	}
+	if config.Conf.Finger.MaxConns <= 0 {
+		config.Conf.Finger.MaxConns = 20
+	}
+	if config.Conf.Finger.MaxPerIP <= 0 {
+		config.Conf.Finger.MaxPerIP = 3
+	}
+
+	if config.Conf.Gemini.Host == "" {
+		config.Conf.Gemini.Host = config.Conf.Server.Host
+	}
+	if config.Conf.Gemini.Port == 0 {
+		config.Conf.Gemini.Port = 1965
+	}
+	if config.Conf.Gemini.Hostname == "" {
+		config.Conf.Gemini.Hostname = config.Conf.Server.Domain
+		if host, _, err := net.SplitHostPort(config.Conf.Gemini.Hostname); err == nil {
+			config.Conf.Gemini.Hostname = host
+		}
+	}
+	if config.Conf.Gemini.Cert == "" && config.Conf.Gemini.Key == "" {
+		if config.Conf.Server.Cert != "" && config.Conf.Server.Key != "" {
+			config.Conf.Gemini.Cert = config.Conf.Server.Cert
+			config.Conf.Gemini.Key = config.Conf.Server.Key
+		} else {
+			config.Conf.Gemini.Cert = filepath.Join(config.Conf.Data.Dir, "gemini-cert.pem")
+			config.Conf.Gemini.Key = filepath.Join(config.Conf.Data.Dir, "gemini-key.pem")
+		}
+	}
+	if config.Conf.Gemini.MaxConns <= 0 {
+		config.Conf.Gemini.MaxConns = 50
+	}
+
+	if config.Conf.Web.SessionLifetime.Duration <= 0 {
+		config.Conf.Web.SessionLifetime.Duration = 30 * 24 * time.Hour
+	}
+
+	if config.Conf.Backup.Keep <= 0 {
+		config.Conf.Backup.Keep = 7
+	}
+	if config.Conf.Backup.Interval.Duration > 0 && config.Conf.Backup.Dir == "" {
+		log.Fatal("backup.dir must be set for scheduled backups")
+	}
+	if d := config.Conf.Data.Driver; config.Conf.Backup.Interval.Duration > 0 && d != "" && d != "sqlite" {
+		log.Fatal(`scheduled backups only work with the "sqlite" driver`)
+	}
+
+	serverWebhooks := make([]*model.Webhook, len(config.Conf.Webhooks.Server))
+	for i, whc := range config.Conf.Webhooks.Server {
+		wh := &model.Webhook{URL: whc.URL, Secret: whc.Secret, Events: whc.Events, Users: []string{}}
+		if wh.Events == nil {
+			wh.Events = []string{model.WebhookStatus, model.WebhookFollowing}
+		}
+		if err := wh.Validate(); err != nil {
+			log.Fatalf("Invalid server webhook %s: %v", whc.URL, err)
+		}
+		if wh.Secret == "" {
+			log.Fatalf("Server webhook %s has no secret", whc.URL)
+		}
+		serverWebhooks[i] = wh
+	}
+
 	for username := range config.Conf.Users {
-		if !validUsername(username) {
+		if !model.ValidUsername(username) {
 			log.Fatal("Username uses invalid characters: " + username)
 		}
 	}
 
+	if flag.Arg(0) == "migrate" {
+		// Runs before db.Init, which would apply the migrations itself
+		os.Exit(migrateCommand(flag.Args()[1:]))
+	}
+	if flag.Arg(0) == "db" {
+		// Runs before db.Init, which refuses to start with a damaged database
+		os.Exit(dbCommand(flag.Args()[1:]))
+	}
+
+	if flag.NArg() == 0 {
+		// Held until the server exits, so commands like "whatsup db rekey"
+		// can tell it's running
+		if _, err := db.LockDataDir(); err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	if err := db.Init(); err != nil {
 		log.Fatal(err)
 	}
+	if err := web.Init(filepath.Join(config.Conf.Data.Dir, "templates")); err != nil {
+		log.Fatal(err)
+	}
 
-	apiHandler := api.NewServer()
+	if flag.NArg() > 0 {
+		code := runCommand(flag.Args())
+		db.Close()
+		os.Exit(code)
+	}
 
+	if err := db.SyncServerWebhooks(db.Default, serverWebhooks); err != nil {
+		log.Fatal(err)
+	}
+
+	log.Println("started")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if config.Conf.Following.Validate {
+		remote.StartRechecks(ctx, db.Default, config.Conf.Following.RecheckInterval.Duration)
+	}
+
+	keyring, err := httpsig.LoadKeyring(filepath.Join(config.Conf.Data.Dir, "server-keys.json"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	remote.DefaultClient.Signer = &httpsig.Signer{Keyring: keyring, BaseURL: config.Conf.Server.URL}
+	if config.Conf.Remote.AllowPrivate {
+		remote.DefaultClient.HTTP = &http.Client{Timeout: 10 * time.Second}
+	}
+	startKeyRotation(ctx, keyring, config.Conf.Keys.RotateAfter.Duration)
+
+	remote.DefaultWatcher.Interval = config.Conf.Stream.RemotePoll.Duration
+	if config.Conf.WebSub.Subscribe {
+		remote.DefaultWatcher.Callback = config.Conf.Server.URL + websub.CallbackPath
+		remote.DefaultWatcher.Lease = config.Conf.WebSub.Lease.Duration
+	}
+	go remote.DefaultWatcher.Run(ctx)
+
+	webhook.Start(ctx, db.Default)
+	websub.Start(ctx, db.Default)
+	db.StartOptimize(ctx)
+
+	if config.Conf.Backup.Interval.Duration > 0 {
+		if err := os.MkdirAll(config.Conf.Backup.Dir, 0700); err != nil {
+			log.Fatal(err)
+		}
+		dataDir, err := filepath.Abs(config.Conf.Data.Dir)
+		if err != nil {
+			log.Fatal(err)
+		}
+		backupDir, err := filepath.Abs(config.Conf.Backup.Dir)
+		if err != nil {
+			log.Fatal(err)
+		}
+		backup.Start(ctx, dataDir, backupDir, config.Conf.Backup.Interval.Duration, config.Conf.Backup.Keep)
+	}
+
+	apiHandler := api.NewServer(keyring, db.Default)
+
+	// There are no read or write timeouts for whole requests, because streaming
+	// responses last much longer. api.Server applies a timeout to the
+	// other handlers instead.
 	s := &http.Server{
-		Addr:         net.JoinHostPort(config.Conf.Server.Host, strconv.Itoa(int(config.Conf.Server.Port))),
-		Handler:      apiHandler,
-		ReadTimeout:  time.Second * 10,
-		WriteTimeout: time.Second * 10,
+		Addr:              net.JoinHostPort(config.Conf.Server.Host, strconv.Itoa(int(config.Conf.Server.Port))),
+		Handler:           apiHandler,
+		ReadHeaderTimeout: time.Second * 10,
+		IdleTimeout:       time.Second * 60,
 	}
-	errc := make(chan error, 1)
+	errc := make(chan error, 3)
 
 	if config.Conf.Server.Cert != "" && config.Conf.Server.Key != "" {
 		go func() {
@@ -94,6 +330,33 @@ func main() {
 		log.Printf("Listening on http://%s", s.Addr)
 	}
 
+	if config.Conf.Finger.Enabled {
+		fingerSrv := &finger.Server{
+			Store:     db.Default,
+			Verbose:   config.Conf.Finger.Verbose,
+			ListUsers: config.Conf.Finger.ListUsers,
+			MaxConns:  config.Conf.Finger.MaxConns,
+			MaxPerIP:  config.Conf.Finger.MaxPerIP,
+		}
+		addr := net.JoinHostPort(config.Conf.Finger.Host, strconv.Itoa(int(config.Conf.Finger.Port)))
+		go func() {
+			errc <- fingerSrv.ListenAndServe(ctx, addr)
+		}()
+		log.Printf("Finger listening on %s", addr)
+	}
+
+	if config.Conf.Gemini.Enabled {
+		gs, err := geminiServer()
+		if err != nil {
+			log.Fatal(err)
+		}
+		addr := net.JoinHostPort(config.Conf.Gemini.Host, strconv.Itoa(int(config.Conf.Gemini.Port)))
+		go func() {
+			errc <- gs.ListenAndServe(ctx, addr)
+		}()
+		log.Printf("Gemini listening on %s", addr)
+	}
+
 	// Wait for server error or process signals (like Ctrl-C)
 	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
@@ -105,9 +368,9 @@ func main() {
 	}
 
 	// Gracefully shut down HTTP server with 5 second timeout
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
-	defer cancel()
-	if err := s.Shutdown(ctx); err != nil {
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer shutdownCancel()
+	if err := s.Shutdown(shutdownCtx); err != nil {
 		log.Printf("shutting down HTTP server with timeout: %v", err)
 	}
 
@@ -118,24 +381,58 @@ func main() {
 	log.Println("stopped")
 }
 
-// validUsername returns a bool indicating the provided username is valid under
-// the fmrl spec.
-func validUsername(username string) bool {
-	if len(username) > 40 || len(username) == 0 {
-		// Usernames are limited to 40 characters/bytes
-		return false
-	}
-
-	// From spec:
-	// 		A valid username consists only of ASCII lowercase letters, numbers,
-	//		and the following characters: _. All together, the valid character
-	//		set is abcdefghijklmnopqrstuvwxyz0123456789_.
-	for _, b := range []byte(username) {
-		if b < 0x30 || (b >= 0x3A && b <= 0x60) || b >= 0x7B {
-			return false
+// geminiServer creates the Gemini server, generating a self-signed certificate
+// if there isn't one yet.
+func geminiServer() (*gemini.Server, error) {
+	conf := config.Conf.Gemini
+	if _, err := os.Stat(conf.Cert); errors.Is(err, fs.ErrNotExist) {
+		if err := gemini.GenerateCert(conf.Cert, conf.Key, conf.Hostname, geminiCertValidity); err != nil {
+			return nil, fmt.Errorf("generating Gemini certificate: %w", err)
+		}
+		fp, err := gemini.Fingerprint(conf.Cert, conf.Key)
+		if err != nil {
+			return nil, err
 		}
+		log.Printf("Generated self-signed Gemini certificate with SHA-256 fingerprint %s", fp)
 	}
-	return true
+
+	cert, err := tls.LoadX509KeyPair(conf.Cert, conf.Key)
+	if err != nil {
+		return nil, fmt.Errorf("loading Gemini certificate: %w", err)
+	}
+	return &gemini.Server{
+		Store:    db.Default,
+		Hostname: conf.Hostname,
+		History:  conf.History,
+		MaxConns: conf.MaxConns,
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			MinVersion:   tls.VersionTLS12,
+		},
+	}, nil
+}
+
+// startKeyRotation rotates the server key in the background whenever the
+// active key is older than rotateAfter.
+func startKeyRotation(ctx context.Context, keyring *httpsig.Keyring, rotateAfter time.Duration) {
+	go func() {
+		ticker := time.NewTicker(time.Hour)
+		defer ticker.Stop()
+		for {
+			if time.Since(keyring.Active().Created) > rotateAfter {
+				if key, err := keyring.Rotate(); err != nil {
+					log.Printf("rotating server key: %v", err)
+				} else {
+					log.Printf("rotated server key, new key is %s", key.ID)
+				}
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
 }
 
 func passwordHash() int {
@@ -0,0 +1,26 @@
+package model
+
+import "time"
+
+const (
+	RoleUser  = "user"
+	RoleAdmin = "admin"
+)
+
+// Account is the server-side state of a local user, separate from their
+// status. Users themselves still come from the config file.
+//
+// PasswordHash is empty unless an admin has reset the password, in which
+// case it replaces the hash in the config.
+type Account struct {
+	Username     string
+	Role         string
+	Disabled     bool
+	PasswordHash string
+	CreatedAt    time.Time
+}
+
+// IsAdmin returns true if the account can use the admin pages.
+func (a *Account) IsAdmin() bool {
+	return a.Role == RoleAdmin && !a.Disabled
+}
@@ -40,3 +40,10 @@ type Following struct {
 	UpdatedAt time.Time
 	Usernames FollowingUsernames
 }
+
+// Merge adds all the usernames from other.
+func (fu FollowingUsernames) Merge(other FollowingUsernames) {
+	for u := range other {
+		fu[u] = struct{}{}
+	}
+}
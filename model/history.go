@@ -0,0 +1,11 @@
+package model
+
+import "time"
+
+// StatusEntry is a past status of a user, recorded whenever it changed.
+type StatusEntry struct {
+	ID        int64
+	Username  string
+	CreatedAt time.Time
+	Status    *Status
+}
@@ -0,0 +1,11 @@
+package model
+
+import "time"
+
+// List is a named group of global usernames owned by a user.
+// The usernames are always a subset of the usernames the owner follows.
+type List struct {
+	Name      string
+	UpdatedAt time.Time
+	Usernames FollowingUsernames
+}
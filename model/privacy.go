@@ -0,0 +1,91 @@
+package model
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Privacy modes, which control who can see a user's status
+const (
+	// PrivacyPublic lets anyone see the status
+	PrivacyPublic = "public"
+	// PrivacyLocal only lets authenticated users of the same server see the status
+	PrivacyLocal = "local"
+	// PrivacyAllowList only lets authenticated requesters in the allow list see the status
+	PrivacyAllowList = "allowlist"
+)
+
+// Privacy holds the privacy settings for a user.
+// The owner of the status can always see it, and blocked users never can.
+//
+// Finger is false if the user opted out of the finger server, even if their
+// status is public.
+type Privacy struct {
+	Mode   string             `json:"mode"`
+	Allow  FollowingUsernames `json:"allow"`
+	Block  FollowingUsernames `json:"block"`
+	Finger bool               `json:"finger"`
+}
+
+// NewPrivacy returns the default privacy settings, which makes the status public.
+func NewPrivacy() *Privacy {
+	return &Privacy{
+		Mode:   PrivacyPublic,
+		Allow:  NewFollowingUsernames(),
+		Block:  NewFollowingUsernames(),
+		Finger: true,
+	}
+}
+
+// Requester is who is making a request.
+// The zero value is an anonymous requester.
+type Requester struct {
+	// Username is the global username of the requester, if known
+	Username string
+	// Server is the host of the remote server making the request, if it was signed
+	Server string
+	// Local is true if Username is a user of this server
+	Local bool
+}
+
+// Validate returns an error indicating how the settings are invalid.
+func (p *Privacy) Validate() error {
+	if p.Mode != PrivacyPublic && p.Mode != PrivacyLocal && p.Mode != PrivacyAllowList {
+		return errors.New("mode must be public, local, or allowlist")
+	}
+	for u := range p.Allow {
+		if !FollowingUsernameRE.MatchString(u) {
+			return fmt.Errorf("invalid global username in allow list: %s", u)
+		}
+	}
+	for u := range p.Block {
+		if !FollowingUsernameRE.MatchString(u) {
+			return fmt.Errorf("invalid global username in block list: %s", u)
+		}
+	}
+	return nil
+}
+
+// Allows returns true if the requester can see the status of the owner,
+// who is specified by global username.
+func (p *Privacy) Allows(owner string, req *Requester) bool {
+	if req.Username != "" {
+		if req.Username == owner {
+			return true
+		}
+		if _, ok := p.Block[req.Username]; ok {
+			return false
+		}
+	}
+
+	switch p.Mode {
+	case PrivacyPublic:
+		return true
+	case PrivacyLocal:
+		return req.Local
+	case PrivacyAllowList:
+		_, ok := p.Allow[req.Username]
+		return ok && req.Username != ""
+	}
+	return false
+}
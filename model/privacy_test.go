@@ -0,0 +1,74 @@
+package model
+
+import "testing"
+
+func TestPrivacyAllows(t *testing.T) {
+	const owner = "@alice@example.org"
+	var (
+		anonymous = &Requester{}
+		self      = &Requester{Username: owner, Local: true}
+		local     = &Requester{Username: "@bob@example.org", Local: true}
+		remote    = &Requester{Username: "@carol@remote.example", Server: "remote.example"}
+		// Signed by a server, but not for any user
+		server = &Requester{Server: "remote.example"}
+	)
+
+	privacy := func(mode string, allow, block []string) *Privacy {
+		p := NewPrivacy()
+		p.Mode = mode
+		for _, u := range allow {
+			p.Allow[u] = struct{}{}
+		}
+		for _, u := range block {
+			p.Block[u] = struct{}{}
+		}
+		return p
+	}
+
+	tests := []struct {
+		name    string
+		privacy *Privacy
+		req     *Requester
+		want    bool
+	}{
+		{"public anonymous", privacy(PrivacyPublic, nil, nil), anonymous, true},
+		{"public local", privacy(PrivacyPublic, nil, nil), local, true},
+		{"public remote", privacy(PrivacyPublic, nil, nil), remote, true},
+		{"public blocked", privacy(PrivacyPublic, nil, []string{"@carol@remote.example"}), remote, false},
+		{"public blocked other", privacy(PrivacyPublic, nil, []string{"@dave@remote.example"}), remote, true},
+
+		{"local anonymous", privacy(PrivacyLocal, nil, nil), anonymous, false},
+		{"local local", privacy(PrivacyLocal, nil, nil), local, true},
+		{"local remote", privacy(PrivacyLocal, nil, nil), remote, false},
+		{"local server", privacy(PrivacyLocal, nil, nil), server, false},
+		{"local remote allowed", privacy(PrivacyLocal, []string{"@carol@remote.example"}, nil), remote, false},
+		{"local blocked", privacy(PrivacyLocal, nil, []string{"@bob@example.org"}), local, false},
+
+		{"allowlist anonymous", privacy(PrivacyAllowList, nil, nil), anonymous, false},
+		{"allowlist local", privacy(PrivacyAllowList, nil, nil), local, false},
+		{"allowlist local allowed", privacy(PrivacyAllowList, []string{"@bob@example.org"}, nil), local, true},
+		{"allowlist remote allowed", privacy(PrivacyAllowList, []string{"@carol@remote.example"}, nil), remote, true},
+		{"allowlist remote not allowed", privacy(PrivacyAllowList, []string{"@bob@example.org"}, nil), remote, false},
+		{"allowlist server", privacy(PrivacyAllowList, []string{"@carol@remote.example"}, nil), server, false},
+		{"allowlist empty username", privacy(PrivacyAllowList, []string{""}, nil), anonymous, false},
+		{
+			"block overrides allow",
+			privacy(PrivacyAllowList, []string{"@carol@remote.example"}, []string{"@carol@remote.example"}),
+			remote, false,
+		},
+
+		{"self public", privacy(PrivacyPublic, nil, nil), self, true},
+		{"self local", privacy(PrivacyLocal, nil, nil), self, true},
+		{"self allowlist", privacy(PrivacyAllowList, nil, nil), self, true},
+		{"self blocked", privacy(PrivacyAllowList, nil, []string{owner}), self, true},
+
+		{"unknown mode", privacy("friends", nil, nil), local, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.privacy.Allows(owner, tt.req); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
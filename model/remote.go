@@ -0,0 +1,19 @@
+package model
+
+import "time"
+
+// Existence states for remote users
+const (
+	RemoteUnchecked   = "unchecked"
+	RemoteExists      = "exists"
+	RemoteNotFound    = "not_found"
+	RemoteUnreachable = "unreachable"
+)
+
+// RemoteUser is the result of checking whether a global username exists on
+// its home server.
+type RemoteUser struct {
+	Username  string     `json:"username"`
+	State     string     `json:"state"`
+	CheckedAt *time.Time `json:"checked_at,omitempty"`
+}
@@ -0,0 +1,16 @@
+package model
+
+import "time"
+
+// Session is a logged in browser session of the settings web UI.
+//
+// ID is the hash of the token in the session cookie, so the cookie can't be
+// recreated from the database. CSRF is the token that must be sent with
+// every form submission.
+type Session struct {
+	ID        string
+	Username  string
+	CSRF      string
+	CreatedAt time.Time
+	ExpiresAt time.Time
+}
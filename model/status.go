@@ -96,7 +96,7 @@ func (s *Status) Validate() error {
 	if s.Media != nil && !validString(*s.Media, 100) {
 		return errors.New("media is longer than 100 code points or contains control characters")
 	}
-	if s.MediaType != nil && (*s.MediaType < 0 || *s.MediaType > 5) {
+	if s.MediaType != nil && (*s.MediaType < 0 || *s.MediaType > MaxMediaType) {
 		return errors.New("media_type value is undefined")
 	}
 	if s.URI != nil {
@@ -110,6 +110,29 @@ func (s *Status) Validate() error {
 	return nil
 }
 
+// MaxMediaType is the largest valid media_type value.
+const MaxMediaType = 5
+
+// mediaTypeLabels are the human-readable meanings of media_type values,
+// indexed by value.
+var mediaTypeLabels = [MaxMediaType + 1]string{
+	"Media",
+	"Listening to",
+	"Watching",
+	"Reading",
+	"Playing",
+	"Other",
+}
+
+// MediaTypeLabel returns a human-readable label for a media_type value,
+// for displaying next to the media field.
+func MediaTypeLabel(mediaType int) string {
+	if mediaType < 0 || mediaType >= len(mediaTypeLabels) {
+		return mediaTypeLabels[0]
+	}
+	return mediaTypeLabels[mediaType]
+}
+
 // validString returns false if the provided string has any characters
 // defined as control characters by Unicode, or if it has more code points
 // than the provided max.s
@@ -0,0 +1,188 @@
+package model
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Import and export of following lists, for moving between servers and clients.
+
+// FollowingUsernameRE matches valid global usernames.
+var FollowingUsernameRE = regexp.MustCompile(`^@[a-z0-9_\.]{1,40}@[\w\.-]+$`)
+
+// Supported import and export formats
+const (
+	FormatJSON = "json"
+	FormatCSV  = "csv"
+	FormatOPML = "opml"
+)
+
+var ErrUnknownFormat = errors.New("unknown format, must be json, csv, or opml")
+
+// EntryError describes why a single entry of an imported file was rejected.
+// Entry is the 1-based position of the entry in the file.
+type EntryError struct {
+	Entry    int    `json:"entry"`
+	Username string `json:"username"`
+	Msg      string `json:"msg"`
+}
+
+func (e *EntryError) Error() string {
+	return fmt.Sprintf("entry %d (%s): %s", e.Entry, e.Username, e.Msg)
+}
+
+type opml struct {
+	XMLName xml.Name `xml:"opml"`
+	Version string   `xml:"version,attr"`
+	Head    struct {
+		Title       string `xml:"title"`
+		DateCreated string `xml:"dateCreated,omitempty"`
+	} `xml:"head"`
+	Body struct {
+		Outlines []opmlOutline `xml:"outline"`
+	} `xml:"body"`
+}
+
+type opmlOutline struct {
+	Type     string        `xml:"type,attr,omitempty"`
+	Text     string        `xml:"text,attr"`
+	Title    string        `xml:"title,attr,omitempty"`
+	Outlines []opmlOutline `xml:"outline"`
+}
+
+// Sorted returns the usernames as a sorted slice.
+func (fu FollowingUsernames) Sorted() []string {
+	usernames := make([]string, 0, len(fu))
+	for u := range fu {
+		usernames = append(usernames, u)
+	}
+	sort.Strings(usernames)
+	return usernames
+}
+
+// ContentType returns the MIME type for the given format.
+func ContentType(format string) string {
+	switch format {
+	case FormatCSV:
+		return "text/csv; charset=utf-8"
+	case FormatOPML:
+		return "text/x-opml; charset=utf-8"
+	default:
+		return "application/json"
+	}
+}
+
+// ExportFollowing encodes the usernames in the given format.
+// Usernames are always sorted.
+func ExportFollowing(fu FollowingUsernames, format string) ([]byte, error) {
+	usernames := fu.Sorted()
+
+	switch format {
+	case FormatJSON:
+		return json.Marshal(&usernames)
+	case FormatCSV:
+		var buf bytes.Buffer
+		w := csv.NewWriter(&buf)
+		w.Write([]string{"username"})
+		for _, u := range usernames {
+			w.Write([]string{u})
+		}
+		w.Flush()
+		return buf.Bytes(), w.Error()
+	case FormatOPML:
+		doc := opml{Version: "2.0"}
+		doc.Head.Title = "fmrl following"
+		doc.Head.DateCreated = time.Now().UTC().Format(time.RFC1123Z)
+		for _, u := range usernames {
+			doc.Body.Outlines = append(doc.Body.Outlines, opmlOutline{Type: "fmrl", Text: u})
+		}
+		out, err := xml.MarshalIndent(&doc, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		return append([]byte(xml.Header), append(out, '\n')...), nil
+	}
+	return nil, ErrUnknownFormat
+}
+
+// ImportFollowing decodes usernames from data in the given format.
+//
+// Every entry is validated separately. Valid entries are returned as
+// usernames, and invalid ones are described in the returned EntryErrors.
+// The error is only non-nil if the data as a whole couldn't be decoded.
+func ImportFollowing(data []byte, format string) (FollowingUsernames, []*EntryError, error) {
+	var entries []string
+
+	switch format {
+	case FormatJSON:
+		if err := json.Unmarshal(data, &entries); err != nil {
+			return nil, nil, err
+		}
+	case FormatCSV:
+		r := csv.NewReader(bytes.NewReader(data))
+		r.FieldsPerRecord = -1
+		for i := 0; ; i++ {
+			record, err := r.Read()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				return nil, nil, err
+			}
+			if i == 0 && strings.EqualFold(strings.TrimSpace(record[0]), "username") {
+				// Header row
+				continue
+			}
+			// Only the first column is used, the rest could be client metadata
+			entries = append(entries, strings.TrimSpace(record[0]))
+		}
+	case FormatOPML:
+		var doc opml
+		if err := xml.Unmarshal(data, &doc); err != nil {
+			return nil, nil, err
+		}
+		entries = opmlEntries(doc.Body.Outlines, entries)
+	default:
+		return nil, nil, ErrUnknownFormat
+	}
+
+	fu := NewFollowingUsernames()
+	var errs []*EntryError
+	for i, u := range entries {
+		if !FollowingUsernameRE.MatchString(u) {
+			errs = append(errs, &EntryError{Entry: i + 1, Username: u, Msg: "invalid global username"})
+			continue
+		}
+		fu[u] = struct{}{}
+	}
+	return fu, errs, nil
+}
+
+// opmlEntries appends the usernames of all outlines to entries, recursing
+// into folders. Outlines for other things like RSS feeds are skipped.
+func opmlEntries(outlines []opmlOutline, entries []string) []string {
+	for _, o := range outlines {
+		if len(o.Outlines) > 0 {
+			entries = opmlEntries(o.Outlines, entries)
+			continue
+		}
+		if o.Type != "" && o.Type != "fmrl" {
+			continue
+		}
+		if o.Text != "" {
+			entries = append(entries, strings.TrimSpace(o.Text))
+		} else {
+			entries = append(entries, strings.TrimSpace(o.Title))
+		}
+	}
+	return entries
+}
@@ -0,0 +1,181 @@
+package model
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestFollowingRoundTrip(t *testing.T) {
+	fu := FollowingUsernames{
+		"@bob@example.org":      {},
+		"@alice@example.org":    {},
+		"@carol@remote.example": {},
+	}
+	for _, format := range []string{FormatJSON, FormatCSV, FormatOPML} {
+		t.Run(format, func(t *testing.T) {
+			data, err := ExportFollowing(fu, format)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, errs, err := ImportFollowing(data, format)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(errs) != 0 {
+				t.Errorf("entry errors: %v", errs)
+			}
+			if !reflect.DeepEqual(got, fu) {
+				t.Errorf("got %v, want %v", got.Sorted(), fu.Sorted())
+			}
+		})
+	}
+
+	// Exports are sorted, so they're the same every time
+	data, err := ExportFollowing(fu, FormatCSV)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "username\n@alice@example.org\n@bob@example.org\n@carol@remote.example\n"
+	if string(data) != want {
+		t.Errorf("CSV export is %q, want %q", data, want)
+	}
+
+	if _, err := ExportFollowing(fu, "yaml"); !errors.Is(err, ErrUnknownFormat) {
+		t.Errorf("unknown format: got %v", err)
+	}
+}
+
+func TestImportFollowing(t *testing.T) {
+	tests := []struct {
+		name   string
+		format string
+		data   string
+		want   []string
+		errs   []EntryError
+	}{
+		{
+			name:   "json",
+			format: FormatJSON,
+			data:   `["@alice@example.org", "@bob@example.org", "@alice@example.org"]`,
+			want:   []string{"@alice@example.org", "@bob@example.org"},
+		},
+		{
+			name:   "json invalid entries",
+			format: FormatJSON,
+			data:   `["@alice@example.org", "bob@example.org", "", "@Carol@example.org"]`,
+			want:   []string{"@alice@example.org"},
+			errs: []EntryError{
+				{Entry: 2, Username: "bob@example.org"},
+				{Entry: 3, Username: ""},
+				{Entry: 4, Username: "@Carol@example.org"},
+			},
+		},
+		{
+			name:   "csv with header",
+			format: FormatCSV,
+			data:   "Username\n@alice@example.org\n",
+			want:   []string{"@alice@example.org"},
+		},
+		{
+			name:   "csv without header",
+			format: FormatCSV,
+			data:   "@alice@example.org\n@bob@example.org\n",
+			want:   []string{"@alice@example.org", "@bob@example.org"},
+		},
+		{
+			name:   "csv extra columns and spaces",
+			format: FormatCSV,
+			data:   "username,note\n @alice@example.org ,friend\n@bob@example.org\n",
+			want:   []string{"@alice@example.org", "@bob@example.org"},
+		},
+		{
+			// Positions don't count the header row
+			name:   "csv invalid entries",
+			format: FormatCSV,
+			data:   "username\n@alice@example.org\nnot a username\n@bob@example.org\nusername\n",
+			want:   []string{"@alice@example.org", "@bob@example.org"},
+			errs: []EntryError{
+				{Entry: 2, Username: "not a username"},
+				{Entry: 4, Username: "username"},
+			},
+		},
+		{
+			name:   "opml nested folders",
+			format: FormatOPML,
+			data: `<?xml version="1.0"?>
+<opml version="2.0">
+  <head><title>following</title></head>
+  <body>
+    <outline type="fmrl" text="@alice@example.org"/>
+    <outline text="Friends">
+      <outline type="fmrl" text="@bob@example.org"/>
+      <outline text="Close">
+        <outline type="fmrl" title="@carol@remote.example"/>
+      </outline>
+    </outline>
+    <outline type="rss" text="Some feed" xmlUrl="https://example.org/feed"/>
+    <outline text="@dave@example.org"/>
+  </body>
+</opml>`,
+			want: []string{"@alice@example.org", "@bob@example.org", "@carol@remote.example", "@dave@example.org"},
+		},
+		{
+			name:   "opml invalid entries",
+			format: FormatOPML,
+			data: `<opml version="2.0"><body>
+  <outline text="Folder">
+    <outline text="@alice@example.org"/>
+    <outline text="alice"/>
+  </outline>
+  <outline text="@bob@"/>
+</body></opml>`,
+			want: []string{"@alice@example.org"},
+			errs: []EntryError{
+				{Entry: 2, Username: "alice"},
+				{Entry: 3, Username: "@bob@"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fu, errs, err := ImportFollowing([]byte(tt.data), tt.format)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := fu.Sorted(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+			if len(errs) != len(tt.errs) {
+				t.Fatalf("got entry errors %v, want %v", errs, tt.errs)
+			}
+			for i, e := range errs {
+				if e.Entry != tt.errs[i].Entry || e.Username != tt.errs[i].Username || e.Msg == "" {
+					t.Errorf("entry error %d is %+v, want %+v", i, e, tt.errs[i])
+				}
+			}
+		})
+	}
+}
+
+func TestImportFollowingInvalid(t *testing.T) {
+	tests := []struct {
+		format string
+		data   string
+	}{
+		{FormatJSON, `{"usernames": []}`},
+		{FormatJSON, `["@alice@example.org"`},
+		{FormatCSV, "\"@alice@example.org\n"},
+		{FormatOPML, "<opml><body>"},
+	}
+	for _, tt := range tests {
+		if _, _, err := ImportFollowing([]byte(tt.data), tt.format); err == nil {
+			t.Errorf("%s %q: no error", tt.format, tt.data)
+		}
+	}
+
+	_, _, err := ImportFollowing([]byte("@alice@example.org"), "yaml")
+	if !errors.Is(err, ErrUnknownFormat) {
+		t.Errorf("unknown format: got %v", err)
+	}
+}
@@ -0,0 +1,21 @@
+package model
+
+// ValidUsername returns a bool indicating the provided username is valid under
+// the fmrl spec.
+func ValidUsername(username string) bool {
+	if len(username) > 40 || len(username) == 0 {
+		// Usernames are limited to 40 characters/bytes
+		return false
+	}
+
+	// From spec:
+	// 		A valid username consists only of ASCII lowercase letters, numbers,
+	//		and the following characters: _. All together, the valid character
+	//		set is abcdefghijklmnopqrstuvwxyz0123456789_.
+	for _, b := range []byte(username) {
+		if b < 0x30 || (b >= 0x3A && b <= 0x60) || b >= 0x7B {
+			return false
+		}
+	}
+	return true
+}
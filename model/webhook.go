@@ -0,0 +1,91 @@
+package model
+
+import (
+	"encoding/json"
+	"errors"
+	"net/url"
+	"time"
+)
+
+// Webhook event names. They are the same as the hub event types.
+const (
+	WebhookStatus    = "status"
+	WebhookFollowing = "following"
+)
+
+// Delivery states
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryFailed    = "failed"
+)
+
+// Webhook is a URL that changes are POSTed to.
+//
+// Owner is the local username that registered it, or empty for server-wide
+// webhooks from the config. Users are the local usernames whose status
+// changes are sent, and empty means only the owner's, or everyone's for
+// server-wide webhooks. Following events are only ever sent for the owner,
+// or for everyone for server-wide webhooks.
+type Webhook struct {
+	ID        int64     `json:"id"`
+	Owner     string    `json:"-"`
+	URL       string    `json:"url"`
+	Secret    string    `json:"secret,omitempty"`
+	Events    []string  `json:"events"`
+	Users     []string  `json:"users"`
+	Enabled   bool      `json:"enabled"`
+	Failures  int       `json:"failures"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Validate returns an error indicating how the webhook is invalid.
+func (wh *Webhook) Validate() error {
+	u, err := url.Parse(wh.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("url must be an absolute http or https URL")
+	}
+	if len(wh.URL) > 2048 {
+		return errors.New("url is longer than 2048 bytes")
+	}
+	if len(wh.Events) == 0 {
+		return errors.New("no events")
+	}
+	for _, e := range wh.Events {
+		if e != WebhookStatus && e != WebhookFollowing {
+			return errors.New("events must be status or following")
+		}
+	}
+	for _, u := range wh.Users {
+		if !ValidUsername(u) {
+			return errors.New("invalid username in users: " + u)
+		}
+	}
+	return nil
+}
+
+// WantsEvent returns true if the webhook is subscribed to the event type.
+func (wh *Webhook) WantsEvent(event string) bool {
+	for _, e := range wh.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// WebhookDelivery is one event to be sent to a webhook, along with the
+// result of trying to send it.
+type WebhookDelivery struct {
+	ID          int64           `json:"id"`
+	WebhookID   int64           `json:"webhook_id"`
+	Event       string          `json:"event"`
+	Payload     json.RawMessage `json:"payload"`
+	State       string          `json:"state"`
+	Attempts    int             `json:"attempts"`
+	NextAttempt time.Time       `json:"next_attempt"`
+	LastCode    int             `json:"last_code"`
+	LastError   string          `json:"last_error"`
+	CreatedAt   time.Time       `json:"created_at"`
+	UpdatedAt   time.Time       `json:"updated_at"`
+}
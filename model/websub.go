@@ -0,0 +1,17 @@
+package model
+
+import "time"
+
+// WebSubSubscription is a remote party that gets a user's status pushed to
+// a callback URL whenever it changes, until the lease expires.
+//
+// The requester is whoever signed the subscription request, and the status
+// is only pushed if the user's privacy settings allow them to see it.
+type WebSubSubscription struct {
+	Username  string
+	Callback  string
+	Secret    string
+	Requester Requester
+	Expires   time.Time
+	CreatedAt time.Time
+}
@@ -0,0 +1,93 @@
+// netguard makes HTTP clients that only connect to public addresses, for
+// requests to URLs that come from users or other servers. Otherwise they
+// could be used to reach services on this machine or its private network.
+//
+// Addresses are checked when connecting, after DNS resolution, so a hostname
+// that resolves to a private address is refused too.
+package netguard
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+)
+
+var ErrNotPublic = errors.New("address is not public")
+
+var privateNets []*net.IPNet
+
+func init() {
+	for _, cidr := range []string{
+		"0.0.0.0/8",      // This network
+		"10.0.0.0/8",     // Private
+		"100.64.0.0/10",  // Carrier-grade NAT
+		"172.16.0.0/12",  // Private
+		"192.0.0.0/24",   // IETF protocol assignments
+		"192.168.0.0/16", // Private
+		"198.18.0.0/15",  // Benchmarking
+		"240.0.0.0/4",    // Reserved
+		"64:ff9b:1::/48", // Local-use IPv4/IPv6 translation
+		"fc00::/7",       // Unique local
+		"2001:db8::/32",  // Documentation
+	} {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		privateNets = append(privateNets, n)
+	}
+}
+
+// Public returns true if ip is an address on the public internet. Loopback,
+// link-local, private and other special addresses are not.
+func Public(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() ||
+		ip.IsMulticast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() {
+		return false
+	}
+	for _, n := range privateNets {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// control is run by the dialer after resolving an address and before
+// connecting to it.
+func control(network, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !Public(ip) {
+		return fmt.Errorf("%w: %s", ErrNotPublic, host)
+	}
+	return nil
+}
+
+// DialContext connects like net.Dialer.DialContext, but only to public
+// addresses.
+func DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	d := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		Control:   control,
+	}
+	return d.DialContext(ctx, network, address)
+}
+
+// NewClient returns an HTTP client that only connects to public addresses.
+// Proxies from the environment aren't used, since they would do the
+// connecting instead.
+func NewClient(timeout time.Duration) *http.Client {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.Proxy = nil
+	t.DialContext = DialContext
+	return &http.Client{Timeout: timeout, Transport: t}
+}
@@ -0,0 +1,185 @@
+// remote talks to other fmrl servers.
+package remote
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/makeworld-the-better-one/whatsup/httpsig"
+	"github.com/makeworld-the-better-one/whatsup/netguard"
+	"github.com/makeworld-the-better-one/whatsup/version"
+)
+
+// Client queries the status API of remote servers.
+type Client struct {
+	HTTP *http.Client
+
+	// BaseURL returns the URL the fmrl API of the given host is under,
+	// without a trailing slash. If nil, https://<host> is used.
+	// This can be set to point to local servers for testing.
+	BaseURL func(host string) string
+
+	// Signer signs requests if it is set, so remote servers know which server
+	// is asking. See AsUser.
+	Signer *httpsig.Signer
+}
+
+type asUserKey struct{}
+
+// AsUser returns a context that makes signed requests on behalf of the
+// local user with the given global username.
+func AsUser(ctx context.Context, global string) context.Context {
+	return context.WithValue(ctx, asUserKey{}, global)
+}
+
+// Do sends the request, signing it first if the client has a Signer.
+// The request must not have a body, use Post for that.
+func (c *Client) Do(req *http.Request) (*http.Response, error) {
+	return c.do(req, nil)
+}
+
+// Post sends a POST request with the body, signing it and the body first if
+// the client has a Signer. Headers can be added to the request with header.
+func (c *Client) Post(ctx context.Context, url, contentType string, body []byte, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", contentType)
+	return c.do(req, body)
+}
+
+func (c *Client) do(req *http.Request, body []byte) (*http.Response, error) {
+	req.Header.Set("User-Agent", version.UserAgent)
+	if c.Signer != nil {
+		user, _ := req.Context().Value(asUserKey{}).(string)
+		if err := c.Signer.Sign(req, body, user); err != nil {
+			return nil, err
+		}
+	}
+	return c.HTTP.Do(req)
+}
+
+// DefaultClient is used by the package-level functions, and by DefaultWatcher.
+// Remote hosts come from global usernames that anyone can send, so it only
+// connects to public addresses, unless the HTTP client is replaced.
+var DefaultClient = &Client{
+	HTTP: netguard.NewClient(10 * time.Second),
+}
+
+// ErrUnreachable is returned when the remote server couldn't be reached or
+// didn't return a valid response.
+var ErrUnreachable = errors.New("remote server unreachable")
+
+// QueryUser is the dictionary for each user in a remote status query response.
+type QueryUser struct {
+	Username string          `json:"username"`
+	Code     int             `json:"code"`
+	Msg      string          `json:"msg,omitempty"`
+	Data     json.RawMessage `json:"data,omitempty"`
+}
+
+// SplitGlobal splits a global username like @alice@example.com into
+// the username and host.
+func SplitGlobal(global string) (username, host string, ok bool) {
+	parts := strings.Split(global, "@")
+	if len(parts) != 3 || parts[0] != "" || parts[1] == "" || parts[2] == "" {
+		return "", "", false
+	}
+	return parts[1], parts[2], true
+}
+
+func (c *Client) baseURL(host string) string {
+	if c.BaseURL != nil {
+		return c.BaseURL(host)
+	}
+	return "https://" + host
+}
+
+// Query runs a status query for the provided usernames on the given host.
+// The returned map is keyed by username. If ifModSince is not zero it is sent
+// as the If-Modified-Since header.
+//
+// If the server returns a 404 for the whole request, ErrNotFound is returned.
+func (c *Client) Query(ctx context.Context, host string, usernames []string, ifModSince time.Time) (map[string]*QueryUser, http.Header, error) {
+	q := make(url.Values)
+	q["user"] = usernames
+
+	req, err := http.NewRequestWithContext(ctx, "GET", c.baseURL(host)+"/.well-known/fmrl/users?"+q.Encode(), nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !ifModSince.IsZero() {
+		req.Header.Set("If-Modified-Since", ifModSince.UTC().Format(http.TimeFormat))
+	}
+
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", ErrUnreachable, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, resp.Header, ErrNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, resp.Header, fmt.Errorf("%w: status code %d", ErrUnreachable, resp.StatusCode)
+	}
+
+	// Limit the response, a valid one is much smaller than this
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 8*1024*1024))
+	if err != nil {
+		return nil, resp.Header, fmt.Errorf("%w: %v", ErrUnreachable, err)
+	}
+
+	var users []*QueryUser
+	if err := json.Unmarshal(body, &users); err != nil {
+		return nil, resp.Header, fmt.Errorf("%w: invalid JSON: %v", ErrUnreachable, err)
+	}
+
+	m := make(map[string]*QueryUser, len(users))
+	for _, u := range users {
+		m[u.Username] = u
+	}
+	return m, resp.Header, nil
+}
+
+// ErrNotFound is returned when the remote server says a user doesn't exist.
+var ErrNotFound = errors.New("remote user not found")
+
+// Exists checks whether the global username exists on its home server.
+// It returns nil if it does, ErrNotFound if it doesn't, and an error
+// wrapping ErrUnreachable otherwise.
+func (c *Client) Exists(ctx context.Context, global string) error {
+	username, host, ok := SplitGlobal(global)
+	if !ok {
+		return fmt.Errorf("invalid global username: %s", global)
+	}
+
+	users, _, err := c.Query(ctx, host, []string{username}, time.Time{})
+	if err != nil {
+		return err
+	}
+	user, ok := users[username]
+	if !ok {
+		return fmt.Errorf("%w: user missing from response", ErrUnreachable)
+	}
+	switch user.Code {
+	case http.StatusOK, http.StatusNotModified:
+		return nil
+	case http.StatusNotFound, http.StatusGone:
+		return ErrNotFound
+	}
+	return fmt.Errorf("%w: user code %d", ErrUnreachable, user.Code)
+}
@@ -0,0 +1,112 @@
+package remote
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/makeworld-the-better-one/whatsup/db"
+	"github.com/makeworld-the-better-one/whatsup/model"
+)
+
+// Validation of followed global usernames.
+// Results are stored in the database, see db.GetRemoteUsers.
+
+// checkSem limits how many remote checks happen at once
+var checkSem = make(chan struct{}, 4)
+
+// Check asynchronously checks whether each global username exists, and stores
+// the result. It returns immediately.
+//
+// The semaphore is taken before each check's goroutine is started, so a long
+// list only waits in one goroutine instead of one per username.
+func Check(usernames []string) {
+	usernames = append([]string(nil), usernames...)
+	go func() {
+		for _, u := range usernames {
+			checkSem <- struct{}{}
+			go func(u string) {
+				defer func() { <-checkSem }()
+				checkOne(u)
+			}(u)
+		}
+	}()
+}
+
+// checkOne checks a global username with DefaultClient, which doesn't
+// connect to private addresses, so following users of hosts like localhost
+// can't be used to probe this server's network. They're stored as
+// unreachable.
+func checkOne(global string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	state := model.RemoteExists
+	err := DefaultClient.Exists(ctx, global)
+	if errors.Is(err, ErrNotFound) {
+		state = model.RemoteNotFound
+	} else if err != nil {
+		state = model.RemoteUnreachable
+	}
+
+	if err := db.SetRemoteUser(global, state); err != nil {
+		log.Printf("remote: storing state for %s: %v", global, err)
+	}
+}
+
+// Recheck checks all global usernames followed by users in st that haven't
+// been checked within the interval, and removes state for usernames nobody
+// follows anymore. It blocks until all checks are done.
+func Recheck(st db.Store, interval time.Duration) error {
+	all, err := st.AllFollowing()
+	if err != nil {
+		return err
+	}
+	if err := db.DeleteRemoteUsersExcept(all); err != nil {
+		return err
+	}
+
+	states, err := db.GetRemoteUsers(all.Sorted())
+	if err != nil {
+		return err
+	}
+
+	// Buffered so finished checks don't wait while more are started
+	done := make(chan struct{}, len(states))
+	n := 0
+	for _, ru := range states {
+		if ru.CheckedAt != nil && time.Since(*ru.CheckedAt) < interval {
+			continue
+		}
+		n++
+		checkSem <- struct{}{}
+		go func(u string) {
+			checkOne(u)
+			<-checkSem
+			done <- struct{}{}
+		}(ru.Username)
+	}
+	for ; n > 0; n-- {
+		<-done
+	}
+	return nil
+}
+
+// StartRechecks runs Recheck periodically in the background, until ctx is done.
+func StartRechecks(ctx context.Context, st db.Store, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval / 4)
+		defer ticker.Stop()
+		for {
+			if err := Recheck(st, interval); err != nil {
+				log.Printf("remote: rechecking following: %v", err)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
@@ -0,0 +1,216 @@
+package remote
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/makeworld-the-better-one/whatsup/config"
+	"github.com/makeworld-the-better-one/whatsup/db"
+	"github.com/makeworld-the-better-one/whatsup/model"
+)
+
+// openTestDB sets up the database in a temporary data dir, and closes it when
+// the test ends.
+func openTestDB(t *testing.T) {
+	t.Helper()
+
+	conf := config.Conf
+	t.Cleanup(func() { config.Conf = conf })
+
+	config.Conf.Data = config.DataConf{
+		Dir:         t.TempDir(),
+		Driver:      "sqlite",
+		Readers:     2,
+		BusyTimeout: config.Duration{Duration: 5 * time.Second},
+	}
+	config.Conf.Cache = config.CacheConf{}
+	config.Conf.Users = map[string]string{}
+
+	if err := os.Mkdir(filepath.Join(config.Conf.Data.Dir, "avatars"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Init(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := db.Close(); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+// standIn is a local server standing in for every remote server. Users whose
+// name starts with "gone" don't exist, the others do. Requests wait until
+// release is closed.
+type standIn struct {
+	release chan struct{}
+
+	mu       sync.Mutex
+	inFlight int
+	maxIn    int
+}
+
+func newStandIn(t *testing.T) *standIn {
+	s := &standIn{release: make(chan struct{})}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		s.inFlight++
+		if s.inFlight > s.maxIn {
+			s.maxIn = s.inFlight
+		}
+		s.mu.Unlock()
+		defer func() {
+			s.mu.Lock()
+			s.inFlight--
+			s.mu.Unlock()
+		}()
+
+		<-s.release
+
+		username := r.URL.Query().Get("user")
+		code := http.StatusOK
+		if strings.HasPrefix(username, "gone") {
+			code = http.StatusNotFound
+		}
+		json.NewEncoder(w).Encode([]*QueryUser{{Username: username, Code: code}})
+	}))
+	t.Cleanup(srv.Close)
+
+	client := DefaultClient
+	DefaultClient = &Client{
+		HTTP:    srv.Client(),
+		BaseURL: func(host string) string { return srv.URL },
+	}
+	t.Cleanup(func() { DefaultClient = client })
+	return s
+}
+
+func TestCheck(t *testing.T) {
+	openTestDB(t)
+	s := newStandIn(t)
+
+	var usernames []string
+	for i := 0; i < 100; i++ {
+		usernames = append(usernames, fmt.Sprintf("@user%d@host%d.example", i, i%7))
+	}
+	usernames = append(usernames, "@gone@host0.example")
+
+	before := runtime.NumGoroutine()
+	Check(usernames)
+
+	// Checks are waiting on the server, but only as many as the semaphore
+	// allows have started
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		s.mu.Lock()
+		n := s.inFlight
+		s.mu.Unlock()
+		if n == cap(checkSem) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d checks in flight, want %d", n, cap(checkSem))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// Each started check has goroutines for its connection on both sides,
+	// but there isn't one waiting for each username
+	if n := runtime.NumGoroutine() - before; n >= len(usernames)/2 {
+		t.Errorf("%d new goroutines for %d usernames", n, len(usernames))
+	}
+
+	close(s.release)
+	for {
+		states, err := db.GetRemoteUsers(usernames)
+		if err != nil {
+			t.Fatal(err)
+		}
+		unchecked := 0
+		for _, ru := range states {
+			if ru.State == model.RemoteUnchecked {
+				unchecked++
+			}
+		}
+		if unchecked == 0 {
+			for u, ru := range states {
+				want := model.RemoteExists
+				if u == "@gone@host0.example" {
+					want = model.RemoteNotFound
+				}
+				if ru.State != want {
+					t.Errorf("%s is %s, want %s", u, ru.State, want)
+				}
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d usernames still unchecked", unchecked)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.maxIn > cap(checkSem) {
+		t.Errorf("%d checks at once, the limit is %d", s.maxIn, cap(checkSem))
+	}
+}
+
+func TestCheckRefusesPrivate(t *testing.T) {
+	openTestDB(t)
+	var mu sync.Mutex
+	requested := false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requested = true
+		mu.Unlock()
+		json.NewEncoder(w).Encode([]*QueryUser{{Username: r.URL.Query().Get("user"), Code: http.StatusOK}})
+	}))
+	defer srv.Close()
+
+	// The default HTTP client, pointed at the local server
+	client := DefaultClient
+	DefaultClient = &Client{HTTP: client.HTTP, BaseURL: func(host string) string { return srv.URL }}
+	defer func() { DefaultClient = client }()
+
+	usernames := []string{"@a@127.0.0.1", "@a@10.0.0.1", "@a@localhost"}
+	Check(usernames)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		states, err := db.GetRemoteUsers(usernames)
+		if err != nil {
+			t.Fatal(err)
+		}
+		done := true
+		for u, ru := range states {
+			if ru.State == model.RemoteUnchecked {
+				done = false
+			} else if ru.State != model.RemoteUnreachable {
+				t.Errorf("%s is %s, want %s", u, ru.State, model.RemoteUnreachable)
+			}
+		}
+		if done {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("usernames still unchecked")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if requested {
+		t.Error("the local server was requested")
+	}
+}
@@ -0,0 +1,220 @@
+package remote
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/makeworld-the-better-one/whatsup/hub"
+)
+
+// Watcher polls remote servers for the status of remote users that local
+// clients are interested in, and publishes changes to the hub like
+// local status changes.
+type Watcher struct {
+	Client   *Client
+	Interval time.Duration
+
+	// Callback is the URL that hubs push to, which a token is appended to.
+	// If empty, hubs aren't subscribed to and all users are polled.
+	Callback string
+	// Lease is the subscription lease asked for from hubs.
+	Lease time.Duration
+
+	mu      sync.Mutex
+	ctx     context.Context
+	watches map[string]*watch   // Keyed by global username
+	subs    map[string]*pushSub // Keyed by callback token
+	wake    chan struct{}
+}
+
+type watch struct {
+	refs    int
+	last    *QueryUser
+	lastMod time.Time
+
+	sub         *pushSub
+	noPushUntil time.Time // Set after subscribing to a hub fails
+}
+
+// DefaultWatcher is used by streaming APIs.
+var DefaultWatcher = &Watcher{
+	Client:   DefaultClient,
+	Interval: time.Minute,
+	Lease:    10 * 24 * time.Hour,
+}
+
+// Watch starts watching a global username. Each call must be paired with
+// a call to Unwatch.
+func (w *Watcher) Watch(global string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.watches == nil {
+		w.watches = make(map[string]*watch)
+	}
+	wt, ok := w.watches[global]
+	if !ok {
+		wt = &watch{}
+		w.watches[global] = wt
+		// Poll soon so the new user's status is known
+		w.poke()
+	}
+	wt.refs++
+}
+
+// Unwatch stops watching a global username, if nothing else is watching it.
+func (w *Watcher) Unwatch(global string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	wt, ok := w.watches[global]
+	if !ok {
+		return
+	}
+	wt.refs--
+	if wt.refs <= 0 {
+		delete(w.watches, global)
+		if wt.sub != nil {
+			w.unsubscribe(wt.sub)
+		}
+	}
+}
+
+// Last returns the last known status query result for the global username,
+// or nil if it isn't known yet.
+func (w *Watcher) Last(global string) *QueryUser {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if wt, ok := w.watches[global]; ok {
+		return wt.last
+	}
+	return nil
+}
+
+func (w *Watcher) poke() {
+	if w.wake == nil {
+		w.wake = make(chan struct{}, 1)
+	}
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (w *Watcher) context() context.Context {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.ctx == nil {
+		return context.Background()
+	}
+	return w.ctx
+}
+
+// Run polls until ctx is done.
+func (w *Watcher) Run(ctx context.Context) {
+	w.mu.Lock()
+	w.ctx = ctx
+	if w.wake == nil {
+		w.wake = make(chan struct{}, 1)
+	}
+	wake := w.wake
+	w.mu.Unlock()
+
+	ticker := time.NewTicker(w.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-wake:
+		}
+		w.poll(ctx)
+	}
+}
+
+// poll queries every watched user that isn't pushed by a hub, grouped into
+// one request per host.
+func (w *Watcher) poll(ctx context.Context) {
+	type hostQuery struct {
+		usernames []string
+		lastMod   time.Time // Oldest known modification time
+	}
+	hosts := make(map[string]*hostQuery)
+
+	w.mu.Lock()
+	for global, wt := range w.watches {
+		username, host, ok := SplitGlobal(global)
+		if !ok {
+			continue
+		}
+		if wt.sub != nil && wt.sub.active() {
+			w.renew(wt.sub)
+			continue
+		}
+		hq, ok := hosts[host]
+		if !ok {
+			hq = &hostQuery{lastMod: wt.lastMod}
+			hosts[host] = hq
+		}
+		hq.usernames = append(hq.usernames, username)
+		if wt.lastMod.Before(hq.lastMod) {
+			hq.lastMod = wt.lastMod
+		}
+	}
+	w.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for host, hq := range hosts {
+		wg.Add(1)
+		go func(host string, hq *hostQuery) {
+			defer wg.Done()
+			w.pollHost(ctx, host, hq.usernames, hq.lastMod)
+		}(host, hq)
+	}
+	wg.Wait()
+}
+
+func (w *Watcher) pollHost(ctx context.Context, host string, usernames []string, lastMod time.Time) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	users, header, err := w.Client.Query(ctx, host, usernames, lastMod)
+	if err != nil {
+		log.Printf("remote: polling %s: %v", host, err)
+		return
+	}
+	modTime, _ := http.ParseTime(header.Get("Last-Modified"))
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for username, user := range users {
+		global := "@" + username + "@" + host
+		wt, ok := w.watches[global]
+		if !ok {
+			// Unwatched while polling
+			continue
+		}
+		w.update(wt, global, user, modTime)
+	}
+	w.discoverHub(host, usernames, header)
+}
+
+// update stores a status query result for a watched user, publishing it if
+// it changed. The caller must hold w.mu.
+func (w *Watcher) update(wt *watch, global string, user *QueryUser, modTime time.Time) {
+	if user.Code == http.StatusNotModified {
+		return
+	}
+	changed := wt.last == nil || wt.last.Code != user.Code || !bytes.Equal(wt.last.Data, user.Data)
+	wt.last = user
+	if user.Code == http.StatusOK && modTime.After(wt.lastMod) {
+		wt.lastMod = modTime
+	}
+	if changed && user.Code == http.StatusOK {
+		hub.Publish(&hub.Event{Type: hub.EventStatus, Username: global, Data: user.Data})
+	}
+}
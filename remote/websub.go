@@ -0,0 +1,263 @@
+package remote
+
+import (
+	"context"
+	"crypto/hmac"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/makeworld-the-better-one/whatsup/webhook"
+)
+
+// Subscribing to pushes from WebSub-style hubs, see package websub for the
+// hub side. Remote servers that send a Link header with rel="hub" in status
+// query responses get subscribed to, and the watched users on them aren't
+// polled while the subscription is active.
+
+// HubSignatureHeader holds the HMAC signature of pushed content.
+const HubSignatureHeader = "X-Hub-Signature"
+
+// ErrUnknownSubscription is returned for pushes and verification requests
+// that don't match a subscription.
+var ErrUnknownSubscription = errors.New("unknown subscription")
+
+// ErrBadHubSignature is returned for pushes with a missing or wrong signature.
+var ErrBadHubSignature = errors.New("bad hub signature")
+
+// Topic returns the topic URL of a user, given the base URL of their server.
+func Topic(baseURL, username string) string {
+	return baseURL + "/.well-known/fmrl/users?user=" + url.QueryEscape(username)
+}
+
+// pushSub is a subscription to a hub for a single watched user.
+type pushSub struct {
+	token  string
+	global string
+	hub    string
+	topic  string
+	secret string
+
+	expires       time.Time // Zero until verified
+	renewing      bool
+	unsubscribing bool
+}
+
+func (s *pushSub) active() bool {
+	return !s.unsubscribing && time.Now().Before(s.expires)
+}
+
+// parseLinks returns the URLs in the Link headers keyed by their rel.
+func parseLinks(header http.Header) map[string]string {
+	links := make(map[string]string)
+	for _, h := range header.Values("Link") {
+		for _, link := range strings.Split(h, ",") {
+			parts := strings.Split(link, ";")
+			target := strings.TrimSpace(parts[0])
+			if !strings.HasPrefix(target, "<") || !strings.HasSuffix(target, ">") {
+				continue
+			}
+			for _, param := range parts[1:] {
+				param = strings.TrimSpace(param)
+				if !strings.HasPrefix(param, "rel=") {
+					continue
+				}
+				for _, rel := range strings.Fields(strings.Trim(param[len("rel="):], `"`)) {
+					links[rel] = target[1 : len(target)-1]
+				}
+			}
+		}
+	}
+	return links
+}
+
+// renewMargin is how long before a subscription expires it is renewed.
+func (w *Watcher) renewMargin() time.Duration {
+	m := w.Lease / 10
+	if m < 2*w.Interval {
+		m = 2 * w.Interval
+	}
+	return m
+}
+
+// discoverHub subscribes to pushes for the watched users on the host, if the
+// host advertises a hub. The caller must hold w.mu.
+func (w *Watcher) discoverHub(host string, usernames []string, header http.Header) {
+	if w.Callback == "" {
+		return
+	}
+	hubURL := parseLinks(header)["hub"]
+	if hubURL == "" {
+		return
+	}
+	for _, username := range usernames {
+		global := "@" + username + "@" + host
+		wt, ok := w.watches[global]
+		if !ok || wt.sub != nil || time.Now().Before(wt.noPushUntil) {
+			continue
+		}
+		token, err := webhook.NewSecret()
+		if err != nil {
+			log.Printf("remote: generating WebSub token: %v", err)
+			return
+		}
+		secret, err := webhook.NewSecret()
+		if err != nil {
+			log.Printf("remote: generating WebSub secret: %v", err)
+			return
+		}
+		sub := &pushSub{
+			token:  token[:32],
+			global: global,
+			hub:    hubURL,
+			topic:  Topic(w.Client.baseURL(host), username),
+			secret: secret,
+		}
+		wt.sub = sub
+		if w.subs == nil {
+			w.subs = make(map[string]*pushSub)
+		}
+		w.subs[sub.token] = sub
+		go w.requestSub(sub, "subscribe")
+	}
+}
+
+// requestSub sends a subscription request to the hub. The hub then verifies
+// it with a request to the callback, see VerifyIntent.
+func (w *Watcher) requestSub(sub *pushSub, mode string) {
+	ctx, cancel := context.WithTimeout(w.context(), 30*time.Second)
+	defer cancel()
+
+	form := url.Values{
+		"hub.mode":     {mode},
+		"hub.topic":    {sub.topic},
+		"hub.callback": {w.Callback + sub.token},
+	}
+	if mode == "subscribe" {
+		form.Set("hub.secret", sub.secret)
+		form.Set("hub.lease_seconds", strconv.Itoa(int(w.Lease/time.Second)))
+	}
+
+	err := w.postHub(ctx, sub.hub, form)
+	if err == nil || mode != "subscribe" {
+		if err != nil {
+			log.Printf("remote: unsubscribing from %s at %s: %v", sub.global, sub.hub, err)
+		}
+		return
+	}
+
+	log.Printf("remote: subscribing to %s at %s: %v", sub.global, sub.hub, err)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	sub.renewing = false
+	if sub.active() {
+		// Renewal failed, try again at the next poll
+		return
+	}
+	// Fall back to polling for a while
+	delete(w.subs, sub.token)
+	if wt, ok := w.watches[sub.global]; ok && wt.sub == sub {
+		wt.sub = nil
+		wt.noPushUntil = time.Now().Add(time.Hour)
+	}
+}
+
+func (w *Watcher) postHub(ctx context.Context, hubURL string, form url.Values) error {
+	resp, err := w.Client.Post(ctx, hubURL, "application/x-www-form-urlencoded", []byte(form.Encode()), nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("status code %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// renew renews subscriptions that are about to expire. The caller must hold w.mu.
+func (w *Watcher) renew(sub *pushSub) {
+	if sub.renewing || time.Until(sub.expires) > w.renewMargin() {
+		return
+	}
+	sub.renewing = true
+	go w.requestSub(sub, "subscribe")
+}
+
+// VerifyIntent handles the hub's verification of a subscription request made
+// for the callback token. It returns true if the request was made by this
+// server, and the challenge should be echoed.
+func (w *Watcher) VerifyIntent(token, mode, topic string, lease time.Duration) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	sub, ok := w.subs[token]
+	if !ok || sub.topic != topic {
+		return false
+	}
+	switch mode {
+	case "subscribe":
+		if sub.unsubscribing || lease <= 0 {
+			return false
+		}
+		sub.expires = time.Now().Add(lease)
+		sub.renewing = false
+		return true
+	case "unsubscribe":
+		if !sub.unsubscribing {
+			return false
+		}
+		delete(w.subs, token)
+		return true
+	}
+	return false
+}
+
+// Push handles content pushed by a hub to the callback token. sig is the
+// value of the HubSignatureHeader.
+func (w *Watcher) Push(token string, body []byte, sig string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	sub, ok := w.subs[token]
+	if !ok || sub.unsubscribing {
+		return ErrUnknownSubscription
+	}
+	if !hmac.Equal([]byte(sig), []byte(webhook.Sign(sub.secret, body))) {
+		return ErrBadHubSignature
+	}
+
+	var users []*QueryUser
+	if err := json.Unmarshal(body, &users); err != nil {
+		return fmt.Errorf("invalid JSON: %w", err)
+	}
+	username, _, _ := SplitGlobal(sub.global)
+	for _, user := range users {
+		if user.Username != username {
+			// Hubs can only push the subscribed user
+			continue
+		}
+		if wt, ok := w.watches[sub.global]; ok {
+			w.update(wt, sub.global, user, time.Time{})
+		}
+	}
+	return nil
+}
+
+// unsubscribe asks the hub to stop pushing. The caller must hold w.mu.
+func (w *Watcher) unsubscribe(sub *pushSub) {
+	sub.unsubscribing = true
+	if sub.expires.IsZero() {
+		// Never verified, so the hub has nothing to remove
+		delete(w.subs, sub.token)
+		return
+	}
+	go w.requestSub(sub, "unsubscribe")
+}
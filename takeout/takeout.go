@@ -0,0 +1,181 @@
+// takeout exports everything stored about a local user, for data requests.
+//
+// The export is a gzipped tarball of JSON files, and the avatar image if
+// there is one:
+//
+//	account.json    - username, role, and when the account was created
+//	status.json     - current status, with when it was last updated
+//	history.json    - past statuses, newest first
+//	following.json  - followed global usernames
+//	lists.json      - follow lists
+//	privacy.json    - privacy settings
+//	webhooks.json   - webhooks, without their secrets
+//	avatar          - avatar image as uploaded, in PNG or JPEG
+package takeout
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/makeworld-the-better-one/whatsup/config"
+	"github.com/makeworld-the-better-one/whatsup/db"
+	"github.com/makeworld-the-better-one/whatsup/model"
+)
+
+// ContentType of exports.
+const ContentType = "application/gzip"
+
+// Filename returns a name to save the export of the user as.
+func Filename(username string) string {
+	return "whatsup-" + username + "-" + time.Now().UTC().Format("20060102") + ".tar.gz"
+}
+
+type account struct {
+	Username   string    `json:"username"`
+	Global     string    `json:"global_username"`
+	Role       string    `json:"role"`
+	Disabled   bool      `json:"disabled"`
+	CreatedAt  time.Time `json:"created_at"`
+	ExportedAt time.Time `json:"exported_at"`
+}
+
+type status struct {
+	UpdatedAt time.Time     `json:"updated_at"`
+	Status    *model.Status `json:"status"`
+}
+
+type historyEntry struct {
+	CreatedAt time.Time     `json:"created_at"`
+	Status    *model.Status `json:"status"`
+}
+
+type list struct {
+	Name      string    `json:"name"`
+	UpdatedAt time.Time `json:"updated_at"`
+	Usernames []string  `json:"usernames"`
+}
+
+// Write writes the export of the local user in store to w. Returns
+// db.ErrNotFound if the user doesn't exist.
+func Write(w io.Writer, store db.Store, username string) error {
+	acct, err := store.GetAccount(username)
+	if err != nil {
+		return err
+	}
+	st, err := store.GetUser(username)
+	if err != nil {
+		return err
+	}
+	history, err := store.GetHistory(username, db.MaxHistory)
+	if err != nil {
+		return err
+	}
+	fu, err := store.GetFollowing(username)
+	if err != nil {
+		return err
+	}
+	lists, err := store.GetLists(username)
+	if err != nil {
+		return err
+	}
+	privacy, err := store.GetPrivacy(username)
+	if err != nil {
+		return err
+	}
+	webhooks, err := store.GetWebhooks(username)
+	if err != nil {
+		return err
+	}
+	for _, wh := range webhooks {
+		wh.Secret = ""
+	}
+
+	now := time.Now().UTC()
+	files := []struct {
+		name string
+		v    interface{}
+	}{
+		{"account.json", &account{
+			Username:   username,
+			Global:     "@" + username + "@" + config.Conf.Server.Domain,
+			Role:       acct.Role,
+			Disabled:   acct.Disabled,
+			CreatedAt:  acct.CreatedAt,
+			ExportedAt: now,
+		}},
+		{"status.json", &status{UpdatedAt: st.UpdatedAt, Status: st}},
+		{"history.json", historyEntries(history)},
+		{"following.json", fu.Usernames.Sorted()},
+		{"lists.json", listEntries(lists)},
+		{"privacy.json", privacy},
+		{"webhooks.json", webhooks},
+	}
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	for _, f := range files {
+		b, err := json.MarshalIndent(f.v, "", "  ")
+		if err != nil {
+			return err
+		}
+		err = tw.WriteHeader(&tar.Header{Name: f.name, Mode: 0644, Size: int64(len(b)), ModTime: now})
+		if err != nil {
+			return err
+		}
+		if _, err := tw.Write(b); err != nil {
+			return err
+		}
+	}
+	if err := writeAvatar(tw, username); err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+func historyEntries(history []*model.StatusEntry) []*historyEntry {
+	entries := make([]*historyEntry, len(history))
+	for i, e := range history {
+		entries[i] = &historyEntry{CreatedAt: e.CreatedAt, Status: e.Status}
+	}
+	return entries
+}
+
+func listEntries(lists []*model.List) []*list {
+	entries := make([]*list, len(lists))
+	for i, l := range lists {
+		entries[i] = &list{Name: l.Name, UpdatedAt: l.UpdatedAt, Usernames: l.Usernames.Sorted()}
+	}
+	return entries
+}
+
+func writeAvatar(tw *tar.Writer, username string) error {
+	f, err := os.Open(filepath.Join(config.Conf.Data.Dir, "avatars", username, "original"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	err = tw.WriteHeader(&tar.Header{Name: "avatar", Mode: 0644, Size: fi.Size(), ModTime: fi.ModTime()})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, io.LimitReader(f, fi.Size()))
+	return err
+}
@@ -1,6 +1,9 @@
 package version
 
-import "fmt"
+import (
+	"fmt"
+	"strings"
+)
 
 // Version info. This is set by the Makefile
 var (
@@ -10,3 +13,6 @@ var (
 )
 
 var VersionInfo = fmt.Sprintf("Version: %s\nCommit: %s\nBuilt by: %s\n", version, commit, builtBy)
+
+// UserAgent is used for outgoing HTTP requests
+var UserAgent = strings.TrimSuffix("whatsup/"+version, "/")
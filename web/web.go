@@ -0,0 +1,256 @@
+// web renders the HTML pages of the server from templates.
+//
+// Templates are embedded in the binary, and each can be overridden by a file
+// with the same name in the templates directory of the data dir. Pages are
+// rendered with layout.html around them.
+package web
+
+import (
+	"bytes"
+	"embed"
+	"errors"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/makeworld-the-better-one/whatsup/logring"
+	"github.com/makeworld-the-better-one/whatsup/model"
+)
+
+//go:embed templates/*.html
+var embedded embed.FS
+
+// Pages are the templates that can be rendered, other than layout.html.
+var Pages = []string{"index", "profile", "error", "login", "settings", "admin"}
+
+var pages map[string]*template.Template
+
+var funcs = template.FuncMap{
+	"mediaLabel": model.MediaTypeLabel,
+	"deref": func(p interface{}) interface{} {
+		switch v := p.(type) {
+		case *string:
+			if v == nil {
+				return ""
+			}
+			return *v
+		case *int:
+			if v == nil {
+				return 0
+			}
+			return *v
+		}
+		return p
+	},
+	"size": FormatSize,
+}
+
+// FormatSize returns a human-readable size of a file.
+func FormatSize(n int64) string {
+	switch {
+	case n < 1024:
+		return fmt.Sprintf("%d B", n)
+	case n < 1024*1024:
+		return fmt.Sprintf("%.1f KiB", float64(n)/1024)
+	}
+	return fmt.Sprintf("%.1f MiB", float64(n)/(1024*1024))
+}
+
+// Init loads the templates, preferring ones in dir over the embedded ones.
+func Init(dir string) error {
+	layout, err := readTemplate(dir, "layout")
+	if err != nil {
+		return err
+	}
+
+	pages = make(map[string]*template.Template, len(Pages))
+	for _, name := range Pages {
+		page, err := readTemplate(dir, name)
+		if err != nil {
+			return err
+		}
+		t, err := template.New("layout.html").Funcs(funcs).Parse(layout)
+		if err != nil {
+			return fmt.Errorf("parsing layout.html: %w", err)
+		}
+		if _, err := t.New(name + ".html").Parse(page); err != nil {
+			return fmt.Errorf("parsing %s.html: %w", name, err)
+		}
+		pages[name] = t
+	}
+	return nil
+}
+
+func readTemplate(dir, name string) (string, error) {
+	b, err := os.ReadFile(filepath.Join(dir, name+".html"))
+	if err == nil {
+		return string(b), nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return "", err
+	}
+	b, err = embedded.ReadFile("templates/" + name + ".html")
+	return string(b), err
+}
+
+// Render writes the page with the status code. data is available in
+// templates as .Data, and the page title as .Title.
+func Render(w http.ResponseWriter, code int, page, title string, data interface{}) {
+	var buf bytes.Buffer
+	err := pages[page].Execute(&buf, &struct {
+		Title string
+		Data  interface{}
+	}{title, data})
+	if err != nil {
+		log.Printf("web: rendering %s: %v", page, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(code)
+	w.Write(buf.Bytes())
+}
+
+// ProfileData is the data for a user's profile page. URLs are absolute.
+type ProfileData struct {
+	Global      string
+	Title       string
+	Description string
+	URL         string
+	Avatar      string
+	FeedURL     string // Without the format extension
+	Updated     time.Time
+	Status      *model.Status
+}
+
+// IndexUser is a user listed on the landing page.
+type IndexUser struct {
+	Global string
+	Link   string
+	Status *model.Status
+}
+
+// IndexData is the data for the landing page.
+type IndexData struct {
+	Domain string
+	URL    string
+	Users  []*IndexUser
+}
+
+// LoginData is the data for the settings login page.
+type LoginData struct {
+	Username string
+	Error    string
+}
+
+// MediaTypeOption is a choice of media type on the settings page.
+type MediaTypeOption struct {
+	Value int
+	Label string
+}
+
+// SettingsData is the data for the settings page.
+type SettingsData struct {
+	Username   string
+	Global     string
+	CSRF       string
+	Status     *model.Status
+	Avatar     string
+	Emoji      []string
+	MediaTypes []*MediaTypeOption
+	Following  []string
+	Admin      bool // Whether to link to the admin page
+	Message    string
+	Error      string
+}
+
+// AdminUser is a row of the users table on the admin page.
+type AdminUser struct {
+	Username   string
+	Global     string
+	Role       string
+	Disabled   bool
+	Self       bool // The logged in admin
+	Updated    time.Time
+	HasStatus  bool
+	AvatarSize int64 // Zero if there's no avatar
+	Following  int
+}
+
+// AdminStat is a named server statistic on the admin page.
+type AdminStat struct {
+	Name  string
+	Value string
+}
+
+// AdminData is the data for the admin page.
+type AdminData struct {
+	CSRF  string
+	Users []*AdminUser
+	Stats []*AdminStat
+	Logs  []logring.Entry
+
+	// Set after a password reset, so it can be shown once
+	PasswordUser string
+	Password     string
+
+	Message string
+	Error   string
+}
+
+// ErrorData is the data for the error page.
+type ErrorData struct {
+	Code int
+	Text string
+}
+
+// RenderError writes an HTML status code page, like writeStatusCodePage in api.
+func RenderError(w http.ResponseWriter, code int) {
+	Render(w, code, "error", http.StatusText(code), &ErrorData{Code: code, Text: http.StatusText(code)})
+}
+
+// WantsHTML returns true if the request's Accept header prefers HTML over
+// JSON. Clients that accept anything get JSON, since they're API clients.
+func WantsHTML(r *http.Request) bool {
+	htmlQ, jsonQ := -1.0, -1.0
+	anyQ := 0.0
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		fields := strings.Split(part, ";")
+		mediaType := strings.ToLower(strings.TrimSpace(fields[0]))
+		q := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if v, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		switch mediaType {
+		case "text/html", "application/xhtml+xml":
+			if q > htmlQ {
+				htmlQ = q
+			}
+		case "application/json":
+			if q > jsonQ {
+				jsonQ = q
+			}
+		case "*/*":
+			anyQ = q
+		}
+	}
+	if jsonQ < 0 {
+		jsonQ = anyQ
+	}
+	return htmlQ > 0 && htmlQ > jsonQ
+}
@@ -0,0 +1,324 @@
+// webhook delivers changes to user data as signed JSON POSTs to webhook URLs.
+//
+// Events from the hub are turned into deliveries, which are queued in the
+// database and retried with exponential backoff until they succeed or run
+// out of attempts. Webhooks that keep failing are disabled.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/makeworld-the-better-one/whatsup/config"
+	"github.com/makeworld-the-better-one/whatsup/db"
+	"github.com/makeworld-the-better-one/whatsup/hub"
+	"github.com/makeworld-the-better-one/whatsup/model"
+	"github.com/makeworld-the-better-one/whatsup/netguard"
+	"github.com/makeworld-the-better-one/whatsup/version"
+)
+
+// SignatureHeader holds the hex HMAC-SHA256 of the request body, keyed with
+// the webhook secret, prefixed with "sha256=".
+const SignatureHeader = "X-Whatsup-Signature"
+
+// Client is used to send deliveries. It only connects to public addresses,
+// since webhook URLs come from users, and the results of deliveries would
+// tell them what's on the server's network. Start replaces it if private
+// addresses are allowed in the config.
+var Client = netguard.NewClient(10 * time.Second)
+
+// Payload is the JSON body sent to webhooks.
+type Payload struct {
+	Event     string        `json:"event"`
+	Username  string        `json:"username"` // Global username
+	Timestamp time.Time     `json:"timestamp"`
+	Status    *model.Status `json:"status,omitempty"`
+	Following []string      `json:"following,omitempty"`
+}
+
+// NewSecret returns a random secret for signing deliveries.
+func NewSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Sign returns the signature header value for the body.
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+var wake = make(chan struct{}, 1)
+
+// Start queues deliveries for hub events in st and sends them in the
+// background, until ctx is done.
+//
+// Deliveries are queued as each change is made, by a hub handler rather than
+// a subscription, so none are dropped when there are many changes at once.
+func Start(ctx context.Context, st db.Store) {
+	if config.Conf.Webhooks.AllowPrivate {
+		Client = &http.Client{Timeout: 10 * time.Second}
+	}
+
+	remove := hub.Default.Handle(func(e *hub.Event) {
+		if err := enqueue(st, e); err != nil {
+			log.Printf("webhook: queueing deliveries for %s event of %s: %v", e.Type, e.Username, err)
+		}
+	})
+	go func() {
+		<-ctx.Done()
+		remove()
+	}()
+
+	go func() {
+		ticker := time.NewTicker(5 * time.Second)
+		defer ticker.Stop()
+		lastPrune := time.Time{}
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			case <-wake:
+			}
+			deliverDue(ctx, st)
+
+			if time.Since(lastPrune) > time.Hour {
+				// Keep the delivery log for a week
+				if err := st.PruneDeliveries(time.Now().Add(-7 * 24 * time.Hour)); err != nil {
+					log.Printf("webhook: pruning deliveries: %v", err)
+				}
+				lastPrune = time.Now()
+			}
+		}
+	}()
+}
+
+func globalUsername(username string) string {
+	return "@" + username + "@" + config.Conf.Server.Domain
+}
+
+// enqueue queues a delivery of the event for every webhook that wants it.
+func enqueue(st db.Store, e *hub.Event) error {
+	if len(e.Username) > 0 && e.Username[0] == '@' {
+		// Remote users only matter to streaming clients
+		return nil
+	}
+	if e.Relayed {
+		// Queued by the server that made the change
+		return nil
+	}
+
+	webhooks, err := st.GetEnabledWebhooks()
+	if err != nil {
+		return err
+	}
+
+	p := &Payload{
+		Event:     e.Type,
+		Username:  globalUsername(e.Username),
+		Timestamp: time.Now().UTC(),
+	}
+	switch e.Type {
+	case hub.EventStatus:
+		p.Status = e.Status
+	case hub.EventFollowing:
+		p.Following = e.Following.Usernames.Sorted()
+	default:
+		return nil
+	}
+	body, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+
+	var ids []int64
+	for _, wh := range webhooks {
+		ok, err := wants(st, wh, e)
+		if err != nil {
+			return err
+		}
+		if ok {
+			ids = append(ids, wh.ID)
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	if err := st.EnqueueDeliveries(ids, e.Type, body); err != nil {
+		return err
+	}
+
+	select {
+	case wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// wants returns true if the webhook should get the event.
+func wants(st db.Store, wh *model.Webhook, e *hub.Event) (bool, error) {
+	if !wh.WantsEvent(e.Type) {
+		return false, nil
+	}
+	if wh.Owner == "" {
+		// Server-wide
+		return true, nil
+	}
+
+	if e.Type == hub.EventFollowing {
+		// Private to the owner
+		return e.Username == wh.Owner, nil
+	}
+
+	users := wh.Users
+	if len(users) == 0 {
+		users = []string{wh.Owner}
+	}
+	found := false
+	for _, u := range users {
+		if u == e.Username {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return false, nil
+	}
+
+	// The owner must be allowed to see the status
+	p, err := st.GetPrivacy(e.Username)
+	if err != nil {
+		return false, err
+	}
+	return p.Allows(globalUsername(e.Username), &model.Requester{Username: globalUsername(wh.Owner), Local: true}), nil
+}
+
+// backoff returns how long to wait before the next attempt, after the given
+// number of failed attempts.
+func backoff(attempts int) time.Duration {
+	d := 30 * time.Second
+	for i := 1; i < attempts && d < 12*time.Hour; i++ {
+		d *= 2
+	}
+	if d > 12*time.Hour {
+		d = 12 * time.Hour
+	}
+	return d
+}
+
+func deliverDue(ctx context.Context, st db.Store) {
+	for {
+		deliveries, err := st.DueDeliveries(50)
+		if err != nil {
+			log.Printf("webhook: getting due deliveries: %v", err)
+			return
+		}
+		if len(deliveries) == 0 {
+			return
+		}
+
+		sem := make(chan struct{}, 4)
+		var wg sync.WaitGroup
+		for _, d := range deliveries {
+			wg.Add(1)
+			sem <- struct{}{}
+			go func(d *model.WebhookDelivery) {
+				defer wg.Done()
+				defer func() { <-sem }()
+				attempt(ctx, st, d)
+			}(d)
+		}
+		wg.Wait()
+
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// attempt tries to send the delivery once and stores the result.
+func attempt(ctx context.Context, st db.Store, d *model.WebhookDelivery) {
+	wh, err := st.GetWebhookByID(d.WebhookID)
+	if errors.Is(err, db.ErrNotFound) || (err == nil && !wh.Enabled) {
+		d.State = model.DeliveryFailed
+		d.LastError = "webhook deleted or disabled"
+		if err := st.UpdateDelivery(d); err != nil {
+			log.Printf("webhook: updating delivery %d: %v", d.ID, err)
+		}
+		return
+	}
+	if err != nil {
+		log.Printf("webhook: getting webhook %d: %v", d.WebhookID, err)
+		return
+	}
+
+	d.Attempts++
+	d.LastCode, err = send(ctx, wh, d)
+	success := err == nil
+	if success {
+		d.State = model.DeliveryDelivered
+		d.LastError = ""
+	} else {
+		d.LastError = err.Error()
+		if d.Attempts >= config.Conf.Webhooks.MaxAttempts {
+			d.State = model.DeliveryFailed
+		} else {
+			d.NextAttempt = time.Now().Add(backoff(d.Attempts))
+		}
+	}
+	if err := st.UpdateDelivery(d); err != nil {
+		log.Printf("webhook: updating delivery %d: %v", d.ID, err)
+	}
+
+	disabled, err := st.RecordWebhookResult(wh.ID, success, config.Conf.Webhooks.DisableAfter)
+	if err != nil {
+		log.Printf("webhook: recording result for webhook %d: %v", wh.ID, err)
+	}
+	if disabled {
+		log.Printf("webhook: disabled webhook %d for %s after %d failures in a row",
+			wh.ID, wh.URL, config.Conf.Webhooks.DisableAfter)
+	}
+}
+
+// send POSTs the delivery to the webhook URL and returns the status code.
+func send(ctx context.Context, wh *model.Webhook, d *model.WebhookDelivery) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", wh.URL, bytes.NewReader(d.Payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", version.UserAgent)
+	req.Header.Set("X-Whatsup-Event", d.Event)
+	req.Header.Set("X-Whatsup-Delivery", strconv.FormatInt(d.ID, 10))
+	req.Header.Set(SignatureHeader, Sign(wh.Secret, d.Payload))
+
+	resp, err := Client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("status code %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
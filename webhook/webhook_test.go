@@ -0,0 +1,330 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/makeworld-the-better-one/whatsup/config"
+	"github.com/makeworld-the-better-one/whatsup/db"
+	"github.com/makeworld-the-better-one/whatsup/hub"
+	"github.com/makeworld-the-better-one/whatsup/model"
+)
+
+// openTestDB sets up the database in a temporary data dir with the users
+// alice and bob, and closes it when the test ends. Webhooks can reach
+// private addresses, like the local receivers of the tests.
+func openTestDB(t *testing.T) {
+	t.Helper()
+
+	conf := config.Conf
+	t.Cleanup(func() { config.Conf = conf })
+	client := Client
+	t.Cleanup(func() { Client = client })
+
+	config.Conf.Server.Domain = "example.org"
+	config.Conf.Webhooks.AllowPrivate = true
+	config.Conf.Webhooks.MaxAttempts = 3
+	config.Conf.Webhooks.DisableAfter = 100
+	config.Conf.Data = config.DataConf{
+		Dir:         t.TempDir(),
+		Driver:      "sqlite",
+		Readers:     2,
+		BusyTimeout: config.Duration{Duration: 5 * time.Second},
+	}
+	config.Conf.Cache = config.CacheConf{}
+	config.Conf.Users = map[string]string{"alice": "", "bob": ""}
+
+	if err := os.Mkdir(filepath.Join(config.Conf.Data.Dir, "avatars"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Init(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := db.Close(); err != nil {
+			t.Error(err)
+		}
+	})
+	Client = &http.Client{Timeout: 10 * time.Second}
+}
+
+// request is what a receiver got.
+type request struct {
+	header http.Header
+	body   []byte
+}
+
+// newReceiver starts a local webhook receiver that responds with code, and
+// sends the requests it gets on the returned channel.
+func newReceiver(t *testing.T, code int) (*httptest.Server, <-chan *request) {
+	got := make(chan *request, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		got <- &request{r.Header, body}
+		w.WriteHeader(code)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, got
+}
+
+func createWebhook(t *testing.T, wh *model.Webhook) *model.Webhook {
+	t.Helper()
+	wh.Enabled = true
+	if wh.Events == nil {
+		wh.Events = []string{model.WebhookStatus, model.WebhookFollowing}
+	}
+	if err := db.Default.CreateWebhook(wh); err != nil {
+		t.Fatal(err)
+	}
+	return wh
+}
+
+func statusEvent(username, text string) *hub.Event {
+	return &hub.Event{Type: hub.EventStatus, Username: username, Status: &model.Status{Status: &text}}
+}
+
+// due returns the deliveries that are due, and fails unless there are n.
+func due(t *testing.T, n int) []*model.WebhookDelivery {
+	t.Helper()
+	ds, err := db.Default.DueDeliveries(100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ds) != n {
+		t.Fatalf("%d due deliveries, want %d", len(ds), n)
+	}
+	return ds
+}
+
+func TestDelivery(t *testing.T) {
+	openTestDB(t)
+	srv, got := newReceiver(t, http.StatusNoContent)
+	wh := createWebhook(t, &model.Webhook{Owner: "alice", URL: srv.URL + "/hook", Secret: "s3cret"})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	Start(ctx, db.Default)
+
+	text := "delivered"
+	if err := db.Default.SetUser("alice", &model.Status{Status: &text}); err != nil {
+		t.Fatal(err)
+	}
+	var req *request
+	select {
+	case req = <-got:
+	case <-time.After(5 * time.Second):
+		t.Fatal("nothing delivered")
+	}
+	if sig := req.header.Get(SignatureHeader); sig != Sign("s3cret", req.body) {
+		t.Errorf("signature is %q", sig)
+	}
+	if ev := req.header.Get("X-Whatsup-Event"); ev != model.WebhookStatus {
+		t.Errorf("event header is %q", ev)
+	}
+	var p Payload
+	if err := json.Unmarshal(req.body, &p); err != nil {
+		t.Fatal(err)
+	}
+	if p.Event != hub.EventStatus || p.Username != "@alice@example.org" || p.Status == nil || *p.Status.Status != text {
+		t.Errorf("payload is %s", req.body)
+	}
+
+	// The result is stored once the response is in
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		ds, err := db.Default.GetDeliveries(wh.ID, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ds) == 1 && ds[0].State == model.DeliveryDelivered {
+			if ds[0].LastCode != http.StatusNoContent || ds[0].Attempts != 1 {
+				t.Errorf("delivery is %+v", ds[0])
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("deliveries are %+v", ds)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRetry(t *testing.T) {
+	openTestDB(t)
+	srv, got := newReceiver(t, http.StatusBadGateway)
+	wh := createWebhook(t, &model.Webhook{Owner: "alice", URL: srv.URL})
+	ctx := context.Background()
+
+	if err := enqueue(db.Default, statusEvent("alice", "retried")); err != nil {
+		t.Fatal(err)
+	}
+	d := due(t, 1)[0]
+	for i := 1; i <= config.Conf.Webhooks.MaxAttempts; i++ {
+		before := time.Now()
+		attempt(ctx, db.Default, d)
+		<-got
+
+		ds, err := db.Default.GetDeliveries(wh.ID, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		d = ds[0]
+		if d.Attempts != i || d.LastCode != http.StatusBadGateway {
+			t.Fatalf("after attempt %d delivery is %+v", i, d)
+		}
+		if i < config.Conf.Webhooks.MaxAttempts {
+			// Waits grow exponentially
+			wait := d.NextAttempt.Sub(before)
+			if want := backoff(i); d.State != model.DeliveryPending || wait < want-time.Second || wait > want+time.Second {
+				t.Errorf("after attempt %d: %s, next in %v, want %v", i, d.State, wait, want)
+			}
+		} else if d.State != model.DeliveryFailed {
+			t.Errorf("after the last attempt the delivery is %s", d.State)
+		}
+	}
+	if backoff(2) != 2*backoff(1) || backoff(100) != 12*time.Hour {
+		t.Errorf("backoffs are %v, %v, %v", backoff(1), backoff(2), backoff(100))
+	}
+}
+
+func TestAutoDisable(t *testing.T) {
+	openTestDB(t)
+	config.Conf.Webhooks.DisableAfter = 2
+	srv, got := newReceiver(t, http.StatusInternalServerError)
+	wh := createWebhook(t, &model.Webhook{Owner: "alice", URL: srv.URL})
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		if err := enqueue(db.Default, statusEvent("alice", "failing")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ds := due(t, 3)
+	for _, d := range ds[:2] {
+		attempt(ctx, db.Default, d)
+		<-got
+	}
+	got2, err := db.Default.GetWebhookByID(wh.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got2.Enabled || got2.Failures != 2 {
+		t.Errorf("webhook after failures is %+v", got2)
+	}
+
+	// Deliveries to the disabled webhook fail without being sent
+	attempt(ctx, db.Default, ds[2])
+	select {
+	case <-got:
+		t.Error("delivered to a disabled webhook")
+	default:
+	}
+	all, err := db.Default.GetDeliveries(wh.ID, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range all {
+		if d.ID == ds[2].ID && d.State != model.DeliveryFailed {
+			t.Errorf("delivery to disabled webhook is %s", d.State)
+		}
+	}
+
+	// New events aren't queued for it
+	if err := enqueue(db.Default, statusEvent("alice", "ignored")); err != nil {
+		t.Fatal(err)
+	}
+	due(t, 0)
+}
+
+func TestEnqueue(t *testing.T) {
+	openTestDB(t)
+	for _, wh := range []*model.Webhook{
+		{Owner: "alice", URL: "https://a.example/"},
+		{Owner: "bob", URL: "https://b.example/"},
+		{URL: "https://server.example/"},
+	} {
+		createWebhook(t, wh)
+	}
+
+	// Alice's event goes to her webhook and the server-wide one, in one go
+	if err := enqueue(db.Default, statusEvent("alice", "hi")); err != nil {
+		t.Fatal(err)
+	}
+	ds := due(t, 2)
+	if ds[0].Event != model.WebhookStatus || string(ds[0].Payload) != string(ds[1].Payload) {
+		t.Errorf("deliveries are %+v", ds)
+	}
+
+	// Relayed events were queued by the other server, and remote users only
+	// matter to streaming clients
+	relayed := statusEvent("alice", "relayed")
+	relayed.Relayed = true
+	for _, e := range []*hub.Event{relayed, statusEvent("@carol@remote.example", "remote")} {
+		if err := enqueue(db.Default, e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	due(t, 0)
+}
+
+func TestWants(t *testing.T) {
+	openTestDB(t)
+	aliceHook := &model.Webhook{ID: 1, Owner: "alice", Events: []string{model.WebhookStatus, model.WebhookFollowing}, Users: []string{"alice", "bob"}}
+	statusOnly := &model.Webhook{ID: 2, Owner: "alice", Events: []string{model.WebhookStatus}}
+	serverHook := &model.Webhook{ID: 3, Events: []string{model.WebhookStatus, model.WebhookFollowing}}
+	following := &hub.Event{Type: hub.EventFollowing, Username: "bob", Following: &model.Following{Usernames: model.NewFollowingUsernames()}}
+
+	privacy := func(mode string, allow, block []string) *model.Privacy {
+		p := model.NewPrivacy()
+		p.Mode = mode
+		for _, u := range allow {
+			p.Allow[u] = struct{}{}
+		}
+		for _, u := range block {
+			p.Block[u] = struct{}{}
+		}
+		return p
+	}
+	const alice = "@alice@example.org"
+
+	tests := []struct {
+		name    string
+		privacy *model.Privacy // Bob's
+		wh      *model.Webhook
+		e       *hub.Event
+		want    bool
+	}{
+		{"public", privacy(model.PrivacyPublic, nil, nil), aliceHook, statusEvent("bob", "x"), true},
+		{"local", privacy(model.PrivacyLocal, nil, nil), aliceHook, statusEvent("bob", "x"), true},
+		{"allowlist without owner", privacy(model.PrivacyAllowList, nil, nil), aliceHook, statusEvent("bob", "x"), false},
+		{"allowlist with owner", privacy(model.PrivacyAllowList, []string{alice}, nil), aliceHook, statusEvent("bob", "x"), true},
+		{"blocked", privacy(model.PrivacyPublic, nil, []string{alice}), aliceHook, statusEvent("bob", "x"), false},
+		{"blocked and allowed", privacy(model.PrivacyAllowList, []string{alice}, []string{alice}), aliceHook, statusEvent("bob", "x"), false},
+		{"own status", privacy(model.PrivacyPublic, nil, nil), aliceHook, statusEvent("alice", "x"), true},
+		{"user not in webhook", privacy(model.PrivacyPublic, nil, nil), statusOnly, statusEvent("bob", "x"), false},
+		{"following of someone else", privacy(model.PrivacyPublic, nil, nil), aliceHook, following, false},
+		{"event not wanted", privacy(model.PrivacyPublic, nil, nil), statusOnly, &hub.Event{Type: hub.EventFollowing, Username: "alice"}, false},
+		{"server-wide", privacy(model.PrivacyAllowList, nil, nil), serverHook, statusEvent("bob", "x"), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := db.Default.SetPrivacy("bob", tt.privacy); err != nil {
+				t.Fatal(err)
+			}
+			got, err := wants(db.Default, tt.wh, tt.e)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
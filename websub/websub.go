@@ -0,0 +1,304 @@
+// websub makes whatsup a WebSub-style hub for its users.
+//
+// Remote servers and aggregators subscribe to a user's topic, which is the
+// status query URL for that user, with a callback URL and a lease. After the
+// subscriber confirms its intent by echoing a challenge, every status change
+// is POSTed to the callback in the same format as a status query response,
+// until the lease expires or the subscriber unsubscribes.
+//
+// See remote.Watcher for the subscriber side.
+package websub
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/makeworld-the-better-one/whatsup/config"
+	"github.com/makeworld-the-better-one/whatsup/db"
+	"github.com/makeworld-the-better-one/whatsup/hub"
+	"github.com/makeworld-the-better-one/whatsup/model"
+	"github.com/makeworld-the-better-one/whatsup/netguard"
+	"github.com/makeworld-the-better-one/whatsup/remote"
+	"github.com/makeworld-the-better-one/whatsup/webhook"
+)
+
+// Path is where subscription requests are made.
+const Path = "/.well-known/fmrl/websub"
+
+// CallbackPath is where hubs push to when this server is the subscriber,
+// followed by a token for the subscription. See remote.Watcher.
+const CallbackPath = Path + "/callback/"
+
+// MinLease is the shortest lease that is granted.
+const MinLease = time.Hour
+
+// Modes of subscription requests
+const (
+	ModeSubscribe   = "subscribe"
+	ModeUnsubscribe = "unsubscribe"
+)
+
+// Client is used for verifying intent and pushing. Callback URLs come from
+// anyone that subscribes, so it only connects to public addresses. Start
+// signs its requests like remote.DefaultClient, and replaces its HTTP client
+// if private addresses are allowed in the config.
+var Client = &remote.Client{HTTP: netguard.NewClient(10 * time.Second)}
+
+// HubURL returns the absolute URL of the hub.
+func HubURL() string {
+	return config.Conf.Server.URL + Path
+}
+
+// Topic returns the topic URL for the local user.
+func Topic(username string) string {
+	return remote.Topic(config.Conf.Server.URL, username)
+}
+
+// TopicUser returns the local username the topic URL is for.
+func TopicUser(topic string) (string, bool) {
+	u, err := url.Parse(topic)
+	if err != nil {
+		return "", false
+	}
+	username := u.Query().Get("user")
+	if username == "" || topic != Topic(username) {
+		return "", false
+	}
+	if _, ok := config.Conf.Users[username]; !ok {
+		return "", false
+	}
+	return username, true
+}
+
+// Request is a subscription or unsubscription request made to the hub.
+type Request struct {
+	Mode      string
+	Username  string
+	Callback  string
+	Secret    string
+	Lease     time.Duration
+	Requester model.Requester
+}
+
+// verifySem limits how many verifications happen at once
+var verifySem = make(chan struct{}, 8)
+
+// StartVerify verifies the request in the background, since the subscriber
+// may not be able to handle the verification request until it gets the
+// response to its own. It returns false without doing anything if too many
+// verifications are already running.
+func StartVerify(r *Request) bool {
+	select {
+	case verifySem <- struct{}{}:
+	default:
+		return false
+	}
+	go func() {
+		defer func() { <-verifySem }()
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if err := Verify(ctx, r); err != nil {
+			log.Printf("websub: verifying %s of %s for %s: %v", r.Mode, r.Callback, r.Username, err)
+		}
+	}()
+	return true
+}
+
+// Verify confirms the subscriber intended to make the request, by asking the
+// callback to echo a random challenge, and then applies the request.
+//
+// New subscriptions are limited by config.Conf.WebSub.MaxPerHost, and
+// db.ErrLimit is returned if they go over it.
+func Verify(ctx context.Context, r *Request) error {
+	challenge, err := webhook.NewSecret()
+	if err != nil {
+		return err
+	}
+
+	u, err := url.Parse(r.Callback)
+	if err != nil {
+		return err
+	}
+	q := u.Query()
+	q.Set("hub.mode", r.Mode)
+	q.Set("hub.topic", Topic(r.Username))
+	q.Set("hub.challenge", challenge)
+	if r.Mode == ModeSubscribe {
+		q.Set("hub.lease_seconds", strconv.Itoa(int(r.Lease/time.Second)))
+	}
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 || string(body) != challenge {
+		return fmt.Errorf("callback didn't echo the challenge, status code %d", resp.StatusCode)
+	}
+
+	if r.Mode == ModeUnsubscribe {
+		return db.DeleteWebSubSubscription(r.Username, r.Callback)
+	}
+	return db.SetWebSubSubscription(&model.WebSubSubscription{
+		Username:  r.Username,
+		Callback:  r.Callback,
+		Secret:    r.Secret,
+		Requester: r.Requester,
+		Expires:   time.Now().Add(r.Lease),
+	}, config.Conf.WebSub.MaxPerHost)
+}
+
+// pushSem limits how many pushes happen at once
+var pushSem = make(chan struct{}, 8)
+
+// Start pushes status changes to subscribers and expires old subscriptions,
+// until ctx is done. Privacy settings are read from st.
+//
+// Subscriptions are kept by the server they were made to, which pushes the
+// changes other servers sharing st make too.
+func Start(ctx context.Context, st db.Store) {
+	Client.Signer = remote.DefaultClient.Signer
+	if config.Conf.WebSub.AllowPrivate {
+		Client.HTTP = &http.Client{Timeout: 10 * time.Second}
+	}
+
+	go func() {
+		for {
+			sub := hub.Default.SubscribeAll(1024)
+			for e := range sub.C {
+				if e.Type != hub.EventStatus || strings.HasPrefix(e.Username, "@") {
+					// Only statuses of local users are pushed
+					continue
+				}
+				if err := pushEvent(ctx, st, e); err != nil {
+					log.Printf("websub: pushing status of %s: %v", e.Username, err)
+				}
+			}
+			select {
+			case <-ctx.Done():
+				return
+			default:
+				log.Printf("websub: status changes were dropped because pushing was too slow")
+			}
+		}
+	}()
+
+	go func() {
+		ticker := time.NewTicker(time.Hour)
+		defer ticker.Stop()
+		for {
+			if err := db.PruneWebSubSubscriptions(); err != nil {
+				log.Printf("websub: pruning subscriptions: %v", err)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+func pushEvent(ctx context.Context, st db.Store, e *hub.Event) error {
+	subs, err := db.GetWebSubSubscriptions(e.Username)
+	if err != nil || len(subs) == 0 {
+		return err
+	}
+	privacy, err := st.GetPrivacy(e.Username)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(e.Status)
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal([]*remote.QueryUser{{Username: e.Username, Code: http.StatusOK, Data: data}})
+	if err != nil {
+		return err
+	}
+
+	global := "@" + e.Username + "@" + config.Conf.Server.Domain
+	for _, sub := range subs {
+		req := sub.Requester
+		if !privacy.Allows(global, &req) {
+			continue
+		}
+		go func(sub *model.WebSubSubscription) {
+			pushSem <- struct{}{}
+			defer func() { <-pushSem }()
+			push(ctx, sub, body)
+		}(sub)
+	}
+	return nil
+}
+
+// errGone means the subscriber doesn't want pushes anymore.
+var errGone = errors.New("subscription gone")
+
+// push sends the body to the subscriber, retrying a few times on failure.
+func push(ctx context.Context, sub *model.WebSubSubscription, body []byte) {
+	header := make(http.Header)
+	header.Add("Link", fmt.Sprintf(`<%s>; rel="hub"`, HubURL()))
+	header.Add("Link", fmt.Sprintf(`<%s>; rel="self"`, Topic(sub.Username)))
+	if sub.Secret != "" {
+		header.Set(remote.HubSignatureHeader, webhook.Sign(sub.Secret, body))
+	}
+
+	var err error
+	for _, wait := range []time.Duration{0, 10 * time.Second, time.Minute} {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+
+		err = pushOnce(ctx, sub.Callback, body, header)
+		if errors.Is(err, errGone) {
+			if err := db.DeleteWebSubSubscription(sub.Username, sub.Callback); err != nil {
+				log.Printf("websub: deleting subscription: %v", err)
+			}
+			return
+		}
+		if err == nil {
+			return
+		}
+	}
+	log.Printf("websub: pushing status of %s to %s: %v", sub.Username, sub.Callback, err)
+}
+
+func pushOnce(ctx context.Context, callback string, body []byte, header http.Header) error {
+	resp, err := Client.Post(ctx, callback, "application/json", body, header)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+
+	if resp.StatusCode == http.StatusGone {
+		return errGone
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("status code %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,333 @@
+package websub
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/makeworld-the-better-one/whatsup/config"
+	"github.com/makeworld-the-better-one/whatsup/db"
+	"github.com/makeworld-the-better-one/whatsup/hub"
+	"github.com/makeworld-the-better-one/whatsup/model"
+	"github.com/makeworld-the-better-one/whatsup/netguard"
+	"github.com/makeworld-the-better-one/whatsup/remote"
+	"github.com/makeworld-the-better-one/whatsup/webhook"
+)
+
+// openTestDB sets up the database in a temporary data dir with the user
+// alice, and closes it when the test ends.
+func openTestDB(t *testing.T) {
+	t.Helper()
+
+	conf := config.Conf
+	t.Cleanup(func() { config.Conf = conf })
+
+	config.Conf.Server.URL = "https://example.org"
+	config.Conf.Server.Domain = "example.org"
+	config.Conf.WebSub.MaxPerHost = 100
+	config.Conf.Data = config.DataConf{
+		Dir:         t.TempDir(),
+		Driver:      "sqlite",
+		Readers:     2,
+		BusyTimeout: config.Duration{Duration: 5 * time.Second},
+	}
+	config.Conf.Cache = config.CacheConf{}
+	config.Conf.Users = map[string]string{"alice": ""}
+
+	if err := os.Mkdir(filepath.Join(config.Conf.Data.Dir, "avatars"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Init(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := db.Close(); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+// newSubscriber starts a local subscriber, and makes Client able to reach it.
+func newSubscriber(t *testing.T, h http.HandlerFunc) *httptest.Server {
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+
+	client := Client
+	Client = &remote.Client{HTTP: srv.Client()}
+	t.Cleanup(func() { Client = client })
+	return srv
+}
+
+// echo confirms intent for alice's topic, and reports the lease asked for.
+func echo(t *testing.T, leases chan<- time.Duration) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if q.Get("hub.topic") != Topic("alice") {
+			t.Errorf("hub.topic is %s", q.Get("hub.topic"))
+		}
+		if q.Get("hub.mode") == ModeSubscribe {
+			secs, _ := strconv.Atoi(q.Get("hub.lease_seconds"))
+			leases <- time.Duration(secs) * time.Second
+		}
+		io.WriteString(w, q.Get("hub.challenge"))
+	}
+}
+
+func getSubs(t *testing.T) []*model.WebSubSubscription {
+	t.Helper()
+	subs, err := db.GetWebSubSubscriptions("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return subs
+}
+
+func TestVerify(t *testing.T) {
+	openTestDB(t)
+	leases := make(chan time.Duration, 10)
+	srv := newSubscriber(t, echo(t, leases))
+	ctx := context.Background()
+
+	r := &Request{Mode: ModeSubscribe, Username: "alice", Callback: srv.URL + "/cb", Lease: time.Hour}
+	if err := Verify(ctx, r); err != nil {
+		t.Fatal(err)
+	}
+	if lease := <-leases; lease != time.Hour {
+		t.Errorf("lease sent is %v", lease)
+	}
+	subs := getSubs(t)
+	if len(subs) != 1 || subs[0].Callback != r.Callback {
+		t.Fatalf("subscriptions are %+v", subs)
+	}
+	if until := time.Until(subs[0].Expires); until < 59*time.Minute || until > time.Hour {
+		t.Errorf("expires in %v", until)
+	}
+
+	// Subscribing again renews the lease
+	r.Lease = 2 * time.Hour
+	if err := Verify(ctx, r); err != nil {
+		t.Fatal(err)
+	}
+	<-leases
+	subs = getSubs(t)
+	if len(subs) != 1 {
+		t.Fatalf("%d subscriptions after renewing", len(subs))
+	}
+	if until := time.Until(subs[0].Expires); until < 119*time.Minute {
+		t.Errorf("renewed lease expires in %v", until)
+	}
+
+	r.Mode = ModeUnsubscribe
+	if err := Verify(ctx, r); err != nil {
+		t.Fatal(err)
+	}
+	if subs := getSubs(t); len(subs) != 0 {
+		t.Errorf("subscriptions after unsubscribing are %+v", subs)
+	}
+}
+
+func TestVerifyWrongChallenge(t *testing.T) {
+	openTestDB(t)
+	srv := newSubscriber(t, func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "not the challenge")
+	})
+
+	r := &Request{Mode: ModeSubscribe, Username: "alice", Callback: srv.URL + "/cb", Lease: time.Hour}
+	if err := Verify(context.Background(), r); err == nil {
+		t.Error("no error")
+	}
+	if subs := getSubs(t); len(subs) != 0 {
+		t.Errorf("subscriptions are %+v", subs)
+	}
+}
+
+func TestLeaseExpiry(t *testing.T) {
+	openTestDB(t)
+	config.Conf.WebSub.MaxPerHost = 1
+
+	expired := &model.WebSubSubscription{
+		Username: "alice",
+		Callback: "https://sub.example/old",
+		Expires:  time.Now().Add(-time.Minute),
+	}
+	if err := db.SetWebSubSubscription(expired, 1); err != nil {
+		t.Fatal(err)
+	}
+	if subs := getSubs(t); len(subs) != 0 {
+		t.Errorf("expired subscriptions returned: %+v", subs)
+	}
+
+	// The expired subscription doesn't count towards the limit
+	sub := &model.WebSubSubscription{
+		Username: "alice",
+		Callback: "https://sub.example/new",
+		Expires:  time.Now().Add(time.Hour),
+	}
+	if err := db.SetWebSubSubscription(sub, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PruneWebSubSubscriptions(); err != nil {
+		t.Fatal(err)
+	}
+	if subs := getSubs(t); len(subs) != 1 || subs[0].Callback != sub.Callback {
+		t.Errorf("subscriptions after pruning are %+v", subs)
+	}
+}
+
+func TestLimits(t *testing.T) {
+	openTestDB(t)
+	leases := make(chan time.Duration, 10)
+	srv := newSubscriber(t, echo(t, leases))
+	config.Conf.WebSub.MaxPerHost = 2
+	ctx := context.Background()
+
+	for _, path := range []string{"/a", "/b"} {
+		r := &Request{Mode: ModeSubscribe, Username: "alice", Callback: srv.URL + path, Lease: time.Hour}
+		if err := Verify(ctx, r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r := &Request{Mode: ModeSubscribe, Username: "alice", Callback: srv.URL + "/c", Lease: time.Hour}
+	if err := Verify(ctx, r); !errors.Is(err, db.ErrLimit) {
+		t.Errorf("third callback on the host: got %v, want ErrLimit", err)
+	}
+	// Renewing is still allowed
+	r.Callback = srv.URL + "/a"
+	if err := Verify(ctx, r); err != nil {
+		t.Errorf("renewing: %v", err)
+	}
+
+	// One requester is limited across callback hosts
+	req := model.Requester{Server: "remote.example", Username: "@bob@remote.example"}
+	for i, host := range []string{"a.example", "b.example", "c.example"} {
+		err := db.SetWebSubSubscription(&model.WebSubSubscription{
+			Username:  "alice",
+			Callback:  "https://" + host + "/cb",
+			Requester: req,
+			Expires:   time.Now().Add(time.Hour),
+		}, 2)
+		if i < 2 && err != nil {
+			t.Fatal(err)
+		}
+		if i == 2 && !errors.Is(err, db.ErrLimit) {
+			t.Errorf("third subscription of the requester: got %v, want ErrLimit", err)
+		}
+	}
+}
+
+func TestStartVerifyLimit(t *testing.T) {
+	for i := 0; i < cap(verifySem); i++ {
+		verifySem <- struct{}{}
+	}
+	defer func() {
+		for i := 0; i < cap(verifySem); i++ {
+			<-verifySem
+		}
+	}()
+
+	if StartVerify(&Request{Mode: ModeSubscribe, Username: "alice", Callback: "https://sub.example/cb"}) {
+		t.Error("verification started with all slots taken")
+	}
+}
+
+func TestPush(t *testing.T) {
+	openTestDB(t)
+	type pushed struct {
+		header http.Header
+		body   []byte
+	}
+	got := make(chan pushed, 1)
+	srv := newSubscriber(t, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		got <- pushed{r.Header, body}
+	})
+
+	const secret = "s3cret"
+	err := db.SetWebSubSubscription(&model.WebSubSubscription{
+		Username: "alice",
+		Callback: srv.URL + "/cb",
+		Secret:   secret,
+		Expires:  time.Now().Add(time.Hour),
+	}, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	text := "pushed status"
+	status := &model.Status{Status: &text, UpdatedAt: time.Now()}
+	if err := pushEvent(context.Background(), db.Default, &hub.Event{Type: hub.EventStatus, Username: "alice", Status: status}); err != nil {
+		t.Fatal(err)
+	}
+
+	var p pushed
+	select {
+	case p = <-got:
+	case <-time.After(5 * time.Second):
+		t.Fatal("nothing pushed")
+	}
+	if sig := p.header.Get(remote.HubSignatureHeader); sig != webhook.Sign(secret, p.body) {
+		t.Errorf("signature is %q", sig)
+	}
+	links := p.header.Values("Link")
+	if len(links) != 2 || links[1] != `<`+Topic("alice")+`>; rel="self"` {
+		t.Errorf("Link headers are %q", links)
+	}
+	var users []*remote.QueryUser
+	if err := json.Unmarshal(p.body, &users); err != nil {
+		t.Fatal(err)
+	}
+	var data model.Status
+	if len(users) != 1 || users[0].Username != "alice" || json.Unmarshal(users[0].Data, &data) != nil ||
+		data.Status == nil || *data.Status != text {
+		t.Errorf("pushed %s", p.body)
+	}
+}
+
+func TestPushGone(t *testing.T) {
+	openTestDB(t)
+	srv := newSubscriber(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusGone)
+	})
+
+	sub := &model.WebSubSubscription{Username: "alice", Callback: srv.URL + "/cb", Expires: time.Now().Add(time.Hour)}
+	if err := db.SetWebSubSubscription(sub, 100); err != nil {
+		t.Fatal(err)
+	}
+	push(context.Background(), sub, []byte(`[]`))
+	if subs := getSubs(t); len(subs) != 0 {
+		t.Errorf("subscription wasn't removed: %+v", subs)
+	}
+}
+
+func TestPrivateCallbackRefused(t *testing.T) {
+	openTestDB(t)
+	called := false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+		io.WriteString(w, r.URL.Query().Get("hub.challenge"))
+	}))
+	defer srv.Close()
+
+	// The default client, which isn't replaced without allow_private
+	r := &Request{Mode: ModeSubscribe, Username: "alice", Callback: srv.URL + "/cb", Lease: time.Hour}
+	if err := Verify(context.Background(), r); !errors.Is(err, netguard.ErrNotPublic) {
+		t.Errorf("verifying: got %v, want ErrNotPublic", err)
+	}
+	if err := pushOnce(context.Background(), srv.URL+"/cb", []byte(`[]`), nil); !errors.Is(err, netguard.ErrNotPublic) {
+		t.Errorf("pushing: got %v, want ErrNotPublic", err)
+	}
+	if called {
+		t.Error("callback was requested")
+	}
+	if subs := getSubs(t); len(subs) != 0 {
+		t.Errorf("subscriptions are %+v", subs)
+	}
+}